@@ -0,0 +1,142 @@
+package sidb
+
+// DefaultMaxAppendChain is the default Options.MaxAppendChain.
+const DefaultMaxAppendChain = 16
+
+// Append appends suffix to the value of key, or sets it to suffix if the key
+// doesn't exist. Only suffix is written, as a fragment of the value: a record
+// flagged KVAppended, which reads put together with the records of the key
+// before it in the order they were written, like GetAll. A value with
+// Options.MaxAppendChain fragments already is written whole instead, with
+// suffix, and Compact writes every value whole. In DupKeys mode suffix is
+// appended to the newest value. Append commits and syncs on its own, like
+// Put.
+//
+// The first fragment written sets FeatureAppend in the file, which binaries
+// that don't know it can't open.
+func (db *DB) Append(key, suffix []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	var kv keyValues
+	if db.maxAppendChain >= 0 {
+		db.mmaplock.RLock()
+		var err error
+		kv, err = db.values(key, nil)
+		db.mmaplock.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	pairs, flags := db.appendRecords(key, suffix, &kv)
+	if len(pairs) == 1 {
+		return db.put(pairs[0], flags[0])
+	}
+	defer db.commitStats()
+	return db.putBatch(pairs, flags)
+}
+
+// Append appends suffix to the value of key, see DB.Append, reading the
+// writes buffered in the transaction too. The records are buffered like Put.
+func (tx *Tx) Append(key, suffix []byte) error {
+	if err := tx.checkWrite(key); err != nil {
+		return err
+	}
+	db := tx.db
+	if db.orderedWrite && tx.lastPut != nil && db.comparator(key, tx.lastPut) < 0 {
+		return ErrKeyOutOfOrder
+	}
+	var kv keyValues
+	if db.maxAppendChain >= 0 {
+		var err error
+		if kv, err = tx.values(key); err != nil {
+			return err
+		}
+	}
+	pairs, flags := db.appendRecords(key, suffix, &kv)
+	for i, p := range pairs {
+		p.Key = append([]byte(nil), p.Key...)
+		if p.Value != nil {
+			p.Value = append([]byte(nil), p.Value...)
+		}
+		tx.pairs = append(tx.pairs, p)
+		tx.flags = append(tx.flags, flags[i])
+		tx.lastPut = p.Key
+	}
+	return nil
+}
+
+// values returns the values of key like DB.values, with the writes buffered
+// in the transaction applied.
+func (tx *Tx) values(key []byte) (keyValues, error) {
+	db := tx.db
+	var s *snapshot
+	if !tx.writable {
+		s = &tx.snap
+	}
+	db.mmaplock.RLock()
+	if !db.opened {
+		db.mmaplock.RUnlock()
+		return keyValues{}, ErrDatabaseNotOpen
+	}
+	kv, err := db.values(key, s)
+	db.mmaplock.RUnlock()
+	if err != nil {
+		return kv, err
+	}
+	for i := range tx.pairs {
+		if db.comparator(tx.pairs[i].Key, key) == 0 {
+			kv.replay(&tx.pairs[i], tx.flags[i], 0, db.dupKeys)
+		}
+	}
+	return kv, nil
+}
+
+// appendRecords returns the records Append writes to append suffix to the
+// newest of the values kv of key: a fragment, the value whole if it has
+// db.maxAppendChain fragments, replacing it in DupKeys mode, or a value of
+// its own if there is none. With no limit, kv isn't looked at, a fragment is
+// written anyway.
+func (db *DB) appendRecords(key, suffix []byte, kv *keyValues) ([]KVPair, []KVFlag) {
+	if db.maxAppendChain < 0 {
+		return []KVPair{{Key: key, Value: suffix}}, []KVFlag{KVAppended}
+	}
+	n := len(kv.values)
+	if n == 0 {
+		return []KVPair{{Key: key, Value: suffix}}, []KVFlag{0}
+	}
+	if kv.frags[n-1] < db.maxAppendChain {
+		return []KVPair{{Key: key, Value: suffix}}, []KVFlag{KVAppended}
+	}
+	whole := make([]byte, 0, len(kv.values[n-1])+len(suffix))
+	whole = append(append(whole, kv.values[n-1]...), suffix...)
+	if db.dupKeys {
+		return []KVPair{{Key: key}, {Key: key, Value: whole}}, []KVFlag{KVDeleted | KVDeleteNewest, 0}
+	}
+	return []KVPair{{Key: key, Value: whole}}, []KVFlag{0}
+}
+
+// wholeValue copies the value of key, whose newest record is a fragment of
+// Append, put together, to the cursor's value buffer and returns it. On error
+// c.err is set and it returns nil.
+func (c *Cursor) wholeValue(key []byte) []byte {
+	v, err := c.db.newest(key, c.snap)
+	if err != nil {
+		c.err = err
+		return nil
+	}
+	c.value = append(c.value[:0], v...)
+	if c.value == nil {
+		c.value = []byte{}
+	}
+	return c.value
+}
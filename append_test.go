@@ -0,0 +1,224 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// appendChain returns the values of key and how many fragments were appended
+// to each.
+func appendChain(t *testing.T, db *DB, key string) keyValues {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	kv, err := db.values([]byte(key), nil)
+	assertion.NoError(t, err)
+	return kv
+}
+
+func TestAppend(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	compacted := testDB + ".compacted"
+	os.Remove(compacted)
+	defer os.Remove(compacted)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	db.NoSync = true
+	assert.Zero(db.head.Features.Required & FeatureAppend)
+
+	// interleaved, growing across pages
+	want := map[string][]byte{}
+	for i := 0; i < 300; i++ {
+		key := []string{"a", "b", "c"}[i%3]
+		event := []byte(fmt.Sprintf("event-%d;", i))
+		assert.NoError(db.Append([]byte(key), event))
+		want[key] = append(want[key], event...)
+		if i == 150 {
+			// starts over after a Delete
+			assert.NoError(db.Delete([]byte("b")))
+			want["b"] = nil
+		}
+	}
+	assert.True(len(want["a"]) > db.pageSize)
+	assert.True(db.head.PageCount > 10)
+
+	check := func(db *DB) {
+		for key, value := range want {
+			v, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal(string(value), string(v), key)
+			buf, err := db.GetTo([]byte(key), []byte("buf:"))
+			assert.NoError(err)
+			assert.Equal("buf:"+string(value), string(buf), key)
+			r, size, err := db.GetReader([]byte(key))
+			if assert.NoError(err) {
+				b, err := ioutil.ReadAll(r)
+				assert.NoError(err)
+				assert.Equal(string(value), string(b), key)
+				assert.Equal(int64(len(value)), size)
+			}
+		}
+		many, err := db.GetMany([][]byte{[]byte("c"), []byte("a")})
+		assert.NoError(err)
+		assert.Equal([][]byte{want["c"], want["a"]}, many)
+		walked := map[string][]byte{}
+		c := db.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			walked[string(k)] = append([]byte{}, v...)
+		}
+		assert.NoError(c.Err())
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			assert.Equal(string(walked[string(k)]), string(v), k)
+		}
+		assert.NoError(c.Err())
+		assert.Equal(want, walked)
+	}
+	check(db)
+
+	// written in fragments, at most DefaultMaxAppendChain to a value
+	assert.NotZero(db.head.Features.Required & FeatureAppend)
+	n, err := db.Count()
+	assert.NoError(err)
+	assert.True(n > 200)
+	for _, key := range []string{"a", "b", "c"} {
+		kv := appendChain(t, db, key)
+		assert.Len(kv.frags, 1)
+		assert.True(kv.frags[0] > 0 && kv.frags[0] <= DefaultMaxAppendChain, "%s: %d", key, kv.frags[0])
+	}
+
+	// an empty suffix creates an empty value
+	assert.NoError(db.Append([]byte("empty"), nil))
+	v, err := db.Get([]byte("empty"))
+	assert.NoError(err)
+	assert.NotNil(v)
+	assert.Empty(v)
+	want["empty"] = []byte{}
+
+	// read back in the transaction, whose fragments are counted too
+	assert.NoError(db.Update(func(tx *Tx) error {
+		assert.NoError(tx.Put([]byte("tx"), []byte("1")))
+		for _, s := range []string{"2", "3", "4", "5", "6"} {
+			assert.NoError(tx.Append([]byte("tx"), []byte(s)))
+		}
+		assert.NoError(tx.Append([]byte("a"), []byte("tx;")))
+		v, err := tx.Get([]byte("tx"))
+		assert.NoError(err)
+		assert.Equal("123456", string(v))
+		v, err = tx.Get([]byte("a"))
+		assert.NoError(err)
+		assert.Equal(string(want["a"])+"tx;", string(v))
+		return nil
+	}))
+	want["tx"] = []byte("123456")
+	want["a"] = append(want["a"], "tx;"...)
+	check(db)
+	assert.Equal(5, appendChain(t, db, "tx").frags[0])
+	assert.NoError(db.Close())
+
+	// a limit of 2, the chain of 5 written whole first, then none
+	db, err = Open(testDB, 0755, &Options{MaxAppendChain: 2})
+	assert.NoError(err)
+	check(db)
+	for _, s := range []string{"7", "8", "9"} {
+		assert.NoError(db.Append([]byte("tx"), []byte(s)))
+	}
+	want["tx"] = []byte("123456789")
+	assert.Equal(2, appendChain(t, db, "tx").frags[0])
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, &Options{MaxAppendChain: -1})
+	assert.NoError(err)
+	for i := 0; i < 40; i++ {
+		assert.NoError(db.Append([]byte("c"), []byte("+")))
+		want["c"] = append(want["c"], '+')
+	}
+	assert.True(appendChain(t, db, "c").frags[0] >= 40)
+	check(db)
+	assert.Empty(checkErrors(db))
+
+	// compacted and salvaged whole
+	assert.NoError(db.Compact(compacted, nil))
+	assert.NoError(db.Close())
+	c, err := Open(compacted, 0755, nil)
+	assert.NoError(err)
+	check(c)
+	assert.Zero(c.head.Features.Required & FeatureAppend)
+	n, err = c.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(len(want)), n)
+	assert.Equal(0, appendChain(t, c, "a").frags[0])
+	assert.NoError(c.Close())
+	os.Remove(compacted)
+	_, err = Salvage(testDB, compacted, nil)
+	assert.NoError(err)
+	c, err = Open(compacted, 0755, nil)
+	assert.NoError(err)
+	check(c)
+	assert.NoError(c.Close())
+}
+
+func TestAppendDupKeys(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	compacted := testDB + ".compacted"
+	os.Remove(compacted)
+	defer os.Remove(compacted)
+
+	db, err := Open(testDB, 0755, &Options{DupKeys: true, MaxAppendChain: 2})
+	assert.NoError(err)
+	k := []byte("k")
+	check := func(db *DB, want ...string) {
+		got, err := db.GetAll(k)
+		assert.NoError(err)
+		var values []string
+		for _, v := range got {
+			values = append(values, string(v))
+		}
+		assert.Equal(want, values)
+		assert.Equal(want, func() (values []string) {
+			c := db.Cursor()
+			for _, v := c.Seek(k); v != nil; _, v = c.NextDup() {
+				values = append(values, string(v))
+			}
+			return values
+		}())
+	}
+	// to the newest value
+	assert.NoError(db.Put(k, []byte("1")))
+	assert.NoError(db.Put(k, []byte("2")))
+	assert.NoError(db.Append(k, []byte("a")))
+	assert.NoError(db.Append(k, []byte("b")))
+	check(db, "1", "2ab")
+	// with its fragments
+	assert.NoError(db.DeleteDup(k, false))
+	check(db, "1")
+	assert.NoError(db.Append(k, []byte("a")))
+	assert.NoError(db.Append(k, []byte("b")))
+	// past the limit, replaced whole
+	assert.NoError(db.Append(k, []byte("c")))
+	check(db, "1abc")
+	assert.Equal([]int{0}, appendChain(t, db, "k").frags)
+	assert.NoError(db.Append(k, []byte("d")))
+	assert.NoError(db.DeleteDup(k, true))
+	assert.NoError(db.Append(k, []byte("x")))
+	assert.NoError(db.Append(k, []byte("y")))
+	check(db, "xy")
+	assert.NoError(db.Put(k, []byte("w")))
+	assert.NoError(db.Append(k, []byte("w")))
+	assert.NoError(db.DeleteDup(k, false))
+	assert.NoError(db.Put(k, []byte("z")))
+	check(db, "xy", "z")
+
+	assert.NoError(db.Compact(compacted, nil))
+	assert.NoError(db.Close())
+	c, err := Open(compacted, 0755, nil)
+	assert.NoError(err)
+	check(c, "xy", "z")
+	assert.Equal([]int{0, 0}, appendChain(t, c, "k").frags)
+	assert.NoError(c.Close())
+}
@@ -0,0 +1,12 @@
+//go:build 386 || arm || mips || mipsle
+// +build 386 arm mips mipsle
+
+package sidb
+
+const (
+	// maxMapSize represents the largest mmap size supported by sidb.
+	maxMapSize = 0x7FFFFFFF // 2GB
+
+	// maxAllocSize is the size used when creating array pointers.
+	maxAllocSize = 0xFFFFFFF
+)
@@ -0,0 +1,12 @@
+//go:build amd64 || arm64 || ppc64 || ppc64le || mips64 || mips64le || s390x || riscv64 || loong64 || wasm
+// +build amd64 arm64 ppc64 ppc64le mips64 mips64le s390x riscv64 loong64 wasm
+
+package sidb
+
+const (
+	// maxMapSize represents the largest mmap size supported by sidb.
+	maxMapSize = 0xFFFFFFFFFFFF // 256TB
+
+	// maxAllocSize is the size used when creating array pointers.
+	maxAllocSize = 0x7FFFFFFF
+)
@@ -0,0 +1,85 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.MaxBatchDelay = 50 * time.Millisecond
+
+	var commits int
+	writeAt := db.ops.writeAt
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		if off < db.pageOffset(db.dataStart) {
+			commits++
+		}
+		return writeAt(b, off)
+	}
+
+	const n = 20
+	fail := errors.New("fail")
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Batch(func(tx *Tx) error {
+				if i == 7 {
+					return fail
+				}
+				return tx.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+			})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if i == 7 {
+			// not poisoning the others
+			assert.Equal(fail, err)
+		} else {
+			assert.NoError(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.NoError(err)
+		if i == 7 {
+			assert.Nil(v)
+		} else {
+			assert.Equal("value", string(v))
+		}
+	}
+	// all callers arrive well within the delay
+	assert.Equal(1, commits)
+	assert.NoError(db.Close())
+}
+
+func TestBatchMaxSize(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.MaxBatchSize = 1
+	db.MaxBatchDelay = time.Hour
+	// a full batch runs without waiting for the delay
+	assert.NoError(db.Batch(func(tx *Tx) error {
+		return tx.Put([]byte("key"), []byte("value"))
+	}))
+	v, err := db.Get([]byte("key"))
+	assert.NoError(err)
+	assert.Equal("value", string(v))
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,154 @@
+package sidb
+
+import "encoding/binary"
+
+// With Options.BloomBitsPerKey set, a data page gets a bloom filter of the
+// keys of its records when it is sealed, so that Get passes over the pages
+// that don't hold a key without decoding them. The filter goes in the footer,
+// before the restarts if any, see restartInterval:
+//
+//	filter, number of probes (1 byte), length of filter (uint16)
+//
+// and the page is flagged PageBloom. Pages leave room for it as they are
+// filled, see DB.footerRoom, those filled without aren't filtered.
+
+// bloomTrailerSize is the size of what follows the filter in a footer.
+const bloomTrailerSize = 3
+
+// bloomSize returns the room the filter of count keys takes in a footer, or
+// 0 without filters.
+func (db *DB) bloomSize(count int) int {
+	if db.bloomBits <= 0 {
+		return 0
+	}
+	n := (count*db.bloomBits + 7) / 8
+	// too few bits give too many false positives
+	if n < 8 {
+		n = 8
+	}
+	return n + bloomTrailerSize
+}
+
+// footerRoom returns the room to leave at the end of a page of count records
+// for its footer, restarts and filter.
+func (db *DB) footerRoom(count int) int {
+	return footerSize(count) + db.bloomSize(count)
+}
+
+// bloomHash is FNV-1a, the filter probes are derived from it.
+func bloomHash(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// bloomFilter returns the filter of the keys of hashes, with bitsPerKey bits
+// per key, as stored in a footer of size bytes.
+func bloomFilter(hashes []uint32, bitsPerKey, size int) []byte {
+	// ln 2 times the bits per key minimizes false positives
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	n := size - bloomTrailerSize
+	f := make([]byte, size)
+	bits := uint32(8 * n)
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := 0; i < k; i++ {
+			pos := h % bits
+			f[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	f[n] = byte(k)
+	binary.LittleEndian.PutUint16(f[n+1:], uint16(n))
+	return f
+}
+
+// bloomMayContain reports whether key may be in filter, as returned by
+// pageBloom, whose probes are k.
+func bloomMayContain(filter []byte, k int, key []byte) bool {
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	bits := uint32(8 * len(filter))
+	for i := 0; i < k; i++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// pageBloom returns the filter of data page id, whose header is p, a
+// PageBloom page, and its number of probes. The caller holds mmaplock.
+func (db *DB) pageBloom(id PageId, p *Page) ([]byte, int, error) {
+	end := int(db.pageOffset(id)) + db.pageSize
+	if p.Flag&PageSorted != 0 {
+		end -= 2*int(binary.LittleEndian.Uint16(db.dataSlice(end-2, end))) + 2
+	}
+	trailer := db.dataSlice(end-bloomTrailerSize, end)
+	k, n := int(trailer[0]), int(binary.LittleEndian.Uint16(trailer[1:]))
+	// past the records, which p.ptr ends
+	if k == 0 || n == 0 || end-bloomTrailerSize-n < int(db.pageOffset(id))+int(p.ptr) {
+		return nil, 0, corruptPage(id, end-bloomTrailerSize-int(db.pageOffset(id)), "bad bloom filter of %d bytes, %d probes", n, k)
+	}
+	return db.dataSlice(end-bloomTrailerSize-n, end-bloomTrailerSize), k, nil
+}
+
+// mayContain reports whether data page id, whose header is p, may hold key:
+// unless its filter says otherwise, it may. The caller holds mmaplock.
+func (db *DB) mayContain(id PageId, p *Page, key []byte) (bool, error) {
+	if p.Flag&PageBloom == 0 {
+		return true, nil
+	}
+	filter, k, err := db.pageBloom(id, p)
+	if err != nil {
+		return false, err
+	}
+	return bloomMayContain(filter, k, key), nil
+}
+
+// addFilters gives the sealed data pages before page tail a bloom filter if
+// they have none and room for one. Readers may be looking at them, the
+// filter is written before the flag. The caller holds rwlock.
+func (db *DB) addFilters(tail PageId) error {
+	if db.bloomBits <= 0 {
+		return nil
+	}
+	for id := db.dataStart; id != 0 && id != tail; {
+		db.mmaplock.RLock()
+		p := *db.page(id)
+		var footer []byte
+		var flags PageFlag
+		var err error
+		// compressed pages were sealed for good
+		if p.Flag&(PageBloom|PageCompressed) == 0 && !p.overflow() && p.Count > 0 {
+			start := int(db.pageOffset(id))
+			// the restarts, if any, come out as they are
+			footer, flags, err = db.pageFooter(db.dataSlice(start+pageHeaderSize, start+int(p.ptr)), db.pageSize-int(p.ptr))
+		}
+		db.mmaplock.RUnlock()
+		if err != nil {
+			return err
+		}
+		if flags&PageBloom != 0 {
+			if _, err := db.write(footer, db.pageOffset(id)+int64(db.pageSize-len(footer))); err != nil {
+				return err
+			}
+			p.Flag |= flags
+			if err := db.writePageHeader(id, &p); err != nil {
+				return err
+			}
+		}
+		id = p.Next
+	}
+	return nil
+}
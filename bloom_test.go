@@ -0,0 +1,153 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	assert := assertion.New(t)
+	var hashes []uint32
+	for i := 0; i < 100; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	f := bloomFilter(hashes, 10, 128+bloomTrailerSize)
+	k, n := int(f[128]), int(f[129])|int(f[130])<<8
+	assert.Equal(6, k)
+	assert.Equal(128, n)
+	for i := 0; i < 100; i++ {
+		assert.True(bloomMayContain(f[:n], k, []byte(fmt.Sprintf("key-%d", i))))
+	}
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if bloomMayContain(f[:n], k, []byte(fmt.Sprintf("missing-%d", i))) {
+			positives++
+		}
+	}
+	assert.True(positives < 300, "%d false positives", positives)
+}
+
+func TestBloom(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, BloomBitsPerKey: 10})
+	assert.NoError(err)
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("key-%04d", i)
+		values[k] = []byte(fmt.Sprintf("value-%d", i))
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	var batch []KVPair
+	for i := 999; i >= 0; i-- {
+		k := fmt.Sprintf("batch-%04d", i)
+		values[k] = []byte(fmt.Sprintf("value-%d", i))
+		batch = append(batch, KVPair{Key: []byte(k), Value: values[k]})
+	}
+	assert.NoError(db.PutBatch(batch))
+	assert.NoError(db.Delete([]byte("key-0001")))
+	values["key-0001"] = nil
+
+	// The keys of filtered pages pass their filter, it returns how many
+	// sealed pages aren't filtered.
+	check := func() int {
+		pages, positives, unfiltered := 0, 0, 0
+		for id := db.dataStart; id != PageId(db.head.kvPtr.pageNum); id = db.page(id).Next {
+			p := db.page(id)
+			if p.Flag&PageBloom == 0 {
+				unfiltered++
+				continue
+			}
+			pages++
+			assert.NoError(db.scanPage(id, p, func(kv *KVPair, flag KVFlag) bool {
+				ok, err := db.mayContain(id, p, kv.Key)
+				assert.NoError(err)
+				assert.True(ok, "%s in page %d", kv.Key, id)
+				return true
+			}))
+			for i := 0; i < 100; i++ {
+				ok, err := db.mayContain(id, p, []byte(fmt.Sprintf("missing-%d", i)))
+				assert.NoError(err)
+				if ok {
+					positives++
+				}
+			}
+		}
+		assert.True(pages > 50)
+		assert.True(positives < pages*100/20, "%d false positives in %d pages", positives, pages)
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+			v, err = db.GetTo([]byte(k), nil)
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+		return unfiltered
+	}
+	// every page, sorted or not
+	assert.Zero(check())
+	assert.NoError(db.Close())
+
+	// The filters stay without the option, new pages go without.
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Zero(check())
+	// two records to a page leave room for a filter
+	value := make([]byte, 150)
+	rand.New(rand.NewSource(1)).Read(value)
+	for i := 1000; i < 1100; i++ {
+		k := fmt.Sprintf("key-%04d", i)
+		values[k] = value
+		assert.NoError(db.Put([]byte(k), value))
+	}
+	unfiltered := check()
+	assert.NotZero(unfiltered)
+	assert.NoError(db.Close())
+
+	// Reindex adds the missing ones to the pages with room for them.
+	db, err = Open(testDB, 0755, &Options{BloomBitsPerKey: 10})
+	assert.NoError(err)
+	assert.NoError(db.Reindex())
+	assert.True(check() < unfiltered)
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.True(check() < unfiltered)
+	assert.NoError(db.Close())
+}
+
+// BenchmarkGetMissing looks up keys that aren't there, with and without bloom
+// filters. All keys share their first bytes, so the page index doesn't rule
+// out any page.
+func BenchmarkGetMissing(b *testing.B) {
+	for _, bits := range []int{0, 10} {
+		b.Run(fmt.Sprintf("bits=%d", bits), func(b *testing.B) {
+			os.Remove(testDB)
+			defer os.Remove(testDB)
+			db, err := Open(testDB, 0755, &Options{BloomBitsPerKey: bits})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			db.NoSync = true
+			var batch []KVPair
+			for i := 0; i < 20000; i++ {
+				batch = append(batch, KVPair{Key: []byte(fmt.Sprintf("key-%08d", i)), Value: make([]byte, 100)})
+			}
+			if err := db.PutBatch(batch); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get([]byte(fmt.Sprintf("key-%08d-missing", i%20000))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// pageUse is what a page was reached as by check.
+type pageUse uint8
+
+const (
+	unreached pageUse = iota
+	dataUse
+	indexUse
+	freeUse
+	freelistUse
+)
+
+var pageUseNames = []string{"unreached", "data", "index", "free", "freelist"}
+
+func (u pageUse) String() string {
+	return pageUseNames[u]
+}
+
+// Check verifies the database and sends what it finds inconsistent on the
+// returned channel, closed once done: the head, that every page is reached
+// once, from the data or index chains or the freelist, the page checksums,
+// that every record decodes, the keys of PageSorted pages are in order and
+// the page index matches the data pages. Writers wait for it to be done,
+// reading the errors doesn't hold them.
+func (db *DB) Check() <-chan error {
+	ch := make(chan error)
+	go func() {
+		defer close(ch)
+		db.rwlock.Lock()
+		var errs []error
+		if !db.opened {
+			errs = []error{ErrDatabaseNotOpen}
+		} else {
+			errs = db.check()
+		}
+		db.rwlock.Unlock()
+		for _, err := range errs {
+			ch <- err
+		}
+	}()
+	return ch
+}
+
+// strictCheck panics if the database is inconsistent, see DB.StrictMode. The
+// caller holds rwlock.
+func (db *DB) strictCheck() {
+	errs := db.check()
+	if len(errs) == 0 {
+		return
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	panic("sidb: check failed: " + strings.Join(msgs, "; "))
+}
+
+// checker is the state of a check.
+type checker struct {
+	db   *DB
+	head HeadPage
+	errs []error
+	// what each page was reached as
+	use []pageUse
+	// whether pages carry checksums
+	sums bool
+	// the index entries of the data pages before the tail, see dataIndex
+	entries []Index
+}
+
+// check returns what is inconsistent in the database, see Check. The caller
+// holds rwlock.
+func (db *DB) check() []error {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	c := &checker{db: db, head: *db.head}
+	if !c.checkHead() {
+		return c.errs
+	}
+	c.use = make([]pageUse, c.head.PageCount)
+	c.sums = c.head.Features.WriteRequired&FeaturePageChecksums != 0
+	c.checkData()
+	c.checkIndex()
+	for _, id := range db.freelist {
+		c.reach(id, freeUse)
+	}
+	for _, ids := range db.pending {
+		for _, id := range ids {
+			c.reach(id, freeUse)
+		}
+	}
+	for _, id := range db.freelistPages {
+		if c.reach(id, freelistUse) && db.page(id).Flag&PageFree == 0 {
+			c.errorf("freelist page %d has flags %#x", id, db.page(id).Flag)
+		}
+	}
+	for id := db.dataStart; id < c.head.PageCount; id++ {
+		if c.use[id] == unreached {
+			c.errorf("page %d is unreachable and not free", id)
+		}
+	}
+	return c.errs
+}
+
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.errs = append(c.errs, errors.Errorf(format, args...))
+}
+
+// reach notes page id is reached as use, reporting it if it is out of range
+// or was reached already.
+func (c *checker) reach(id PageId, use pageUse) bool {
+	if id < c.db.dataStart || id >= c.head.PageCount {
+		c.errorf("%s page %d is out of range", use, id)
+		return false
+	}
+	if prev := c.use[id]; prev != unreached {
+		c.errorf("page %d is both a %s and a %s page", id, prev, use)
+		return false
+	}
+	c.use[id] = use
+	return true
+}
+
+// checkSum checks the checksum of page id, whose header is p, if pages have
+// one.
+func (c *checker) checkSum(id PageId, p *Page) {
+	if c.sums {
+		if err := c.db.checkPageSum(id, p); err != nil {
+			c.errs = append(c.errs, err)
+		}
+	}
+}
+
+// checkHead checks the head and that the file holds its pages, reporting
+// whether the pages can be read.
+func (c *checker) checkHead() bool {
+	db := c.db
+	if err := c.head.validate(db, db.headId); err != nil {
+		c.errorf("head page %d: %s", db.headId, err)
+	}
+	size, err := db.fileSize()
+	if err != nil {
+		c.errs = append(c.errs, err)
+		return false
+	}
+	if err := db.checkFileSize(&c.head, size); err != nil {
+		c.errs = append(c.errs, err)
+		return false
+	}
+	if int64(db.datasz) < int64(c.head.PageCount)*int64(db.pageSize) {
+		c.errorf("mapping of %d bytes is short of the %d pages of the head", db.datasz, c.head.PageCount)
+		return false
+	}
+	return true
+}
+
+// checkData checks the data chain, up to the tail page.
+func (c *checker) checkData() {
+	db := c.db
+	tail := PageId(c.head.kvPtr.pageNum)
+	for id := db.dataStart; c.reach(id, dataUse); {
+		p := db.page(id)
+		if p.Flag&PageData == 0 {
+			c.errorf("data page %d has flags %#x", id, p.Flag)
+			return
+		}
+		last, lp := id, p
+		switch {
+		case p.Flag&PageFirst != 0:
+			if last, lp = c.checkOverflow(id, p); last == 0 {
+				return
+			}
+		case p.overflow():
+			c.errorf("data page %d is part of an overflow record without its first page", id)
+		default:
+			c.checkPage(id, p, id == tail)
+		}
+		if last == tail {
+			return
+		}
+		if lp.Next == 0 {
+			c.errorf("data chain ends at page %d before the tail page %d", last, tail)
+			return
+		}
+		id = lp.Next
+	}
+}
+
+// checkOverflow checks the overflow record starting at page id, whose header
+// is p, and returns its last page, 0 if it can't be followed.
+func (c *checker) checkOverflow(id PageId, p *Page) (PageId, *Page) {
+	db := c.db
+	last, lp := id, p
+	for {
+		c.checkSum(last, lp)
+		if lp.Flag&PageLast != 0 {
+			break
+		}
+		if lp.Next == 0 {
+			c.errorf("overflow record of page %d ends at page %d, not a last page", id, last)
+			return 0, nil
+		}
+		last = lp.Next
+		if !c.reach(last, dataUse) {
+			return 0, nil
+		}
+		if lp = db.page(last); lp.Flag&(PageMiddle|PageLast) == 0 {
+			c.errorf("overflow record of page %d goes on to page %d, flags %#x", id, last, lp.Flag)
+			return 0, nil
+		}
+	}
+	rec, _, _, err := db.overflowRecord(id, p)
+	if err != nil {
+		c.errs = append(c.errs, err)
+		return last, lp
+	}
+	var kv KVPair
+	if _, _, err := kv.unmarshal(rec, nil, db.decompressor); err != nil {
+		c.errs = append(c.errs, corruptRecord(err, id, 0))
+		return last, lp
+	}
+	c.entries = append(c.entries, keyIndex(id, kv.Key))
+	return last, lp
+}
+
+// checkPage checks the records of data page id, whose header is p, the tail
+// page if tail.
+func (c *checker) checkPage(id PageId, p *Page, tail bool) {
+	db := c.db
+	// The tail may hold records of a commit that failed past them.
+	whole := !tail || int(c.head.kvPtr.offset) == int(p.ptr)
+	if whole {
+		c.checkSum(id, p)
+	}
+	data, _, err := db.records(&snapshot{head: c.head}, id, p)
+	if err != nil {
+		c.errs = append(c.errs, err)
+		return
+	}
+	if whole && p.Flag&PageCompressed == 0 && int(p.Len) != len(data) {
+		c.errorf("data page %d holds %d bytes of records, its header says %d", id, len(data), p.Len)
+	}
+	var kv KVPair
+	var prevKey []byte
+	starts := make(map[int]bool)
+	count := 0
+	for off := 0; off < len(data); count++ {
+		n, _, err := kv.unmarshal(data[off:], prevKey, db.decompressor)
+		if err != nil {
+			c.errs = append(c.errs, corruptRecord(err, id, off))
+			return
+		}
+		if p.Flag&PageSorted != 0 && count > 0 && db.comparator(prevKey, kv.Key) > 0 {
+			c.errorf("data page %d is sorted but key %q follows %q", id, kv.Key, prevKey)
+		}
+		if ok, err := db.mayContain(id, p, kv.Key); err != nil || !ok {
+			c.errorf("bloom filter of data page %d misses key %q", id, kv.Key)
+		}
+		starts[pageHeaderSize+off] = true
+		prevKey = kv.Key
+		off += n
+	}
+	if whole && count != int(p.Count) {
+		c.errorf("data page %d holds %d records, its header says %d", id, count, p.Count)
+	}
+	if p.Flag&PageSorted != 0 {
+		offsets, err := db.restarts(id, pageHeaderSize+len(data))
+		if err != nil {
+			c.errs = append(c.errs, err)
+		}
+		for _, off := range offsets {
+			if !starts[int(off)] {
+				c.errorf("data page %d has a restart at %d, not a record", id, off)
+			}
+		}
+	}
+	if !tail {
+		if c.entries, err = db.pageIndexEntry(c.entries, id, p, data); err != nil {
+			c.errs = append(c.errs, err)
+		}
+	}
+}
+
+// checkIndex checks the index chain and, if the database is indexed, that
+// its entries are those of the data pages.
+func (c *checker) checkIndex() {
+	db := c.db
+	var entries []Index
+	if c.head.indexPtr.pageNum != 0 {
+		entries = c.indexEntries()
+	}
+	if !db.indexed() {
+		return
+	}
+	want := make(map[uint32]Index, len(c.entries))
+	for _, idx := range c.entries {
+		want[idx.PageNum] = idx
+	}
+	for _, idx := range entries {
+		w, ok := want[idx.PageNum]
+		switch {
+		case !ok:
+			c.errorf("index entry of page %d, not a data page before the tail or indexed twice", idx.PageNum)
+		case w != idx:
+			c.errorf("index entry of data page %d doesn't match its keys", idx.PageNum)
+		}
+		delete(want, idx.PageNum)
+	}
+	for _, idx := range c.entries {
+		if _, ok := want[idx.PageNum]; ok {
+			c.errorf("data page %d isn't indexed", idx.PageNum)
+		}
+	}
+}
+
+// indexEntries returns the entries of the index chain, checking its pages.
+func (c *checker) indexEntries() []Index {
+	db := c.db
+	var entries []Index
+	last := PageId(c.head.indexPtr.pageNum)
+	id := c.head.nextIndexPage
+	for n := uint32(1); c.reach(id, indexUse); n++ {
+		p := db.page(id)
+		if p.Flag&PageIndex == 0 {
+			c.errorf("index page %d has flags %#x", id, p.Flag)
+			return entries
+		}
+		end := int(p.ptr)
+		if id == last {
+			end = int(c.head.indexPtr.offset)
+		}
+		if end < pageHeaderSize || end > int(p.ptr) {
+			c.errorf("index page %d ends at %d", id, end)
+			return entries
+		}
+		if end == int(p.ptr) {
+			c.checkSum(id, p)
+		}
+		start := int(db.pageOffset(id))
+		for data := db.dataSlice(start+pageHeaderSize, start+end); len(data) >= indexEntrySize; data = data[indexEntrySize:] {
+			entries = append(entries, indexDecode(data))
+		}
+		if id == last {
+			if n != c.head.IndexPageCount {
+				c.errorf("index chain of %d pages, the head says %d", n, c.head.IndexPageCount)
+			}
+			return entries
+		}
+		if p.Next == 0 {
+			c.errorf("index chain ends at page %d before page %d", id, last)
+			return entries
+		}
+		id = p.Next
+	}
+	return entries
+}
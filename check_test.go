@@ -0,0 +1,92 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// checkErrors returns what db.Check finds.
+func checkErrors(db *DB) []error {
+	var errs []error
+	for err := range db.Check() {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func TestCheck(t *testing.T) {
+	assert := assertion.New(t)
+	defer os.Remove(testDB)
+	for _, options := range []*Options{
+		{PageSize: 512},
+		{PageSize: 512, Compression: CompLz4, PageCompression: true, BloomBitsPerKey: 10},
+	} {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, options)
+		assert.NoError(err)
+		db.NoSync = true
+		assert.Empty(checkErrors(db))
+
+		db.StrictMode = true
+		value := bytes.Repeat([]byte("value "), 20)
+		for i := 0; i < 200; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), value))
+		}
+		var pairs []KVPair
+		for i := 200; i < 1000; i++ {
+			pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: value})
+		}
+		assert.NoError(db.PutBatch(pairs))
+		assert.NoError(db.Put([]byte("big"), bytes.Repeat(value, 30)))
+		assert.NoError(db.Delete([]byte("key-0001")))
+		assert.NoError(db.Reindex())
+		_, err = freePages(db, 3)
+		assert.NoError(err)
+		assert.Empty(checkErrors(db))
+		assert.NoError(db.Close())
+
+		db, err = Open(testDB, 0755, options)
+		assert.NoError(err)
+		assert.Empty(checkErrors(db))
+		assert.NoError(db.Close())
+	}
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+
+	// a page allocated by a commit but linked from nowhere
+	db.rwlock.Lock()
+	head := *db.head
+	id, err := db.allocateEnd(&head, 1)
+	assert.NoError(err)
+	assert.NoError(db.flushHead(&head))
+	assert.NoError(db.mmap(int(head.PageCount) * db.pageSize))
+	db.rwlock.Unlock()
+	errs := checkErrors(db)
+	assert.Len(errs, 1)
+	assert.Contains(fmt.Sprint(errs), fmt.Sprintf("page %d is unreachable and not free", id))
+	db.StrictMode = true
+	assert.Contains(panicMessage(func() { db.Put([]byte("key"), []byte("value")) }), "check failed")
+	db.StrictMode = false
+	db.free(id)
+	assert.Empty(checkErrors(db))
+	assert.NoError(db.Close())
+
+	f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte("x"), int64(db.dataStart)*512+pageHeaderSize+4)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	var sum *ErrChecksum
+	errs = checkErrors(db)
+	assert.NotEmpty(errs)
+	assert.True(errors.As(errs[0], &sum), "%v", errs)
+	assert.Equal(db.dataStart, sum.Page)
+	assert.NoError(db.Close())
+	assert.Equal([]error{ErrDatabaseNotOpen}, checkErrors(db))
+}
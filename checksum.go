@@ -0,0 +1,130 @@
+package sidb
+
+import (
+	"bytes"
+	"hash/crc32"
+)
+
+// Every page carries the crc32 of its records, the Len bytes after its header,
+// in Page.CheckSum, or of the records as stored for PageCompressed pages.
+// Records are only ever appended, so the checksum is extended as they are
+// written, and a reader seeing a header sees a checksum matching the records
+// it counts.
+
+// ChecksumAlgorithm is how page and head checksums are computed, see
+// Options.ChecksumAlgo.
+type ChecksumAlgorithm uint16
+
+const (
+	// crc32 with the IEEE polynomial, the default and that of files older
+	// than the choice
+	ChecksumIEEE ChecksumAlgorithm = iota
+	// crc32 with the Castagnoli polynomial, hardware accelerated on amd64
+	// and arm64
+	ChecksumCastagnoli
+	// the lower 32 bits of xxhash64
+	ChecksumXXHash64
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// valid reports whether a is known.
+func (a ChecksumAlgorithm) valid() bool {
+	return a <= ChecksumXXHash64
+}
+
+// table returns the crc32 table of a, nil if its checksums can't be extended
+// by crc32.Update.
+func (a ChecksumAlgorithm) table() *crc32.Table {
+	switch a {
+	case ChecksumIEEE:
+		return crc32.IEEETable
+	case ChecksumCastagnoli:
+		return castagnoliTable
+	}
+	return nil
+}
+
+// sum returns the checksum of data, the concatenation of the slices. No data
+// sums to 0 as with the CRCs, the checksum of a new page.
+func (a ChecksumAlgorithm) sum(data ...[]byte) uint32 {
+	if t := a.table(); t != nil {
+		var sum uint32
+		for _, b := range data {
+			sum = crc32.Update(sum, t, b)
+		}
+		return sum
+	}
+	b := data[0]
+	if len(data) > 1 {
+		b = bytes.Join(data, nil)
+	}
+	if len(b) == 0 {
+		return 0
+	}
+	return uint32(xxhash64(b))
+}
+
+// appendSum returns the checksum of the records of data page id, whose header
+// is p, once rec is appended to them. The caller holds rwlock.
+func (db *DB) appendSum(id PageId, p *Page, rec []byte) uint32 {
+	if t := db.checksumAlgo.table(); t != nil {
+		return crc32.Update(p.CheckSum, t, rec)
+	}
+	if int(p.ptr) == pageHeaderSize {
+		return db.checksumAlgo.sum(rec)
+	}
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	return db.checksumAlgo.sum(db.pageData(id, p), rec)
+}
+
+// verifyPage checks the records of page id, whose header is p, against its
+// checksum if Options.VerifyChecksums is set. The caller holds mmaplock.
+func (db *DB) verifyPage(id PageId, p *Page) error {
+	if !db.verifyChecksums {
+		return nil
+	}
+	return db.checkPageSum(id, p)
+}
+
+// checkPageSum checks the records of page id, whose header is p, against its
+// checksum. The caller holds mmaplock.
+func (db *DB) checkPageSum(id PageId, p *Page) error {
+	n := int(p.Len)
+	if p.Flag&PageCompressed != 0 {
+		// the records as stored
+		n = int(p.ptr) - pageHeaderSize
+	}
+	if n < 0 || n > db.pageSize-pageHeaderSize {
+		return &ErrChecksum{Page: id}
+	}
+	start := int(db.pageOffset(id)) + pageHeaderSize
+	if db.checksumAlgo.sum(db.dataSlice(start, start+n)) != p.CheckSum {
+		return &ErrChecksum{Page: id}
+	}
+	return nil
+}
+
+// headChecksum returns HeadPage.Checksum for head, to be written to page id.
+func (db *DB) headChecksum(head *HeadPage, id PageId) uint32 {
+	pos := int(db.pageOffset(id))
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	return headPageChecksum(db.dataSlice(pos, pos+db.pageSize), head)
+}
+
+// headPageChecksum returns the checksum of page, a head page, once head is
+// written over it, with head.ChecksumAlgo: that of the page past head.ptr, or
+// with FeatureDualHead that of head, its checksum zeroed, and the rest of the
+// page, so that a torn head doesn't validate.
+func headPageChecksum(page []byte, head *HeadPage) uint32 {
+	if head.Features.Required&FeatureDualHead == 0 {
+		return head.ChecksumAlgo.sum(page[head.ptr:head.PageSize])
+	}
+	h := *head
+	h.Checksum = 0
+	var buf [headPageSize]byte
+	headPageEncode(buf[:], &h)
+	return head.ChecksumAlgo.sum(buf[:], page[headPageSize:head.PageSize])
+}
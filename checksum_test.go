@@ -0,0 +1,233 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestPageChecksums(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{VerifyChecksums: true, Compression: CompNone})
+	assert.NoError(err)
+	for i := 0; i < 500; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	big := make([]byte, 3*db.pageSize)
+	rand.New(rand.NewSource(1)).Read(big)
+	assert.NoError(db.PutBatch([]KVPair{{Key: []byte("big"), Value: big}, {Key: []byte("key-0000"), Value: []byte("again")}}))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	assert.NotZero(db.head.Checksum)
+	pages := 0
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		assert.NoError(db.verifyPage(id, db.page(id)))
+		pages++
+	}
+	assert.True(pages > 5)
+	v, err := db.Get([]byte("big"))
+	assert.NoError(err)
+	assert.Equal(big, v)
+	assert.NoError(db.Close())
+
+	// A flipped bit in the value of the first record of the first data page,
+	// "value-0" after the flag, the key and both lengths.
+	f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+	assert.NoError(err)
+	var b [1]byte
+	off := db.pageOffset(db.dataStart) + pageHeaderSize + 11
+	_, err = f.ReadAt(b[:], off)
+	assert.NoError(err)
+	b[0] ^= 1
+	_, err = f.WriteAt(b[:], off)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	_, err = db.Get([]byte("key-0001"))
+	var cerr *ErrChecksum
+	assert.True(errors.As(err, &cerr))
+	assert.Equal(db.dataStart, cerr.Page)
+	c := db.Cursor()
+	k, _ := c.First()
+	assert.Nil(k)
+	assert.Equal(&ErrChecksum{Page: db.dataStart}, c.Err())
+	assert.NoError(db.Close())
+
+	// Not checked unless asked for.
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	v, err = db.Get([]byte("key-0000"))
+	assert.NoError(err)
+	assert.Equal("again", string(v))
+	assert.NoError(db.Close())
+}
+
+func TestHeadChecksum(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	assert.NotZero(db.head.Checksum)
+	current := db.pageOffset(db.headId) + int64(db.head.ptr) + 100
+	previous := db.pageOffset(1-db.headId) + int64(db.head.ptr) + 100
+	assert.NoError(db.Close())
+
+	corrupt := func(off int64) {
+		f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte{1}, off)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+	}
+	// The other head, a commit behind, takes over.
+	corrupt(current)
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Equal(uint64(0), db.head.generation)
+	v, err := db.Get([]byte("key"))
+	assert.NoError(err)
+	assert.Nil(v)
+	assert.NoError(db.Close())
+
+	corrupt(previous)
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(&ErrCorrupt{Page: 0, Offset: checksumOffset, Reason: "checksum mismatch"}, errors.Cause(err))
+}
+
+// The checksum of dual heads covers their own fields.
+func TestHeadChecksumFields(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	assert.NoError(db.Put([]byte("key"), []byte("again")))
+	assert.NoError(db.Close())
+
+	// a byte of kvPtr in both heads
+	f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+	assert.NoError(err)
+	for id := PageId(0); id < 2; id++ {
+		_, err = f.WriteAt([]byte{0xff}, db.pageOffset(id)+32)
+		assert.NoError(err)
+	}
+	assert.NoError(f.Close())
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(&ErrCorrupt{Page: 0, Offset: checksumOffset, Reason: "checksum mismatch"}, errors.Cause(err))
+}
+
+func TestWriteToChecksums(t *testing.T) {
+	assert := assertion.New(t)
+	backup := testDB + ".backup"
+	os.Remove(testDB)
+	os.Remove(backup)
+	defer os.Remove(testDB)
+	defer os.Remove(backup)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("a"), []byte("1")))
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	// on the last page of the snapshot, cut from the copy
+	assert.NoError(db.Put([]byte("b"), []byte("2")))
+	f, err := os.Create(backup)
+	assert.NoError(err)
+	_, err = tx.WriteTo(f)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	assert.NoError(tx.Rollback())
+	assert.NoError(db.Close())
+
+	db, err = Open(backup, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	v, err := db.Get([]byte("a"))
+	assert.NoError(err)
+	assert.Equal("1", string(v))
+	assert.NoError(db.Close())
+}
+
+func TestXXHash64(t *testing.T) {
+	assert := assertion.New(t)
+	for s, h := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	} {
+		assert.Equal(h, xxhash64([]byte(s)), s)
+	}
+}
+
+func TestChecksumAlgo(t *testing.T) {
+	assert := assertion.New(t)
+	defer os.Remove(testDB)
+	os.Remove(testDB)
+	_, err := Open(testDB, 0755, &Options{ChecksumAlgo: 9})
+	assert.Equal(ErrUnknownChecksum, errors.Cause(err))
+
+	for _, algo := range []ChecksumAlgorithm{ChecksumIEEE, ChecksumCastagnoli, ChecksumXXHash64} {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, &Options{PageSize: 512, ChecksumAlgo: algo, VerifyChecksums: true})
+		assert.NoError(err)
+		db.NoSync = true
+		// records appended one by one and pages written whole
+		for i := 0; i < 100; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		var pairs []KVPair
+		for i := 100; i < 300; i++ {
+			pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte(fmt.Sprintf("value-%d", i))})
+		}
+		assert.NoError(db.PutBatch(pairs))
+		assert.NoError(db.Close())
+
+		// the head says
+		db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+		assert.NoError(err)
+		assert.Equal(algo, db.head.ChecksumAlgo)
+		assert.Equal(algo != ChecksumIEEE, db.head.Features.Required&FeatureChecksumAlgo != 0)
+		assert.Empty(checkErrors(db))
+		v, err := db.Get([]byte("key-0042"))
+		assert.NoError(err)
+		assert.Equal("value-42", string(v))
+		assert.NoError(db.Close())
+
+		f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte("x"), int64(db.dataStart)*512+pageHeaderSize+4)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+		db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+		assert.NoError(err)
+		_, err = db.Get([]byte("key-0000"))
+		assert.Equal(&ErrChecksum{Page: db.dataStart}, errors.Cause(err))
+		assert.NoError(db.Close())
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range []int{4096, 65536} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(data)
+		for _, algo := range []ChecksumAlgorithm{ChecksumIEEE, ChecksumCastagnoli, ChecksumXXHash64} {
+			b.Run(fmt.Sprintf("algo=%d/size=%d", algo, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					algo.sum(data)
+				}
+			})
+		}
+	}
+}
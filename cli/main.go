@@ -2,11 +2,54 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"sidb"
 	"unsafe"
 )
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == "reindex" {
+		if err := reindex(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) == 3 && os.Args[1] == "check" {
+		if err := check(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) == 4 && os.Args[1] == "salvage" {
+		if err := salvage(os.Args[2], os.Args[3]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "shell" {
+		if err := runShell(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "tail" {
+		if err := runTail(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) == 4 && os.Args[1] == "compact" {
+		if err := compact(os.Args[2], os.Args[3]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	//h := sidb.HeadPage{
 	//	Version:     0,
 	//	compression: sidb.CompSnappy,
@@ -48,3 +91,62 @@ func main() {
 	fmt.Println("Index", unsafe.Alignof(sidb.Index{}), unsafe.Sizeof(sidb.Index{}))
 	fmt.Println("RecordPtr", unsafe.Alignof(sidb.RecordPtr{}), unsafe.Sizeof(sidb.RecordPtr{}))
 }
+
+// reindex rebuilds the page index of the database at path.
+func reindex(path string) error {
+	db, err := sidb.Open(path, 0600, nil)
+	if err != nil {
+		return err
+	}
+	if err := db.Reindex(); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// check verifies the database at path, printing what is inconsistent, see
+// DB.Check.
+func check(path string) error {
+	db, err := sidb.Open(path, 0600, &sidb.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for err := range db.Check() {
+		fmt.Println(err)
+		n++
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%s: %d errors", path, n)
+	}
+	return nil
+}
+
+// salvage copies what can be read of the database at src into a new one at
+// dst, printing what was left behind, see sidb.Salvage.
+func salvage(src, dst string) error {
+	report, err := sidb.Salvage(src, dst, nil)
+	for _, skip := range report.Skipped {
+		fmt.Printf("skipped page %d, %d records: %s\n", skip.Page, skip.Records, skip.Err)
+	}
+	fmt.Printf("copied %d records from %d pages, %d found unlinked\n", report.Records, report.Pages, report.Unlinked)
+	return err
+}
+
+// compact copies the live records of the database at src into a new one at
+// dst, see sidb.DB.Compact.
+func compact(src, dst string) error {
+	db, err := sidb.Open(src, 0600, &sidb.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	if err := db.Compact(dst, nil); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sidb"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const shellHelp = `commands:
+  get KEY                 print the value of KEY
+  put KEY VALUE           set KEY to VALUE, needs --rw
+  del KEY                 delete KEY, needs --rw
+  scan [START [END]]      print the pairs with START <= key < END
+  seek KEY [N]            print N pairs from the first key >= KEY, 10 by default
+  page ID                 print the header of page ID
+  info                    print what the database is
+  stats                   print the counters and memory of the handle
+  history                 print the commands entered, !N runs the Nth again
+  .timing on|off          print how long each command takes
+  help                    print this
+  exit, quit              leave the shell
+
+Keys and values are words, "quoted strings" with Go escapes, hex as 0x...
+or the content of a file as @path. Commands are separated by newlines or ;.`
+
+// shellScreen is how many lines of output are shown before waiting for the
+// user to go on.
+const shellScreen = 23
+
+// errShellStop stops a listing the user quit paging through.
+var errShellStop = errors.New("stopped")
+
+// shell is the state of sidb shell.
+type shell struct {
+	db   *sidb.DB
+	path string
+	in   *bufio.Reader
+	out  io.Writer
+	// interactive shells prompt, page output and keep a history
+	interactive bool
+	timing      bool
+	history     []string
+	lines       int // lines printed since the last command or page break
+}
+
+// runShell implements sidb shell [--rw] [--exec "cmd; cmd"] <file>.
+func runShell(args []string) error {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	rw := fs.Bool("rw", false, "open the database for writing")
+	exec := fs.String("exec", "", "run the commands, separated by ;, and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: sidb shell [--rw] [--exec \"cmd; cmd\"] <file>")
+	}
+	db, err := sidb.Open(fs.Arg(0), 0600, &sidb.Options{ReadOnly: !*rw})
+	if err != nil {
+		return err
+	}
+	sh := &shell{db: db, path: fs.Arg(0), in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	if *exec != "" {
+		err = sh.exec(*exec)
+	} else {
+		info, serr := os.Stdin.Stat()
+		sh.interactive = serr == nil && info.Mode()&os.ModeCharDevice != 0
+		sh.loop()
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exec runs the commands of line, stopping at the first error.
+func (sh *shell) exec(line string) error {
+	cmds, err := parseLine(line)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := sh.run(cmd); err != nil {
+			return fmt.Errorf("%s: %v", cmd[0].s, err)
+		}
+	}
+	return nil
+}
+
+// loop reads and runs commands until the input ends or the user leaves.
+// Errors are printed, they don't end the shell.
+func (sh *shell) loop() {
+	for {
+		if sh.interactive {
+			fmt.Fprint(sh.out, "sidb> ")
+		}
+		line, err := sh.in.ReadString('\n')
+		if err != nil && line == "" {
+			if sh.interactive {
+				fmt.Fprintln(sh.out)
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "!") {
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < 1 || n > len(sh.history) {
+				fmt.Fprintf(sh.out, "error: no command %s in history\n", line)
+				continue
+			}
+			line = sh.history[n-1]
+			fmt.Fprintln(sh.out, line)
+		}
+		if line == "" {
+			continue
+		}
+		if sh.interactive {
+			sh.history = append(sh.history, line)
+		}
+		cmds, err := parseLine(line)
+		if err != nil {
+			fmt.Fprintf(sh.out, "error: %v\n", err)
+			continue
+		}
+		for _, cmd := range cmds {
+			if name := cmd[0].s; name == "exit" || name == "quit" {
+				return
+			}
+			if err := sh.run(cmd); err != nil {
+				fmt.Fprintf(sh.out, "error: %v\n", err)
+			}
+		}
+	}
+}
+
+// run runs a single command, timing it if asked to.
+func (sh *shell) run(cmd []shellArg) error {
+	sh.lines = 0
+	start := time.Now()
+	err := sh.dispatch(cmd[0].s, cmd[1:])
+	if err == errShellStop {
+		err = nil
+	}
+	if sh.timing {
+		fmt.Fprintf(sh.out, "time: %v\n", time.Since(start))
+	}
+	return err
+}
+
+func (sh *shell) dispatch(name string, args []shellArg) error {
+	switch name {
+	case "get":
+		key, err := sh.args(args, 1, 1)
+		if err != nil {
+			return err
+		}
+		v, err := sh.db.Get(key[0])
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return errors.New("key not found")
+		}
+		return sh.println(formatBytes(v))
+	case "put":
+		kv, err := sh.args(args, 2, 2)
+		if err != nil {
+			return err
+		}
+		return sh.db.Put(kv[0], kv[1])
+	case "del":
+		key, err := sh.args(args, 1, 1)
+		if err != nil {
+			return err
+		}
+		return sh.db.Delete(key[0])
+	case "scan":
+		bounds, err := sh.args(args, 0, 2)
+		if err != nil {
+			return err
+		}
+		var start, end []byte
+		if len(bounds) > 0 {
+			start = bounds[0]
+		}
+		if len(bounds) > 1 {
+			end = bounds[1]
+		}
+		return sh.db.Range(start, end, func(k, v []byte) error {
+			return sh.println(formatBytes(k), formatBytes(v))
+		})
+	case "seek":
+		return sh.seek(args)
+	case "page":
+		return sh.page(args)
+	case "info":
+		return sh.info()
+	case "stats":
+		return sh.stats()
+	case "history":
+		for i, line := range sh.history {
+			if err := sh.println(fmt.Sprintf("%4d", i+1), line); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ".timing":
+		if len(args) != 1 || args[0].s != "on" && args[0].s != "off" {
+			return errors.New("usage: .timing on|off")
+		}
+		sh.timing = args[0].s == "on"
+		return nil
+	case "help":
+		fmt.Fprintln(sh.out, shellHelp)
+		return nil
+	case "exit", "quit":
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, see help", name)
+}
+
+func (sh *shell) seek(args []shellArg) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: seek KEY [N]")
+	}
+	key, err := args[0].bytes()
+	if err != nil {
+		return err
+	}
+	n := 10
+	if len(args) == 2 {
+		if n, err = strconv.Atoi(args[1].s); err != nil || n < 0 {
+			return fmt.Errorf("invalid count %q", args[1].s)
+		}
+	}
+	c := sh.db.Cursor()
+	for k, v := c.Seek(key); k != nil && n > 0; k, v = c.Next() {
+		if err := sh.println(formatBytes(k), formatBytes(v)); err != nil {
+			return err
+		}
+		n--
+	}
+	return c.Err()
+}
+
+// pageFlagNames names the bits of sidb.PageFlag.
+var pageFlagNames = []struct {
+	flag sidb.PageFlag
+	name string
+}{
+	{sidb.PageIndex, "index"},
+	{sidb.PageData, "data"},
+	{sidb.PageFull, "full"},
+	{sidb.PageFirst, "first"},
+	{sidb.PageMiddle, "middle"},
+	{sidb.PageLast, "last"},
+	{sidb.PageFree, "free"},
+	{sidb.PageSorted, "sorted"},
+	{sidb.PageBloom, "bloom"},
+	{sidb.PageCompressed, "compressed"},
+}
+
+func (sh *shell) page(args []shellArg) error {
+	if len(args) != 1 {
+		return errors.New("usage: page ID")
+	}
+	id, err := strconv.ParseUint(args[0].s, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid page %q", args[0].s)
+	}
+	p, err := sh.db.PageHeader(sidb.PageId(id))
+	if err != nil {
+		return err
+	}
+	var flags []string
+	for _, f := range pageFlagNames {
+		if p.Flag&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(sh.out, "flags:    %#x [%s]\n", p.Flag, strings.Join(flags, " "))
+	fmt.Fprintf(sh.out, "count:    %d\n", p.Count)
+	fmt.Fprintf(sh.out, "len:      %d\n", p.Len)
+	fmt.Fprintf(sh.out, "next:     %d\n", p.Next)
+	fmt.Fprintf(sh.out, "checksum: %#08x\n", p.CheckSum)
+	return nil
+}
+
+// compressionNames names the built-in sidb.CompressAlgorithm.
+var compressionNames = map[sidb.CompressAlgorithm]string{
+	sidb.CompSnappy: "snappy",
+	sidb.CompNone:   "none",
+	sidb.CompLz4:    "lz4",
+}
+
+func (sh *shell) info() error {
+	count, err := sh.db.Count()
+	if err != nil {
+		return err
+	}
+	a, level := sh.db.Compression()
+	name, ok := compressionNames[a]
+	if !ok {
+		name = fmt.Sprintf("user %d", a)
+	}
+	fmt.Fprintf(sh.out, "path:        %s\n", sh.path)
+	fmt.Fprintf(sh.out, "size:        %d\n", sh.db.Size())
+	fmt.Fprintf(sh.out, "records:     %d\n", count)
+	fmt.Fprintf(sh.out, "generation:  %d\n", sh.db.Generation())
+	fmt.Fprintf(sh.out, "compression: %s, level %d\n", name, level)
+	fmt.Fprintf(sh.out, "features:    %s\n", sh.db.Features())
+	return nil
+}
+
+func (sh *shell) stats() error {
+	s := sh.db.Stats()
+	mem, err := sh.db.MemoryStats()
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"get", s.Get},
+		{"page cache hit", s.PageCacheHit},
+		{"page cache miss", s.PageCacheMiss},
+		{"commits", s.TxN},
+		{"put", s.TxStats.Put},
+		{"delete", s.TxStats.Delete},
+		{"page alloc", s.TxStats.PageAlloc},
+		{"write", s.TxStats.Write},
+		{"write bytes", s.TxStats.WriteBytes},
+		{"sync", s.TxStats.Sync},
+		{"compress in", s.TxStats.CompressIn},
+		{"compress out", s.TxStats.CompressOut},
+		{"compress time", time.Duration(s.CompressTime)},
+		{"decompress time", time.Duration(s.DecompressTime)},
+		{"mapped", mem.Mapped},
+		{"resident", mem.Resident},
+		{"page cache", mem.PageCache},
+		{"index", mem.Index},
+		{"pool", mem.Pool},
+	} {
+		fmt.Fprintf(sh.out, "%-16s %v\n", c.name+":", c.value)
+	}
+	return nil
+}
+
+// args decodes between min and max arguments.
+func (sh *shell) args(args []shellArg, min, max int) ([][]byte, error) {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return nil, fmt.Errorf("%d arguments expected, got %d", min, len(args))
+		}
+		return nil, fmt.Errorf("%d to %d arguments expected, got %d", min, max, len(args))
+	}
+	b := make([][]byte, len(args))
+	for i, a := range args {
+		var err error
+		if b[i], err = a.bytes(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// println prints the fields of a line of output, separated by spaces. Once
+// a screen is full, an interactive shell waits for the user to go on, and
+// returns errShellStop if they quit.
+func (sh *shell) println(fields ...string) error {
+	if sh.interactive && sh.lines == shellScreen {
+		fmt.Fprint(sh.out, "-- more, q to stop --")
+		line, err := sh.in.ReadString('\n')
+		if err != nil || strings.TrimSpace(line) == "q" {
+			return errShellStop
+		}
+		sh.lines = 0
+	}
+	sh.lines++
+	_, err := fmt.Fprintln(sh.out, strings.Join(fields, " "))
+	return err
+}
+
+// shellArg is a word of a command line, quoted or not.
+type shellArg struct {
+	s      string
+	quoted bool
+}
+
+// bytes decodes a key or value: a quoted string as it is, a 0x prefix as hex,
+// an @ prefix as the content of the file, anything else as it is.
+func (a shellArg) bytes() ([]byte, error) {
+	switch {
+	case a.quoted:
+		return []byte(a.s), nil
+	case strings.HasPrefix(a.s, "0x"):
+		b, err := hex.DecodeString(a.s[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex %q", a.s)
+		}
+		return b, nil
+	case strings.HasPrefix(a.s, "@"):
+		return ioutil.ReadFile(a.s[1:])
+	}
+	return []byte(a.s), nil
+}
+
+// parseLine splits line into commands separated by ; and those into words
+// separated by spaces. A word may be a double-quoted string with Go escapes.
+// Empty commands are dropped.
+func parseLine(line string) ([][]shellArg, error) {
+	var cmds [][]shellArg
+	var cmd []shellArg
+	for i := 0; i <= len(line); {
+		if i == len(line) || line[i] == ';' {
+			if len(cmd) > 0 {
+				cmds = append(cmds, cmd)
+			}
+			cmd = nil
+			i++
+			continue
+		}
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"':
+			// the closing quote, past escaped characters
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, errors.New("unterminated quoted string")
+			}
+			s, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string %s", line[i:j+1])
+			}
+			cmd = append(cmd, shellArg{s: s, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r\n;\"", rune(line[j])) {
+				j++
+			}
+			cmd = append(cmd, shellArg{s: line[i:j]})
+			i = j
+		}
+	}
+	return cmds, nil
+}
+
+// formatBytes formats b so that it reads back as the same bytes: as it is if
+// it is a printable word, quoted if it is printable text, in hex otherwise.
+func formatBytes(b []byte) string {
+	if !utf8.Valid(b) {
+		return "0x" + hex.EncodeToString(b)
+	}
+	s := string(b)
+	word := s != "" && !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "@")
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return "0x" + hex.EncodeToString(b)
+		}
+		if unicode.IsSpace(r) || r == '"' || r == ';' || r == '\\' {
+			word = false
+		}
+	}
+	if word {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sidb"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	assert := assertion.New(t)
+	cmds, err := parseLine(`put "a b;\"c\"\x00" 0x00ff ; ; get k;scan`)
+	assert.NoError(err)
+	assert.Equal([][]shellArg{
+		{{s: "put"}, {s: "a b;\"c\"\x00", quoted: true}, {s: "0x00ff"}},
+		{{s: "get"}, {s: "k"}},
+		{{s: "scan"}},
+	}, cmds)
+
+	_, err = parseLine(`get "k`)
+	assert.Error(err)
+	_, err = parseLine(`get "\q"`)
+	assert.Error(err)
+
+	b, err := shellArg{s: "0x00ff"}.bytes()
+	assert.NoError(err)
+	assert.Equal([]byte{0, 0xff}, b)
+	b, err = shellArg{s: "0x00ff", quoted: true}.bytes()
+	assert.NoError(err)
+	assert.Equal([]byte("0x00ff"), b)
+	_, err = shellArg{s: "0xzz"}.bytes()
+	assert.Error(err)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert := assertion.New(t)
+	for _, c := range []struct{ in, out string }{
+		{"key", "key"},
+		{"a b", `"a b"`},
+		{"", `""`},
+		{"0x12", `"0x12"`},
+		{"@file", `"@file"`},
+		{"a;b", `"a;b"`},
+		{"\x00\xff", "0x00ff"},
+		{"tab\t", "0x74616209"},
+	} {
+		assert.Equal(c.out, formatBytes([]byte(c.in)), "%q", c.in)
+		// what is printed reads back as the same bytes
+		cmds, err := parseLine("get " + c.out)
+		assert.NoError(err)
+		b, err := cmds[0][1].bytes()
+		assert.NoError(err)
+		assert.Equal([]byte(c.in), b)
+	}
+}
+
+func TestShell(t *testing.T) {
+	assert := assertion.New(t)
+	path, value := "/tmp/test-sidb-shell.sidb", "/tmp/test-sidb-shell.value"
+	os.Remove(path)
+	defer os.Remove(path)
+	defer os.Remove(value)
+	assert.NoError(ioutil.WriteFile(value, []byte("from a file"), 0600))
+	db, err := sidb.Open(path, 0600, nil)
+	assert.NoError(err)
+	defer db.Close()
+
+	var out bytes.Buffer
+	sh := &shell{db: db, path: path, out: &out}
+	assert.NoError(sh.exec(`put a 1; put "b c" @` + value + `; put d 0x00; del a; get "b c"; scan; seek b 1`))
+	assert.Equal("\"from a file\"\n\"b c\" \"from a file\"\nd 0x00\n\"b c\" \"from a file\"\n", out.String())
+	assert.EqualError(sh.exec("get a; get d"), "get: key not found")
+	assert.EqualError(sh.exec("nope"), `nope: unknown command "nope", see help`)
+
+	// errors don't end an interactive shell, output is paged
+	for i := 0; i < 30; i++ {
+		assert.NoError(db.Put([]byte{'k', byte('a' + i)}, []byte("v")))
+	}
+	out.Reset()
+	sh.in = bufio.NewReader(strings.NewReader("get x\nscan k\n\nscan k\nq\n.timing on\nexit\nget d\n"))
+	sh.interactive = true
+	sh.loop()
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal("sidb> error: key not found", lines[0])
+	assert.Equal("sidb> ka v", lines[1])
+	assert.Equal("-- more, q to stop --k"+string('a'+shellScreen)+" v", lines[shellScreen+1])
+	assert.Contains(out.String(), "-- more, q to stop --sidb> ")
+	assert.NotContains(out.String(), "0x00")
+	assert.True(sh.timing)
+	assert.Equal([]string{"get x", "scan k", "scan k", ".timing on", "exit"}, sh.history)
+}
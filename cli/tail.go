@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sidb"
+	"syscall"
+	"unicode/utf8"
+)
+
+const tailUsage = "usage: sidb tail <file> [--prefix p] [--from-now|--from-start] [--format text|jsonl]"
+
+// runTail implements sidb tail, printing the records committed to the file
+// until interrupted, see sidb.Tail.
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only print the keys starting with `p`")
+	fromNow := fs.Bool("from-now", false, "print the records committed from now on, the default")
+	fromStart := fs.Bool("from-start", false, "print the records already in the file first")
+	format := fs.String("format", "text", "output `format`, text or jsonl")
+	// the file may come before the flags
+	var path string
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if path == "" || fs.NArg() != 0 || *fromNow && *fromStart {
+		return errors.New(tailUsage)
+	}
+	if *format != "text" && *format != "jsonl" {
+		return fmt.Errorf("unknown format %q, %s", *format, tailUsage)
+	}
+
+	// Interrupting stops the tail, which closes the file and releases its
+	// lock before the program exits.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	opts := &sidb.TailOptions{Prefix: []byte(*prefix), FromStart: *fromStart}
+	return tail(ctx, path, opts, *format == "jsonl", os.Stdout)
+}
+
+// tail prints the records sidb.Tail passes to out, a line each.
+func tail(ctx context.Context, path string, opts *sidb.TailOptions, jsonl bool, out io.Writer) error {
+	return sidb.Tail(ctx, path, opts, func(rec *sidb.TailRecord) error {
+		var err error
+		if jsonl {
+			err = tailJSON(out, rec)
+		} else {
+			switch {
+			case rec.Reopened:
+				_, err = fmt.Fprintf(out, "-- %s was replaced, reopened at generation %d, records may be missing\n", path, rec.Generation)
+			case rec.NewestOnly:
+				_, err = fmt.Fprintln(out, "del-newest", formatBytes(rec.Key))
+			case rec.Deleted:
+				_, err = fmt.Fprintln(out, "del", formatBytes(rec.Key))
+			case rec.Appended:
+				_, err = fmt.Fprintln(out, "append", formatBytes(rec.Key), formatBytes(rec.Value))
+			default:
+				_, err = fmt.Fprintln(out, "put", formatBytes(rec.Key), formatBytes(rec.Value))
+			}
+		}
+		return err
+	})
+}
+
+// tailLine is a line of sidb tail --format jsonl. Keys and values that aren't
+// UTF-8 are given in hex, in key_hex and value_hex.
+type tailLine struct {
+	Event    string `json:"event"` // put, append, del, del-newest or reopen
+	Gen      uint64 `json:"gen"`
+	Key      string `json:"key,omitempty"`
+	KeyHex   string `json:"key_hex,omitempty"`
+	Value    string `json:"value,omitempty"`
+	ValueHex string `json:"value_hex,omitempty"`
+}
+
+func tailJSON(out io.Writer, rec *sidb.TailRecord) error {
+	line := tailLine{Event: "put", Gen: rec.Generation}
+	switch {
+	case rec.Reopened:
+		line.Event = "reopen"
+	case rec.NewestOnly:
+		line.Event = "del-newest"
+	case rec.Deleted:
+		line.Event = "del"
+	case rec.Appended:
+		line.Event = "append"
+	}
+	if !rec.Reopened {
+		line.Key, line.KeyHex = jsonBytes(rec.Key)
+		line.Value, line.ValueHex = jsonBytes(rec.Value)
+	}
+	b, err := json.Marshal(&line)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(b, '\n'))
+	return err
+}
+
+// jsonBytes returns b as a string if it is UTF-8, or in hex otherwise.
+func jsonBytes(b []byte) (s, hexs string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return "", hex.EncodeToString(b)
+}
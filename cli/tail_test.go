@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"sidb"
+	"testing"
+	"time"
+)
+
+func TestTail(t *testing.T) {
+	assert := assertion.New(t)
+	path := "/tmp/test-sidb-tail.sidb"
+	os.Remove(path)
+	defer os.Remove(path)
+	db, err := sidb.Open(path, 0600, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("a b"), []byte("1")))
+	assert.NoError(db.Put([]byte("bin"), []byte{0xff}))
+	assert.NoError(db.Put([]byte("other"), []byte("2")))
+	assert.NoError(db.Delete([]byte("a b")))
+	assert.NoError(db.Close())
+
+	run := func(jsonl bool) string {
+		var out bytes.Buffer
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		opts := &sidb.TailOptions{FromStart: true, Prefix: []byte("a"), Interval: time.Millisecond}
+		assert.NoError(tail(ctx, path, opts, jsonl, &out))
+		return out.String()
+	}
+	assert.Equal("put \"a b\" 1\ndel \"a b\"\n", run(false))
+	assert.Equal(`{"event":"put","gen":4,"key":"a b","value":"1"}`+"\n"+
+		`{"event":"del","gen":4,"key":"a b"}`+"\n", run(true))
+
+	var out bytes.Buffer
+	assert.NoError(tailJSON(&out, &sidb.TailRecord{Key: []byte("bin"), Value: []byte{0xff}, Generation: 2}))
+	assert.NoError(tailJSON(&out, &sidb.TailRecord{Reopened: true, Generation: 3}))
+	assert.Equal(`{"event":"put","gen":2,"key":"bin","value_hex":"ff"}`+"\n"+
+		`{"event":"reopen","gen":3}`+"\n", out.String())
+
+	assert.EqualError(runTail([]string{path, "--from-now", "--from-start"}), tailUsage)
+	assert.EqualError(runTail(nil), tailUsage)
+}
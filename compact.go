@@ -0,0 +1,363 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// compactBatchSize is how many records Compact copies per commit.
+const compactBatchSize = 1000
+
+// Compact copies the live records of the database into a new one created at
+// dstPath with opts, in key order and densely packed into sorted pages with a
+// fresh page index, and syncs it. Shadowed records are left behind, and so
+// are tombstones older than the TombstoneRetention of opts, or of the
+// database if that is 0, or all of them if it is negative. Records are
+// marshaled again, with the compression of opts, or that of the database if
+// opts is nil, in which case the new one is created like it was. If opts has
+// no Comparator, the database's is used.
+//
+// A database in DupKeys mode is copied into one in that mode, every key with
+// its values in the order they were put. The tombstones of DeleteDup aren't
+// copied, only the last one of a key deleting all its values can be.
+//
+// The values Append wrote in fragments are put together and copied whole.
+//
+// The new database is shrunk to its pages, see Shrink. The database isn't
+// modified. Compact reads it in a read-only transaction, so writers go on
+// meanwhile, and what they write isn't copied. A database not written in key
+// order has its keys sorted in memory with the position of their record,
+// whose values are then read in key order, which is slower.
+func (db *DB) Compact(dstPath string, opts *Options) (err error) {
+	if _, err := os.Lstat(dstPath); err == nil {
+		return errors.Errorf("compact: %s exists", dstPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = db.compactOptions(&tx.snap.head)
+	} else if opts.Comparator == nil || db.dupKeys && !opts.DupKeys {
+		o := *opts
+		if o.Comparator == nil {
+			o.Comparator = db.comparator
+		}
+		o.DupKeys = o.DupKeys || db.dupKeys
+		opts = &o
+	}
+	dst, err := open(callerOf(), dstPath, info.Mode().Perm(), opts, false)
+	if err != nil {
+		return errors.Wrap(err, "compact: create destination")
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dstPath)
+		}
+	}()
+	c := &compactor{tx: tx, dst: dst, retention: opts.TombstoneRetention, now: db.now()}
+	if c.retention == 0 {
+		c.retention = db.tombstoneRetention
+	}
+	if err := c.run(); err != nil {
+		return err
+	}
+	// The file was grown ahead of the writes.
+	if _, err := dst.Shrink(); err != nil {
+		return errors.Wrap(err, "compact: shrink destination")
+	}
+	return errors.Wrap(dst.Sync(), "compact: sync destination")
+}
+
+// compactOptions returns the options the database, whose head is head, was
+// created with as far as they are known, see Compact.
+func (db *DB) compactOptions(head *HeadPage) *Options {
+	return &Options{
+		PageSize:           uint32(db.pageSize),
+		Compression:        head.Compression,
+		CompressionLevel:   int(head.CompressionLevel),
+		PageCompression:    db.pageCompression,
+		ChecksumAlgo:       db.checksumAlgo,
+		Comparator:         db.comparator,
+		OrderedWrite:       db.orderedWrite,
+		DupKeys:            db.dupKeys,
+		BloomBitsPerKey:    db.bloomBits,
+		TombstoneRetention: db.tombstoneRetention,
+		MaxAppendChain:     db.maxAppendChain,
+	}
+}
+
+// compactor is the state of a Compact.
+type compactor struct {
+	tx  *Tx
+	dst *DB
+	// tombstones younger than retention at now are copied
+	retention time.Duration
+	now       time.Time
+	// records waiting to be copied, with KVDeleted for tombstones
+	pairs []KVPair
+	flags []KVFlag
+	// key decoded by value
+	scratch []byte
+}
+
+// compactRecord is the key of a live record and where the record is, page
+// and offset, as the cursor gives them, and whether it is a tombstone or a
+// fragment of Append.
+type compactRecord struct {
+	key      []byte
+	id       PageId
+	off      int
+	deleted  bool
+	appended bool
+}
+
+// run copies the live records of tx to dst in key order, see Compact.
+func (c *compactor) run() error {
+	if c.tx.db.dupKeys {
+		return c.runDups()
+	}
+	cmp := c.dst.comparator
+	cur := c.tx.Cursor()
+	cur.keysOnly = true
+	cur.tombstones = c.retention > 0
+	var recs []compactRecord
+	sorted := true
+	for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+		if n := len(recs); n > 0 && cmp(recs[n-1].key, k) >= 0 {
+			sorted = false
+		}
+		recs = append(recs, compactRecord{key: append([]byte(nil), k...), id: cur.curID, off: cur.curOff, deleted: cur.deleted, appended: cur.appended})
+	}
+	if err := cur.Err(); err != nil {
+		return errors.Wrap(err, "compact")
+	}
+
+	if sorted {
+		recs = nil
+		cur := c.tx.Cursor()
+		cur.tombstones = c.retention > 0
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if err := c.add(k, v, cur.deleted); err != nil {
+				return err
+			}
+		}
+		if err := cur.Err(); err != nil {
+			return errors.Wrap(err, "compact")
+		}
+		return c.flush()
+	}
+
+	sort.SliceStable(recs, func(i, j int) bool {
+		return cmp(recs[i].key, recs[j].key) < 0
+	})
+	for _, r := range recs {
+		v, err := c.value(&r)
+		if r.appended {
+			v, err = c.whole(r.key)
+		}
+		if err != nil {
+			return errors.Wrap(err, "compact")
+		}
+		if err := c.add(r.key, v, r.deleted); err != nil {
+			return err
+		}
+	}
+	return c.flush()
+}
+
+// dupRun is what Compact copies of key in DupKeys mode: the records of its
+// values, in the order they were put, each followed by the fragments
+// appended to it, and the last tombstone deleting all those before, if any.
+type dupRun struct {
+	key     []byte
+	recs    []compactRecord
+	deleted *compactRecord
+}
+
+// runDups copies the values of every key of tx to dst in key order, in
+// DupKeys mode: the records are replayed in the order they were written, as
+// GetAll does for one key, into the runs of every key, which are then
+// copied, every value whole.
+func (c *compactor) runDups() error {
+	runs, err := c.dupRuns()
+	if err != nil {
+		return errors.Wrap(err, "compact")
+	}
+	keys := make([][]byte, 0, len(runs))
+	for _, r := range runs {
+		if len(r.recs) > 0 || r.deleted != nil {
+			keys = append(keys, r.key)
+		}
+	}
+	cmp := c.dst.comparator
+	sort.Slice(keys, func(i, j int) bool { return cmp(keys[i], keys[j]) < 0 })
+	for _, k := range keys {
+		r := runs[string(k)]
+		if r.deleted != nil {
+			v, err := c.value(r.deleted)
+			if err != nil {
+				return errors.Wrap(err, "compact")
+			}
+			if err := c.add(k, v, true); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < len(r.recs); {
+			v, err := c.value(&r.recs[i])
+			for i++; err == nil && i < len(r.recs) && r.recs[i].appended; i++ {
+				var frag []byte
+				frag, err = c.value(&r.recs[i])
+				v = append(v, frag...)
+			}
+			if err != nil {
+				return errors.Wrap(err, "compact")
+			}
+			if err := c.add(k, v, false); err != nil {
+				return err
+			}
+		}
+	}
+	return c.flush()
+}
+
+// dupRuns decodes the keys of the records of tx in the order they were
+// written into the run of each key, see runDups.
+func (c *compactor) dupRuns() (map[string]*dupRun, error) {
+	db := c.tx.db
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	runs := make(map[string]*dupRun)
+	var key []byte
+	for id := db.dataStart; id != 0; {
+		data, next, err := db.records(&c.tx.snap, id, db.page(id))
+		if err != nil {
+			return nil, err
+		}
+		key = key[:0]
+		for off := 0; off < len(data); {
+			// Only keys are needed, expanded in place in the previous
+			// key's array.
+			k, _, n, flag, err := decodeKV(data[off:], key, key[:0], nil, db.decompressor, false)
+			if err != nil {
+				return nil, corruptRecord(err, id, off)
+			}
+			r := runs[string(k)]
+			if r == nil {
+				r = &dupRun{key: append([]byte(nil), k...)}
+				runs[string(r.key)] = r
+			}
+			// A fragment with no value before it starts one.
+			rec := compactRecord{key: r.key, id: id, off: pageHeaderSize + off, deleted: flag&KVDeleted != 0,
+				appended: flag&KVAppended != 0 && len(r.recs) > 0}
+			switch {
+			case flag&KVDeleteNewest != 0:
+				// the newest value with its fragments
+				for n := len(r.recs); n > 0; n-- {
+					last := r.recs[n-1]
+					r.recs = r.recs[:n-1]
+					if !last.appended {
+						break
+					}
+				}
+			case flag&KVDeleted != 0:
+				r.recs, r.deleted = r.recs[:0], &rec
+			default:
+				r.recs = append(r.recs, rec)
+			}
+			key = k
+			off += n
+		}
+		id = next
+	}
+	return runs, nil
+}
+
+// value returns the value of the record r, decoded in place rather than
+// looked up.
+func (c *compactor) value(r *compactRecord) ([]byte, error) {
+	db := c.tx.db
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	data, _, err := db.records(&c.tx.snap, r.id, db.page(r.id))
+	if err != nil {
+		return nil, err
+	}
+	off := r.off - pageHeaderSize
+	if off < 0 || off >= len(data) {
+		return nil, corruptPage(r.id, r.off, "no record of %q", r.key)
+	}
+	// The key starts with the prefix shared with the previous one, so it
+	// serves as prevKey.
+	k, v, _, _, err := decodeKV(data[off:], r.key, c.scratch[:0], nil, db.decompressor, true)
+	c.scratch = k
+	if err != nil {
+		return nil, corruptRecord(err, r.id, off)
+	}
+	return v, nil
+}
+
+// whole returns the value of key, whose newest record is a fragment of
+// Append, put together.
+func (c *compactor) whole(key []byte) ([]byte, error) {
+	db := c.tx.db
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	return db.newest(key, &c.tx.snap)
+}
+
+// add queues the record of k and v to be copied, unless it is a tombstone
+// past the retention.
+func (c *compactor) add(k, v []byte, deleted bool) error {
+	var flag KVFlag
+	if deleted {
+		if !keepTombstone(v, c.retention, c.now) {
+			return nil
+		}
+		flag = KVDeleted
+	}
+	c.pairs = append(c.pairs, KVPair{
+		Key:   append([]byte(nil), k...),
+		Value: append([]byte(nil), v...),
+	})
+	c.flags = append(c.flags, flag)
+	if len(c.pairs) < compactBatchSize {
+		return nil
+	}
+	return c.flush()
+}
+
+// flush copies the records queued by add.
+func (c *compactor) flush() error {
+	if len(c.pairs) == 0 {
+		return nil
+	}
+	db := c.dst
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	defer db.commitStats()
+	err := db.putBatch(c.pairs, c.flags)
+	c.pairs, c.flags = c.pairs[:0], c.flags[:0]
+	return errors.Wrap(err, "compact: write destination")
+}
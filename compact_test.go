@@ -0,0 +1,212 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	assert := assertion.New(t)
+	dst := testDB + ".compacted"
+	os.Remove(testDB)
+	os.Remove(dst)
+	defer os.Remove(testDB)
+	defer os.Remove(dst)
+
+	big := bytes.Repeat([]byte("big value "), 200)
+	// compact copies db to dst with opts and checks dst holds the live
+	// records of db, in key order
+	compact := func(db *DB, opts *Options) *DB {
+		os.Remove(dst)
+		assert.NoError(db.Compact(dst, opts))
+		assert.Contains(fmt.Sprint(db.Compact(dst, opts)), "exists")
+		c, err := Open(dst, 0755, opts)
+		assert.NoError(err)
+		assert.Empty(checkErrors(c))
+		assert.Equal(int(c.head.PageCount)*c.pageSize, c.filesz)
+		assert.True(c.indexed())
+		var keys []string
+		assert.NoError(c.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			want, err := db.Get(k)
+			assert.NoError(err)
+			assert.Equal(want, v, "%s", k)
+			return nil
+		}))
+		assert.Len(keys, 300)
+		assert.True(sort.StringsAreSorted(keys))
+		v, err := c.Get([]byte("key-0005"))
+		assert.NoError(err)
+		assert.Nil(v)
+		return c
+	}
+
+	// written out of key order, with shadowed records and tombstones
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	for i := 0; i < 300; i++ {
+		k := (i * 7) % 300
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", k)), []byte(fmt.Sprintf("old-%d", k))))
+	}
+	var pairs []KVPair
+	for i := 299; i >= 0; i-- {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte(fmt.Sprintf("value-%d", i))})
+	}
+	assert.NoError(db.PutBatch(pairs))
+	assert.NoError(db.Put([]byte("big"), big))
+	assert.NoError(db.Delete([]byte("key-0005")))
+
+	c := compact(db, nil)
+	assert.Equal(db.pageSize, c.pageSize)
+	info, err := os.Stat(testDB)
+	assert.NoError(err)
+	cinfo, err := os.Stat(dst)
+	assert.NoError(err)
+	assert.True(cinfo.Size() < info.Size(), "%d >= %d", cinfo.Size(), info.Size())
+	assert.NoError(c.Close())
+
+	c = compact(db, &Options{PageSize: 1024, Compression: CompLz4})
+	assert.Equal(CompLz4, c.compression)
+	assert.Equal(1024, c.pageSize)
+	assert.NoError(c.Close())
+
+	assert.NoError(db.Close())
+
+	// written in key order, the records are copied as they are read
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{PageSize: 512, OrderedWrite: true})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("big"), big))
+	for i := 0; i < 300; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Delete([]byte("key-0005")))
+	assert.NoError(compact(db, nil).Close())
+	assert.NoError(db.Close())
+
+	// values are read where the cursor found them, in compressed pages too
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{PageSize: 512, Compression: CompSnappy, PageCompression: true})
+	assert.NoError(err)
+	for i := 299; i >= 0; i-- {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), bytes.Repeat([]byte(fmt.Sprintf("value-%d ", i)), i%20)))
+	}
+	assert.NoError(db.Put([]byte("big"), big))
+	assert.NoError(db.Delete([]byte("key-0005")))
+	assert.NoError(compact(db, nil).Close())
+	assert.NoError(db.Close())
+
+	assert.Equal(ErrDatabaseNotOpen, db.Compact(dst+"2", nil))
+}
+
+func TestCompactTombstoneRetention(t *testing.T) {
+	assert := assertion.New(t)
+	dst := testDB + ".compacted"
+	defer os.Remove(testDB)
+	defer os.Remove(dst)
+
+	// tombstones returns the commit times of the tombstones compacted into
+	// dst, by key
+	tombstones := func(db *DB, opts *Options) map[string]time.Time {
+		os.Remove(dst)
+		assert.NoError(db.Compact(dst, opts))
+		c, err := Open(dst, 0755, nil)
+		assert.NoError(err)
+		defer c.Close()
+		assert.Empty(checkErrors(c))
+		got := make(map[string]time.Time)
+		cur := c.Cursor()
+		cur.tombstones = true
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if cur.deleted {
+				got[string(k)], _ = tombstoneTime(v)
+			} else {
+				assert.True(strings.HasPrefix(string(v), "value-"), "%s", k)
+			}
+		}
+		assert.NoError(cur.Err())
+		assert.Equal(len(got), int(c.head.tombstones))
+		n, err := c.Count()
+		assert.NoError(err)
+		assert.Equal(uint64(181), n)
+		return got
+	}
+
+	// in key order, copied by the sorted path, and not
+	for _, reverse := range []bool{false, true} {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, &Options{PageSize: 512, TombstoneRetention: time.Hour})
+		assert.NoError(err)
+		now := time.Unix(1e9, 0)
+		db.now = func() time.Time { return now }
+		var pairs []KVPair
+		for i := 0; i < 200; i++ {
+			k := i
+			if reverse {
+				k = 199 - i
+			}
+			pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", k)), Value: []byte(fmt.Sprintf("value-%d", k))})
+		}
+		assert.NoError(db.PutBatch(pairs))
+		// out of the window, then in it, by Delete and by a Tx, and one
+		// put again
+		old := now
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Delete([]byte(fmt.Sprintf("key-%04d", i))))
+		}
+		now = now.Add(2 * time.Hour)
+		young := now
+		tx, err := db.Begin(true)
+		assert.NoError(err)
+		for i := 10; i < 20; i++ {
+			assert.NoError(tx.Delete([]byte(fmt.Sprintf("key-%04d", i))))
+		}
+		assert.NoError(tx.Commit())
+		assert.NoError(db.Put([]byte("key-0019"), []byte("value-19")))
+		now = now.Add(10 * time.Minute)
+
+		want := make(map[string]time.Time)
+		for i := 10; i < 19; i++ {
+			want[fmt.Sprintf("key-%04d", i)] = young
+		}
+		assert.Equal(want, tombstones(db, nil), "reverse %v", reverse)
+		// the override, dropping them all, or keeping them all
+		assert.Empty(tombstones(db, &Options{PageSize: 512, TombstoneRetention: -1}))
+		got := tombstones(db, &Options{PageSize: 512, TombstoneRetention: 3 * time.Hour})
+		assert.Len(got, 19)
+		assert.Equal(old, got["key-0000"])
+		assert.Equal(young, got["key-0018"])
+
+		// compacted again, they keep their time
+		c, err := Open(dst, 0755, &Options{TombstoneRetention: 3 * time.Hour})
+		assert.NoError(err)
+		c.now = func() time.Time { return now }
+		compacted := testDB + ".again"
+		os.Remove(compacted)
+		assert.NoError(c.Compact(compacted, nil))
+		assert.NoError(c.Close())
+		again, err := Open(compacted, 0755, nil)
+		assert.NoError(err)
+		v, err := again.Get([]byte("key-0000"))
+		assert.NoError(err)
+		assert.Nil(v)
+		cur := again.Cursor()
+		cur.tombstones = true
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if cur.deleted {
+				tt, _ := tombstoneTime(v)
+				assert.Equal(got[string(k)], tt, "%s", k)
+			}
+		}
+		assert.Equal(uint32(19), again.head.tombstones)
+		assert.NoError(again.Close())
+		os.Remove(compacted)
+		assert.NoError(db.Close())
+	}
+}
@@ -1,23 +1,79 @@
 package sidb
 
-import "math"
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+	"sync"
+)
 
 type Comparator func(a, b []byte) int
 
+// BytesComparator orders keys bytewise, a shorter key before the longer ones
+// it is a prefix of, as bytes.Compare.
 func BytesComparator(a, b []byte) int {
-	lenA, lenB := len(a), len(b)
-	n := int(math.Min(float64(lenA), float64(lenB)))
-	for i := 0; i < n; i++ {
-		if a[i] < b[i] {
-			return -1
-		} else if a[i] > b[i] {
-			return 1
-		}
+	return bytes.Compare(a, b)
+}
+
+// maxComparatorName is the room for the comparator name in the head page.
+const maxComparatorName = 24
+
+// defaultComparatorName names BytesComparator.
+const defaultComparatorName = "bytes"
+
+// ErrComparatorMismatch is returned by Open when the database was created
+// with a different comparator than the one in Options.Comparator.
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
+var comparators = struct {
+	sync.RWMutex
+	byName map[string]Comparator
+	names  map[uintptr]string
+}{
+	byName: map[string]Comparator{defaultComparatorName: BytesComparator},
+	names:  map[uintptr]string{funcPtr(BytesComparator): defaultComparatorName},
+}
+
+// RegisterComparator makes cmp available to Options.Comparator under name,
+// which is stored in the head page of databases created with it so that they
+// can't be reopened with another ordering by mistake.
+//
+// Comparators are told apart by their code, so cmp should be a top-level
+// function: closures of the same function literal can't be distinguished.
+// It panics if name is empty, longer than 24 bytes or already registered.
+func RegisterComparator(name string, cmp Comparator) {
+	if name == "" || len(name) > maxComparatorName {
+		panic("sidb: invalid comparator name " + strconv.Quote(name))
 	}
-	if lenA > lenB {
-		return 1
-	} else if lenA < lenB {
-		return -1
+	if cmp == nil {
+		panic("sidb: RegisterComparator cmp is nil")
 	}
-	return 0
+	comparators.Lock()
+	defer comparators.Unlock()
+	if _, dup := comparators.byName[name]; dup {
+		panic("sidb: RegisterComparator called twice for " + name)
+	}
+	comparators.byName[name] = cmp
+	comparators.names[funcPtr(cmp)] = name
+}
+
+// registeredComparator reports whether a comparator is registered under name.
+func registeredComparator(name string) bool {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	_, ok := comparators.byName[name]
+	return ok
+}
+
+// comparatorName returns the name cmp was registered under.
+func comparatorName(cmp Comparator) (string, bool) {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	name, ok := comparators.names[funcPtr(cmp)]
+	return name, ok
+}
+
+func funcPtr(cmp Comparator) uintptr {
+	return reflect.ValueOf(cmp).Pointer()
 }
@@ -0,0 +1,95 @@
+package sidb
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func uint64Comparator(a, b []byte) int {
+	x, y := binary.BigEndian.Uint64(a), binary.BigEndian.Uint64(b)
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	RegisterComparator("test-uint64be", uint64Comparator)
+}
+
+func TestComparatorPersisted(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	custom := &Options{Comparator: uint64Comparator}
+
+	db, err := Open(testDB, 0755, custom)
+	assert.NoError(err)
+	assert.Equal("test-uint64be", db.cmpName)
+	assert.NoError(db.Close())
+
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrComparatorMismatch))
+	assert.Contains(err.Error(), "test-uint64be")
+	_, err = Open(testDB, 0755, &Options{Comparator: BytesComparator, ReadOnly: true})
+	assert.True(errors.Is(err, ErrComparatorMismatch))
+
+	// recovery may force it
+	db, err = Open(testDB, 0755, &Options{ForceComparator: true})
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, custom)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+}
+
+func TestComparatorNotRegistered(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	_, err := Open(testDB, 0755, &Options{Comparator: func(a, b []byte) int { return 0 }})
+	assert.Error(err)
+	_, err = os.Stat(testDB)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRegisterComparator(t *testing.T) {
+	assert := assertion.New(t)
+	assert.Panics(func() { RegisterComparator("", BytesComparator) })
+	assert.Panics(func() { RegisterComparator("a-name-longer-than-24-bytes", BytesComparator) })
+	assert.Panics(func() { RegisterComparator(defaultComparatorName, BytesComparator) })
+	assert.Panics(func() { RegisterComparator("nil", nil) })
+}
+
+func TestComparatorMissing(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	cmp := func(a, b []byte) int { return -BytesComparator(a, b) }
+	RegisterComparator("test-missing", cmp)
+	db, err := Open(testDB, 0755, &Options{Comparator: cmp})
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	// opened by a program that doesn't register it
+	comparators.Lock()
+	delete(comparators.byName, "test-missing")
+	delete(comparators.names, funcPtr(cmp))
+	comparators.Unlock()
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrComparatorMismatch))
+	assert.Contains(err.Error(), `"test-missing", which isn't registered`)
+}
+
+func BenchmarkBytesComparator(b *testing.B) {
+	x, y := []byte("key-0000000001"), []byte("key-0000000002")
+	for i := 0; i < b.N; i++ {
+		BytesComparator(x, y)
+	}
+}
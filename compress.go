@@ -2,18 +2,31 @@ package sidb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/golang/snappy"
 	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+	"strconv"
+	"sync"
 )
 
 type CompressAlgorithm uint16
 
 const (
 	CompSnappy CompressAlgorithm = iota // default
+	// records are stored as they are, none is flagged compressed
 	CompNone
 	CompLz4
+
+	// CompUser is the first of the ids left to user codecs, see
+	// RegisterCompressor.
+	CompUser CompressAlgorithm = 128
 )
 
+// DefaultCompressMinSize is the default Options.CompressMinSize: shorter keys
+// and values rarely compress to less.
+const DefaultCompressMinSize = 64
+
 type Compressor func([]byte) []byte
 type DeCompressor func([]byte) ([]byte, error)
 
@@ -22,29 +35,392 @@ var (
 		return snappy.Encode(nil, in)
 	}
 	SnappyDeCompress DeCompressor = func(in []byte) ([]byte, error) {
+		// snappy compresses 64 to 3 at most, a corrupt length isn't
+		// allocated
+		if n, err := snappy.DecodedLen(in); err == nil && uint64(n) > uint64(len(in))*64 {
+			return nil, errors.New("snappy: bad decoded length")
+		}
 		return snappy.Decode(nil, in)
-
 	}
 )
 
+// An lz4 record is a block, its uncompressed length first as a uvarint.
+// Records of older versions are frames, told apart by the frame magic: a
+// block record starting with the same byte, 4, holds 4 bytes, which never
+// compress to less.
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4d, 0x18}
+
 var (
-	Lz4Compress Compressor = func(in []byte) []byte {
-		buf := &bytes.Buffer{}
-		writer := lz4.NewWriter(buf)
-		defer writer.Close()
-		writer.NoChecksum = true
-		_, err := writer.Write(in)
+	// Lz4Compress is lz4 at its fastest, Options.CompressionLevel 0.
+	Lz4Compress Compressor = Lz4CompressLevel(0)
+
+	Lz4DeCompress DeCompressor = func(in []byte) ([]byte, error) {
+		if bytes.HasPrefix(in, lz4FrameMagic) {
+			buf := &bytes.Buffer{}
+			_, err := buf.ReadFrom(lz4.NewReader(bytes.NewReader(in)))
+			return buf.Bytes(), err
+		}
+		n, m := binary.Uvarint(in)
+		// lz4 compresses 255 to 1 at most
+		if m <= 0 || n > uint64(len(in)-m)*255 {
+			return nil, errors.New("lz4: bad block length")
+		}
+		out := make([]byte, n)
+		k, err := lz4.UncompressBlock(in[m:], out)
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrap(err, "lz4")
+		}
+		if k != len(out) {
+			return nil, errors.Errorf("lz4: block of %d bytes holds %d", n, k)
 		}
-		_ = writer.Flush()
-		return buf.Bytes()
+		return out, nil
 	}
+)
 
-	Lz4DeCompress DeCompressor = func(in []byte) ([]byte, error) {
-		buf := &bytes.Buffer{}
-		reader := lz4.NewReader(bytes.NewReader(in))
-		_, err := buf.ReadFrom(reader)
-		return buf.Bytes(), err
+// decodedLen returns the decompressed length from the header of raw, compressed by the
+// compressor of the database, if its format records it: snappy and lz4
+// blocks do, lz4 frames and user codecs are left to decompress.
+func (db *DB) decodedLen(raw []byte) (int64, bool) {
+	switch db.compression {
+	case CompSnappy:
+		n, err := snappy.DecodedLen(raw)
+		return int64(n), err == nil
+	case CompLz4:
+		if bytes.HasPrefix(raw, lz4FrameMagic) {
+			return 0, false
+		}
+		n, m := binary.Uvarint(raw)
+		return int64(n), m > 0 && n <= 1<<62
 	}
-)
+	return 0, false
+}
+
+// maxCompressionLevel is the highest Options.CompressionLevel.
+const maxCompressionLevel = 9
+
+// Lz4CompressLevel returns the lz4 compressor of level, from 0, the fastest,
+// to 9, the most compressing. The levels above 0 are lz4 HC, as in the lz4
+// tool. What it fails to compress is returned as it is, and so stored.
+func Lz4CompressLevel(level int) Compressor {
+	a := lz4AppendLevel(level)
+	return func(in []byte) []byte {
+		return a(nil, in)
+	}
+}
+
+// appendCompressor compresses in like a Compressor, but appends the result
+// to dst and returns the extended slice, writing into the spare capacity of
+// dst when it is large enough instead of allocating, see DB.marshal. What
+// doesn't compress is appended as it is.
+type appendCompressor func(dst, in []byte) []byte
+
+// snappyAppend is SnappyCompress as an appendCompressor.
+func snappyAppend(dst, in []byte) []byte {
+	n := snappy.MaxEncodedLen(len(in))
+	dst = growBuf(dst, n)
+	out := snappy.Encode(dst[len(dst):len(dst)+n], in)
+	return dst[:len(dst)+len(out)]
+}
+
+// lz4AppendLevel returns the compressor of Lz4CompressLevel as an
+// appendCompressor.
+func lz4AppendLevel(level int) appendCompressor {
+	return func(dst, in []byte) []byte {
+		bound := binary.MaxVarintLen64 + lz4.CompressBlockBound(len(in))
+		dst = growBuf(dst, bound)
+		out := dst[len(dst) : len(dst)+bound]
+		m := binary.PutUvarint(out, uint64(len(in)))
+		var n int
+		var err error
+		if level > 0 {
+			n, err = lz4.CompressBlockHC(in, out[m:], 1<<(7+level))
+		} else {
+			n, err = lz4.CompressBlock(in, out[m:], nil)
+		}
+		if err != nil || n == 0 {
+			return append(dst, in...)
+		}
+		return dst[:len(dst)+m+n]
+	}
+}
+
+// appendCompressorOf returns the appendCompressor of algorithm a at level,
+// nil for CompNone and user codecs, which only have a Compressor.
+func appendCompressorOf(a CompressAlgorithm, level int) appendCompressor {
+	switch a {
+	case CompSnappy:
+		return snappyAppend
+	case CompLz4:
+		return lz4AppendLevel(level)
+	}
+	return nil
+}
+
+// growBuf returns b with room for n more bytes, b itself if it has them.
+func growBuf(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	buf := make([]byte, len(b), len(b)+n)
+	copy(buf, b)
+	return buf
+}
+
+type codec struct {
+	c Compressor
+	d DeCompressor
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[CompressAlgorithm]codec
+}{
+	m: map[CompressAlgorithm]codec{
+		CompSnappy: {SnappyCompress, SnappyDeCompress},
+		CompNone:   {},
+		CompLz4:    {Lz4Compress, Lz4DeCompress},
+	},
+}
+
+// RegisterCompressor makes the codec c, d available to Options.Compression
+// as id, which is recorded in the head of the databases it creates: opening
+// them takes the same registration. The ids below CompUser are sidb's own.
+// It panics if id is below CompUser or already registered, or c or d is nil.
+func RegisterCompressor(id CompressAlgorithm, c Compressor, d DeCompressor) {
+	if id < CompUser {
+		panic("sidb: RegisterCompressor id " + strconv.Itoa(int(id)) + " is reserved")
+	}
+	if c == nil || d == nil {
+		panic("sidb: RegisterCompressor codec is nil")
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	if _, dup := codecs.m[id]; dup {
+		panic("sidb: RegisterCompressor called twice for " + strconv.Itoa(int(id)))
+	}
+	codecs.m[id] = codec{c, d}
+}
+
+// compressors returns the compressor and decompressor registered as
+// algorithm a, both nil for CompNone.
+func compressors(a CompressAlgorithm) (Compressor, DeCompressor, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	cd, ok := codecs.m[a]
+	if !ok {
+		return nil, nil, errors.Wrapf(ErrUnknownCompression, "%d, see RegisterCompressor", a)
+	}
+	return cd.c, cd.d, nil
+}
+
+// levelCompressor returns the compressor of algorithm a at level, c being its
+// default one. Only lz4 has levels.
+func levelCompressor(a CompressAlgorithm, c Compressor, level int) (Compressor, error) {
+	if level == 0 {
+		return c, nil
+	}
+	if a != CompLz4 || level < 0 || level > maxCompressionLevel {
+		return nil, errors.Wrapf(ErrInvalidCompressionLevel, "%d", level)
+	}
+	return Lz4CompressLevel(level), nil
+}
+
+// Compression returns the algorithm and level recorded in the head of the
+// database when it was created.
+func (db *DB) Compression() (CompressAlgorithm, int) {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	db.headlock.Lock()
+	defer db.headlock.Unlock()
+	return db.head.Compression, int(db.head.CompressionLevel)
+}
+
+// setCompression sets the compressor and decompressor of the database to
+// those of algorithm a at level.
+func (db *DB) setCompression(a CompressAlgorithm, level int) error {
+	c, d, err := compressors(a)
+	if err != nil {
+		return err
+	}
+	if c, err = levelCompressor(a, c, level); err != nil {
+		return err
+	}
+	db.compression, db.compressionLevel = a, level
+	db.compressor, db.decompressor = c, d
+	db.compressAppend = appendCompressorOf(a, level)
+	db.timeCompression()
+	return nil
+}
+
+// marshal appends the encoding of kv after prevKey to dst, see
+// KVPair.MarshalAppend, uncompressed if raw is set. Keys and values are
+// compressed into a pooled buffer, for the built-in codecs.
+func (db *DB) marshal(dst []byte, kv KVPair, prevKey []byte, raw bool) []byte {
+	opts := MarshalOptions{Compressor: db.compressor, CompressMinSize: db.compressMinSize}
+	if raw {
+		opts.Compressor = nil
+	} else if n := len(kv.Key) + len(kv.Value); db.compressAppend != nil && n >= db.compressMinSize {
+		// room for both compressed, see snappy.MaxEncodedLen
+		scratch := db.getBuf(n + n/6 + 128)
+		defer db.putBuf(scratch)
+		opts.compressAppend, opts.scratch = db.compressAppend, scratch[:0]
+	}
+	return kv.MarshalAppend(dst, prevKey, opts)
+}
+
+// countStored counts the key and value of kv as stored in rec, its record
+// from marshal, in the commit in progress, see TxStats.KeyIn.
+func (db *DB) countStored(kv KVPair, rec []byte, raw bool) {
+	if raw {
+		return
+	}
+	flag := KVFlag(rec[0])
+	off, prefix := 1, 0
+	if flag&KVKeyPrefixed != 0 {
+		prefix = int(rec[1])
+		off++
+	}
+	keyLen, n := binary.Uvarint(rec[off:])
+	off += n + int(keyLen)
+	valueLen, _ := binary.Uvarint(rec[off:])
+	key := len(kv.Key) - prefix
+	s := &db.txStats
+	s.KeyIn += int64(key)
+	s.KeyOut += int64(keyLen)
+	s.ValueIn += int64(len(kv.Value))
+	s.ValueOut += int64(valueLen)
+	if db.compressor == nil {
+		return
+	}
+	// tried, see MarshalWith
+	if flag&KVKeyCompressed == 0 && key >= db.compressMinSize {
+		s.CompressFallback++
+	}
+	if flag&KVValueCompressed == 0 && len(kv.Value) >= db.compressMinSize {
+		s.CompressFallback++
+	}
+}
+
+// With page compression, the data pages a batch adds take records past their
+// size for as long as they compress into it. Compressing a page again on
+// every record would be slow: the ratio found at one point predicts how many
+// more fit, and the page is compressed again past those. A prediction may be
+// off, the records past the last point known to fit are then dropped when
+// the page is sealed, and go on the next one.
+
+// packFactor bounds the records of a page compressed together, as a multiple
+// of the page size.
+const packFactor = 4
+
+// packSize returns the most a data page takes in records with page
+// compression. Restart offsets are 16 bits, see restartInterval.
+func (db *DB) packSize() int {
+	n := packFactor * db.pageSize
+	if n > int(maxPageSize) {
+		n = int(maxPageSize)
+	}
+	return n
+}
+
+// fitsPacked reports whether rec can be appended to p, a data page added by a
+// batch with page compression, and notes how far p is known to fit, with the
+// records compressed up to there: compressors such as lz4 may not compress
+// the same input to the same size twice.
+func (db *DB) fitsPacked(p *batchPage, rec []byte) bool {
+	end := int(p.hdr.ptr) + len(rec)
+	footer := db.footerRoom(int(p.hdr.Count) + 1)
+	if end+footer <= db.pageSize {
+		// as it is
+		p.fitCount, p.fitPtr, p.packed = p.hdr.Count+1, PageSz(end), nil
+		return true
+	}
+	if db.compressor == nil || end+footer > len(p.buf) {
+		return false
+	}
+	if end <= p.check {
+		return true
+	}
+	copy(p.buf[p.hdr.ptr:], rec)
+	packed := db.compressor(p.buf[pageHeaderSize:end])
+	c := len(packed)
+	room := db.pageSize - pageHeaderSize - footer
+	if c > room {
+		return false
+	}
+	p.fitCount, p.fitPtr, p.packed = p.hdr.Count+1, PageSz(end), packed
+	// what the room left takes at the same ratio, less some slack
+	p.check = end + (room-c)*(end-pageHeaderSize)/c*7/8
+	return true
+}
+
+// packRewind compresses the records of p, a full data page added by a batch
+// with page compression, dropping those past the last point known to fit if
+// they don't. It returns how many.
+func (db *DB) packRewind(p *batchPage) int {
+	if int(p.hdr.ptr)+db.footerRoom(int(p.hdr.Count)) <= db.pageSize {
+		p.packed = nil
+		return 0
+	}
+	if p.hdr.ptr == p.fitPtr {
+		return 0
+	}
+	data := p.buf[pageHeaderSize:p.hdr.ptr]
+	if packed := db.compressor(data); pageHeaderSize+len(packed)+db.footerRoom(int(p.hdr.Count)) <= db.pageSize {
+		p.packed = packed
+		return 0
+	}
+	n := int(p.hdr.Count - p.fitCount)
+	db.txStats.CompressOut -= int64(p.hdr.ptr - p.fitPtr)
+	p.hdr.Count, p.hdr.ptr = p.fitCount, p.fitPtr
+	p.hdr.Len = p.hdr.ptr - pageHeaderSize
+	return n
+}
+
+// packPage seals p, a full data page added by a batch with page compression,
+// see packRewind, with its records compressed if that makes them shorter.
+func (db *DB) packPage(p *batchPage) error {
+	if p.packed == nil {
+		if int(p.hdr.ptr) > db.pageSize {
+			return errors.Errorf("page %d holds %d bytes of records", p.id, p.hdr.Len)
+		}
+		return db.sealBatchPage(p)
+	}
+	data := p.buf[pageHeaderSize:p.hdr.ptr]
+	end := pageHeaderSize + len(p.packed)
+	footer, flags, err := db.pageFooter(data, db.pageSize-end)
+	if err != nil {
+		return err
+	}
+	db.txStats.CompressOut -= int64(len(data) - len(p.packed))
+	copy(p.buf[pageHeaderSize:], p.packed)
+	// zeroed, the buffer comes from the pool
+	tail := p.buf[end:db.pageSize]
+	for i := range tail {
+		tail[i] = 0
+	}
+	copy(tail[len(tail)-len(footer):], footer)
+	p.hdr.ptr = PageSz(end)
+	p.hdr.Flag |= flags | PageCompressed
+	p.packed = nil
+	return nil
+}
+
+// decompressPage returns the records of data page id, whose header is p, a
+// PageCompressed page. The caller holds mmaplock.
+func (db *DB) decompressPage(id PageId, p *Page) ([]byte, error) {
+	if err := db.verifyPage(id, p); err != nil {
+		return nil, err
+	}
+	if db.decompressor == nil || int(p.ptr) > db.pageSize {
+		return nil, corruptPage(id, pagePtrOffset, "compressed but can't be decompressed")
+	}
+	start := int(db.pageOffset(id))
+	data, err := db.decompressor(db.dataSlice(start+pageHeaderSize, start+int(p.ptr)))
+	if err != nil {
+		return nil, corruptPage(id, pageHeaderSize, "decompress: %s", err)
+	}
+	if len(data) != int(p.Len) {
+		return nil, corruptPage(id, pageLenOffset, "decompresses to %d bytes instead of %d", len(data), p.Len)
+	}
+	return data, nil
+}
@@ -0,0 +1,533 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompNone(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	assert.Equal(CompNone, db.head.Compression)
+	assert.Nil(db.compressor)
+	assert.Nil(db.decompressor)
+
+	// values that would compress well, one spanning overflow pages
+	values := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("key-%04d", i)
+		values[k] = bytes.Repeat([]byte("value"), i%50+1)
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	var batch []KVPair
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("batch-%04d", i)
+		values[k] = bytes.Repeat([]byte("value"), i%50+1)
+		batch = append(batch, KVPair{Key: []byte(k), Value: values[k]})
+	}
+	assert.NoError(db.PutBatch(batch))
+	values["large"] = bytes.Repeat([]byte("large"), 4096)
+	assert.NoError(db.Put([]byte("large"), values["large"]))
+
+	check := func() {
+		records := 0
+		assert.NoError(db.scanPages(nil, func(kv *KVPair, flag KVFlag) bool {
+			records++
+			assert.Zero(flag&(KVKeyCompressed|KVValueCompressed), "%s", kv.Key)
+			return true
+		}))
+		assert.Equal(len(values), records)
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+	}
+	check()
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	check()
+	assert.NoError(db.Close())
+}
+
+func TestKVSerdeNone(t *testing.T) {
+	assert := assertion.New(t)
+	kv := KVPair{[]byte("keykeykeykey"), []byte("valuevaluevaluevaluevaluevalue")}
+	ser := kv.Marshal([]byte("key"), nil)
+	assert.Zero(KVFlag(ser[0]) & (KVKeyCompressed | KVValueCompressed))
+	kv2 := KVPair{}
+	assert.NoError(kv2.Unmarshal(ser, []byte("key"), nil))
+	assert.Equal(kv, kv2)
+
+	// a compressed record can't be read without a decompressor
+	ser = kv.Marshal(nil, SnappyCompress)
+	assert.Error(kv2.Unmarshal(ser, nil, nil))
+}
+
+func TestUnknownCompression(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	_, err := Open(testDB, 0755, &Options{Compression: 99})
+	assert.Equal(ErrUnknownCompression, errors.Cause(err))
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	head := *db.head
+	head.Compression = 99
+	assert.NoError(db.flushHead(&head))
+	assert.NoError(db.Close())
+
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(ErrUnknownCompression, errors.Cause(err))
+	assert.Contains(err.Error(), "99")
+}
+
+func TestCompressionMismatch(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	var compressed int
+	RegisterCompressor(CompUser+3, func(in []byte) []byte {
+		compressed++
+		return SnappyCompress(in)
+	}, SnappyDeCompress)
+	value := bytes.Repeat([]byte("compressible"), 10)
+
+	// a new file takes the options
+	db, err := Open(testDB, 0755, &Options{Compression: CompUser + 3, StrictOptions: true})
+	assert.NoError(err)
+	a, level := db.Compression()
+	assert.Equal(CompUser+3, a)
+	assert.Zero(level)
+	assert.NoError(db.Put([]byte("key-1"), value))
+	assert.Equal(1, compressed)
+	assert.NoError(db.Close())
+
+	// the head wins over them
+	db, err = Open(testDB, 0755, &Options{Compression: CompLz4, CompressionLevel: 5})
+	assert.NoError(err)
+	a, level = db.Compression()
+	assert.Equal(CompUser+3, a)
+	assert.Zero(level)
+	assert.NoError(db.Put([]byte("key-2"), value))
+	assert.Equal(2, compressed)
+	assert.NoError(db.Close())
+
+	// or they fail
+	for _, options := range []*Options{
+		{Compression: CompLz4, StrictOptions: true},
+		{Compression: CompUser + 3, PageCompression: true, StrictOptions: true},
+	} {
+		_, err = Open(testDB, 0755, options)
+		assert.Equal(ErrCompressionMismatch, errors.Cause(err))
+	}
+	db, err = Open(testDB, 0755, &Options{Compression: CompUser + 3, StrictOptions: true})
+	assert.NoError(err)
+	for _, key := range []string{"key-1", "key-2"} {
+		v, err := db.Get([]byte(key))
+		assert.NoError(err)
+		assert.Equal(value, v)
+	}
+	assert.NoError(db.Close())
+
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{Compression: CompLz4, CompressionLevel: 3, StrictOptions: true})
+	assert.NoError(err)
+	a, level = db.Compression()
+	assert.Equal(CompLz4, a)
+	assert.Equal(3, level)
+	assert.NoError(db.Close())
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	assert := assertion.New(t)
+	assert.Panics(func() { RegisterCompressor(CompLz4, SnappyCompress, SnappyDeCompress) })
+	assert.Panics(func() { RegisterCompressor(CompUser-1, SnappyCompress, SnappyDeCompress) })
+	assert.Panics(func() { RegisterCompressor(CompUser+2, nil, SnappyDeCompress) })
+	assert.Panics(func() { RegisterCompressor(CompUser+2, SnappyCompress, nil) })
+
+	var compressed, decompressed int
+	RegisterCompressor(CompUser+1, func(in []byte) []byte {
+		compressed++
+		return SnappyCompress(in)
+	}, func(in []byte) ([]byte, error) {
+		decompressed++
+		return SnappyDeCompress(in)
+	})
+	assert.Panics(func() { RegisterCompressor(CompUser+1, SnappyCompress, SnappyDeCompress) })
+
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompUser + 1})
+	assert.NoError(err)
+	assert.Equal(CompUser+1, db.head.Compression)
+	value := bytes.Repeat([]byte("value"), 100)
+	assert.NoError(db.Put([]byte("key"), value))
+	assert.NotZero(compressed)
+	v, err := db.Get([]byte("key"))
+	assert.NoError(err)
+	assert.Equal(value, v)
+	assert.NotZero(decompressed)
+	assert.NoError(db.Close())
+
+	// A process without the codec can't open the file.
+	codecs.Lock()
+	cd := codecs.m[CompUser+1]
+	delete(codecs.m, CompUser+1)
+	codecs.Unlock()
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(ErrUnknownCompression, errors.Cause(err))
+	assert.Contains(err.Error(), "129")
+	codecs.Lock()
+	codecs.m[CompUser+1] = cd
+	codecs.Unlock()
+
+	db, err = Open(testDB, 0755, &Options{Compression: CompUser + 1})
+	assert.NoError(err)
+	v, err = db.Get([]byte("key"))
+	assert.NoError(err)
+	assert.Equal(value, v)
+	assert.NoError(db.Close())
+}
+
+// lz4CompressFrame is Lz4Compress as it was, writing a frame per record.
+func lz4CompressFrame(in []byte) []byte {
+	buf := &bytes.Buffer{}
+	writer := lz4.NewWriter(buf)
+	writer.NoChecksum = true
+	if _, err := writer.Write(in); err != nil {
+		panic(err)
+	}
+	_ = writer.Close()
+	return buf.Bytes()
+}
+
+func TestLz4(t *testing.T) {
+	assert := assertion.New(t)
+	inputs := [][]byte{
+		nil,
+		[]byte("abcd"),
+		bytes.Repeat([]byte("value"), 20),
+		bytes.Repeat([]byte("value"), 20000),
+	}
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs = append(inputs, random)
+	for level := 0; level <= maxCompressionLevel; level++ {
+		for _, in := range inputs {
+			out := Lz4CompressLevel(level)(in)
+			if len(out) >= len(in) {
+				// stored as it is
+				continue
+			}
+			got, err := Lz4DeCompress(out)
+			assert.NoError(err)
+			assert.Equal(len(in), len(got))
+			assert.True(bytes.Equal(in, got), "level %d", level)
+		}
+	}
+	// the more compressing levels do compress more
+	in := append(bytes.Repeat([]byte("value-0123456789"), 50), random...)
+	assert.True(len(Lz4CompressLevel(9)(in)) <= len(Lz4Compress(in)))
+	// as returned by the frame compressor of older versions
+	in = bytes.Repeat([]byte("value"), 20)
+	got, err := Lz4DeCompress(lz4CompressFrame(in))
+	assert.NoError(err)
+	assert.Equal(in, got)
+
+	out := Lz4Compress(in)
+	out[0]++
+	_, err = Lz4DeCompress(out)
+	assert.Error(err)
+	out[0] = 0xff
+	_, err = Lz4DeCompress(out)
+	assert.Error(err)
+	_, err = Lz4DeCompress(nil)
+	assert.Error(err)
+}
+
+func TestCompressionLevel(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	_, err := Open(testDB, 0755, &Options{Compression: CompLz4, CompressionLevel: maxCompressionLevel + 1})
+	assert.Equal(ErrInvalidCompressionLevel, errors.Cause(err))
+	_, err = Open(testDB, 0755, &Options{CompressionLevel: 1})
+	assert.Equal(ErrInvalidCompressionLevel, errors.Cause(err))
+
+	db, err := Open(testDB, 0755, &Options{Compression: CompLz4, CompressionLevel: 5})
+	assert.NoError(err)
+	assert.Equal(int32(5), db.head.CompressionLevel)
+	value := bytes.Repeat([]byte("value"), 100)
+	assert.NoError(db.Put([]byte("key"), value))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{Compression: CompLz4})
+	assert.NoError(err)
+	algorithm, level := db.Compression()
+	assert.Equal(CompLz4, algorithm)
+	assert.Equal(5, level)
+	v, err := db.Get([]byte("key"))
+	assert.NoError(err)
+	assert.Equal(value, v)
+	assert.NoError(db.Close())
+}
+
+// BenchmarkLz4 compresses 100-byte values a record at a time, as frames the
+// way older versions did and as blocks.
+func BenchmarkLz4(b *testing.B) {
+	value := []byte(strings.Repeat("0123456789", 4) + "some value, some value, some value, some value, some value!!")
+	for _, bc := range []struct {
+		name string
+		c    Compressor
+	}{
+		{"frame", lz4CompressFrame},
+		{"block", Lz4Compress},
+		{"block-hc9", Lz4CompressLevel(9)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(value)))
+			var n int
+			for i := 0; i < b.N; i++ {
+				n = len(bc.c(value))
+			}
+			b.ReportMetric(float64(n), "out-bytes")
+		})
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	assert := assertion.New(t)
+	for _, min := range []int{0, -1, 1 << 20} {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, &Options{CompressMinSize: min})
+		assert.NoError(err)
+		short := bytes.Repeat([]byte("v"), DefaultCompressMinSize-1)
+		long := bytes.Repeat([]byte("v"), 1000)
+		assert.NoError(db.Put([]byte("short"), short))
+		assert.NoError(db.Put([]byte("long"), long))
+		flags := make(map[string]KVFlag)
+		assert.NoError(db.scanPages(nil, func(kv *KVPair, flag KVFlag) bool {
+			flags[string(kv.Key)] = flag & KVValueCompressed
+			return true
+		}))
+		switch min {
+		case 0:
+			assert.Zero(flags["short"])
+			assert.NotZero(flags["long"])
+		case -1:
+			assert.NotZero(flags["short"])
+			assert.NotZero(flags["long"])
+		default:
+			assert.Zero(flags["short"])
+			assert.Zero(flags["long"])
+		}
+		for k, want := range map[string][]byte{"short": short, "long": long} {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v)
+		}
+		assert.NoError(db.Close())
+	}
+	os.Remove(testDB)
+}
+
+func TestPageCompression(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// Short values with a common structure, which compress poorly apart.
+	values := make(map[string][]byte)
+	var batch []KVPair
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("user-%06d", i)
+		values[k] = []byte(fmt.Sprintf(`{"id":%d,"name":"user %d"}`, i, i))
+		batch = append(batch, KVPair{Key: []byte(k), Value: values[k]})
+	}
+	build := func(opts *Options) *DB {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, opts)
+		assert.NoError(err)
+		assert.NoError(db.PutBatch(batch))
+		return db
+	}
+	db := build(nil)
+	plain := db.head.PageCount
+	assert.NoError(db.Close())
+
+	db = build(&Options{PageCompression: true, BloomBitsPerKey: 10})
+	assert.True(db.head.PageCount < plain*2/3, "%d pages, %d without page compression", db.head.PageCount, plain)
+	assert.Contains(db.Features().String(), "page-compression")
+	// Put fills the tail in place, a transaction adds pages.
+	for i := 3000; i < 3100; i++ {
+		k := fmt.Sprintf("user-%06d", i)
+		values[k] = bytes.Repeat([]byte("v"), 100)
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	assert.NoError(db.Update(func(tx *Tx) error {
+		for i := 3100; i < 4000; i++ {
+			k := fmt.Sprintf("user-%06d", i)
+			values[k] = []byte(fmt.Sprintf(`{"id":%d,"name":"user %d"}`, i, i))
+			if err := tx.Put([]byte(k), values[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	assert.NoError(db.Delete([]byte("user-000001")))
+	delete(values, "user-000001")
+	snap, err := db.Begin(false)
+	assert.NoError(err)
+	// puts user-000001 back
+	assert.NoError(db.PutBatch(batch[:100]))
+	values["user-000001"] = batch[1].Value
+
+	check := func(db *DB) {
+		compressed := 0
+		for id := db.dataStart; id != 0; id = db.page(id).Next {
+			p := db.page(id)
+			if p.Flag&PageCompressed != 0 {
+				compressed++
+				assert.NotZero(p.Flag & PageBloom)
+				assert.True(int(p.ptr)-pageHeaderSize < int(p.Len))
+			}
+		}
+		assert.True(compressed > 10, "%d compressed pages", compressed)
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+			v, err = db.GetTo([]byte(k), nil)
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+		r, n, err := db.GetReader([]byte("user-000002"))
+		assert.NoError(err)
+		assert.Equal(int64(len(values["user-000002"])), n)
+		v, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(values["user-000002"], v)
+
+		c := db.Cursor()
+		n = 0
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			assert.Equal(values[string(k)], v, "%s", k)
+			n++
+		}
+		assert.NoError(c.Err())
+		assert.Equal(int64(len(values)), n)
+		n = 0
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			assert.Equal(values[string(k)], v, "%s", k)
+			n++
+		}
+		assert.Equal(int64(len(values)), n)
+		k, v := c.Seek([]byte("user-002500"))
+		assert.Equal("user-002500", string(k))
+		assert.Equal(values["user-002500"], v)
+	}
+	check(db)
+	// the snapshot doesn't see the last batch
+	v, err := snap.Get([]byte("user-000001"))
+	assert.NoError(err)
+	assert.Nil(v)
+	assert.NoError(snap.Rollback())
+	assert.NoError(db.Close())
+
+	// The mode is the file's.
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true, PageCacheSize: 1 << 20})
+	assert.NoError(err)
+	assert.True(db.pageCompression)
+	check(db)
+	check(db)
+
+	// A damaged page is reported, not decoded.
+	var id PageId
+	for id = db.dataStart; db.page(id).Flag&PageCompressed == 0; id = db.page(id).Next {
+	}
+	key := []byte(nil)
+	assert.NoError(db.scanPage(id, db.page(id), func(kv *KVPair, flag KVFlag) bool {
+		key = append([]byte{}, kv.Key...)
+		return false
+	}))
+	assert.NoError(db.Close())
+	f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(id)*int64(db.pageSize)+pageHeaderSize+8)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	_, err = db.Get(key)
+	assert.Equal(&ErrChecksum{Page: id}, err)
+	assert.NoError(db.Close())
+}
+
+// TestPageCompressionMixed writes batches of values compressing more or less
+// well, so that how many records a page holds is often mispredicted.
+func TestPageCompressionMixed(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	for _, compression := range []CompressAlgorithm{CompSnappy, CompLz4} {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, &Options{PageSize: 512, PageCompression: true, Compression: compression})
+		assert.NoError(err)
+		rnd := rand.New(rand.NewSource(1))
+		values := make(map[string][]byte)
+		n := 0
+		for b := 0; b < 50; b++ {
+			var batch []KVPair
+			for j := rnd.Intn(100); j >= 0; j-- {
+				k := fmt.Sprintf("%06d-key", n)
+				n++
+				v := bytes.Repeat([]byte{byte(n)}, rnd.Intn(200))
+				if rnd.Intn(4) == 0 {
+					rnd.Read(v)
+				}
+				values[k] = v
+				batch = append(batch, KVPair{Key: []byte(k), Value: v})
+			}
+			assert.NoError(db.PutBatch(batch))
+			if b%10 == 0 {
+				k := fmt.Sprintf("%06d-key", n)
+				n++
+				values[k] = []byte("put")
+				assert.NoError(db.Put([]byte(k), values[k]))
+			}
+		}
+		check := func() {
+			for k, want := range values {
+				v, err := db.Get([]byte(k))
+				assert.NoError(err)
+				assert.Equal(len(want), len(v), k)
+				assert.True(bytes.Equal(want, v), k)
+			}
+			count, err := db.Count()
+			assert.NoError(err)
+			assert.Equal(uint64(len(values)), count)
+		}
+		check()
+		assert.NoError(db.Close())
+		db, err = Open(testDB, 0755, &Options{VerifyChecksums: true, Compression: compression})
+		assert.NoError(err)
+		check()
+		assert.NoError(db.Close())
+	}
+}
@@ -0,0 +1,72 @@
+package sidb
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// counterSize is the size of a counter value: an int64, big-endian.
+const counterSize = 8
+
+// Increment adds delta to the counter of key, 0 if the key doesn't exist, and
+// returns the new total, atomically like Merge. Counters are stored as 8-byte
+// big-endian integers, a value of another length is ErrNotACounter. A total
+// out of the int64 range is ErrCounterOverflow, and isn't written.
+func (db *DB) Increment(key []byte, delta int64) (int64, error) {
+	var total int64
+	err := db.Update(func(tx *Tx) (err error) {
+		total, err = tx.Increment(key, delta)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// IncrementBatch adds to the counter of each key its delta, like Increment,
+// in a single transaction and commit. If one of them fails, none is written.
+func (db *DB) IncrementBatch(deltas map[string]int64) error {
+	// in key order, as OrderedWrite wants them
+	keys := make([]string, 0, len(deltas))
+	for key := range deltas {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return db.comparator([]byte(keys[i]), []byte(keys[j])) < 0
+	})
+	return db.Update(func(tx *Tx) error {
+		for _, key := range keys {
+			if _, err := tx.Increment([]byte(key), deltas[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Increment adds delta to the counter of key, see DB.Increment, reading the
+// writes buffered in the transaction too.
+func (tx *Tx) Increment(key []byte, delta int64) (int64, error) {
+	var total int64
+	err := tx.Merge(key, func(old []byte, exists bool) ([]byte, error) {
+		var n int64
+		if exists {
+			if len(old) != counterSize {
+				return nil, ErrNotACounter
+			}
+			n = int64(binary.BigEndian.Uint64(old))
+		}
+		total = n + delta
+		if delta > 0 && total < n || delta < 0 && total > n {
+			return nil, ErrCounterOverflow
+		}
+		value := make([]byte, counterSize)
+		binary.BigEndian.PutUint64(value, uint64(total))
+		return value, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
@@ -0,0 +1,83 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIncrement(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+
+	n, err := db.Increment([]byte("c"), 5)
+	assert.NoError(err)
+	assert.Equal(int64(5), n)
+	n, err = db.Increment([]byte("c"), -7)
+	assert.NoError(err)
+	assert.Equal(int64(-2), n)
+	v, err := db.Get([]byte("c"))
+	assert.NoError(err)
+	assert.Equal([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, v)
+
+	// concurrent increments all count
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				_, err := db.Increment([]byte("hits"), int64(g%3))
+				assert.NoError(err)
+			}
+		}(g)
+	}
+	wg.Wait()
+	n, err = db.Increment([]byte("hits"), 0)
+	assert.NoError(err)
+	// 17 goroutines add 1 and 16 add 2, 20 times each
+	assert.Equal(int64((17*1+16*2)*20), n)
+
+	// overflow either way is an error and leaves the counter as it is
+	_, err = db.Increment([]byte("max"), math.MaxInt64)
+	assert.NoError(err)
+	_, err = db.Increment([]byte("max"), 1)
+	assert.Equal(ErrCounterOverflow, err)
+	_, err = db.Increment([]byte("min"), math.MinInt64)
+	assert.NoError(err)
+	_, err = db.Increment([]byte("min"), -1)
+	assert.Equal(ErrCounterOverflow, err)
+	n, err = db.Increment([]byte("max"), 0)
+	assert.NoError(err)
+	assert.Equal(int64(math.MaxInt64), n)
+
+	assert.NoError(db.Put([]byte("text"), []byte("not a counter")))
+	_, err = db.Increment([]byte("text"), 1)
+	assert.Equal(ErrNotACounter, err)
+
+	// in one commit, all or nothing
+	deltas := make(map[string]int64)
+	for i := 0; i < 100; i++ {
+		deltas[fmt.Sprintf("k-%d", i)] = int64(i)
+	}
+	deltas["c"] = 2
+	assert.NoError(db.IncrementBatch(deltas))
+	for i := 0; i < 100; i++ {
+		n, err := db.Increment([]byte(fmt.Sprintf("k-%d", i)), 0)
+		assert.NoError(err)
+		assert.Equal(int64(i), n)
+	}
+	n, _ = db.Increment([]byte("c"), 0)
+	assert.Equal(int64(0), n)
+	assert.Equal(ErrNotACounter, db.IncrementBatch(map[string]int64{"c": 1, "text": 1}))
+	n, _ = db.Increment([]byte("c"), 0)
+	assert.Equal(int64(0), n)
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,657 @@
+package sidb
+
+import "sort"
+
+// Cursor iterates over the live key/value pairs of a database in the order
+// they are stored in the data page chain, which is key order for databases
+// written in OrderedWrite mode.
+//
+// Shadowed records and tombstones are skipped. On databases written in
+// OrderedWrite mode with the page index, a record is live if it is the newest
+// of its key on its page and no later page that may hold the key does, found
+// from the key ranges of the index and looked up like Get, so that seeking
+// costs no more than the records walked. Otherwise, or once the index has
+// had the cursor look at more pages than the database has, as when keys
+// share their first 6 bytes across many pages, the cursor builds a map of the
+// newest record of every key, which costs a scan of the whole database and
+// memory growing with the number of distinct keys.
+//
+// In DupKeys mode, the cursor stops once at every key that has values left,
+// where its newest record is, or its last value in OrderedWrite mode, with
+// the first of them, and NextDup walks the others. Those are looked up like
+// GetAll, which costs a lookup of every key.
+//
+// Keys and values returned are only valid until the next call on the cursor.
+//
+// Reverse iteration decodes a page forward once, keeping every record in a
+// PageObj, and walks that backwards.
+type Cursor struct {
+	db  *DB
+	id  PageId // page of the next record, 0 at the end
+	off int    // offset of the next record in the page
+	// previous key on the page, to expand prefixed keys
+	prevKey []byte
+	// buffer the values returned are decoded into
+	value []byte
+	// values aren't decoded, see ForEachKey
+	keysOnly bool
+	// the newest record of a key is returned if it is a tombstone too, and
+	// deleted tells if the record last returned is, see Compact, appended
+	// if it is a fragment of Append, whose value is put together
+	tombstones, deleted, appended bool
+	// records visible to the cursor, all if nil, see Tx.Cursor
+	snap *snapshot
+	// page and offset of the record last returned, curID is 0 if none
+	curID  PageId
+	curOff int
+	// data pages in chain order
+	pages []PageId
+	// the page last decoded for reverse iteration
+	page *PageObj
+	// the records of the PageCompressed page the cursor is on, decompressed
+	unpacked   []byte
+	unpackedID PageId
+	// with the page index, the key range of each page of pages, PageNum 0
+	// if it has none, the bounds of the ranges from each position on, and
+	// the position of each page, see shadowed
+	ranges []Index
+	later  []Index
+	pos    map[PageId]int
+	trunc  [6]byte // key truncated as in the index, see shadowed
+	// the keys of the page walked and of the last later page looked at, and
+	// the number of later pages looked at
+	cur, other pageKeys
+	lookups    int
+	// without the index, file offset of the newest record of each key
+	newest map[string]int64
+	// in DupKeys mode, the values of the key last looked up, the file
+	// offsets of their records and the one the cursor is on
+	dupKey []byte
+	dups   [][]byte
+	dupPos []int64
+	dupAt  int
+	err    error
+}
+
+// pageKeys maps the keys of the records of page id to the offset of the last
+// record of each.
+type pageKeys struct {
+	id   PageId
+	last map[string]int
+}
+
+// Cursor creates a cursor positioned before the first record.
+func (db *DB) Cursor() *Cursor {
+	return &Cursor{db: db}
+}
+
+// Err returns the error that ended the iteration, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// First moves the cursor to the first live record and returns it. It returns
+// nil key and value on an empty database.
+func (c *Cursor) First() (key []byte, value []byte) {
+	c.db.mmaplock.RLock()
+	defer c.db.mmaplock.RUnlock()
+	if !c.init() {
+		return nil, nil
+	}
+	c.rewind(c.db.dataStart)
+	return c.next(nil)
+}
+
+// Next moves the cursor to the next live record and returns it. It returns
+// nil key and value at the end of the data.
+func (c *Cursor) Next() (key []byte, value []byte) {
+	c.db.mmaplock.RLock()
+	defer c.db.mmaplock.RUnlock()
+	if !c.init() {
+		return nil, nil
+	}
+	return c.next(nil)
+}
+
+// Seek moves the cursor to the first live record whose key is greater than
+// or equal to seek, and returns it. Any prefix of a key finds that key. When
+// the page index is loaded, pages entirely before seek are skipped.
+func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
+	c.db.mmaplock.RLock()
+	defer c.db.mmaplock.RUnlock()
+	if !c.init() {
+		return nil, nil
+	}
+	id := c.db.seekPage(seek)
+	if c.pageIndex(id) < 0 {
+		// indexed after the snapshot of the cursor was taken
+		id = c.pages[len(c.pages)-1]
+	}
+	c.rewind(id)
+	return c.next(seek)
+}
+
+// init checks the database is usable and gathers what tells live records,
+// see Cursor. The caller holds mmaplock.
+func (c *Cursor) init() bool {
+	if c.err != nil {
+		return false
+	}
+	if !c.db.opened {
+		c.err = ErrDatabaseNotOpen
+		return false
+	}
+	if c.pages != nil {
+		return true
+	}
+	for id := c.db.dataStart; id != 0; id = c.snap.next(id, c.db.page(id)) {
+		c.pages = append(c.pages, id)
+	}
+	if c.db.orderedWrite && c.db.indexed() {
+		// A broken index is reported by Get, the map does without it.
+		if indexes, _, err := c.db.index(-1); err == nil {
+			return c.initRanges(indexes)
+		}
+	}
+	return c.buildNewest()
+}
+
+// buildNewest maps every key to the file offset of its newest record, as
+// nextRecord gives it. The caller holds mmaplock.
+func (c *Cursor) buildNewest() bool {
+	db := c.db
+	newest := make(map[string]int64)
+	var key []byte
+	for id := db.dataStart; id != 0; {
+		p := db.page(id)
+		data, next, err := db.records(c.snap, id, p)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		start := db.pageOffset(id) + pageHeaderSize
+		key = key[:0]
+		for off := 0; off < len(data); {
+			// Only keys are needed, expanded in place in the previous
+			// key's array.
+			k, _, n, _, err := decodeKV(data[off:], key, key[:0], nil, db.decompressor, false)
+			if err != nil {
+				c.err = corruptRecord(err, id, off)
+				return false
+			}
+			newest[string(k)] = start + int64(off)
+			key = k
+			off += n
+		}
+		id = next
+	}
+	c.newest = newest
+	return true
+}
+
+// initRanges sets the key range of every page of the cursor from the page
+// index entries, the unindexed pages at the end decoded. The caller holds
+// mmaplock.
+func (c *Cursor) initRanges(indexes []*Index) bool {
+	db := c.db
+	c.pos = make(map[PageId]int, len(c.pages))
+	for i, id := range c.pages {
+		c.pos[id] = i
+	}
+	c.ranges = make([]Index, len(c.pages))
+	for _, idx := range indexes {
+		// entries of pages after the snapshot are left out
+		if i, ok := c.pos[PageId(idx.PageNum)]; ok {
+			c.ranges[i] = *idx
+		}
+	}
+	for i, id := range c.pages {
+		p := db.page(id)
+		if c.ranges[i].PageNum != 0 || p.Flag&(PageMiddle|PageLast) != 0 {
+			continue
+		}
+		data, _, err := db.records(c.snap, id, p)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		var entries [1]Index
+		e, err := db.pageIndexEntry(entries[:0], id, p, data)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if len(e) > 0 {
+			c.ranges[i] = e[0]
+		}
+	}
+	c.later = make([]Index, len(c.pages)+1)
+	for i := len(c.pages) - 1; i >= 0; i-- {
+		b, r := c.later[i+1], c.ranges[i]
+		if r.PageNum != 0 {
+			if b.PageNum == 0 || db.comparator(r.Start[:], b.Start[:]) < 0 {
+				b.Start = r.Start
+			}
+			if b.PageNum == 0 || db.comparator(r.End[:], b.End[:]) > 0 {
+				b.End = r.End
+			}
+			b.PageNum = r.PageNum
+		}
+		c.later[i] = b
+	}
+	return true
+}
+
+// rewind positions the cursor at the start of page id.
+func (c *Cursor) rewind(id PageId) {
+	c.id = id
+	c.off = pageHeaderSize
+	c.prevKey = c.prevKey[:0]
+}
+
+// next returns the next live record whose key isn't before from, if not nil.
+// Records before from are passed over without telling if they are live.
+func (c *Cursor) next(from []byte) ([]byte, []byte) {
+	for {
+		key, value, pos, flag, ok := c.nextRecord()
+		deleted := flag&KVDeleted != 0
+		if !ok {
+			c.curID = 0
+			return nil, nil
+		}
+		if from != nil && c.db.comparator(key, from) < 0 {
+			continue
+		}
+		if c.live(key, deleted, pos) {
+			c.curID, c.curOff = PageId(pos/int64(c.db.pageSize)), int(pos%int64(c.db.pageSize))
+			c.deleted, c.appended = deleted, flag&KVAppended != 0
+			if c.db.dupKeys {
+				value = c.dupValue()
+			} else if c.appended && !c.keysOnly {
+				if value = c.wholeValue(key); value == nil {
+					c.id, c.curID = 0, 0
+					return nil, nil
+				}
+			}
+			return key, value
+		}
+		if c.err != nil {
+			c.id, c.curID = 0, 0
+			return nil, nil
+		}
+	}
+}
+
+// live reports whether the record at pos is the newest record of key and not
+// a tombstone, unless c.tombstones is set. In DupKeys mode, see liveDups. On
+// error c.err is set.
+func (c *Cursor) live(key []byte, deleted bool, pos int64) bool {
+	if c.db.dupKeys {
+		return c.liveDups(key, deleted, pos)
+	}
+	if deleted && !c.tombstones {
+		return false
+	}
+	return c.newestOf(key, pos)
+}
+
+// newestOf reports whether the record at pos is the newest record of key. On
+// error c.err is set.
+func (c *Cursor) newestOf(key []byte, pos int64) bool {
+	// Looking at more pages than there are costs more than the map.
+	if c.newest == nil && c.lookups > len(c.pages) && !c.buildNewest() {
+		return false
+	}
+	if c.newest != nil {
+		return c.newest[string(key)] == pos
+	}
+	id := PageId(pos / int64(c.db.pageSize))
+	if err := c.keysOf(&c.cur, id); err != nil {
+		return false
+	}
+	if c.cur.last[string(key)] != int(pos%int64(c.db.pageSize)) {
+		return false
+	}
+	return !c.shadowed(id, key)
+}
+
+// shadowed reports whether a page after page id holds a record of key,
+// looking only at the pages whose key range takes key in.
+func (c *Cursor) shadowed(id PageId, key []byte) bool {
+	db := c.db
+	// in the cursor, not to be allocated on every call
+	trunc := c.trunc[:]
+	copy(trunc, key)
+	for i := len(key); i < len(trunc); i++ {
+		trunc[i] = 0
+	}
+	for j := c.pos[id] + 1; j < len(c.pages); j++ {
+		// none of the pages left may hold key
+		if b := &c.later[j]; b.PageNum == 0 || db.comparator(trunc, b.Start[:]) < 0 || db.comparator(trunc, b.End[:]) > 0 {
+			return false
+		}
+		r := &c.ranges[j]
+		if r.PageNum == 0 || db.comparator(trunc, r.Start[:]) < 0 || db.comparator(trunc, r.End[:]) > 0 {
+			continue
+		}
+		if ok, err := c.holds(c.pages[j], key); err != nil {
+			c.err = err
+			return true
+		} else if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// holds reports whether page id has a record of key, as Get looks it up.
+func (c *Cursor) holds(id PageId, key []byte) (bool, error) {
+	db := c.db
+	c.lookups++
+	p := db.page(id)
+	if ok, err := db.mayContain(id, p, key); err != nil || !ok {
+		return false, err
+	}
+	found := false
+	fn := func(*KVPair, KVFlag) { found = true }
+	obj, err := db.cachedPage(c.snap, id, p)
+	if err != nil {
+		return false, err
+	}
+	if obj != nil {
+		obj.search(key, p.Flag&PageSorted != 0, db.comparator, fn)
+		return found, nil
+	}
+	if p.Flag&PageSorted != 0 {
+		data, _, err := db.records(c.snap, id, p)
+		if err != nil {
+			return false, err
+		}
+		err = db.searchPage(id, data, key, fn)
+		return found, err
+	}
+	// The tail page is looked at for most keys, its keys are kept.
+	if err := c.keysOf(&c.other, id); err != nil {
+		return false, err
+	}
+	_, found = c.other.last[string(key)]
+	return found, nil
+}
+
+// keysOf fills k with the keys of page id, unless it has them already. On
+// error c.err is set too.
+func (c *Cursor) keysOf(k *pageKeys, id PageId) error {
+	if k.last != nil && k.id == id {
+		return nil
+	}
+	db := c.db
+	p := db.page(id)
+	data, _, err := db.records(c.snap, id, p)
+	if err != nil {
+		c.err = err
+		return err
+	}
+	if k.last == nil {
+		k.last = make(map[string]int)
+	}
+	for key := range k.last {
+		delete(k.last, key)
+	}
+	k.id = 0
+	var key []byte
+	for off := 0; off < len(data); {
+		// The key is expanded in place in the previous key's array.
+		next, _, n, _, err := decodeKV(data[off:], key, key[:0], nil, db.decompressor, false)
+		if err != nil {
+			c.err = corruptRecord(err, id, off)
+			return c.err
+		}
+		k.last[string(next)] = pageHeaderSize + off
+		key = next
+		off += n
+	}
+	k.id = id
+	return nil
+}
+
+// nextRecord decodes the record at the cursor and advances past it. It
+// returns its key, its value, its file offset, as if its page weren't
+// compressed, and its flags.
+// The value is nil in keysOnly mode, and for a tombstone unless c.tombstones
+// is set.
+func (c *Cursor) nextRecord() (key []byte, value []byte, pos int64, flag KVFlag, ok bool) {
+	db := c.db
+	for c.id != 0 {
+		p := db.page(c.id)
+		start := db.pageOffset(c.id)
+		var data []byte
+		// page after the overflow record decoded, see records
+		var after PageId
+		if p.overflow() {
+			rec, next, err := db.records(c.snap, c.id, p)
+			if err != nil {
+				c.err = err
+				c.id = 0
+				return nil, nil, 0, 0, false
+			}
+			if len(rec) == 0 || c.off > pageHeaderSize {
+				c.rewind(next)
+				continue
+			}
+			data, after = rec, next
+		} else {
+			end := c.snap.end(c.id, p)
+			if c.off >= end {
+				c.rewind(c.snap.next(c.id, p))
+				continue
+			}
+			if p.Flag&PageCompressed != 0 {
+				if c.unpackedID != c.id {
+					rec, _, err := db.records(c.snap, c.id, p)
+					if err != nil {
+						c.err = err
+						c.id = 0
+						return nil, nil, 0, 0, false
+					}
+					c.unpacked, c.unpackedID = rec, c.id
+				}
+				data = c.unpacked[c.off-pageHeaderSize : end-pageHeaderSize]
+			} else {
+				if c.off == pageHeaderSize {
+					if err := db.verifyPage(c.id, p); err != nil {
+						c.err = err
+						c.id = 0
+						return nil, nil, 0, 0, false
+					}
+				}
+				data = db.dataSlice(int(start)+c.off, int(start)+end)
+			}
+		}
+		// The key is expanded in place in prevKey's array.
+		key, value, n, flag, err := decodeKV(data, c.prevKey, c.prevKey[:0], c.value[:0], db.decompressor, !c.keysOnly)
+		if err != nil {
+			c.err = corruptRecord(err, c.id, c.off-pageHeaderSize)
+			c.id = 0
+			return nil, nil, 0, 0, false
+		}
+		pos = start + int64(c.off)
+		c.off += n
+		if p.overflow() {
+			c.rewind(after)
+		}
+		c.prevKey = key
+		if flag&KVDeleted != 0 && !c.tombstones || c.keysOnly {
+			return key, nil, pos, flag, true
+		}
+		c.value = value
+		if value == nil {
+			value = []byte{}
+		}
+		return key, value, pos, flag, true
+	}
+	return nil, nil, 0, 0, false
+}
+
+// KeyCopy appends the key of the record the cursor is on to dst and returns
+// the extended slice, which stays valid after the cursor moves. It returns dst
+// unchanged if the cursor isn't on a record.
+func (c *Cursor) KeyCopy(dst []byte) []byte {
+	if c.curID == 0 {
+		return dst
+	}
+	return append(dst, c.prevKey...)
+}
+
+// ValueCopy is like KeyCopy for the value. Values are decoded into the
+// cursor's buffer, reused from one record to the next, and copied from there,
+// so walking uncompressed values into buffers large enough doesn't allocate.
+// Compressed ones are decompressed by a DeCompressor, which does. Cursors of
+// ForEachKey have no values.
+func (c *Cursor) ValueCopy(dst []byte) []byte {
+	if c.curID == 0 || c.keysOnly {
+		return dst
+	}
+	return append(dst, c.value...)
+}
+
+// Last moves the cursor to the last live record and returns it. It returns
+// nil key and value on an empty database.
+func (c *Cursor) Last() (key []byte, value []byte) {
+	c.db.mmaplock.RLock()
+	defer c.db.mmaplock.RUnlock()
+	if !c.init() {
+		return nil, nil
+	}
+	id := c.pages[len(c.pages)-1]
+	return c.prev(id, c.snap.end(id, c.db.page(id)))
+}
+
+// Prev moves the cursor to the previous live record and returns it. It
+// returns nil key and value at the start of the data, leaving the cursor on
+// the first record. On a cursor not positioned on a record yet, or past the
+// end, it behaves like Last.
+func (c *Cursor) Prev() (key []byte, value []byte) {
+	c.db.mmaplock.RLock()
+	defer c.db.mmaplock.RUnlock()
+	if !c.init() {
+		return nil, nil
+	}
+	if c.curID == 0 {
+		id := c.pages[len(c.pages)-1]
+		return c.prev(id, c.snap.end(id, c.db.page(id)))
+	}
+	return c.prev(c.curID, c.curOff)
+}
+
+// prev returns the last live record before offset off of page id and
+// positions the cursor on it.
+func (c *Cursor) prev(id PageId, off int) ([]byte, []byte) {
+	db := c.db
+	obj, err := c.decodePage(id)
+	if err != nil {
+		return nil, nil
+	}
+	i := sort.Search(len(obj.offsetList), func(i int) bool { return int(obj.offsetList[i]) >= off })
+	for {
+		for i--; i < 0; i = len(obj.offsetList) - 1 {
+			n := c.pageIndex(id)
+			if n <= 0 {
+				return nil, nil
+			}
+			id = c.pages[n-1]
+			if obj, err = c.decodePage(id); err != nil {
+				return nil, nil
+			}
+		}
+
+		off, end := int(obj.offsetList[i]), obj.ptr
+		if i+1 < len(obj.offsetList) {
+			end = int(obj.offsetList[i+1])
+		}
+		key := obj.keys[i]
+		if c.live(key, obj.flags[i]&KVDeleted != 0, db.pageOffset(id)+int64(off)) {
+			c.curID, c.curOff = id, off
+			// Next continues after this record.
+			c.id, c.off = id, end
+			// copies, obj may be shared with the page cache
+			c.prevKey = append(c.prevKey[:0], key...)
+			c.appended = obj.flags[i]&KVAppended != 0
+			if c.db.dupKeys {
+				return c.prevKey, c.dupValue()
+			}
+			if c.appended && !c.keysOnly {
+				if v := c.wholeValue(c.prevKey); v != nil {
+					return c.prevKey, v
+				}
+				c.curID = 0
+				return nil, nil
+			}
+			c.value = append(c.value[:0], obj.values[i]...)
+			return c.prevKey, c.value
+		}
+		if c.err != nil {
+			return nil, nil
+		}
+	}
+}
+
+// decodePage decodes the records of data page id into c.page, unless they
+// are there already, or takes them from the page cache.
+func (c *Cursor) decodePage(id PageId) (*PageObj, error) {
+	if c.page != nil && c.page.Id == id {
+		return c.page, nil
+	}
+	db := c.db
+	p := db.page(id)
+	obj, err := db.cachedPage(c.snap, id, p)
+	if err == nil && obj == nil {
+		var data []byte
+		if data, _, err = db.records(c.snap, id, p); err == nil {
+			obj, err = db.decodePage(id, p, data)
+		}
+	}
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	c.page = obj
+	return obj, nil
+}
+
+// pageIndex returns the position of page id in the chain.
+func (c *Cursor) pageIndex(id PageId) int {
+	for i, p := range c.pages {
+		if p == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// seekPage returns the first data page that may hold keys greater than or
+// equal to key, according to the page index. Without an index it is the
+// first data page. The caller holds mmaplock.
+func (db *DB) seekPage(key []byte) PageId {
+	var trunc [6]byte
+	copy(trunc[:], key)
+	// index pages are loaded as the entries before are passed
+	indexes, _, err := db.index(0)
+	for i := 0; err == nil && i < len(indexes); i++ {
+		if db.comparator(indexes[i].End[:], trunc[:]) >= 0 {
+			return PageId(indexes[i].PageNum)
+		}
+		if i+1 == len(indexes) {
+			indexes, _, err = db.index(i + 1)
+		}
+	}
+	if err != nil {
+		// from the start without the index, Get reports it broken
+		return db.dataStart
+	}
+	// Past the indexed pages, only the last of them and the unindexed ones
+	// after it are left.
+	if n := len(indexes); n > 0 {
+		return PageId(indexes[n-1].PageNum)
+	}
+	return db.dataStart
+}
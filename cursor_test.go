@@ -0,0 +1,324 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestCursorEmpty(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	c := db.Cursor()
+	k, v := c.First()
+	assert.Nil(k)
+	assert.Nil(v)
+	k, _ = c.Next()
+	assert.Nil(k)
+	k, _ = c.Seek([]byte("a"))
+	assert.Nil(k)
+	assert.NoError(c.Err())
+	assert.NoError(db.Close())
+
+	c = db.Cursor()
+	k, _ = c.First()
+	assert.Nil(k)
+	assert.Equal(ErrDatabaseNotOpen, c.Err())
+}
+
+func TestCursor(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	const n = 3000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		assert.NoError(db.Put(key, []byte("old")))
+		if i%3 == 0 {
+			// shadows the previous record
+			assert.NoError(db.Put(key, []byte(fmt.Sprintf("value-%d", i))))
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		assert.NoError(db.Delete([]byte(fmt.Sprintf("key-%05d", i))))
+	}
+	assert.True(db.head.PageCount > 5)
+
+	live := func(i int) bool { return i%10 != 0 }
+	value := func(i int) string {
+		if i%3 == 0 {
+			return fmt.Sprintf("value-%d", i)
+		}
+		return "old"
+	}
+
+	c := db.Cursor()
+	var i int
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		for !live(i) {
+			i++
+		}
+		assert.Equal(fmt.Sprintf("key-%05d", i), string(k))
+		assert.Equal(value(i), string(v))
+		i++
+	}
+	assert.NoError(c.Err())
+	assert.Equal(n, i)
+	// stays at the end
+	k, v := c.Next()
+	assert.Nil(k)
+	assert.Nil(v)
+
+	k, v = c.Seek([]byte("key-01503"))
+	assert.Equal("key-01503", string(k))
+	assert.Equal(value(1503), string(v))
+	k, _ = c.Next()
+	assert.Equal("key-01504", string(k))
+	// deleted keys are skipped
+	k, _ = c.Seek([]byte("key-01500"))
+	assert.Equal("key-01501", string(k))
+	// prefix
+	k, _ = c.Seek([]byte("key-02"))
+	assert.Equal("key-02001", string(k))
+	k, _ = c.Seek([]byte("zzz"))
+	assert.Nil(k)
+	assert.NoError(db.Close())
+}
+
+func TestCursorReverse(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		assert.NoError(db.Put(key, []byte("old")))
+		if i%3 == 0 {
+			assert.NoError(db.Put(key, []byte(fmt.Sprintf("value-%d", i))))
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		assert.NoError(db.Delete([]byte(fmt.Sprintf("key-%05d", i))))
+	}
+	assert.True(db.head.PageCount > 3)
+
+	c := db.Cursor()
+	var keys []string
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, string(k))
+	}
+	i := len(keys) - 1
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		assert.Equal(keys[i], string(k))
+		i--
+	}
+	assert.NoError(c.Err())
+	assert.Equal(-1, i)
+	// stays on the first record
+	k, _ := c.Prev()
+	assert.Nil(k)
+	k, _ = c.Next()
+	assert.Equal(keys[1], string(k))
+
+	// back and forth across a page boundary
+	var kv KVPair
+	assert.NoError(kv.Unmarshal(db.pageData(db.dataStart+1, db.page(db.dataStart+1)), nil, db.decompressor))
+	k, _ = c.Seek(kv.Key)
+	after := string(k)
+	k, _ = c.Prev()
+	assert.True(string(k) < string(kv.Key))
+	before := string(k)
+	k, _ = c.Next()
+	assert.Equal(after, string(k))
+	k, _ = c.Prev()
+	assert.Equal(before, string(k))
+
+	// past the end
+	k, _ = c.Seek([]byte("zzz"))
+	assert.Nil(k)
+	k, _ = c.Prev()
+	assert.Equal(keys[len(keys)-1], string(k))
+	assert.NoError(db.Close())
+}
+
+func TestCursorReverseSingleRecordPages(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	rnd := rand.New(rand.NewSource(1))
+	value := make([]byte, db.pageSize*3/4)
+	for i := 0; i < 5; i++ {
+		rnd.Read(value)
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%d", i)), value))
+	}
+	assert.Equal(uint16(1), db.page(db.dataStart).Count)
+	assert.Equal(uint16(1), db.page(5).Count)
+
+	c := db.Cursor()
+	k, v := c.Last()
+	assert.Equal("key-4", string(k))
+	assert.Equal(value, v)
+	for i := 3; i >= 0; i-- {
+		k, _ = c.Prev()
+		assert.Equal(fmt.Sprintf("key-%d", i), string(k))
+	}
+	k, _ = c.Prev()
+	assert.Nil(k)
+	assert.NoError(c.Err())
+	assert.NoError(db.Close())
+}
+
+func TestCursorIndexed(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true, PageSize: 512, BloomBitsPerKey: 10})
+	assert.NoError(err)
+	db.NoSync = true
+	rnd := rand.New(rand.NewSource(1))
+	model := make(map[string]string)
+	var tx *Tx
+	var snap map[string]string
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		// repeats may span pages
+		for j := rnd.Intn(3); j >= 0; j-- {
+			value := fmt.Sprintf("value-%d-%d", i, j)
+			assert.NoError(db.Put([]byte(key), []byte(value)))
+			model[key] = value
+		}
+		// tombstones are put out of order
+		if i%7 == 0 {
+			del := fmt.Sprintf("key-%05d", rnd.Intn(i+1))
+			assert.NoError(db.Delete([]byte(del)))
+			delete(model, del)
+		}
+		if i == 2000 {
+			tx, err = db.Begin(false)
+			assert.NoError(err)
+			snap = make(map[string]string, len(model))
+			for k, v := range model {
+				snap[k] = v
+			}
+		}
+	}
+	assert.True(db.head.PageCount > 100)
+
+	check := func(c *Cursor, model map[string]string) {
+		var keys []string
+		for k := range model {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		i := 0
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if assert.True(i < len(keys)) {
+				assert.Equal(keys[i], string(k))
+				assert.Equal(model[keys[i]], string(v))
+			}
+			i++
+		}
+		assert.Equal(len(keys), i)
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			i--
+			assert.Equal(keys[i], string(k))
+			assert.Equal(model[keys[i]], string(v))
+		}
+		assert.Equal(0, i)
+		for n := 0; n < 100; n++ {
+			seek := fmt.Sprintf("key-%05d", rnd.Intn(3100))
+			i := sort.SearchStrings(keys, seek)
+			k, v := c.Seek([]byte(seek))
+			if i == len(keys) {
+				assert.Nil(k)
+				continue
+			}
+			assert.Equal(keys[i], string(k))
+			assert.Equal(model[keys[i]], string(v))
+		}
+		assert.NoError(c.Err())
+	}
+	check(db.Cursor(), model)
+	check(tx.Cursor(), snap)
+	assert.NoError(tx.Rollback())
+
+	assert.NoError(db.Close())
+
+	// Without tombstones out of order and with keys apart in their first 6
+	// bytes, the walk looks at no other pages than its own.
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true, PageSize: 512})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 3000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("%06d", i)), []byte("value")))
+	}
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(db.Delete([]byte(fmt.Sprintf("%06d", 2900+i))))
+	}
+	c := db.Cursor()
+	k, _ := c.Seek([]byte("001500"))
+	assert.Equal("001500", string(k))
+	for i := 1501; i < 2000; i++ {
+		k, _ = c.Next()
+		assert.Equal(fmt.Sprintf("%06d", i), string(k))
+	}
+	assert.NoError(c.Err())
+	assert.Nil(c.newest)
+	assert.Equal(0, c.lookups)
+	assert.NoError(db.Close())
+}
+
+func TestCursorCopy(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	c := db.Cursor()
+	assert.Nil(c.KeyCopy(nil))
+	assert.Nil(c.ValueCopy(nil))
+	c.First()
+	key := c.KeyCopy([]byte("prefix-"))
+	value := c.ValueCopy(nil)
+	c.Next()
+	assert.Equal("prefix-key-000", string(key))
+	assert.Equal("value-0", string(value))
+	assert.Equal("key-001", string(c.KeyCopy(nil)))
+	c.Prev()
+	assert.Equal("value-0", string(c.ValueCopy(nil)))
+
+	// walking into buffers large enough doesn't allocate
+	kbuf, vbuf := make([]byte, 0, 64), make([]byte, 0, 64)
+	c.First()
+	assert.Zero(testing.AllocsPerRun(50, func() {
+		c.Next()
+		kbuf = c.KeyCopy(kbuf[:0])
+		vbuf = c.ValueCopy(vbuf[:0])
+	}))
+	assert.True(bytes.HasPrefix(kbuf, []byte("key-0")))
+	assert.True(bytes.HasPrefix(vbuf, []byte("value-")))
+	assert.NoError(c.Err())
+	assert.NoError(db.Close())
+}
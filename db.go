@@ -1,28 +1,33 @@
 package sidb
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
 const (
 	// sidbMagic = "SIDB" in bigEndian
-	Magic        uint32 = 0x42444953
-	Version      uint16 = 1
-	IgnoreNoSync        = runtime.GOOS == "openbsd"
-	// maxMapSize represents the largest mmap size supported by Bolt.
-	maxMapSize = 0xFFFFFFFFFFFF // 256TB
+	Magic   uint32 = 0x42444953
+	Version uint16 = 1
+	// IgnoreNoSync makes commits synced despite DB.NoSync, on systems such as
+	// OpenBSD without a unified buffer cache, where the mapping only sees
+	// what was written once it is synced. It doesn't override a SyncPolicy
+	// other than SyncAlways, which leaves reads there behind until DB.Sync.
+	IgnoreNoSync = runtime.GOOS == "openbsd"
 	// The largest step that can be taken when remapping the mmap.
 	maxMmapStep = 1 << 30 // 1GB
 
-	// maxAllocSize is the size used when creating array pointers.
-	maxAllocSize = 0x7FFFFFFF
 	// alloc 8 * pagesize on every grow
 	AllocPages = 8
 )
@@ -36,8 +41,62 @@ type Options struct {
 	// grab a shared lock (UNIX).
 	ReadOnly bool
 
+	// FallbackReadOnly makes a read-write Open that can't get the exclusive
+	// lock return a read-only handle instead of ErrWriteByOther, see
+	// DB.WasDemoted. The handle takes a shared lock, or no lock at all if a
+	// writer holds the exclusive one, and then reads a live database.
+	FallbackReadOnly bool
+
+	// NoLock skips file locking entirely, for files on media where flock
+	// fails or is meaningless (e.g. read-only squashfs or overlay images).
+	// It is only valid together with ReadOnly. The caller is responsible for
+	// making sure no other process writes the file while it is open.
+	NoLock bool
+
+	// ExternalLockFile takes the lock on path + ".lock" (created with mode
+	// 0600) instead of on the data file itself, so that tools opening the
+	// data file or replacing it by rename don't interfere with locking.
+	// A writer removes the lock file on Close if it created it.
+	ExternalLockFile bool
+
+	// FlockTimeout is how long Open waits for another process to release
+	// its flock on the file, or on the ExternalLockFile. If 0, Open fails
+	// right away with ErrWriteByOther.
+	FlockTimeout time.Duration
+
+	// LockMode selects the locking protocol. LockDotfile replaces flock
+	// with an O_EXCL-created path + ".dotlock" for filesystems such as NFS;
+	// see LockDotfile for its (weaker) guarantees.
+	LockMode LockMode
+
+	// LockStaleTTL is how long a LockDotfile lock may go without a heartbeat
+	// before it is considered abandoned and broken.
+	// If <=0, it defaults to DefaultLockStaleTTL.
+	LockStaleTTL time.Duration
+
+	// OrderedWrite requires keys to be put in non-decreasing order, so that
+	// data pages hold sorted, non-overlapping key ranges, which reads then
+	// rely on. It is set when the database is created, see
+	// FeatureOrderedWrite, and ignored when opening an existing one: a file
+	// written in any order can't be read as sorted, and one written in order
+	// must stay so.
 	OrderedWrite bool
 
+	// DupKeys keeps every value put under a key, in the order they were put,
+	// instead of the newest shadowing the others: Get returns the newest,
+	// GetAll all of them, and cursors stop once at every key, Cursor.NextDup
+	// walking its other values. Delete deletes them all, DeleteDup the
+	// newest alone. It is set when the database is created, see
+	// FeatureDupKeys, and ignored when opening an existing one.
+	DupKeys bool
+
+	// MaxAppendChain is how many fragments Append writes to a value before
+	// it writes the value whole again, so that reading it doesn't go
+	// through more records. If 0, it defaults to DefaultMaxAppendChain. If
+	// <0, chains aren't limited and Append writes fragments without looking
+	// the key up.
+	MaxAppendChain int
+
 	// Sets the DB.MmapFlags flag before memory mapping the file.
 	MmapFlags int
 
@@ -51,9 +110,98 @@ type Options struct {
 	// it takes no effect.
 	InitialMmapSize int
 
+	// MmapGrowthPolicy decides how far the mmap is grown past the database size.
+	// The zero value doubles from 32KB until 1GB, then steps by 1GB.
+	MmapGrowthPolicy MmapGrowthPolicy
+
+	// SyncPolicy decides when commits are synced to disk, every commit by
+	// default, see SyncInterval and SyncNever. DB.NoSync still skips the
+	// syncs of SyncAlways.
+	SyncPolicy SyncPolicy
+
+	// Compression is the algorithm records are compressed with, CompSnappy by
+	// default. Codecs of ids from CompUser on are added by RegisterCompressor.
+	// Like CompressionLevel and PageCompression, it is recorded in the head
+	// when the database is created, and the recorded one is used from then
+	// on, see StrictOptions.
 	Compression CompressAlgorithm
 
-	//PageSize uint32
+	// CompressionLevel trades write speed for smaller records with CompLz4,
+	// from 0, the fastest, to 9. It is recorded in the head of the databases
+	// created with it.
+	CompressionLevel int
+
+	// CompressMinSize is the size from which keys and values are compressed,
+	// shorter ones are written as they are without trying.
+	// If 0, it defaults to DefaultCompressMinSize, if <0, all are tried.
+	CompressMinSize int
+
+	// PageCompression compresses the records of a data page together, with
+	// Compression, once the page is sealed, instead of every key and value
+	// on its own: neighbouring records share much that doesn't compress
+	// apart. Only pages written whole by a PutBatch or a transaction are,
+	// those filled by Put are compressed record by record, as they are
+	// committed in place. It is set when the database is created, see
+	// FeaturePageCompression, and ignored when opening an existing one.
+	PageCompression bool
+
+	// ChecksumAlgo is how page and head checksums are computed, ChecksumIEEE
+	// by default. It is recorded in the head when the database is created,
+	// and the recorded one is used from then on.
+	ChecksumAlgo ChecksumAlgorithm
+
+	// StrictOptions makes Open fail with ErrCompressionMismatch when the
+	// database was created with another Compression, CompressionLevel or
+	// PageCompression, instead of ignoring them with a warning.
+	StrictOptions bool
+
+	// Comparator orders keys, it defaults to BytesComparator. Its name, see
+	// RegisterComparator, is stored when the database is created, and Open
+	// fails with ErrComparatorMismatch if it differs from the stored one.
+	Comparator Comparator
+
+	// ForceComparator skips the comparator check, for recovery only.
+	ForceComparator bool
+
+	// BoundsCheck makes every access to the mmap validate its offset against
+	// the mapping size and the page count, panicking with a descriptive message
+	// instead of faulting on a bad offset. It is meant for debugging and is
+	// implied by DB.StrictMode.
+	BoundsCheck bool
+
+	// VerifyChecksums makes every read of a page check the checksum of its
+	// records first, failing with an ErrChecksum. Files created before page
+	// checksums were written aren't checked.
+	VerifyChecksums bool
+
+	// PageCacheSize is the size in bytes of a cache of decoded data pages,
+	// keys and values, kept by Get and cursors. The least recently used pages
+	// are evicted first. If <=0, pages aren't cached.
+	PageCacheSize int
+
+	// PageSize is the page size of a new database, a power of two from 512
+	// bytes to 64KB. Larger pages hold larger records without splitting them
+	// across pages. If 0, it is the OS page size. It is stored in the file,
+	// and ignored when opening an existing one.
+	PageSize uint32
+
+	// BloomBitsPerKey, if >0, gives every data page sealed from then on a
+	// bloom filter of its keys with that many bits per key, so that Get
+	// doesn't decode pages that don't hold the key looked up. 10 bits make
+	// about 1% of false positives. Filters are kept in the file, Reindex
+	// adds them to the pages that have room. Databases ordered by another
+	// comparator than BytesComparator aren't filtered.
+	BloomBitsPerKey int
+
+	// TombstoneRetention is how long tombstones are kept through Compact.
+	// Every tombstone records when it was committed. Compact drops shadowed
+	// records either way, and a tombstone younger than the window is copied,
+	// so that followers of the database, see Tail, still see the delete.
+	// Older ones are dropped, like every tombstone is if TombstoneRetention
+	// is <=0. A follower lagging more than the window behind a compaction
+	// may miss deletes. Compact takes a per-compaction override from the
+	// options it is given.
+	TombstoneRetention time.Duration
 }
 
 var DefaultOptions = &Options{
@@ -63,7 +211,17 @@ var DefaultOptions = &Options{
 type PageId uint32
 type PageSz uint32
 
-const maxPageSize PageSz = 0xFFFF
+// Page sizes allowed, see Options.PageSize. Offsets in a page, see
+// restartInterval, are 16 bits.
+const (
+	minPageSize PageSz = 512
+	maxPageSize PageSz = 1 << 16
+)
+
+// validPageSize reports whether size is a page size allowed.
+func validPageSize(size uint32) bool {
+	return size >= uint32(minPageSize) && size <= uint32(maxPageSize) && size&(size-1) == 0
+}
 
 // size: 8
 type RecordPtr struct {
@@ -79,7 +237,7 @@ type Index struct {
 	PageNum uint32
 }
 
-// size: 48, aligned: 48
+// size: 112, stored as laid out in layout.go
 type HeadPage struct {
 	magic uint32 // 4
 	// checksum of the rest data of this first page
@@ -103,17 +261,61 @@ type HeadPage struct {
 	nextIndexPage PageId // 4
 	// the start pos of data in page
 	ptr PageSz // 4
+
+	// name of the comparator the database was created with, NUL padded
+	comparator [maxComparatorName]byte // 24
+
+	// on-disk features in use, see Features
+	Features Features // 12
+
+	// count of tombstone records, fills what used to be padding before
+	// generation on 64-bit platforms
+	tombstones uint32 // 4
+
+	// bumped by every commit, written last so that a reader observing
+	// generation N sees all of N's data, see DB.Generation
+	generation uint64 // 8
+
+	// first page of the freelist, 0 if none, and the number of ids it
+	// lists, see loadFreelist
+	freelist  PageId // 4
+	freeCount uint32 // 4
+
+	// Options.CompressionLevel the database was created with, 0 in files
+	// older than it
+	CompressionLevel int32 // 4
+
+	// Options.ChecksumAlgo the database was created with, ChecksumIEEE in
+	// files older than it
+	ChecksumAlgo ChecksumAlgorithm // 2
+	_            [2]byte
 }
 
-func (h *HeadPage) validate(db *DB) error {
+// validate checks h, the head page in page id.
+func (h *HeadPage) validate(db *DB, id PageId) error {
 	if h.magic != Magic {
-		return errors.New("wrong magic")
+		return ErrBadMagic
+	}
+	// Compatibility is decided by the feature masks, not the version.
+	if h.Version == 0 {
+		return &ErrVersionMismatch{Got: h.Version, Want: Version}
+	}
+	if err := h.checkFeatures(db.readOnly); err != nil {
+		return err
+	}
+	if int(h.PageSize) != db.pageSize {
+		return corruptPage(id, pageSizeOffset, "page size %d, the file's is %d", h.PageSize, db.pageSize)
 	}
-	if h.Version != Version {
-		return errors.New("version mismatch")
+	if !h.ChecksumAlgo.valid() {
+		return errors.Wrapf(ErrUnknownChecksum, "%d", h.ChecksumAlgo)
 	}
-	if h.Checksum != 0 && h.Checksum != crc32.ChecksumIEEE(db.data[h.ptr:h.PageSize]) {
-		return errors.New("checksum mismatch")
+	// Torn writes of dual heads must not go unnoticed, their checksum is
+	// always set and covers their fields, see headPageChecksum. Files older
+	// than FeatureDualHead keep theirs, 0 if it was never set.
+	dual := h.Features.Required&FeatureDualHead != 0
+	pos := int(db.pageOffset(id))
+	if (h.Checksum != 0 || dual) && h.Checksum != headPageChecksum(db.pager.slice(pos, pos+db.pageSize), h) {
+		return corruptPage(id, checksumOffset, "checksum mismatch")
 	}
 	return nil
 }
@@ -149,68 +351,273 @@ type DB struct {
 	// syscall.MAP_POPULATE on Linux 2.6.23+ for sequential read-ahead.
 	MmapFlags int
 
-	path string
-	file *os.File
-	//lockfile *os.File // windows only
-	dataref   []byte // mmap'ed readonly, write throws SEGV
-	data      *[maxMapSize]byte
-	datasz    int
-	filesz    int // current on disk file size
-	pageSize  int
-	allocSize int
-	opened    bool
+	// MaxBatchSize is the maximum size of a batch. Default value is
+	// copied from DefaultMaxBatchSize in Open.
+	//
+	// If <=0, disables batching.
+	//
+	// Do not change concurrently with calls to Batch.
+	MaxBatchSize int
+
+	// MaxBatchDelay is the maximum delay before a batch starts.
+	// Default value is copied from DefaultMaxBatchDelay in Open.
+	//
+	// If <=0, effectively disables batching.
+	//
+	// Do not change concurrently with calls to Batch.
+	MaxBatchDelay time.Duration
+
+	// PreloadProgress, if set, is called periodically by Preload with the
+	// number of pages touched so far and the total number of pages.
+	PreloadProgress func(done, total int)
+
+	// MaxReaderBuffer is the largest compressed value GetReader decompresses
+	// in memory, in bytes once decompressed. Default value is copied from
+	// DefaultMaxReaderBuffer in Open.
+	//
+	// If <=0, there is no limit.
+	MaxReaderBuffer int
+
+	mmapGrowth   MmapGrowthPolicy
+	syncPolicy   SyncPolicy
+	boundsCheck  bool
+	orderedWrite bool
+	dupKeys      bool
+	// see Options.VerifyChecksums, only set if the file has page checksums
+	verifyChecksums bool
+	pageCache       *pageCache // nil unless Options.PageCacheSize is set
+	// a head was flushed since the last sync, and the goroutine of
+	// SyncInterval, see startSyncer
+	unsynced bool
+	syncStop chan struct{}
+	syncDone chan struct{}
+
+	path         string
+	file         *os.File
+	lockfile     *os.File // file holding the lock if not file, see Options.ExternalLockFile
+	lockCreated  bool     // whether this handle created lockfile
+	externalLock bool     // lock is held on lockfile instead of file
+	ownerWritten bool     // this handle wrote the owner file
+	dotlock      *dotLock // set if the lock is a dotfile, see Options.LockMode
+	lockedAt     time.Time
+	fileKey      *fileKey // set while registered, see ErrDatabaseOpen
+	dataref      []byte   // mmap'ed readonly, write throws SEGV
+	data         *[maxMapSize]byte
+	datasz       int
+	mapGen       uint64 // bumped on every mmap
+	filesz       int    // current on disk file size
+	pageSize     int
+	allocSize    int
+	opened       bool
+
+	// reads the file, the mapping or reader, see OpenReader
+	pager  pager
+	reader *readerPager
 
 	rwlock   sync.Mutex   // Allows only one writer at a time.
 	headlock sync.Mutex   // Protects head page access.
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
-	pagePool sync.Pool
+	bufPool  bufferPool   // Size-bucketed scratch buffers, see getBuf.
+	batchMu  sync.Mutex
+	batch    *batch
+	stats    *Stats  // allocated apart for the alignment of its atomics
+	txStats  TxStats // counters of the commit in progress, under rwlock
 
+	// writes and syncs of the file, test hooks
 	ops struct {
 		writeAt func(b []byte, off int64) (n int, err error)
+		sync    func() error
 	}
 
 	// Read only mode.
 	// When true, Update() and Begin(true) return ErrDatabaseReadOnly immediately.
 	readOnly bool
 
+	// noLock skips flock/funlock, only allowed in read only mode.
+	noLock   bool
+	lockMode LockMode
+	// demoted is set if a read-write Open fell back to read-only.
+	demoted bool
+
 	head    *HeadPage
 	indexes []*Index
-
-	compression  CompressAlgorithm
-	compressor   Compressor
-	decompressor DeCompressor
+	// positions in indexes sorted by Start, the tail page as of the last
+	// entry, and whether the index is kept, see loadIndex
+	indexOrder []int
+	indexTail  PageId
+	indexing   bool
+	// next index page to load, 0 once all are, the end of the last entry
+	// and the number of pages left, see loadIndexPage. Readers load pages
+	// under indexlock.
+	indexNext PageId
+	indexEnd  RecordPtr
+	indexLeft uint32
+	indexlock sync.Mutex
+	// page of the current head and first data page, 0 and 1, or with
+	// FeatureDualHead 0 or 1 and 2
+	headId    PageId
+	dataStart PageId
+	// last key written to the current data page and last key written by Put,
+	// loaded on the first write, see loadTail
+	lastKey    []byte
+	lastPutKey []byte
+	tailLoaded bool
+	// generation of the head when the file was last mapped or refreshed
+	seenGen uint64
+	// free pages, sorted, and the pages the freelist was loaded from, see
+	// loadFreelist
+	freelist      []PageId
+	freelistPages []PageId
+	freelistDirty bool
+	// pages to free by the generation of the head that dropped them, see
+	// freeLater, and the head generation of each open read-only
+	// transaction, under txlock
+	pending map[uint64][]PageId
+	txs     map[*Tx]uint64
+	txlock  sync.Mutex
+
+	// bits per key of the bloom filters of data pages, see
+	// Options.BloomBitsPerKey
+	bloomBits int
+
+	// see Options.MaxAppendChain
+	maxAppendChain int
+
+	// see Options.TombstoneRetention, and the clock of the commit times of
+	// tombstones, a test hook
+	tombstoneRetention time.Duration
+	now                func() time.Time
+
+	compression     CompressAlgorithm
+	comparator      Comparator
+	cmpName         string
+	compressor      Compressor
+	decompressor    DeCompressor
+	compressAppend  appendCompressor // compressor into pooled buffers, see marshal
+	compressMinSize int
+	// the records of the data pages a batch adds are compressed together,
+	// see Options.PageCompression
+	pageCompression bool
+	// only used to create the file, see init
+	compressionLevel int
+	// set from the head, see mmap
+	checksumAlgo ChecksumAlgorithm
+
+	// opened by Salvage, and what open passed over, see salvageHead
+	salvaging    bool
+	salvageSkips []SalvageSkip
 }
 
 func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
-	var db = &DB{opened: true}
+	return open(callerOf(), path, mode, options, false)
+}
+
+// newDB returns a database handle set up with options, not open yet.
+func newDB(options *Options) (*DB, error) {
+	var db = &DB{opened: true, stats: &Stats{}}
+	db.NoGrowSync = options.NoGrowSync
+	db.MmapFlags = options.MmapFlags
+	db.mmapGrowth = options.MmapGrowthPolicy
+	db.syncPolicy = options.SyncPolicy
+	db.boundsCheck = options.BoundsCheck
+	db.lockMode = options.LockMode
+	// only used to create the file, see init, the head says from then on
+	db.orderedWrite = options.OrderedWrite
+	db.dupKeys = options.DupKeys
+	db.pageCache = newPageCache(options.PageCacheSize)
+	db.MaxBatchSize = DefaultMaxBatchSize
+	db.MaxBatchDelay = DefaultMaxBatchDelay
+	db.MaxReaderBuffer = DefaultMaxReaderBuffer
+	db.tombstoneRetention = options.TombstoneRetention
+	db.now = time.Now
+	db.maxAppendChain = options.MaxAppendChain
+	if db.maxAppendChain == 0 {
+		db.maxAppendChain = DefaultMaxAppendChain
+	}
+
+	if options.PageSize != 0 {
+		if !validPageSize(options.PageSize) {
+			return nil, errors.Wrapf(ErrInvalidPageSize, "%d", options.PageSize)
+		}
+		// only used to create the file, see init
+		db.pageSize = int(options.PageSize)
+	}
+
+	// only used to create the file, see init, the head says from then on,
+	// see checkCompression
+	if err := db.setCompression(options.Compression, options.CompressionLevel); err != nil {
+		return nil, err
+	}
+	db.pageCompression = options.PageCompression
+	if !options.ChecksumAlgo.valid() {
+		return nil, errors.Wrapf(ErrUnknownChecksum, "%d", options.ChecksumAlgo)
+	}
+	// only used to create the file, see init
+	db.checksumAlgo = options.ChecksumAlgo
+	db.compressMinSize = options.CompressMinSize
+	if db.compressMinSize == 0 {
+		db.compressMinSize = DefaultCompressMinSize
+	}
+	db.comparator = options.Comparator
+	if db.comparator == nil {
+		db.comparator = BytesComparator
+	}
+	if name, ok := comparatorName(db.comparator); ok {
+		db.cmpName = name
+	} else {
+		return nil, errors.New("comparator is not registered, see RegisterComparator")
+	}
 
+	return db, nil
+}
+
+// open opens the database for the Open called at caller. With salvage, heads
+// and a freelist that don't validate are passed over, see Salvage.
+func open(caller, path string, mode os.FileMode, options *Options, salvage bool) (*DB, error) {
 	// Set default options if no options are provided.
 	if options == nil {
 		options = DefaultOptions
 	}
-	db.NoGrowSync = options.NoGrowSync
-	db.MmapFlags = options.MmapFlags
-
-	db.compression = options.Compression
+	db, err := newDB(options)
+	if err != nil {
+		return nil, err
+	}
+	db.salvaging = salvage
+	db.pager = mmapPager{db}
 
 	flag := os.O_RDWR
 	if options.ReadOnly {
 		flag = os.O_RDONLY
 		db.readOnly = true
 	}
+	if options.NoLock {
+		if !options.ReadOnly {
+			return nil, errors.New("NoLock requires ReadOnly")
+		}
+		db.noLock = true
+	}
 
 	// Open data file and separate sync handler for metadata writes.
 	db.path = path
-	var err error
-	if db.file, err = os.OpenFile(db.path, flag, mode); err != nil {
-		if os.IsNotExist(err) && db.readOnly {
-			_ = db.close()
-			return nil, err
-		}
-		if db.file, err = os.OpenFile(db.path, flag|os.O_CREATE, mode); err != nil {
-			_ = db.close()
-			return nil, err
-		}
+	// The file is only ever created in read-write mode, and O_CREATE is
+	// never passed, see create.
+	db.file, err = os.OpenFile(db.path, flag, 0)
+	switch {
+	case err == nil:
+		err = checkRegular(db.file)
+	case os.IsNotExist(err) && !db.readOnly:
+		err = db.create(mode)
+	}
+	if err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	// Catch a second read-write Open of the file within this process, which
+	// flock can't be relied upon to do.
+	if err := db.register(caller); err != nil {
+		_ = db.close()
+		return nil, err
 	}
 
 	// Lock file so that other processes using in read-write mode cannot
@@ -220,52 +627,49 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	// if !options.ReadOnly.
 	// The database file is locked using the shared lock (more than one process may
 	// hold a lock at the same time) otherwise (options.ReadOnly is set).
-	if err := flock(db); err != nil {
+	if options.LockMode == LockDotfile && !db.noLock {
+		// Readers can't share a dotfile lock and run unlocked.
+		if !db.readOnly {
+			db.dotlock, err = acquireDotLock(path+dotLockSuffix, options.LockStaleTTL)
+			db.lockedAt = time.Now()
+		}
+	} else if options.ExternalLockFile && !db.noLock {
+		db.externalLock = true
+		err = db.lockExternal(options.FlockTimeout)
+	} else if !db.noLock {
+		err = waitflock(db, options.FlockTimeout)
+		db.lockedAt = time.Now()
+	}
+	if err != nil && options.FallbackReadOnly && !db.readOnly && errors.Is(err, ErrWriteByOther) {
+		err = db.fallbackReadOnly()
+	}
+	if err != nil {
 		_ = db.close()
+		if _, ok := err.(*LockHeldError); !ok && errors.Is(err, ErrWriteByOther) {
+			return nil, lockHeldError(path)
+		}
 		return nil, err
 	}
 
-	// Default values for test hooks
-	db.ops.writeAt = db.file.WriteAt
-
-	// Initialize the database if it doesn't exist.
-	if info, err := db.file.Stat(); err != nil {
-		return nil, err
-	} else if info.Size() == 0 {
-		// Initialize new files with meta pages.
-		if err := db.init(); err != nil {
+	// Leave a note about who holds the exclusive lock.
+	if !db.readOnly {
+		if err := db.writeOwner(); err != nil {
+			_ = db.close()
 			return nil, err
 		}
-	} else {
-		// Read the first meta page to determine the page size.
-		var buf [4096]byte
-		if _, err := db.file.ReadAt(buf[:], 0); err == nil {
-			h := (*HeadPage)(unsafe.Pointer(&buf))
-			db.pageSize = int(h.PageSize)
-		}
 	}
-	db.allocSize = AllocPages * db.pageSize
 
-	// Initialize page pool.
-	db.pagePool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, db.pageSize)
-		},
-	}
+	// Default values for test hooks
+	db.ops.writeAt = db.file.WriteAt
+	db.ops.sync = db.file.Sync
 
-	// Memory map the data file.
-	if err := db.mmap(options.InitialMmapSize); err != nil {
+	if err := db.load(options); err != nil {
 		_ = db.close()
 		return nil, err
 	}
 
-	switch db.compression {
-	case CompSnappy:
-		db.compressor = SnappyCompress
-		db.decompressor = SnappyDeCompress
-	case CompLz4:
-		db.compressor = Lz4Compress
-		db.decompressor = Lz4DeCompress
+	if !db.readOnly {
+		db.startSyncer()
 	}
 
 	// Mark the database as opened and return.
@@ -275,8 +679,27 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 // Close releases all database resources.
 // All transactions must be closed before closing the database.
 func (db *DB) Close() error {
+	var syncDone chan struct{}
+	// The syncer may be waiting for rwlock, wait for it once released.
+	defer func() {
+		if syncDone != nil {
+			<-syncDone
+		}
+	}()
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
+	syncDone = db.stopSyncer()
+
+	// Free pages not written out would leak, but only that: close anyway.
+	var ferr error
+	if db.opened && !db.readOnly {
+		// No transaction reads past Close.
+		db.releasePending(^uint64(0))
+		ferr = db.flushFreelist()
+		if ferr == nil && db.unsynced && db.syncPolicy.interval > 0 {
+			ferr = db.sync()
+		}
+	}
 
 	db.headlock.Lock()
 	defer db.headlock.Unlock()
@@ -284,7 +707,10 @@ func (db *DB) Close() error {
 	db.mmaplock.RLock()
 	defer db.mmaplock.RUnlock()
 
-	return db.close()
+	if err := db.close(); err != nil {
+		return err
+	}
+	return ferr
 }
 
 func (db *DB) close() error {
@@ -296,16 +722,38 @@ func (db *DB) close() error {
 
 	// Clear ops.
 	db.ops.writeAt = nil
+	db.ops.sync = nil
 
 	// Close the mmap.
 	if err := db.munmap(); err != nil {
 		return err
 	}
 
+	// Clean close, the owner file goes away with the exclusive lock.
+	if db.ownerWritten {
+		if err := db.removeOwner(); err != nil {
+			log.Printf("sidb.Close(): %s", err)
+		}
+	}
+
+	// Release the external lock file.
+	if err := db.unlockExternal(); err != nil {
+		log.Printf("sidb.Close(): unlock error: %s", err)
+	}
+
+	db.unregister()
+
+	if db.dotlock != nil {
+		if err := db.dotlock.release(); err != nil {
+			log.Printf("sidb.Close(): unlock error: %s", err)
+		}
+		db.dotlock = nil
+	}
+
 	// Close file handles.
 	if db.file != nil {
 		// No need to unlock read-only file.
-		if !db.readOnly {
+		if !db.readOnly && !db.noLock && !db.externalLock && db.lockMode != LockDotfile {
 			// Unlock the file.
 			if err := funlock(db); err != nil {
 				log.Printf("sidb.Close(): funlock error: %s", err)
@@ -321,80 +769,350 @@ func (db *DB) close() error {
 	return nil
 }
 
-// init creates a new database file and initializes its meta pages.
+// checkComparator makes sure the database was created with the comparator
+// it is opened with. Files without a comparator name predate it and used
+// BytesComparator.
+func (db *DB) checkComparator() error {
+	stored := string(bytes.TrimRight(db.head.comparator[:], "\x00"))
+	if stored == "" {
+		stored = defaultComparatorName
+	}
+	if stored != db.cmpName && !registeredComparator(stored) {
+		return errors.Wrapf(ErrComparatorMismatch, "created with %q, which isn't registered in this program, see RegisterComparator", stored)
+	}
+	if stored != db.cmpName {
+		return errors.Wrapf(ErrComparatorMismatch, "created with %q, opened with %q", stored, db.cmpName)
+	}
+	return nil
+}
+
+// checkCompression switches to the compression recorded in the head, which
+// options only set for new files, failing if they differ with StrictOptions.
+func (db *DB) checkCompression(options *Options) error {
+	a, level := db.head.Compression, int(db.head.CompressionLevel)
+	page := db.head.Features.Required&FeaturePageCompression != 0
+	if !db.salvaging && (a != options.Compression || level != options.CompressionLevel || page != options.PageCompression) {
+		msg := fmt.Sprintf("created with compression %d level %d, page compression %t, opened with %d level %d, %t",
+			a, level, page, options.Compression, options.CompressionLevel, options.PageCompression)
+		if options.StrictOptions {
+			return errors.Wrap(ErrCompressionMismatch, msg)
+		}
+		log.Warnf("sidb: %s: %s, the options are ignored", db.path, msg)
+	}
+	db.pageCompression = page
+	// The file may need a user codec not registered in this process, or one
+	// of a newer sidb.
+	return errors.Wrap(db.setCompression(a, level), "head")
+}
+
+// create creates the data file at db.path. It is initialized under a
+// temporary name and then linked into place, so that no other Open ever sees
+// a partially written head. If another process creates the file first, that
+// file is opened instead.
+func (db *DB) create(mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".init-*")
+	if err != nil {
+		return errors.Wrap(err, "create db file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(mode); err != nil {
+		return errors.Wrap(err, "create db file")
+	}
+
+	db.file = tmp
+	db.ops.writeAt = tmp.WriteAt
+	db.ops.sync = tmp.Sync
+	err = db.init()
+	db.file = nil
+	db.ops.writeAt = nil
+	db.ops.sync = nil
+	if err != nil {
+		return err
+	}
+
+	// Unlike rename, link never replaces a file created in the meantime.
+	if err := os.Link(tmp.Name(), db.path); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "link db file")
+	}
+	if db.file, err = os.OpenFile(db.path, os.O_RDWR, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkRegular fails if f, opened read-only, is a directory, which unlike
+// read-write opens succeeds.
+func checkRegular(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "open", Path: f.Name(), Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+// load reads the head, checks it against options and loads what lookups and
+// writes start from, see Open.
+func (db *DB) load(options *Options) error {
+	// Read the first meta page to determine the page size.
+	if err := db.readPageSize(); err != nil {
+		return err
+	}
+	db.allocSize = AllocPages * db.pageSize
+
+	// Memory map the data file.
+	if err := db.mmap(options.InitialMmapSize); err != nil {
+		return err
+	}
+
+	if !db.salvaging {
+		if err := db.checkFileSize(db.head, int64(db.filesz)); err != nil {
+			return err
+		}
+	}
+
+	if err := db.checkCompression(options); err != nil {
+		return err
+	}
+
+	if !options.ForceComparator {
+		if err := db.checkComparator(); err != nil {
+			return err
+		}
+	}
+
+	db.verifyChecksums = options.VerifyChecksums && db.head.Features.WriteRequired&FeaturePageChecksums != 0
+	db.orderedWrite = db.head.Features.WriteRequired&FeatureOrderedWrite != 0
+	db.dupKeys = db.head.Features.Required&FeatureDupKeys != 0
+	// Another comparator may take different keys as equal, which the
+	// filters, hashing keys, don't.
+	if db.cmpName == defaultComparatorName {
+		db.bloomBits = options.BloomBitsPerKey
+	}
+
+	if err := db.loadFreelist(); err != nil {
+		if !db.salvaging {
+			return err
+		}
+		db.salvageSkip(db.head.freelist, 0, errors.Wrap(err, "freelist"))
+		db.freelist, db.freelistPages = nil, nil
+	}
+
+	if !db.readOnly {
+		if err := db.rollbackTail(); err != nil {
+			return err
+		}
+		if err := db.rollbackIndex(); err != nil {
+			return err
+		}
+	}
+
+	if err := db.loadIndex(); err != nil {
+		// Lookups and writes that get to it fail, Reindex rebuilds it.
+		log.Warnf("sidb: %s: broken page index: %s", db.path, err)
+	}
+	return nil
+}
+
+// readPageSize reads the page size from the head page and makes sure the file
+// is large enough to hold the head pages. No field of the head is trusted
+// before its magic and version are checked.
+func (db *DB) readPageSize() error {
+	size, err := db.fileSize()
+	if err != nil {
+		return err
+	}
+	var buf [headPageSize]byte
+	n, err := db.readAt(buf[:], 0)
+	if n < headPageSize && err != nil && err != io.EOF {
+		return errors.Wrap(err, "read head page")
+	}
+	h := headPageDecode(buf[:])
+	switch {
+	case n < headPageSize || buf == [headPageSize]byte{}:
+		err = db.initError(size)
+	case h.magic != Magic:
+		err = ErrBadMagic
+	case h.Version == 0:
+		err = &ErrVersionMismatch{Got: h.Version, Want: Version}
+	case !validPageSize(uint32(h.PageSize)):
+		err = errors.Wrapf(ErrInvalidPageSize, "head page size %d", h.PageSize)
+	case size < 2*int64(h.PageSize):
+		err = db.initError(size)
+	default:
+		db.pageSize = int(h.PageSize)
+		return nil
+	}
+	if db.salvaging && db.findPageSize(size) {
+		return nil
+	}
+	return err
+}
+
+// initError returns the error of a file of size bytes too small to hold the
+// head pages.
+func (db *DB) initError(size int64) error {
+	if size == 0 || db.readOnly {
+		return ErrNotInitialized
+	}
+	return ErrIncompleteInit
+}
+
+// checkFileSize returns an ErrTruncated if the file, of size bytes, doesn't
+// hold the pages counted by head. Its last page may end short of the page
+// size, if written without growing the file first, see NoGrowSync, but not
+// short of what its header says it holds. The last data page and the last
+// index page hold what head says: their header may be of a commit that didn't
+// make it, see rollbackTail and rollbackIndex.
+func (db *DB) checkFileSize(head *HeadPage, size int64) error {
+	want := int64(head.PageCount) * int64(db.pageSize)
+	if size >= want {
+		return nil
+	}
+	last := head.PageCount - 1
+	start := db.pageOffset(last)
+	if last < db.dataStart || size < start+pageHeaderSize {
+		return &ErrTruncated{Expected: want, Actual: size}
+	}
+	used := db.pageUsed(db.page(last))
+	switch last {
+	case PageId(head.kvPtr.pageNum):
+		used = int(head.kvPtr.offset)
+	case PageId(head.indexPtr.pageNum):
+		used = int(head.indexPtr.offset)
+	}
+	if size >= start+int64(used) {
+		return nil
+	}
+	return &ErrTruncated{Expected: want, Actual: size}
+}
+
+// pageUsed returns how much of page p, from its start, was written.
+func (db *DB) pageUsed(p *Page) int {
+	switch {
+	case p.Flag&(PageSorted|PageBloom) != 0:
+		// the footer ends the page
+		return db.pageSize
+	case p.Flag&PageFree != 0:
+		return pageHeaderSize + int(p.Len)
+	}
+	return int(p.ptr)
+}
+
+// init creates a new database file and initializes its meta pages, with pages
+// of Options.PageSize if set in db.pageSize.
 func (db *DB) init() error {
-	// Set the page size to the OS page size.
-	db.pageSize = os.Getpagesize()
-	if db.pageSize > int(maxPageSize) {
-		db.pageSize = int(maxPageSize)
+	// Default to the OS page size.
+	if db.pageSize == 0 {
+		db.pageSize = os.Getpagesize()
+		if db.pageSize > int(maxPageSize) {
+			db.pageSize = int(maxPageSize)
+		}
 	}
 
-	// 1 headPage + 1 dataPage
-	buf := make([]byte, db.pageSize*2)
+	// 2 headPages + 1 dataPage
+	buf := make([]byte, db.pageSize*3)
 	{
-		head := db.headPageInBuffer(buf)
+		head := &HeadPage{}
 		head.magic = Magic
 		head.Compression = db.compression
+		head.CompressionLevel = int32(db.compressionLevel)
+		head.ChecksumAlgo = db.checksumAlgo
+		copy(head.comparator[:], db.cmpName)
+		head.Features.Optional = FeatureGeneration
+		head.Features.WriteRequired = FeaturePageChecksums
+		head.Features.Required = FeatureDualHead
+		if db.pageCompression {
+			head.Features.Required |= FeaturePageCompression
+		}
+		if db.checksumAlgo != ChecksumIEEE {
+			head.Features.Required |= FeatureChecksumAlgo
+		}
+		if db.cmpName != defaultComparatorName {
+			head.Features.Required |= FeatureComparator
+		} else {
+			head.Features.WriteRequired |= FeaturePageIndex
+		}
+		if db.orderedWrite {
+			head.Features.WriteRequired |= FeatureOrderedWrite
+		}
+		if db.dupKeys {
+			head.Features.Required |= FeatureDupKeys
+		}
 		head.Version = Version
-		offset := PageSz(unsafe.Sizeof(*head))
+		offset := PageSz(headPageSize)
 		head.indexPtr = RecordPtr{0, offset}
-		head.kvPtr = RecordPtr{1, PageSz(unsafe.Sizeof(Page{}))}
+		head.kvPtr = RecordPtr{2, PageSz(pageHeaderSize)}
 		head.ptr = offset
-		head.PageCount = 2
+		head.PageCount = 3
 		head.IndexPageCount = 0
 		head.PageSize = PageSz(db.pageSize)
+		head.Checksum = headPageChecksum(buf[:db.pageSize], head)
+		// both heads start out the same
+		headPageEncode(buf, head)
+		headPageEncode(buf[db.pageSize:], head)
 		db.head = head
 	}
 	{
-		page1 := db.pageInBuffer(buf, 1)
-		page1.ptr = PageSz(unsafe.Sizeof(*page1))
-		page1.Flag = PageData | PageFull
+		page2 := Page{Flag: PageData | PageFull, ptr: PageSz(pageHeaderSize)}
+		pageHeaderEncode(buf[2*db.pageSize:], &page2)
 	}
 
 	// Write the buffer to our data file.
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		return err
 	}
-	if err := db.file.Sync(); err != nil {
+	if err := db.ops.sync(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (db *DB) gerFreePage() PageId {
-	return 0
-}
-
-// grow grows the size of the database to the given sz.
-func (db *DB) grow(sz int) error {
+// grow grows the file to at least sz bytes. Files up to allocSize grow to
+// what's needed, larger ones in multiples of allocSize. filesz is the size
+// on disk afterwards, which stays behind with NoGrowSync: the file grows with
+// the writes instead.
+func (db *DB) grow(sz int64) error {
 	// Ignore if the new size is less than available file size.
-	if sz <= db.filesz {
+	if sz <= int64(db.filesz) {
 		return nil
 	}
 
-	// If the data is smaller than the alloc size then only allocate what's needed.
-	// Once it goes over the allocation size then allocate in chunks.
-	if db.datasz < db.allocSize {
-		sz = db.datasz
-	} else {
-		sz += db.allocSize
+	// The file must stay addressable by the mmap.
+	if sz > maxMapSize {
+		return ErrDatabaseFull
+	}
+	if sz > int64(db.allocSize) {
+		sz = roundUp(sz, int64(db.allocSize))
+		if sz > maxMapSize {
+			sz = maxMapSize
+		}
 	}
 
 	// Truncate and fsync to ensure file size metadata is flushed.
 	// https://github.com/sidbdb/sidb/issues/284
 	if !db.NoGrowSync && !db.readOnly {
+		// On Windows the file grows with the mapping, see mmap.
 		if runtime.GOOS != "windows" {
-			if err := db.file.Truncate(int64(sz)); err != nil {
+			if err := db.file.Truncate(sz); err != nil {
 				return errors.Wrap(err, "file resize error")
 			}
 		}
-		if err := db.file.Sync(); err != nil {
+		db.txStats.Sync++
+		if err := db.ops.sync(); err != nil {
 			return errors.Wrap(err, "file sync error")
 		}
 	}
 
-	db.filesz = sz
+	info, err := db.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "file stat error")
+	}
+	db.filesz = int(info.Size())
 	return nil
 }
 
@@ -403,24 +1121,35 @@ func (db *DB) grow(sz int) error {
 func (db *DB) mmap(minsz int) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
+	return db.remap(minsz)
+}
+
+// remap maps the file again, at the size the mmap growth policy gives it or
+// minsz, whichever is larger, see mmap. The caller holds mmaplock.
+func (db *DB) remap(minsz int) error {
+	if db.reader != nil {
+		// nothing to map, see OpenReader
+		return db.loadHead()
+	}
 
 	info, err := db.file.Stat()
 	if err != nil {
 		return errors.Wrap(err, "mmap stat error")
-	} else if int(info.Size()) < db.pageSize*2 {
+	} else if info.Size() < int64(db.pageSize)*2 {
 		return errors.New("file size too small")
 	}
 
 	// Ensure the size is at least the minimum size.
-	var size = int(info.Size())
-	db.filesz = size
-	if size < minsz {
-		size = minsz
+	var fsize = info.Size()
+	if fsize < int64(minsz) {
+		fsize = int64(minsz)
 	}
-	size, err = db.mmapSize(size)
+	size, err := db.mmapSize(fsize)
 	if err != nil {
 		return err
 	}
+	// The file fits in the mapping, so its size fits in an int.
+	db.filesz = int(info.Size())
 
 	// Unmap existing data before continuing.
 	if err := db.munmap(); err != nil {
@@ -432,19 +1161,72 @@ func (db *DB) mmap(minsz int) error {
 		return err
 	}
 
-	// Save references to the meta pages.
-	db.head = db.headPage()
+	// Pointers into the previous mapping are stale from now on.
+	db.mapGen++
+	db.pageCache.clear()
+	return db.loadHead()
+}
 
-	// Validate the meta pages. We only return an error if both meta pages fail
-	// validation, since meta0 failing validation means that it wasn't saved
-	// properly -- but we can recover using meta1. And vice-versa.
-	err = db.head.validate(db)
+// loadHead sets the current head page, see currentHead. The caller holds
+// mmaplock.
+func (db *DB) loadHead() error {
+	head, id, err := db.currentHead()
+	if db.salvaging {
+		head, id, err = db.salvageHead(head, id, err)
+	}
 	if err != nil {
 		return err
 	}
+	db.head, db.headId = head, id
+	db.checksumAlgo = head.ChecksumAlgo
+	db.dataStart = 1
+	if head.Features.Required&FeatureDualHead != 0 {
+		db.dataStart = 2
+	}
+	db.seenGen = head.generation
 	return nil
 }
 
+// currentHead validates the head pages and returns the current one and its
+// page. That is page 0, or with FeatureDualHead the valid head of pages 0 and
+// 1 with the highest generation: a head torn by a crash is passed over for
+// the previous commit. The error of page 0 is returned if none is valid.
+func (db *DB) currentHead() (*HeadPage, PageId, error) {
+	head := db.headPageAt(0)
+	err := head.validate(db, 0)
+	if err == nil && head.Features.Required&FeatureDualHead == 0 {
+		return head, 0, nil
+	}
+	var best *HeadPage
+	var bestId PageId
+	if err == nil {
+		best = head
+	}
+	// Only a file created with dual heads has a second one.
+	if db.filesz >= 3*db.pageSize {
+		h := db.headPageAt(1)
+		if h.Features.Required&FeatureDualHead != 0 && h.validate(db, 1) == nil &&
+			(best == nil || h.generation > best.generation) {
+			best, bestId = h, 1
+		}
+	}
+	if best == nil {
+		return nil, 0, err
+	}
+	return best, bestId, nil
+}
+
+// mmapRelocate remaps the file if the mapping is smaller than minsz, once
+// pages were appended past its end. Readers hold mmaplock around every access
+// to the mapping, so they see it either before or after the move. The caller
+// holds rwlock.
+func (db *DB) mmapRelocate(minsz int) error {
+	if minsz <= db.datasz {
+		return nil
+	}
+	return db.mmap(minsz)
+}
+
 // munmap unmaps the data file from memory.
 func (db *DB) munmap() error {
 	if err := munmap(db); err != nil {
@@ -454,32 +1236,21 @@ func (db *DB) munmap() error {
 }
 
 // mmapSize determines the appropriate size for the mmap given the current size
-// of the database. The minimum size is 32KB and doubles until it reaches 1GB.
-// Returns an error if the new mmap size is greater than the max allowed.
-func (db *DB) mmapSize(size int) (int, error) {
-	// Double the size from 32KB until 1GB.
-	for i := uint(15); i <= 30; i++ {
-		if size <= 1<<i {
-			return 1 << i, nil
-		}
-	}
-
+// of the database, as decided by the mmap growth policy. By default the minimum
+// size is 32KB and doubles until it reaches 1GB.
+// Returns ErrMapTooLarge if the new mmap size is greater than the max allowed
+// on this platform.
+func (db *DB) mmapSize(size int64) (int, error) {
 	// Verify the requested size is not above the maximum allowed.
 	if size > maxMapSize {
-		return 0, errors.New("mmap too large")
+		return 0, ErrMapTooLarge
 	}
 
-	// If larger than 1GB then grow by 1GB at a time.
-	sz := int64(size)
-	if remainder := sz % int64(maxMmapStep); remainder > 0 {
-		sz += int64(maxMmapStep) - remainder
-	}
+	sz := db.mmapGrowth.size(size)
 
 	// Ensure that the mmap size is a multiple of the page size.
-	// This should always be true since we're incrementing in MBs.
-	pageSize := int64(db.pageSize)
-	if (sz % pageSize) != 0 {
-		sz = ((sz / pageSize) + 1) * pageSize
+	if db.pageSize > 0 {
+		sz = roundUp(sz, int64(db.pageSize))
 	}
 
 	// If we've exceeded the max size then only grow up to the max size.
@@ -490,9 +1261,25 @@ func (db *DB) mmapSize(size int) (int, error) {
 	return int(sz), nil
 }
 
-// page retrieves a page reference from the mmap based on the current page size.
+// headPage retrieves the current head page reference from the mmap. Unless
+// the host has the on-disk layout, see nativeLayout, it is a decoded copy.
 func (db *DB) headPage() *HeadPage {
-	return (*HeadPage)(unsafe.Pointer(&db.data[0]))
+	return db.headPageAt(db.headId)
+}
+
+// headPageAt retrieves the head page in page id, 0 or 1, see headPage.
+func (db *DB) headPageAt(id PageId) *HeadPage {
+	pos := db.pageOffset(id)
+	if db.debugBounds() {
+		// head pages are always counted, don't check against a stale head
+		db.checkBounds(0, pos, headPageSize)
+	}
+	b := db.pager.slice(int(pos), int(pos)+headPageSize)
+	if !nativeLayout || !db.pager.mapped() {
+		h := headPageDecode(b)
+		return &h
+	}
+	return (*HeadPage)(unsafe.Pointer(&b[0]))
 }
 
 // page retrieves a page reference from the mmap based on the current page size.
@@ -500,18 +1287,77 @@ func (db *DB) page(id PageId) *Page {
 	if id == 0 {
 		panic("reading HeadPage page 0 as Page ")
 	}
-	pos := id * PageId(db.pageSize)
-	return (*Page)(unsafe.Pointer(&db.data[pos]))
+	pos := db.pageOffset(id)
+	if db.debugBounds() {
+		db.checkBounds(id, pos, pageHeaderSize)
+	}
+	b := db.pager.slice(int(pos), int(pos)+pageHeaderSize)
+	if !nativeLayout || !db.pager.mapped() {
+		p := pageHeaderDecode(b)
+		return &p
+	}
+	return (*Page)(unsafe.Pointer(&b[0]))
 }
 
-// headPageInBuffer retrieves a page reference from a given byte array based on the current page size.
-func (*DB) headPageInBuffer(b []byte) *HeadPage {
-	return (*HeadPage)(unsafe.Pointer(&b[0]))
+// pageOffset returns the byte offset of a page in the file.
+func (db *DB) pageOffset(id PageId) int64 {
+	return int64(id) * int64(db.pageSize)
 }
 
-// pageInBuffer retrieves a page reference from a given byte array based on the current page size.
-func (db *DB) pageInBuffer(b []byte, id PageId) *Page {
-	return (*Page)(unsafe.Pointer(&b[id*PageId(db.pageSize)]))
+// checkPageCount returns ErrDatabaseFull if a database of count pages can't
+// be addressed, either because page ids would overflow or because the file
+// would be larger than the largest mmap supported by the platform.
+func (db *DB) checkPageCount(count int64) error {
+	if count > int64(^PageId(0))+1 || count*int64(db.pageSize) > maxMapSize {
+		return ErrDatabaseFull
+	}
+	return nil
+}
+
+// dataSlice returns the bytes of the mmap between start and end.
+func (db *DB) dataSlice(start, end int) []byte {
+	if db.debugBounds() {
+		if start > end {
+			panic(fmt.Sprintf("sidb: bad mmap range [%d:%d], datasz %d", start, end, db.datasz))
+		}
+		var id PageId
+		if db.pageSize > 0 {
+			id = PageId(start / db.pageSize)
+		}
+		db.checkBounds(id, int64(start), int64(end-start))
+	}
+	return db.pager.slice(start, end)
+}
+
+// debugBounds reports whether mmap accesses should be bounds checked.
+func (db *DB) debugBounds() bool {
+	return db.boundsCheck || db.StrictMode
+}
+
+// checkBounds panics if n bytes at offset pos of page id are not inside the
+// mapping, or if the page is beyond the page count of the head page.
+func (db *DB) checkBounds(id PageId, pos, n int64) {
+	if db.datasz == 0 {
+		panic(fmt.Sprintf("sidb: access to page %d at offset %d while unmapped", id, pos))
+	}
+	if pos < 0 || n < 0 || pos+n > int64(db.datasz) {
+		panic(fmt.Sprintf("sidb: access out of mmap bounds: page %d, offset %d, size %d, datasz %d", id, pos, n, db.datasz))
+	}
+	if id != 0 && db.head != nil && id >= db.head.PageCount {
+		panic(fmt.Sprintf("sidb: access beyond page count: page %d, offset %d, page count %d, datasz %d", id, pos, db.head.PageCount, db.datasz))
+	}
+}
+
+// pageInBuffer decodes the header of page id from a given byte array based on
+// the current page size. Changes are written back with pageHeaderEncode.
+func (db *DB) pageInBuffer(b []byte, id PageId) Page {
+	pos := db.pageOffset(id)
+	if db.debugBounds() {
+		if pos+pageHeaderSize > int64(len(b)) {
+			panic(fmt.Sprintf("sidb: page %d out of buffer bounds: offset %d, buffer size %d", id, pos, len(b)))
+		}
+	}
+	return pageHeaderDecode(b[pos:])
 }
 
 // GoString returns the Go string representation of the database.
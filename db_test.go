@@ -1,10 +1,18 @@
 package sidb
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/pkg/errors"
 	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
+	"unsafe"
 )
 
 const testDB = "/tmp/test-sidb-init.sidb"
@@ -15,6 +23,7 @@ func TestInit(t *testing.T) {
 	var err error
 	db.file, err = os.OpenFile(testDB, os.O_RDWR|os.O_CREATE, 0755)
 	db.ops.writeAt = db.file.WriteAt
+	db.ops.sync = db.file.Sync
 	assert.NoError(err)
 	assert.NoError(db.init())
 	assert.NoError(db.close())
@@ -35,7 +44,7 @@ func TestOpen(t *testing.T) {
 	db, err = Open(testDB, 0755, nil)
 	assert.NoError(err)
 	assert.Equal(CompSnappy, db.compression)
-	assert.Equal(2*db.pageSize, db.filesz)
+	assert.Equal(3*db.pageSize, db.filesz)
 	assert.Equal(32*1024, db.datasz)
 	assert.Equal(Magic, db.head.magic)
 
@@ -51,7 +60,7 @@ func TestOpen(t *testing.T) {
 	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
 	assert.NoError(err)
 	assert.Equal(CompSnappy, db.compression)
-	assert.Equal(2*db.pageSize, db.filesz)
+	assert.Equal(3*db.pageSize, db.filesz)
 	assert.Equal(32*1024, db.datasz)
 	assert.Equal(Magic, db.head.magic)
 
@@ -59,10 +68,491 @@ func TestOpen(t *testing.T) {
 	dbr, err = Open(testDB, 0755, &Options{ReadOnly: true})
 	assert.NoError(err)
 	assert.Equal(CompSnappy, db.compression)
-	assert.Equal(2*db.pageSize, db.filesz)
+	assert.Equal(3*db.pageSize, db.filesz)
 	assert.Equal(32*1024, db.datasz)
 	assert.Equal(Magic, db.head.magic)
 
 	assert.NoError(db.Close())
 	assert.NoError(dbr.Close())
 }
+
+func panicMessage(fn func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+	fn()
+	return
+}
+
+func TestBoundsCheck(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{BoundsCheck: true})
+	assert.NoError(err)
+	defer db.Close()
+
+	// in mapping and in page count
+	assert.NotPanics(func() { db.page(db.dataStart) })
+
+	// in mapping but beyond page count
+	msg := panicMessage(func() { db.page(3) })
+	assert.Contains(msg, "beyond page count: page 3")
+
+	// beyond mapping
+	id := PageId(db.datasz / db.pageSize)
+	msg = panicMessage(func() { db.page(id) })
+	assert.Contains(msg, fmt.Sprintf("out of mmap bounds: page %d", id))
+	assert.Contains(msg, fmt.Sprintf("datasz %d", db.datasz))
+
+	msg = panicMessage(func() { db.dataSlice(0, db.datasz+1) })
+	assert.Contains(msg, "out of mmap bounds")
+
+	msg = panicMessage(func() { db.pageInBuffer(make([]byte, db.pageSize), 1) })
+	assert.Contains(msg, "out of buffer bounds: offset")
+
+	// StrictMode implies bounds checking
+	db.boundsCheck = false
+	db.StrictMode = true
+	assert.Contains(panicMessage(func() { db.page(3) }), "beyond page count")
+}
+
+func TestPageOffset(t *testing.T) {
+	assert := assertion.New(t)
+	db := &DB{pageSize: 512}
+	id := PageId(1 << 24)
+	// uint32 math wraps around to the head page
+	assert.Equal(PageId(0), id*PageId(db.pageSize))
+	assert.Equal(int64(1)<<33, db.pageOffset(id))
+	assert.Equal(int64(^PageId(0))*512, db.pageOffset(^PageId(0)))
+
+	assert.NoError(db.checkPageCount(100))
+	assert.Equal(ErrDatabaseFull, db.checkPageCount(int64(^PageId(0))+2))
+	assert.Equal(ErrDatabaseFull, db.checkPageCount(maxMapSize/512+1))
+	assert.Equal(ErrDatabaseFull, db.grow(int64(maxMapSize)+1))
+
+	// page ids beyond the mapping fail with a go panic instead of reading
+	// the wrapped offset
+	buf := make([]byte, 1024)
+	db.data = (*[maxMapSize]byte)(unsafe.Pointer(&buf[0]))
+	db.datasz = len(buf)
+	db.boundsCheck = true
+	assert.Contains(panicMessage(func() { db.page(id) }), fmt.Sprintf("offset %d", int64(1)<<33))
+}
+
+func TestGrow(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 4096})
+	assert.NoError(err)
+	onDisk := func() int {
+		info, err := os.Stat(testDB)
+		assert.NoError(err)
+		return int(info.Size())
+	}
+	assert.Equal(8*4096, db.allocSize)
+
+	// small files grow to what's needed
+	assert.NoError(db.grow(4 * 4096))
+	assert.Equal(4*4096, db.filesz)
+	assert.NoError(db.grow(3 * 4096))
+	assert.Equal(4*4096, db.filesz)
+	assert.NoError(db.grow(8 * 4096))
+	assert.Equal(8*4096, db.filesz)
+	assert.Equal(onDisk(), db.filesz)
+
+	// past allocSize in whole chunks
+	assert.NoError(db.grow(9 * 4096))
+	assert.Equal(16*4096, db.filesz)
+	assert.NoError(db.grow(16*4096 + 1))
+	assert.Equal(24*4096, db.filesz)
+	assert.Equal(onDisk(), db.filesz)
+	assert.NoError(db.Close())
+
+	// the file is left to the writes
+	db, err = Open(testDB, 0755, &Options{NoGrowSync: true})
+	assert.NoError(err)
+	assert.NoError(db.grow(32 * 4096))
+	assert.Equal(24*4096, db.filesz)
+	assert.Equal(onDisk(), db.filesz)
+	assert.Zero(db.txStats.Sync)
+	assert.NoError(db.Close())
+}
+
+func TestOpenNoLock(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// NoLock is only valid with ReadOnly
+	db, err := Open(testDB, 0755, &Options{NoLock: true})
+	assert.Nil(db)
+	assert.Error(err)
+	_, err = os.Stat(testDB)
+	assert.True(os.IsNotExist(err))
+
+	// never creates the file
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true, NoLock: true})
+	assert.Nil(db)
+	assert.True(os.IsNotExist(err))
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+	assert.NoError(os.Chmod(testDB, 0444))
+
+	// another process holds the exclusive lock: shared locking fails, but
+	// NoLock doesn't lock at all
+	f, err := os.Open(testDB)
+	assert.NoError(err)
+	defer f.Close()
+	assert.NoError(flockFile(f, true))
+
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.True(errors.Is(err, ErrWriteByOther))
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true, NoLock: true})
+	assert.NoError(err)
+	assert.Equal(Magic, db.head.magic)
+	// writes fail cleanly at the fd level
+	_, err = db.ops.writeAt([]byte{0}, 0)
+	assert.Error(err)
+	assert.NoError(db.Close())
+}
+
+func TestOpenUninitialized(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// empty file
+	f, err := os.Create(testDB)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.Equal(ErrNotInitialized, err)
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(ErrNotInitialized, err)
+
+	// a partially written head
+	db, err := Open(testDB+".tmp", 0755, nil)
+	assert.NoError(err)
+	head := make([]byte, db.pageSize)
+	copy(head, db.dataref)
+	assert.NoError(db.Close())
+	os.Remove(testDB + ".tmp")
+	assert.NoError(ioutil.WriteFile(testDB, head, 0755))
+
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.Equal(ErrNotInitialized, err)
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(ErrIncompleteInit, err)
+	// and it was left alone
+	b, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	assert.Equal(head, b)
+}
+
+func TestOpenTruncated(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// the last page of a file grown with NoGrowSync ends with its records
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, NoGrowSync: true})
+	assert.NoError(err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")))
+	}
+	want := int64(db.head.PageCount) * 512
+	last := want - 512
+	end := last + int64(db.page(db.head.PageCount-1).ptr)
+	assert.NoError(db.Close())
+	info, err := os.Stat(testDB)
+	assert.NoError(err)
+	assert.True(info.Size() < want && info.Size()%512 != 0, "%d", info.Size())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Empty(checkErrors(db))
+	assert.NoError(db.Close())
+
+	orig, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	for _, size := range []int64{end - 1, last + 10, last, 3*512 + 100, 3 * 512} {
+		assert.NoError(ioutil.WriteFile(testDB, orig[:size], 0755))
+		for _, options := range []*Options{nil, {ReadOnly: true}} {
+			_, err = Open(testDB, 0755, options)
+			var trunc *ErrTruncated
+			if assert.True(errors.As(err, &trunc), "%d: %v", size, err) {
+				assert.Equal(&ErrTruncated{Expected: want, Actual: size}, trunc)
+			}
+		}
+	}
+
+	// the last page is the index's, cut in a rewrite that didn't commit
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{PageSize: 512, NoGrowSync: true})
+	assert.NoError(err)
+	var pairs []KVPair
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte("value")})
+	}
+	assert.NoError(db.PutBatch(pairs))
+	ptr := db.head.indexPtr
+	assert.Equal(db.head.PageCount-1, PageId(ptr.pageNum))
+	last = db.pageOffset(PageId(ptr.pageNum))
+	p := *db.page(PageId(ptr.pageNum))
+	assert.NoError(db.Close())
+	orig, err = ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	assert.Equal(last+int64(ptr.offset), int64(len(orig)))
+	p.Count++
+	p.Len += indexEntrySize
+	p.ptr += indexEntrySize
+	pageHeaderEncode(orig[last:], &p)
+	assert.NoError(ioutil.WriteFile(testDB, orig[:len(orig)-1], 0755))
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.True(errors.As(err, new(*ErrTruncated)), "%v", err)
+	assert.NoError(ioutil.WriteFile(testDB, append(orig, 1, 2, 3), 0755))
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Empty(checkErrors(db))
+	assert.NoError(db.Close())
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")))
+	}
+	assert.NoError(db.Close())
+	orig, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	// writes b at off of both heads, or of page id
+	corrupt := func(id PageId, off int, b []byte) {
+		buf := append([]byte(nil), orig...)
+		if id == 0 {
+			copy(buf[512+off:], b)
+		}
+		copy(buf[int(id)*512+off:], b)
+		assert.NoError(ioutil.WriteFile(testDB, buf, 0755))
+	}
+
+	corrupt(0, 0, []byte("SQLite"))
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrBadMagic), "%v", err)
+	corrupt(0, 8, []byte{0, 0})
+	_, err = Open(testDB, 0755, nil)
+	assert.Equal(&ErrVersionMismatch{Got: 0, Want: Version}, errors.Cause(err))
+
+	// the prefix length of the last record of the first data page, after
+	// its flag: the first record takes 16 bytes, the others share "key-000"
+	// and take 10
+	off := pageHeaderSize + 16 + 8*10 + 1
+	corrupt(db.dataStart, off, []byte{0xff})
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	_, err = db.Get([]byte("key-0009"))
+	var c *ErrCorrupt
+	if assert.True(errors.As(err, &c), "%v", err) {
+		assert.Equal(db.dataStart, c.Page)
+		assert.Equal(PageSz(off), c.Offset)
+	}
+	assert.NoError(db.Close())
+}
+
+func TestOpenBadHead(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	// open checks the file holding b fails to open with want, in both modes
+	open := func(b []byte, want error) {
+		assert.NoError(ioutil.WriteFile(testDB, b, 0644))
+		for _, options := range []*Options{{ReadOnly: true}, nil} {
+			db, err := Open(testDB, 0755, options)
+			assert.Nil(db)
+			assert.True(errors.Is(err, want), "%v", err)
+		}
+	}
+
+	garbage := make([]byte, 16<<10)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	open(garbage, ErrBadMagic)
+
+	// a bolt file: a page header, then the meta with bolt's magic
+	bolt := make([]byte, 4*4096)
+	for i := 0; i < 2; i++ {
+		page := bolt[i*4096:]
+		binary.LittleEndian.PutUint64(page, uint64(i))
+		binary.LittleEndian.PutUint16(page[8:], 0x04)
+		binary.LittleEndian.PutUint32(page[16:], 0xED0CDAED)
+		binary.LittleEndian.PutUint32(page[20:], 2)
+		binary.LittleEndian.PutUint32(page[24:], 4096)
+	}
+	open(bolt, ErrBadMagic)
+
+	os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	assert.NoError(db.Close())
+	orig, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	for _, size := range []uint32{0, 256, 3000, 3 << 20, 1 << 31} {
+		b := append([]byte(nil), orig...)
+		binary.LittleEndian.PutUint32(b[pageSizeOffset:], size)
+		open(b, ErrInvalidPageSize)
+	}
+}
+
+func TestOpenCreate(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0640, nil)
+	assert.NoError(err)
+	info, err := os.Stat(testDB)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0640), info.Mode().Perm())
+	assert.Equal(int64(3*db.pageSize), info.Size())
+	assert.NoError(db.Close())
+
+	// no temporary file is left behind
+	matches, err := filepath.Glob(testDB + ".init-*")
+	assert.NoError(err)
+	assert.Empty(matches)
+}
+
+func TestOpenNoCreate(t *testing.T) {
+	assert := assertion.New(t)
+	dir := testDB + ".dir"
+	os.Remove(testDB)
+	os.Remove(dir)
+	defer os.Remove(testDB)
+	defer os.Remove(dir)
+
+	// a directory opens in read-only mode, but isn't a database
+	assert.NoError(os.Mkdir(dir, 0755))
+	_, err := Open(dir, 0755, &Options{ReadOnly: true})
+	assert.True(errors.Is(err, syscall.EISDIR), "%v", err)
+	_, err = Open(dir, 0755, nil)
+	assert.True(errors.Is(err, syscall.EISDIR), "%v", err)
+	matches, err := filepath.Glob(dir + "*")
+	assert.NoError(err)
+	assert.Equal([]string{dir}, matches)
+
+	// errors other than a missing file are returned in both modes
+	assert.NoError(ioutil.WriteFile(testDB, nil, 0600))
+	for _, options := range []*Options{{ReadOnly: true}, nil} {
+		_, err = Open(testDB+"/db", 0755, options)
+		assert.True(errors.Is(err, syscall.ENOTDIR), "%v", err)
+	}
+
+	// root reads anything, and Windows has no such modes
+	if os.Geteuid() == 0 || runtime.GOOS == "windows" {
+		return
+	}
+	assert.NoError(os.Chmod(testDB, 0))
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.True(os.IsPermission(err), "%v", err)
+}
+
+func TestPageSize(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	for _, size := range []uint32{256, 1000, 1 << 17} {
+		_, err := Open(testDB, 0755, &Options{PageSize: size})
+		assert.True(errors.Is(err, ErrInvalidPageSize), "%d: %v", size, err)
+	}
+	_, err := os.Stat(testDB)
+	assert.True(os.IsNotExist(err))
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 64 << 10, Compression: CompNone})
+	assert.NoError(err)
+	assert.Equal(64<<10, db.pageSize)
+	assert.Equal(PageSz(64<<10), db.head.PageSize)
+	rnd := rand.New(rand.NewSource(1))
+	values := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		// values of 20 to 50KB, a page each
+		v := make([]byte, 20<<10+i*1536)
+		rnd.Read(v)
+		k := fmt.Sprintf("key-%d", i)
+		values[k] = v
+		assert.NoError(db.Put([]byte(k), v))
+	}
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		assert.False(db.page(id).overflow(), "page %d", id)
+	}
+	assert.NoError(db.Close())
+
+	// The stored page size wins.
+	for _, options := range []*Options{nil, {PageSize: 4096}} {
+		db, err = Open(testDB, 0755, options)
+		assert.NoError(err)
+		assert.Equal(64<<10, db.pageSize)
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+		assert.NoError(db.Close())
+	}
+}
+
+func TestPageSizeSmall(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	big := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(big)
+	for i := 0; i < 200; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Put([]byte("big"), big))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	assert.Equal(512, db.pageSize)
+	for i := 0; i < 200; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%03d", i)))
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf("value-%d", i), string(v))
+	}
+	v, err := db.Get([]byte("big"))
+	assert.NoError(err)
+	assert.Equal(big, v)
+	assert.NoError(db.Close())
+}
+
+func TestPageHeader(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	p, err := db.PageHeader(db.dataStart)
+	assert.NoError(err)
+	assert.Equal(*db.page(db.dataStart), p)
+	assert.Equal(uint16(1), p.Count)
+	_, err = db.PageHeader(0)
+	assert.Error(err)
+	_, err = db.PageHeader(db.head.PageCount)
+	assert.Error(err)
+	assert.NoError(db.Close())
+	_, err = db.PageHeader(db.dataStart)
+	assert.Equal(ErrDatabaseNotOpen, err)
+}
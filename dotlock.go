@@ -0,0 +1,180 @@
+package sidb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// LockMode selects the locking protocol used by Open.
+type LockMode uint8
+
+const (
+	// flock the data file, or the external lock file (default)
+	LockFlock LockMode = iota
+	// create path + ".dotlock" with O_CREATE|O_EXCL, for NFS and other
+	// filesystems where flock is unreliable across clients
+	LockDotfile
+)
+
+// dotLockSuffix is appended to the database path to name the dotfile lock.
+const dotLockSuffix = ".dotlock"
+
+// DefaultLockStaleTTL is the default Options.LockStaleTTL.
+const DefaultLockStaleTTL = 30 * time.Second
+
+// dotLock is an exclusive lock held by the existence of a file.
+//
+// The protocol is advisory and best-effort:
+//   - a lock is acquired by creating the file with O_CREATE|O_EXCL, which is
+//     atomic on local filesystems and on NFSv3+;
+//   - the holder writes its LockOwner into the file and touches its mtime
+//     every ttl/3, so a live holder never looks stale;
+//   - a lock whose mtime is older than ttl is assumed to belong to a dead
+//     holder and is broken, with a logged warning.
+//
+// Breaking relies on clocks of all clients being roughly in sync, and a holder
+// stalled for longer than ttl (e.g. a stopped process) loses its lock without
+// noticing until its next heartbeat. Only writers take the lock: readers
+// can't share a dotfile and run unlocked.
+type dotLock struct {
+	path string
+	info os.FileInfo // the lock file we created
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireDotLock takes the dotfile lock at path, breaking it if its holder
+// hasn't touched it for ttl.
+func acquireDotLock(path string, ttl time.Duration) (*dotLock, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockStaleTTL
+	}
+	for i := 0; i < maxLockRetries; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			l, err := newDotLock(f, ttl)
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, err
+			}
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrap(err, "create dotfile lock")
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// released in the meantime
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "stat dotfile lock")
+		}
+		if time.Since(info.ModTime()) < ttl {
+			return nil, ownerHeldError(path)
+		}
+		log.Warnf("sidb: breaking stale lock %s, last heartbeat at %s", path, info.ModTime().Format(time.RFC3339))
+		if err := breakDotLock(path, info); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("lock file keeps changing")
+}
+
+// newDotLock records the owner in the freshly created lock file f and starts
+// the heartbeat.
+func newDotLock(f *os.File, ttl time.Duration) (*dotLock, error) {
+	defer f.Close()
+	host, _ := os.Hostname()
+	b, err := json.Marshal(&LockOwner{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: processStart,
+		Version: Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(b); err != nil {
+		return nil, errors.Wrap(err, "write dotfile lock")
+	}
+	if err := f.Sync(); err != nil {
+		return nil, errors.Wrap(err, "sync dotfile lock")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat dotfile lock")
+	}
+	l := &dotLock{
+		path: f.Name(),
+		info: info,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.heartbeat(ttl / 3)
+	return l, nil
+}
+
+// breakDotLock removes the stale lock file described by stale. The file is
+// first renamed away, which is atomic, and put back if it turns out another
+// process replaced the stale lock with a live one in between.
+func breakDotLock(path string, stale os.FileInfo) error {
+	tmp := fmt.Sprintf("%s.stale.%d", path, os.Getpid())
+	if err := os.Rename(path, tmp); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "break stale lock")
+	}
+	defer os.Remove(tmp)
+	if info, err := os.Stat(tmp); err == nil && !os.SameFile(info, stale) {
+		// Not the file we judged stale. Link fails if yet another lock
+		// has been created meanwhile, which is then the one that counts.
+		_ = os.Link(tmp, path)
+	}
+	return nil
+}
+
+// heartbeat touches the lock file every interval until release.
+func (l *dotLock) heartbeat(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if !l.held() {
+				log.Warnf("sidb: lock %s was broken by another process", l.path)
+				return
+			}
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				log.Warnf("sidb: lock heartbeat: %s", err)
+			}
+		}
+	}
+}
+
+// held reports whether the file at path is still the one we created.
+func (l *dotLock) held() bool {
+	info, err := os.Stat(l.path)
+	return err == nil && os.SameFile(info, l.info)
+}
+
+// release stops the heartbeat and removes the lock file if it is still ours.
+func (l *dotLock) release() error {
+	close(l.stop)
+	<-l.done
+	if !l.held() {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove dotfile lock")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDotLock(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + dotLockSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + dotLockSuffix)
+	opts := &Options{LockMode: LockDotfile}
+
+	db, err := Open(testDB, 0755, opts)
+	assert.NoError(err)
+	info, err := os.Stat(testDB + dotLockSuffix)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(LockMechanismDotfile, db.LockInfo().Mechanism)
+
+	// contention reports the holder
+	asOtherProcess(db)
+	_, err = Open(testDB, 0755, opts)
+	assert.True(errors.Is(err, ErrWriteByOther))
+	held, ok := err.(*LockHeldError)
+	if assert.True(ok) && assert.NotNil(held.Owner) {
+		assert.Equal(os.Getpid(), held.Owner.PID)
+	}
+
+	// readers run unlocked
+	r, err := Open(testDB, 0755, &Options{LockMode: LockDotfile, ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(LockMechanismNone, r.LockInfo().Mechanism)
+	assert.NoError(r.Close())
+
+	// clean release
+	assert.NoError(db.Close())
+	_, err = os.Stat(testDB + dotLockSuffix)
+	assert.True(os.IsNotExist(err))
+	db, err = Open(testDB, 0755, opts)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+}
+
+func TestDotLockBreakStale(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + dotLockSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + dotLockSuffix)
+
+	assert.NoError(ioutil.WriteFile(testDB+dotLockSuffix, []byte(`{"pid":1}`), 0600))
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(os.Chtimes(testDB+dotLockSuffix, old, old))
+
+	db, err := Open(testDB, 0755, &Options{LockMode: LockDotfile, LockStaleTTL: time.Minute})
+	assert.NoError(err)
+	assert.Equal(LockMechanismDotfile, db.LockInfo().Mechanism)
+	b, err := ioutil.ReadFile(testDB + dotLockSuffix)
+	assert.NoError(err)
+	assert.Contains(string(b), `"host"`)
+	assert.NoError(db.Close())
+}
+
+func TestDotLockHeartbeat(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + dotLockSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + dotLockSuffix)
+	opts := &Options{LockMode: LockDotfile, LockStaleTTL: 300 * time.Millisecond}
+
+	db, err := Open(testDB, 0755, opts)
+	assert.NoError(err)
+	// well past the TTL, the heartbeat keeps the lock fresh
+	time.Sleep(900 * time.Millisecond)
+	asOtherProcess(db)
+	_, err = Open(testDB, 0755, opts)
+	assert.True(errors.Is(err, ErrWriteByOther))
+	assert.True(db.dotlock.held())
+	assert.NoError(db.Close())
+}
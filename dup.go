@@ -0,0 +1,205 @@
+package sidb
+
+// GetAll returns every value of key, in the order they were put, or nil if
+// the key doesn't exist or was deleted, see Options.DupKeys. Without DupKeys
+// a key has at most one. Every page that may hold key is decoded whole, as
+// a run of values may span pages.
+func (db *DB) GetAll(key []byte) ([][]byte, error) {
+	if !db.dupKeys {
+		v, err := db.Get(key)
+		if v == nil || err != nil {
+			return nil, err
+		}
+		return [][]byte{v}, nil
+	}
+	db.countGet(1)
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	kv, err := db.values(key, nil)
+	if len(kv.values) == 0 || err != nil {
+		return nil, err
+	}
+	return kv.values, nil
+}
+
+// DeleteDup deletes the newest value of key, or all of them if all is set,
+// like Delete, see Options.DupKeys. Without DupKeys it is Delete.
+func (db *DB) DeleteDup(key []byte, all bool) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	flag := KVDeleted
+	if db.dupKeys && !all {
+		flag |= KVDeleteNewest
+	}
+	return db.put(KVPair{Key: key}, flag)
+}
+
+// keyValues are the values of a key replayed from its records, see values.
+type keyValues struct {
+	values [][]byte
+	// the file offset of the record putting each value, as if its page
+	// weren't compressed, and how many fragments were appended to it since,
+	// see Append
+	pos   []int64
+	frags []int
+}
+
+// values returns the values of key in the records visible in s, or all
+// records if s is nil, in the order they were put: the records of key are
+// replayed in the order they were written, a record putting a value in place
+// of the one before, or after it in DupKeys mode, a fragment of Append
+// extending the last one, and a tombstone dropping every value before it or
+// only the last one, see KVDeleteNewest. The caller holds mmaplock.
+func (db *DB) values(key []byte, s *snapshot) (keyValues, error) {
+	var kv keyValues
+	// The index is of the latest commit, snapshots walk their own pages.
+	id, advance := db.dataStart, func(next PageId) PageId { return next }
+	if s == nil && db.indexed() {
+		var err error
+		if id, advance, err = db.candidates(key); err != nil {
+			return kv, err
+		}
+	}
+	for id != 0 {
+		p := db.page(id)
+		ok, err := db.mayContain(id, p, key)
+		if err != nil {
+			return kv, err
+		}
+		if !ok {
+			id = advance(s.next(id, p))
+			continue
+		}
+		data, next, err := db.records(s, id, p)
+		if err != nil {
+			return kv, err
+		}
+		start := db.pageOffset(id) + pageHeaderSize
+		var rec KVPair
+		var prevKey []byte
+		for off := 0; off < len(data); {
+			n, flag, err := rec.unmarshal(data[off:], prevKey, db.decompressor)
+			if err != nil {
+				return kv, corruptRecord(err, id, off)
+			}
+			if db.comparator(rec.Key, key) == 0 {
+				kv.replay(&rec, flag, start+int64(off), db.dupKeys)
+			}
+			prevKey = rec.Key
+			off += n
+		}
+		id = advance(next)
+	}
+	return kv, nil
+}
+
+// replay applies the record rec of the key, written with flag at pos, see
+// values.
+func (kv *keyValues) replay(rec *KVPair, flag KVFlag, pos int64, dupKeys bool) {
+	n := len(kv.values)
+	switch {
+	case flag&KVDeleteNewest != 0:
+		if n > 0 {
+			kv.values, kv.pos, kv.frags = kv.values[:n-1], kv.pos[:n-1], kv.frags[:n-1]
+		}
+	case flag&KVDeleted != 0:
+		kv.values, kv.pos, kv.frags = nil, nil, nil
+	case flag&KVAppended != 0 && n > 0:
+		kv.values[n-1] = append(kv.values[n-1], rec.Value...)
+		kv.frags[n-1]++
+	default:
+		if !dupKeys {
+			kv.values, kv.pos, kv.frags = kv.values[:0], kv.pos[:0], kv.frags[:0]
+		}
+		frags := 0
+		if flag&KVAppended != 0 {
+			frags = 1
+		}
+		kv.values = append(kv.values, append([]byte{}, rec.Value...))
+		kv.pos = append(kv.pos, pos)
+		kv.frags = append(kv.frags, frags)
+	}
+}
+
+// newest returns the newest value of key, as Get, see values. The caller
+// holds mmaplock.
+func (db *DB) newest(key []byte, s *snapshot) ([]byte, error) {
+	kv, err := db.values(key, s)
+	if len(kv.values) == 0 || err != nil {
+		return nil, err
+	}
+	return kv.values[len(kv.values)-1], nil
+}
+
+// NextDup moves the cursor to the next value of the key it is on, in the
+// order they were put, and returns it, see Options.DupKeys. It returns nil
+// key and value once the key has no more, leaving the cursor on it for Next
+// to move past. Without DupKeys a key has a single value.
+func (c *Cursor) NextDup() (key []byte, value []byte) {
+	if c.curID == 0 || c.dupAt+1 >= len(c.dups) {
+		return nil, nil
+	}
+	c.dupAt++
+	return c.prevKey, c.dupValue()
+}
+
+// liveDups tells live for a record of key in DupKeys mode, whether the key
+// is to be returned at the record at pos, and loads its values into c.dups if
+// so: its newest record, or in OrderedWrite mode its last value, as
+// tombstones may come after later keys. On error c.err is set.
+func (c *Cursor) liveDups(key []byte, deleted bool, pos int64) bool {
+	if !c.db.orderedWrite {
+		return c.newestOf(key, pos) && c.loadDups(key)
+	}
+	if deleted {
+		return false
+	}
+	// The values of a key were put in a row, it is looked up once.
+	if c.dupKey == nil || c.db.comparator(key, c.dupKey) != 0 {
+		if !c.loadDups(key) && c.err != nil {
+			return false
+		}
+	}
+	n := len(c.dupPos)
+	return n > 0 && c.dupPos[n-1] == pos
+}
+
+// loadDups sets c.dups to the values of key, in DupKeys mode, and reports
+// whether it has any. On error c.err is set.
+func (c *Cursor) loadDups(key []byte) bool {
+	kv, err := c.db.values(key, c.snap)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.dupKey = append(c.dupKey[:0], key...)
+	c.dups, c.dupPos, c.dupAt = kv.values, kv.pos, 0
+	return len(kv.values) > 0
+}
+
+// dupValue copies the value of c.dups the cursor is on to its value buffer
+// and returns it, nil in keysOnly mode.
+func (c *Cursor) dupValue() []byte {
+	if c.keysOnly {
+		return nil
+	}
+	c.value = append(c.value[:0], c.dups[c.dupAt]...)
+	if c.value == nil {
+		c.value = []byte{}
+	}
+	return c.value
+}
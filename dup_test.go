@@ -0,0 +1,247 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// dupValues returns the values "v-0000" to "v-<n-1>".
+func dupValues(n int) [][]byte {
+	var values [][]byte
+	for i := 0; i < n; i++ {
+		values = append(values, []byte(fmt.Sprintf("v-%04d", i)))
+	}
+	return values
+}
+
+// walkDups returns the values of every key, walking db with a cursor and
+// NextDup, and checks the cursor stops once at every key.
+func walkDups(t *testing.T, db *DB) map[string][][]byte {
+	assert := assertion.New(t)
+	got := make(map[string][][]byte)
+	c := db.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		_, seen := got[string(k)]
+		assert.False(seen, "%s", k)
+		values := [][]byte{append([]byte(nil), v...)}
+		for dk, dv := c.NextDup(); dk != nil; dk, dv = c.NextDup() {
+			assert.Equal(k, dk)
+			values = append(values, append([]byte(nil), dv...))
+		}
+		got[string(k)] = values
+	}
+	assert.NoError(c.Err())
+	return got
+}
+
+func TestDupKeys(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	compacted := testDB + ".compacted"
+	os.Remove(compacted)
+	defer os.Remove(compacted)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, DupKeys: true})
+	assert.NoError(err)
+	db.NoSync = true
+	// a log of 3000 values, by Put and PutBatch, between other keys
+	log := []byte("log")
+	values := dupValues(3000)
+	for i := 0; i < 3000; i += 100 {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k-%02d", i/100)), []byte("x")))
+		var pairs []KVPair
+		for _, v := range values[i+50 : i+100] {
+			pairs = append(pairs, KVPair{Key: log, Value: v})
+		}
+		for _, v := range values[i : i+50] {
+			assert.NoError(db.Put(log, v))
+		}
+		assert.NoError(db.PutBatch(pairs))
+	}
+	assert.True(db.head.PageCount > 50)
+	assert.True(db.indexed())
+
+	check := func(db *DB, want [][]byte) {
+		got, err := db.GetAll(log)
+		assert.NoError(err)
+		assert.Equal(want, got)
+		v, err := db.Get(log)
+		assert.NoError(err)
+		buf, err := db.GetTo(log, []byte("buf:"))
+		assert.NoError(err)
+		many, err := db.GetMany([][]byte{log, []byte("k-00")})
+		assert.NoError(err)
+		r, size, rerr := db.GetReader(log)
+		if len(want) == 0 {
+			assert.Nil(v)
+			assert.Nil(buf)
+			assert.Equal([][]byte{nil, []byte("x")}, many)
+			assert.Equal(ErrKeyNotFound, rerr)
+			assert.NotContains(walkDups(t, db), "log")
+			return
+		}
+		newest := want[len(want)-1]
+		assert.Equal(newest, v)
+		assert.Equal("buf:"+string(newest), string(buf))
+		assert.Equal([][]byte{newest, []byte("x")}, many)
+		if assert.NoError(rerr) {
+			b, err := ioutil.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(newest, b)
+			assert.Equal(int64(len(newest)), size)
+		}
+		walked := walkDups(t, db)
+		assert.Len(walked, 31)
+		assert.Equal(want, walked["log"])
+		assert.Equal([][]byte{[]byte("x")}, walked["k-29"])
+	}
+	check(db, values)
+	n, err := db.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(3030), n)
+
+	// the newest, then all
+	assert.NoError(db.DeleteDup(log, false))
+	assert.NoError(db.DeleteDup(log, false))
+	check(db, values[:2998])
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	assert.NoError(db.DeleteDup(log, true))
+	check(db, nil)
+	assert.NoError(db.Put(log, []byte("again")))
+	check(db, [][]byte{[]byte("again")})
+	assert.NoError(db.DeleteDup([]byte("k-00"), false))
+	v, err := db.Get([]byte("k-00"))
+	assert.NoError(err)
+	assert.Nil(v)
+	assert.NoError(db.Put([]byte("k-00"), []byte("x")))
+	assert.NoError(db.Delete(log))
+	check(db, nil)
+	assert.NoError(db.PutBatch([]KVPair{{Key: log, Value: values[0]}, {Key: log, Value: values[1]}, {Key: log, Value: values[2]}}))
+	assert.NoError(db.DeleteDup(log, false))
+	check(db, values[:2])
+	// the snapshot of before
+	v, err = tx.Get(log)
+	assert.NoError(err)
+	assert.Equal(values[2997], v)
+	assert.NoError(tx.Rollback())
+
+	// kept by the file, compacted and salvaged with their values
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.True(db.dupKeys)
+	check(db, values[:2])
+	assert.Empty(checkErrors(db))
+	assert.NoError(db.Compact(compacted, &Options{PageSize: 1024}))
+	assert.NoError(db.Close())
+	for _, copy := range []func() error{
+		func() error { return nil },
+		func() error {
+			os.Remove(testDB)
+			_, err := Salvage(compacted, testDB, nil)
+			return err
+		},
+	} {
+		assert.NoError(copy())
+		c, err := Open(testDB, 0755, nil)
+		assert.NoError(err)
+		assert.True(c.dupKeys)
+		check(c, values[:2])
+		assert.Empty(checkErrors(c))
+		assert.NoError(c.Close())
+	}
+	c, err := Open(compacted, 0755, nil)
+	assert.NoError(err)
+	check(c, values[:2])
+	n, err = c.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(32), n)
+	assert.NoError(c.Close())
+}
+
+func TestDupKeysOrdered(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// runs of values crossing pages, in sorted pages
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, DupKeys: true, OrderedWrite: true, BloomBitsPerKey: 10})
+	assert.NoError(err)
+	values := dupValues(2000)
+	want := map[string][][]byte{"a": values[:1], "b": values[:1000], "c": values, "d": values[:1]}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		var pairs []KVPair
+		for _, v := range want[k] {
+			pairs = append(pairs, KVPair{Key: []byte(k), Value: v})
+		}
+		assert.NoError(db.PutBatch(pairs))
+	}
+	assert.True(errors.Is(db.Put([]byte("c"), []byte("late")), ErrKeyOutOfOrder))
+	assert.NoError(db.Put([]byte("d"), values[1]))
+	want["d"] = values[:2]
+	assert.NoError(db.DeleteDup([]byte("c"), false))
+	want["c"] = values[:1999]
+	assert.True(db.indexed())
+	assert.Equal(want, walkDups(t, db))
+	for k, values := range want {
+		got, err := db.GetAll([]byte(k))
+		assert.NoError(err)
+		assert.Equal(values, got, k)
+	}
+	c := db.Cursor()
+	k, v := c.Seek([]byte("b"))
+	assert.Equal("b", string(k))
+	assert.Equal(values[0], v)
+	k, v = c.NextDup()
+	assert.Equal("b", string(k))
+	assert.Equal(values[1], v)
+	k, v = c.Next()
+	assert.Equal("c", string(k))
+	assert.Equal(values[0], v)
+	k, v = c.Last()
+	assert.Equal("d", string(k))
+	assert.Equal(values[0], v)
+	k, _ = c.Prev()
+	assert.Equal("c", string(k))
+	_, v = c.NextDup()
+	assert.Equal(values[1], v)
+	assert.NoError(c.Err())
+	// c is found in order, before its tombstone
+	var keys []string
+	assert.NoError(db.Range([]byte("b"), []byte("d"), func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	assert.Equal([]string{"b", "c"}, keys)
+	n, err := db.DeleteRange([]byte("b"), []byte("d"))
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.Equal(map[string][][]byte{"a": values[:1], "d": values[:2]}, walkDups(t, db))
+	assert.Empty(checkErrors(db))
+	assert.NoError(db.Close())
+
+	// without DupKeys a key has one value
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("a"), []byte("1")))
+	assert.NoError(db.Put([]byte("a"), []byte("2")))
+	got, err := db.GetAll([]byte("a"))
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("2")}, got)
+	c = db.Cursor()
+	c.First()
+	k, _ = c.NextDup()
+	assert.Nil(k)
+	assert.NoError(db.DeleteDup([]byte("a"), false))
+	got, err = db.GetAll([]byte("a"))
+	assert.NoError(err)
+	assert.Nil(got)
+	assert.NoError(db.Close())
+}
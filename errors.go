@@ -0,0 +1,162 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// ErrMapTooLarge is returned when the database would need a mapping larger
+// than the platform supports.
+var ErrMapTooLarge = errors.New("mmap too large for this platform")
+
+// ErrNotInitialized is returned when opening a file that is empty or too
+// small to hold the head pages. sidb only initializes files it creates.
+var ErrNotInitialized = errors.New("database file not initialized")
+
+// ErrIncompleteInit is returned by a read-write Open of a file that holds
+// some data but not a complete head. It is not initialized again, since it may
+// not be a sidb file at all.
+var ErrIncompleteInit = errors.New("database file incompletely initialized")
+
+// ErrInvalidPageSize is returned by Open when Options.PageSize, or the page
+// size in the head page of the file, isn't a power of two from 512 bytes to
+// 64KB.
+var ErrInvalidPageSize = errors.New("invalid page size")
+
+// ErrUnknownCompression is returned by Open when Options.Compression, or the
+// algorithm recorded in the head, isn't registered, see RegisterCompressor.
+var ErrUnknownCompression = errors.New("unknown compression algorithm")
+
+// ErrInvalidCompressionLevel is returned by Open when Options.CompressionLevel
+// is out of range, or set for an algorithm without levels.
+var ErrInvalidCompressionLevel = errors.New("invalid compression level")
+
+// ErrUnknownChecksum is returned by Open when Options.ChecksumAlgo, or the
+// algorithm recorded in the head, isn't known.
+var ErrUnknownChecksum = errors.New("unknown checksum algorithm")
+
+// ErrCompressionMismatch is returned by Open with Options.StrictOptions when
+// the database was created with other compression options.
+var ErrCompressionMismatch = errors.New("compression mismatch")
+
+// ErrDatabaseReadOnly is returned when writing through a read-only handle.
+var ErrDatabaseReadOnly = errors.New("database is in read-only mode")
+
+// ErrDatabaseFull is returned when the database can't grow any further
+// without overflowing page ids or the mmap.
+var ErrDatabaseFull = errors.New("database is full")
+
+// ErrDatabaseNotOpen is returned when using a database that is not open.
+var ErrDatabaseNotOpen = errors.New("database not open")
+
+// ErrTxClosed is returned when using a transaction that was committed or
+// rolled back.
+var ErrTxClosed = errors.New("tx closed")
+
+// ErrTxNotWritable is returned when writing through a read-only transaction.
+var ErrTxNotWritable = errors.New("tx not writable")
+
+// ErrKeyRequired is returned when writing an empty key.
+var ErrKeyRequired = errors.New("key required")
+
+// ErrKeyNotFound is returned by GetReader for a key that doesn't exist or was
+// deleted.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyOutOfOrder is returned by Put in OrderedWrite mode when the key sorts
+// before the last key written.
+var ErrKeyOutOfOrder = errors.New("key out of order")
+
+// ErrNotACounter is returned by Increment when the value of the key isn't a
+// counter, an 8-byte integer.
+var ErrNotACounter = errors.New("value is not a counter")
+
+// ErrCounterOverflow is returned by Increment when the total would be out of
+// the int64 range.
+var ErrCounterOverflow = errors.New("counter overflow")
+
+// ErrBadMagic is returned by Open when the head pages don't start with Magic,
+// as in a file that isn't a sidb database.
+var ErrBadMagic = errors.New("wrong magic")
+
+// ErrVersionMismatch is returned by Open when the head page has a version
+// this sidb can't read.
+type ErrVersionMismatch struct {
+	Got, Want uint16
+}
+
+func (e *ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("invalid version %d, want %d", e.Got, e.Want)
+}
+
+// ErrCorrupt is returned when a page doesn't decode: Offset is where in page
+// Page, in the records as decompressed for PageCompressed pages. Records
+// decoded on their own, by KVPair.Unmarshal, have no page, and the offset is
+// in the data decoded.
+type ErrCorrupt struct {
+	Page   PageId
+	Offset PageSz
+	Reason string
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("corrupt page %d at offset %d: %s", e.Page, e.Offset, e.Reason)
+}
+
+// corruptPage returns an ErrCorrupt of page id at offset off.
+func corruptPage(id PageId, off int, format string, args ...interface{}) error {
+	return &ErrCorrupt{Page: id, Offset: PageSz(off), Reason: fmt.Sprintf(format, args...)}
+}
+
+// corruptRecord returns err, that of decoding the record at offset off of the
+// records of page id, placed in the page if it is an ErrCorrupt.
+func corruptRecord(err error, id PageId, off int) error {
+	var c *ErrCorrupt
+	if errors.As(err, &c) && c.Page == 0 {
+		c.Page, c.Offset = id, c.Offset+PageSz(pageHeaderSize+off)
+	}
+	return err
+}
+
+// ErrChecksum is returned when the records of a page don't match the checksum
+// in its header, see Options.VerifyChecksums.
+type ErrChecksum struct {
+	Page PageId
+}
+
+func (e *ErrChecksum) Error() string {
+	return fmt.Sprintf("checksum mismatch on page %d", e.Page)
+}
+
+// ErrTruncated is returned by Open when the file is shorter than the pages
+// counted by its head, as after an incomplete copy.
+type ErrTruncated struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *ErrTruncated) Error() string {
+	return fmt.Sprintf("database file truncated to %d bytes, its pages take %d", e.Actual, e.Expected)
+}
+
+// ErrAllocTooLarge is returned when more contiguous pages are asked for than
+// a slice of the mapping can hold, see maxAllocSize.
+type ErrAllocTooLarge struct {
+	Count int
+	Max   int
+}
+
+func (e *ErrAllocTooLarge) Error() string {
+	return fmt.Sprintf("allocation of %d contiguous pages exceeds %d", e.Count, e.Max)
+}
+
+// ErrReaderTooLarge is returned by GetReader for a compressed value larger
+// than DB.MaxReaderBuffer once decompressed, which it can't stream.
+type ErrReaderTooLarge struct {
+	Size int64
+	Max  int64
+}
+
+func (e *ErrReaderTooLarge) Error() string {
+	return fmt.Sprintf("compressed value of %d bytes exceeds the reader buffer of %d", e.Size, e.Max)
+}
@@ -0,0 +1,353 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// faultMode is what a write going past the budget of faults does.
+type faultMode uint8
+
+const (
+	// nothing is written, the write fails
+	faultFail faultMode = iota
+	// what the budget allows is written, the write fails short
+	faultShort
+	// what the budget allows is written and the write succeeds, as do later
+	// ones without writing anything, as if the machine had crashed
+	faultTorn
+)
+
+// faults wraps the writes and syncs of a database to fail them, and logs the
+// writes done for crashImage, see injectFaults.
+type faults struct {
+	writeAt func(b []byte, off int64) (int, error)
+	sync    func() error
+	// bytes written before writes fail with err, no limit if <0
+	budget int64
+	err    error
+	mode   faultMode
+	// error syncs fail with, if set
+	syncErr error
+	log     []faultWrite
+	// len(log) at every sync that went through
+	synced  []int
+	written int64
+}
+
+type faultWrite struct {
+	off int64
+	b   []byte
+}
+
+// injectFaults wraps the writes and syncs of db, which don't fail until told
+// to.
+func injectFaults(db *DB) *faults {
+	f := &faults{writeAt: db.ops.writeAt, sync: db.ops.sync, budget: -1}
+	db.ops.writeAt = f.write
+	db.ops.sync = f.doSync
+	return f
+}
+
+func (f *faults) write(b []byte, off int64) (int, error) {
+	n := len(b)
+	if f.budget >= 0 && int64(n) > f.budget {
+		n = int(f.budget)
+		if f.mode == faultFail {
+			n = 0
+		}
+	}
+	if n > 0 {
+		if _, err := f.writeAt(b[:n], off); err != nil {
+			return 0, err
+		}
+		f.log = append(f.log, faultWrite{off: off, b: append([]byte(nil), b[:n]...)})
+		f.written += int64(n)
+	}
+	if f.budget >= 0 {
+		f.budget -= int64(n)
+	}
+	switch {
+	case n == len(b):
+		return n, nil
+	case f.mode == faultTorn:
+		return len(b), nil
+	case f.mode == faultShort:
+		return n, f.err
+	}
+	return 0, f.err
+}
+
+func (f *faults) doSync() error {
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	if f.mode == faultTorn && f.budget == 0 {
+		// crashed
+		return nil
+	}
+	if err := f.sync(); err != nil {
+		return err
+	}
+	f.synced = append(f.synced, len(f.log))
+	return nil
+}
+
+// crashImage returns the file as it would be after a crash once n bytes of
+// the logged writes reached it, in order, over base, the file before.
+func (f *faults) crashImage(base []byte, n int64) []byte {
+	img := append([]byte(nil), base...)
+	for _, w := range f.log {
+		if n <= 0 {
+			break
+		}
+		b := w.b
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		if end := int(w.off) + len(b); end > len(img) {
+			img = append(img, make([]byte, end-len(img))...)
+		}
+		copy(img[w.off:], b)
+		n -= int64(len(b))
+	}
+	return img
+}
+
+// crashImageReordered is crashImage for a disk that reorders the writes
+// between syncs: those logged before the last sync preceding the crash, n
+// bytes into the log, are on disk, each later one may or may not be, and the
+// one n cuts may be in part.
+func (f *faults) crashImageReordered(base []byte, n int64, rnd *rand.Rand) []byte {
+	img := append([]byte(nil), base...)
+	apply := func(w faultWrite) {
+		if end := int(w.off) + len(w.b); end > len(img) {
+			img = append(img, make([]byte, end-len(img))...)
+		}
+		copy(img[w.off:], w.b)
+	}
+	// the writes done in full by n, and the bytes of the next one
+	cut := 0
+	for ; cut < len(f.log) && n >= int64(len(f.log[cut].b)); cut++ {
+		n -= int64(len(f.log[cut].b))
+	}
+	barrier := 0
+	for _, s := range f.synced {
+		if s <= cut {
+			barrier = s
+		}
+	}
+	for i, w := range f.log[:cut] {
+		if i < barrier || rnd.Intn(2) == 0 {
+			apply(w)
+		}
+	}
+	if cut < len(f.log) && n > 0 && rnd.Intn(2) == 0 {
+		w := f.log[cut]
+		apply(faultWrite{off: w.off, b: w.b[:n]})
+	}
+	return img
+}
+
+// dbState returns the live records of db.
+func dbState(db *DB) (map[string]string, error) {
+	state := make(map[string]string)
+	err := db.ForEach(func(k, v []byte) error {
+		state[string(k)] = string(v)
+		return nil
+	})
+	return state, err
+}
+
+func TestFaults(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	for i := 0; i < 20; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	want, err := dbState(db)
+	assert.NoError(err)
+	f := injectFaults(db)
+	big := bytes.Repeat([]byte("big value "), 200)
+
+	// the disk fills up, in the middle of a page and before anything
+	f.budget, f.err, f.mode = 100, syscall.ENOSPC, faultShort
+	assert.Equal(syscall.ENOSPC, errors.Cause(db.Put([]byte("big"), big)))
+	f.budget, f.mode = 0, faultFail
+	assert.Equal(syscall.ENOSPC, errors.Cause(db.Put([]byte("small"), []byte("value"))))
+	var pairs []KVPair
+	for i := 100; i < 200; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte("batch")})
+	}
+	f.budget = 700
+	assert.Equal(syscall.ENOSPC, errors.Cause(db.PutBatch(pairs)))
+	state, err := dbState(db)
+	assert.NoError(err)
+	assert.Equal(want, state)
+
+	// once there is room again
+	f.budget = -1
+	assert.NoError(db.Put([]byte("small"), []byte("value")))
+	want["small"] = "value"
+
+	// a sync failing fails the commit, which may be on disk all the same
+	f.syncErr = errors.New("sync failed")
+	assert.Equal(f.syncErr, db.Put([]byte("unsynced"), []byte("value")))
+	f.syncErr = nil
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Empty(checkErrors(db))
+	state, err = dbState(db)
+	assert.NoError(err)
+	delete(state, "unsynced")
+	assert.Equal(want, state)
+
+	// the machine crashes in the middle of a page of a batch, the batch is
+	// lost whole
+	f = injectFaults(db)
+	f.budget, f.mode = 1000, faultTorn
+	assert.NoError(db.PutBatch(pairs))
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Empty(checkErrors(db))
+	state, err = dbState(db)
+	assert.NoError(err)
+	delete(state, "unsynced")
+	assert.Equal(want, state)
+	assert.NoError(db.Close())
+}
+
+// TestCrashConsistency cuts the writes of a series of commits at random bytes
+// and checks the file then opens with the records of the last commit whose
+// head was written in full, or of the one before while it is being written,
+// or fails to open, but never opens with anything else. The writes since the
+// last sync are replayed in order, and then as a disk reordering them could
+// have left them.
+func TestCrashConsistency(t *testing.T) {
+	assert := assertion.New(t)
+	img := testDB + ".crash"
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	defer os.Remove(img)
+
+	// the file grows with the writes, there are no truncates to replay
+	opts := &Options{PageSize: 512, NoGrowSync: true}
+	db, err := Open(testDB, 0755, opts)
+	assert.NoError(err)
+	for i := 0; i < 50; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Close())
+	base, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+
+	db, err = Open(testDB, 0755, opts)
+	assert.NoError(err)
+	f := injectFaults(db)
+	big := bytes.Repeat([]byte("big value "), 200)
+	ops := []func() error{
+		func() error { return db.Put([]byte("new"), []byte("value")) },
+		func() error {
+			var pairs []KVPair
+			for i := 100; i < 200; i++ {
+				pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte(fmt.Sprintf("batch-%d", i))})
+			}
+			return db.PutBatch(pairs)
+		},
+		func() error { return db.Delete([]byte("key-0003")) },
+		func() error { return db.Put([]byte("big"), big) },
+		func() error {
+			return db.Update(func(tx *Tx) error {
+				for i := 0; i < 20; i++ {
+					if err := tx.Put([]byte(fmt.Sprintf("tx-%04d", i)), big[:i*20]); err != nil {
+						return err
+					}
+				}
+				return tx.Delete([]byte("key-0150"))
+			})
+		},
+		func() error { return db.Put([]byte("key-0010"), []byte("overwritten")) },
+		db.Close,
+	}
+	states := make([]map[string]string, 1, len(ops)+1)
+	states[0], err = dbState(db)
+	assert.NoError(err)
+	// bytes written by the end of every op
+	ends := []int64{0}
+	for _, op := range ops {
+		assert.NoError(op())
+		if db.opened {
+			state, err := dbState(db)
+			assert.NoError(err)
+			states = append(states, state)
+		} else {
+			states = append(states, states[len(states)-1])
+		}
+		ends = append(ends, f.written)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var cuts []int64
+	for _, end := range ends {
+		for d := int64(-2); d <= 2; d++ {
+			if end+d >= 0 && end+d <= f.written {
+				cuts = append(cuts, end+d)
+			}
+		}
+	}
+	for i := 0; i < 300; i++ {
+		cuts = append(cuts, rnd.Int63n(f.written+1))
+	}
+	opened := 0
+	images := 0
+	for _, n := range cuts {
+		// the op the cut falls in, or the last one whose writes it ends
+		j := sort.Search(len(ends), func(i int) bool { return ends[i] >= n })
+		imgs := [][]byte{f.crashImage(base, n)}
+		for k := 0; k < 3; k++ {
+			imgs = append(imgs, f.crashImageReordered(base, n, rnd))
+		}
+		for k, b := range imgs {
+			images++
+			assert.NoError(ioutil.WriteFile(img, b, 0755))
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("cut at %d of %d, image %d: panic: %v", n, f.written, k, r)
+					}
+				}()
+				c, err := Open(img, 0755, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				opened++
+				assert.Empty(checkErrors(c), "cut at %d, image %d", n, k)
+				state, err := dbState(c)
+				assert.NoError(err, "cut at %d, image %d", n, k)
+				if ends[j] == n {
+					assert.Equal(states[j], state, "cut at %d, the end of op %d, image %d", n, j, k)
+				} else if !assertion.ObjectsAreEqual(states[j], state) {
+					assert.Equal(states[j-1], state, "cut at %d, in op %d, image %d", n, j, k)
+				}
+			}()
+		}
+	}
+	// dual heads keep the previous commit valid whatever is cut
+	assert.Equal(images, opened)
+}
@@ -0,0 +1,149 @@
+package sidb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Features lists the optional on-disk features a database uses, in three
+// masks telling what a binary must understand to use the file, like ext4's
+// incompat, ro_compat and compat masks.
+type Features struct {
+	// Required features must be known to read the file at all.
+	Required uint32
+	// WriteRequired features must be known to modify the file. A file with
+	// unknown ones can still be opened read-only.
+	WriteRequired uint32
+	// Optional features can be ignored by binaries that don't know them.
+	Optional uint32
+}
+
+// Required features.
+const (
+	// keys are ordered by a comparator other than BytesComparator
+	FeatureComparator uint32 = 1 << iota
+	// pages 0 and 1 are both head pages, written alternately, and data
+	// starts at page 2
+	FeatureDualHead
+	// data pages may have their records compressed together, see
+	// Options.PageCompression
+	FeaturePageCompression
+	// checksums aren't crc32 IEEE, see Options.ChecksumAlgo
+	FeatureChecksumAlgo
+	// a key keeps every value put, see Options.DupKeys, and tombstones may
+	// delete only the newest, see KVDeleteNewest
+	FeatureDupKeys
+	// records may hold a fragment of the value of their key, see
+	// KVAppended, set by the first commit writing one
+	FeatureAppend
+)
+
+// Write-required features.
+const (
+	// data pages carry the checksum of their records, see
+	// Options.VerifyChecksums
+	FeaturePageChecksums uint32 = 1 << iota
+	// every data page is in the page index, binaries that don't keep it
+	// mustn't write
+	FeaturePageIndex
+	// keys were put in order, see Options.OrderedWrite, binaries that don't
+	// keep it mustn't write
+	FeatureOrderedWrite
+)
+
+// Optional features.
+const (
+	// the head page carries a commit generation, see DB.Generation
+	FeatureGeneration uint32 = 1 << iota
+)
+
+var (
+	requiredFeatureNames      = []string{"comparator", "dual-head", "page-compression", "checksum-algo", "dup-keys", "append"}
+	writeRequiredFeatureNames = []string{"page-checksums", "page-index", "ordered-write"}
+	optionalFeatureNames      = []string{"generation"}
+)
+
+// knownFeatures are the features this binary understands.
+var knownFeatures = Features{
+	Required:      featureMask(requiredFeatureNames),
+	WriteRequired: featureMask(writeRequiredFeatureNames),
+	Optional:      featureMask(optionalFeatureNames),
+}
+
+func featureMask(names []string) uint32 {
+	return 1<<uint(len(names)) - 1
+}
+
+// featureList names the bits of mask, unknown ones as "bit N".
+func featureList(mask uint32, names []string) []string {
+	var list []string
+	for i := uint(0); i < 32; i++ {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		if int(i) < len(names) {
+			list = append(list, names[i])
+		} else {
+			list = append(list, fmt.Sprintf("bit %d", i))
+		}
+	}
+	return list
+}
+
+func (f Features) String() string {
+	return fmt.Sprintf("required: [%s], write-required: [%s], optional: [%s]",
+		strings.Join(featureList(f.Required, requiredFeatureNames), " "),
+		strings.Join(featureList(f.WriteRequired, writeRequiredFeatureNames), " "),
+		strings.Join(featureList(f.Optional, optionalFeatureNames), " "))
+}
+
+// unknown returns the features of f this binary doesn't know.
+func (f Features) unknown() Features {
+	return Features{
+		Required:      f.Required &^ knownFeatures.Required,
+		WriteRequired: f.WriteRequired &^ knownFeatures.WriteRequired,
+		Optional:      f.Optional &^ knownFeatures.Optional,
+	}
+}
+
+// IncompatibilityError is returned by Open when the database uses features
+// this binary doesn't know. ReadOnly is set if only write-required features
+// are unknown, in which case a read-only Open succeeds.
+type IncompatibilityError struct {
+	Unknown  Features
+	ReadOnly bool
+}
+
+func (e *IncompatibilityError) Error() string {
+	var parts []string
+	if e.Unknown.Required != 0 {
+		parts = append(parts, "required "+strings.Join(featureList(e.Unknown.Required, nil), ", "))
+	}
+	if e.Unknown.WriteRequired != 0 {
+		parts = append(parts, "write-required "+strings.Join(featureList(e.Unknown.WriteRequired, nil), ", "))
+	}
+	msg := "unknown database features: " + strings.Join(parts, "; ")
+	if e.ReadOnly {
+		msg += " (can be opened read-only)"
+	}
+	return msg
+}
+
+// checkFeatures fails if the database uses features this binary can't handle
+// in the mode it was opened in.
+func (h *HeadPage) checkFeatures(readOnly bool) error {
+	unknown := h.Features.unknown()
+	if unknown.Required == 0 && (unknown.WriteRequired == 0 || readOnly) {
+		return nil
+	}
+	return &IncompatibilityError{Unknown: unknown, ReadOnly: unknown.Required == 0}
+}
+
+// Features returns the on-disk features used by the database.
+func (db *DB) Features() Features {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	db.headlock.Lock()
+	defer db.headlock.Unlock()
+	return db.head.Features
+}
@@ -0,0 +1,111 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// setFeatures overwrites the feature masks of both heads of the database at
+// path.
+func setFeatures(t *testing.T, path string, f Features) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	buf := make([]byte, headPageSize)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	page := make([]byte, headPageDecode(buf).PageSize)
+	for id := int64(0); id < 2; id++ {
+		off := id * int64(len(page))
+		if _, err := file.ReadAt(page, off); err != nil {
+			t.Fatal(err)
+		}
+		h := headPageDecode(page)
+		h.Features = f
+		h.Checksum = headPageChecksum(page, &h)
+		headPageEncode(page, &h)
+		if _, err := file.WriteAt(page[:headPageSize], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Equal(Features{Required: FeatureDualHead, WriteRequired: FeaturePageChecksums | FeaturePageIndex, Optional: FeatureGeneration}, db.Features())
+	assert.Equal("required: [dual-head], write-required: [page-checksums page-index], optional: [generation]", db.Features().String())
+	assert.NoError(db.Close())
+	os.Remove(testDB)
+
+	db, err = Open(testDB, 0755, &Options{Comparator: uint64Comparator})
+	assert.NoError(err)
+	assert.Equal(FeatureComparator|FeatureDualHead, db.Features().Required)
+	assert.NoError(db.Close())
+	os.Remove(testDB)
+
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.Equal(FeaturePageChecksums|FeaturePageIndex|FeatureOrderedWrite, db.Features().WriteRequired)
+	assert.Contains(db.Features().String(), "write-required: [page-checksums page-index ordered-write]")
+	assert.NoError(db.Close())
+	os.Remove(testDB)
+
+	db, err = Open(testDB, 0755, &Options{DupKeys: true})
+	assert.NoError(err)
+	assert.Equal(FeatureDualHead|FeatureDupKeys, db.Features().Required)
+	assert.Contains(db.Features().String(), "required: [dual-head dup-keys]")
+	assert.NoError(db.Close())
+}
+
+func TestFeaturesUnknown(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	const unknownBit = 1 << 31
+	for i := 0; i < 8; i++ {
+		f := Features{Required: FeatureDualHead, Optional: FeatureGeneration}
+		if i&1 != 0 {
+			f.Optional |= unknownBit
+		}
+		if i&2 != 0 {
+			f.WriteRequired |= unknownBit
+		}
+		if i&4 != 0 {
+			f.Required |= unknownBit
+		}
+		setFeatures(t, testDB, f)
+
+		for _, readOnly := range []bool{false, true} {
+			db, err := Open(testDB, 0755, &Options{ReadOnly: readOnly})
+			ok := f.Required&unknownBit == 0 && (f.WriteRequired == 0 || readOnly)
+			if ok {
+				if assert.NoError(err, "%s, read-only %v", f, readOnly) {
+					assert.Equal(f, db.Features())
+					assert.NoError(db.Close())
+				}
+				continue
+			}
+			var incompat *IncompatibilityError
+			if assert.True(errors.As(err, &incompat), "%s, read-only %v", f, readOnly) {
+				assert.Equal(f.Required&unknownBit, incompat.Unknown.Required)
+				assert.Equal(f.WriteRequired, incompat.Unknown.WriteRequired)
+				assert.Equal(f.Required&unknownBit == 0, incompat.ReadOnly)
+				assert.Contains(err.Error(), "bit 31")
+			}
+		}
+	}
+}
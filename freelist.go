@@ -0,0 +1,272 @@
+package sidb
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// The freelist keeps pages that are allocated in the file but hold nothing
+// reachable, so that allocate hands them out again before growing the file.
+//
+// In memory it is db.freelist, sorted. On disk it is a chain of PageFree pages
+// starting at head.freelist, each listing page ids after its header, written
+// by Close. A listed page may be reused only once no committed head points at
+// the list anymore, so the first commit reusing one drops head.freelist, and
+// the pages holding the list are kept apart in db.freelistPages until the
+// next list, not stored in them, is committed.
+
+// freeIdSize is the size of a page id in a freelist page.
+const freeIdSize = 4
+
+// freeIdsPerPage returns how many page ids a freelist page holds.
+func (db *DB) freeIdsPerPage() int {
+	return (db.pageSize - pageHeaderSize) / freeIdSize
+}
+
+// loadFreelist reads the freelist the head points at, on Open.
+func (db *DB) loadFreelist() error {
+	db.freelist = db.freelist[:0]
+	db.freelistPages = db.freelistPages[:0]
+	db.freelistDirty = false
+	count := db.head.PageCount
+	// where id comes from
+	from, fromOff := db.headId, freelistOffset
+	for id := db.head.freelist; id != 0; {
+		if id < 2 || id >= count || len(db.freelistPages) >= int(count) {
+			return corruptPage(from, fromOff, "invalid freelist page %d", id)
+		}
+		p := db.page(id)
+		if p.Flag&PageFree == 0 {
+			return corruptPage(id, 0, "not a freelist page, flags %#x", p.Flag)
+		}
+		if err := db.verifyPage(id, p); err != nil {
+			return err
+		}
+		if int(p.Count) > db.freeIdsPerPage() {
+			return corruptPage(id, pageCountOffset, "freelist page lists %d pages", p.Count)
+		}
+		start := int(db.pageOffset(id)) + pageHeaderSize
+		data := db.dataSlice(start, start+int(p.Count)*freeIdSize)
+		for i := 0; i < len(data); i += freeIdSize {
+			free := PageId(binary.LittleEndian.Uint32(data[i:]))
+			if free < 2 || free >= count {
+				return corruptPage(id, pageHeaderSize+i, "freelist page lists invalid page %d", free)
+			}
+			db.freelist = append(db.freelist, free)
+		}
+		db.freelistPages = append(db.freelistPages, id)
+		from, fromOff = id, pageNextOffset
+		id = p.Next
+	}
+	if len(db.freelist) != int(db.head.freeCount) {
+		return corruptPage(db.headId, freeCountOffset, "freelist lists %d pages, head says %d", len(db.freelist), db.head.freeCount)
+	}
+	sort.Slice(db.freelist, func(i, j int) bool { return db.freelist[i] < db.freelist[j] })
+	return nil
+}
+
+// free adds page id to the freelist. Nothing may reach the page anymore,
+// including open read-only transactions, pages they may still read go through
+// freeLater. The caller holds rwlock.
+func (db *DB) free(id PageId) {
+	i := sort.Search(len(db.freelist), func(i int) bool { return db.freelist[i] >= id })
+	if i < len(db.freelist) && db.freelist[i] == id {
+		return
+	}
+	db.freelist = append(db.freelist, 0)
+	copy(db.freelist[i+1:], db.freelist[i:])
+	db.freelist[i] = id
+	db.freelistDirty = true
+	db.pageCache.remove(id)
+}
+
+// freeLater frees pages that the head of generation gen no longer reaches,
+// once no read-only transaction reads an older head, see releasePending. The
+// caller holds rwlock.
+func (db *DB) freeLater(gen uint64, ids []PageId) {
+	if len(ids) == 0 {
+		return
+	}
+	if db.pending == nil {
+		db.pending = make(map[uint64][]PageId)
+	}
+	db.pending[gen] = append(db.pending[gen], ids...)
+	db.releasePending(db.oldestTx())
+}
+
+// releasePending frees the pages of freeLater that no read-only transaction
+// reading the head of generation oldest or later can reach. Commits call it
+// before saving the freelist they restore on failure. The caller holds rwlock.
+func (db *DB) releasePending(oldest uint64) {
+	for gen, ids := range db.pending {
+		if oldest < gen {
+			continue
+		}
+		for _, id := range ids {
+			db.free(id)
+		}
+		delete(db.pending, gen)
+	}
+}
+
+// oldestTx returns the generation of the oldest head an open read-only
+// transaction reads, or the maximum if there is none.
+func (db *DB) oldestTx() uint64 {
+	db.txlock.Lock()
+	defer db.txlock.Unlock()
+	oldest := ^uint64(0)
+	for _, gen := range db.txs {
+		if gen < oldest {
+			oldest = gen
+		}
+	}
+	return oldest
+}
+
+// allocate returns a page for the commit of head in progress: the lowest free
+// page, or a new one at the end of the file. Its header is left to the caller.
+// The caller holds rwlock.
+func (db *DB) allocate(head *HeadPage) (PageId, error) {
+	if len(db.freelist) == 0 {
+		return db.allocateEnd(head, 1)
+	}
+	id := db.freelist[0]
+	db.freelist = db.freelist[1:]
+	db.freelistDirty = true
+	db.pageCache.remove(id)
+	// The list on disk goes with this commit.
+	head.freelist = 0
+	head.freeCount = 0
+	db.txStats.PageAlloc++
+	return id, nil
+}
+
+// allocateRun returns the first of count contiguous pages for the commit of
+// head in progress, read back as a single slice of the mapping: the lowest run
+// of free pages, or new pages at the end of the file. As with allocate,
+// head.PageCount is published with the head, under headlock, see flushHead.
+// The caller holds rwlock.
+func (db *DB) allocateRun(head *HeadPage, count int) (PageId, error) {
+	if max := maxAllocSize / db.pageSize; count > max {
+		return 0, &ErrAllocTooLarge{Count: count, Max: max}
+	}
+	if count == 1 {
+		return db.allocate(head)
+	}
+	// The list is sorted without duplicates, count ids spanning count pages
+	// are a run.
+	for i := 0; i+count <= len(db.freelist); i++ {
+		id := db.freelist[i]
+		if db.freelist[i+count-1]-id != PageId(count-1) {
+			continue
+		}
+		// A new list, the old one is restored if the commit fails.
+		rest := make([]PageId, 0, len(db.freelist)-count)
+		rest = append(append(rest, db.freelist[:i]...), db.freelist[i+count:]...)
+		for _, used := range db.freelist[i : i+count] {
+			db.pageCache.remove(used)
+		}
+		db.freelist = rest
+		db.freelistDirty = true
+		head.freelist = 0
+		head.freeCount = 0
+		db.txStats.PageAlloc += int64(count)
+		return id, nil
+	}
+	return db.allocateEnd(head, count)
+}
+
+// allocateEnd returns the first of count new pages at the end of the file,
+// growing it as needed.
+func (db *DB) allocateEnd(head *HeadPage, count int) (PageId, error) {
+	id := head.PageCount
+	if err := db.checkPageCount(int64(id) + int64(count)); err != nil {
+		return 0, err
+	}
+	if err := db.grow((int64(id) + int64(count)) * int64(db.pageSize)); err != nil {
+		return 0, err
+	}
+	head.PageCount += PageId(count)
+	db.txStats.PageAlloc += int64(count)
+	return id, nil
+}
+
+// flushFreelist writes the freelist and commits a head pointing at it, if it
+// changed since it was loaded. The caller holds rwlock.
+//
+// The list is stored in the highest free pages, taken off the list. The pages
+// of the previous list are listed too, but can't hold the new one while the
+// current head points at them.
+func (db *DB) flushFreelist() error {
+	if !db.freelistDirty {
+		return nil
+	}
+	defer db.commitStats()
+	db.mmaplock.RLock()
+	head := *db.head
+	db.mmaplock.RUnlock()
+
+	all := append(append([]PageId(nil), db.freelist...), db.freelistPages...)
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	spare := db.freelist
+	if head.freelist == 0 {
+		spare = all
+	}
+	per := db.freeIdsPerPage()
+	var hosts []PageId
+	hosted := make(map[PageId]bool)
+	for listed := len(all); len(hosts)*per < listed; {
+		if n := len(spare); n > 0 {
+			hosts = append(hosts, spare[n-1])
+			hosted[spare[n-1]] = true
+			spare = spare[:n-1]
+			listed--
+			continue
+		}
+		id, err := db.allocateEnd(&head, 1)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, id)
+	}
+	var rest []PageId
+	for _, id := range all {
+		if !hosted[id] {
+			rest = append(rest, id)
+		}
+	}
+
+	buf := db.getBuf(db.pageSize)
+	defer db.putBuf(buf)
+	for i, id := range hosts {
+		ids := rest[i*per:]
+		if len(ids) > per {
+			ids = ids[:per]
+		}
+		p := &batchPage{id: id, buf: buf}
+		p.hdr = Page{Flag: PageFree, Count: uint16(len(ids)), Len: PageSz(len(ids) * freeIdSize)}
+		p.hdr.ptr = PageSz(pageHeaderSize) + p.hdr.Len
+		if i+1 < len(hosts) {
+			p.hdr.Next = hosts[i+1]
+		}
+		for j, free := range ids {
+			binary.LittleEndian.PutUint32(buf[pageHeaderSize+j*freeIdSize:], uint32(free))
+		}
+		if err := db.writeBatchPage(p); err != nil {
+			return err
+		}
+	}
+
+	head.freelist = 0
+	if len(hosts) > 0 {
+		head.freelist = hosts[0]
+	}
+	head.freeCount = uint32(len(rest))
+	if err := db.flushHead(&head); err != nil {
+		return err
+	}
+	db.freelist = rest
+	db.freelistPages = hosts
+	db.freelistDirty = false
+	return nil
+}
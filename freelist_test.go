@@ -0,0 +1,166 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// freePages allocates n pages at the end of the file and frees them.
+func freePages(db *DB, n int) ([]PageId, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	head := *db.head
+	var ids []PageId
+	for i := 0; i < n; i++ {
+		id, err := db.allocateEnd(&head, 1)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := db.flushHead(&head); err != nil {
+		return nil, err
+	}
+	if err := db.mmap(int(head.PageCount) * db.pageSize); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		db.free(id)
+	}
+	return ids, nil
+}
+
+func TestFreelistReuse(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	ids, err := freePages(db, 6)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	// The list is kept in the highest free page.
+	assert.Equal(ids[:5], db.freelist)
+	assert.Equal(ids[5:], db.freelistPages)
+	filesz, count := db.filesz, db.head.PageCount
+
+	// A record per page, the first one fits after "key".
+	value := make([]byte, db.pageSize/2+1)
+	rand.New(rand.NewSource(1)).Read(value)
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%d", i)), value))
+	}
+	assert.Equal(filesz, db.filesz)
+	assert.Equal(count, db.head.PageCount)
+	assert.Empty(db.freelist)
+	assert.Equal(PageId(0), db.head.freelist)
+	var chain []PageId
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		chain = append(chain, id)
+	}
+	// the index goes to the page after the first one taken
+	assert.Equal(append([]PageId{db.dataStart, ids[0]}, ids[2:5]...), chain)
+	assert.Equal(ids[1], db.head.nextIndexPage)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	for i := 0; i < 5; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.NoError(err)
+		assert.Equal(value, v)
+	}
+	assert.NoError(db.Close())
+}
+
+func TestFreelistPages(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	n := 2*db.freeIdsPerPage() + 10
+	ids, err := freePages(db, n)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Len(db.freelistPages, 3)
+	assert.Equal(ids[:n-3], db.freelist)
+	assert.Equal(uint32(n-3), db.head.freeCount)
+
+	// Reusing a page drops the list from the head, its pages are listed
+	// again by the next Close.
+	value := make([]byte, db.pageSize/2+1)
+	rand.New(rand.NewSource(1)).Read(value)
+	assert.NoError(db.Put([]byte("key"), value))
+	assert.NoError(db.Put([]byte("key"), value))
+	assert.Equal(PageId(0), db.head.freelist)
+	assert.NoError(db.Close())
+
+	// One page went to the record, one to the index of the page before.
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Equal(n-2, len(db.freelist)+len(db.freelistPages))
+	assert.NoError(db.Close())
+}
+
+func TestAllocateRun(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	ids, err := freePages(db, 6)
+	assert.NoError(err)
+
+	// runs of 2 and 3 pages
+	db.freelist = append([]PageId{ids[0], ids[1]}, ids[3:]...)
+	head := *db.head
+	id, err := db.allocateRun(&head, 3)
+	assert.NoError(err)
+	assert.Equal(ids[3], id)
+	assert.Equal(ids[:2], db.freelist)
+	id, err = db.allocateRun(&head, 3)
+	assert.NoError(err)
+	assert.Equal(db.head.PageCount, id)
+	assert.Equal(db.head.PageCount+3, head.PageCount)
+	assert.True(db.filesz >= int(head.PageCount)*db.pageSize)
+	id, err = db.allocateRun(&head, 2)
+	assert.NoError(err)
+	assert.Equal(ids[0], id)
+	assert.Empty(db.freelist)
+
+	_, err = db.allocateRun(&head, maxAllocSize/db.pageSize+1)
+	var tooLarge *ErrAllocTooLarge
+	assert.True(errors.As(err, &tooLarge))
+	assert.Equal(maxAllocSize/db.pageSize, tooLarge.Max)
+
+	// Overflow records take a run.
+	db.freelist = nil
+	value := make([]byte, 5*db.pageSize)
+	rand.New(rand.NewSource(1)).Read(value)
+	assert.NoError(db.Put([]byte("big"), value))
+	pages := 0
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		p := db.page(id)
+		if p.Flag&(PageFirst|PageMiddle) != 0 {
+			assert.Equal(id+1, p.Next)
+			pages++
+		}
+	}
+	assert.Equal(5, pages)
+	v, err := db.Get([]byte("big"))
+	assert.NoError(err)
+	assert.Equal(value, v)
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,576 @@
+package sidb
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Get returns the value of key, or nil if the key doesn't exist or was
+// deleted. The newest record of a key is authoritative. If it is a fragment
+// of Append, the value is put together from the records of the key like
+// GetAll does. In DupKeys mode, it is the newest of its values, found like
+// GetAll.
+//
+// With the page index, only the pages that may hold key are looked at, see
+// findPage, without it every data page is. Pages whose bloom filter rules key
+// out are passed over, see Options.BloomBitsPerKey. Sealed pages of sorted
+// keys are binary-searched, see restartInterval, others are decoded whole.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.countGet(1)
+	return db.get(key, nil)
+}
+
+// get looks key up in the records visible in s, or all records if s is nil.
+func (db *DB) get(key []byte, s *snapshot) ([]byte, error) {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	if db.dupKeys {
+		return db.newest(key, s)
+	}
+	var value []byte
+	var appended bool
+	found := func(kv *KVPair, flag KVFlag) {
+		appended = flag&KVAppended != 0
+		if flag&KVDeleted != 0 {
+			value = nil
+		} else {
+			value = kv.Value
+		}
+	}
+	// The index is of the latest commit, snapshots walk their own pages.
+	id, advance := db.dataStart, func(next PageId) PageId { return next }
+	if s == nil && db.indexed() {
+		var err error
+		if id, advance, err = db.candidates(key); err != nil {
+			return nil, err
+		}
+	}
+	for id != 0 {
+		p := db.page(id)
+		ok, err := db.mayContain(id, p, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			id = advance(s.next(id, p))
+			continue
+		}
+		obj, err := db.cachedPage(s, id, p)
+		if err != nil {
+			return nil, err
+		}
+		if obj != nil {
+			obj.search(key, p.Flag&PageSorted != 0, db.comparator, func(kv *KVPair, flag KVFlag) {
+				found(kv, flag)
+				if value != nil {
+					// the cache keeps its own
+					value = append([]byte{}, value...)
+				}
+			})
+			id = advance(s.next(id, p))
+			continue
+		}
+		data, next, err := db.records(s, id, p)
+		if err != nil {
+			return nil, err
+		}
+		if p.Flag&PageSorted != 0 {
+			err = db.searchPage(id, data, key, found)
+		} else {
+			err = db.scanData(id, data, func(kv *KVPair, flag KVFlag) bool {
+				if db.comparator(kv.Key, key) == 0 {
+					found(kv, flag)
+				}
+				return true
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		id = advance(next)
+	}
+	if appended {
+		return db.newest(key, s)
+	}
+	return value, nil
+}
+
+// candidates returns the first page findPage gives for key and a function
+// returning the following ones in turn, in place of the next page in the
+// chain, then 0.
+func (db *DB) candidates(key []byte) (PageId, func(PageId) PageId, error) {
+	pages, err := db.findPage(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	advance := func(PageId) PageId {
+		if len(pages) == 0 {
+			return 0
+		}
+		id := pages[0]
+		pages = pages[1:]
+		return id
+	}
+	return advance(0), advance, nil
+}
+
+// GetTo is like Get, but appends the value to dst and returns the extended
+// slice, so that a hit doesn't allocate when dst has enough spare capacity.
+// It returns nil if the key doesn't exist or was deleted.
+func (db *DB) GetTo(key, dst []byte) ([]byte, error) {
+	db.countGet(1)
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	if db.dupKeys {
+		v, err := db.newest(key, nil)
+		if v == nil || err != nil {
+			return nil, err
+		}
+		return append(dst, v...), nil
+	}
+	scratch := keyBufPool.Get().(*[]byte)
+	defer keyBufPool.Put(scratch)
+	var found, appended bool
+	value := dst
+	id, advance := db.dataStart, func(next PageId) PageId { return next }
+	if db.indexed() {
+		var err error
+		if id, advance, err = db.candidates(key); err != nil {
+			return nil, err
+		}
+	}
+	for id != 0 {
+		p := db.page(id)
+		ok, err := db.mayContain(id, p, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			id = advance(p.Next)
+			continue
+		}
+		obj, err := db.cachedPage(nil, id, p)
+		if err != nil {
+			return nil, err
+		}
+		if obj != nil {
+			obj.search(key, p.Flag&PageSorted != 0, db.comparator, func(kv *KVPair, flag KVFlag) {
+				appended = flag&KVAppended != 0
+				if found = flag&KVDeleted == 0; found {
+					value = append(dst, kv.Value...)
+				}
+			})
+			id = advance(p.Next)
+			continue
+		}
+		data, next, err := db.records(nil, id, p)
+		if err != nil {
+			return nil, err
+		}
+		k := (*scratch)[:0]
+		for off := 0; len(data) > 0; {
+			var n int
+			var flag KVFlag
+			// Values are only decoded for the key looked up, as the scan
+			// goes the newest record overwrites older ones.
+			k, _, n, flag, err = decodeKV(data, k, k[:0], nil, db.decompressor, false)
+			if err != nil {
+				return nil, corruptRecord(err, id, off)
+			}
+			if db.comparator(k, key) == 0 {
+				found, appended = flag&KVDeleted == 0, flag&KVAppended != 0
+				if found {
+					// The key starts with the prefix shared with the
+					// previous one, so it serves as prevKey.
+					_, value, _, _, err = decodeKV(data, k, k[:0], dst, db.decompressor, true)
+					if err != nil {
+						return nil, corruptRecord(err, id, off)
+					}
+				}
+			}
+			off += n
+			data = data[n:]
+		}
+		// keep the buffer if it had to grow
+		*scratch = k[:0]
+		id = advance(next)
+	}
+	if !found {
+		return nil, nil
+	}
+	if appended {
+		v, err := db.newest(key, nil)
+		if err != nil {
+			return nil, err
+		}
+		value = append(dst, v...)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// DefaultMaxReaderBuffer is the default DB.MaxReaderBuffer.
+const DefaultMaxReaderBuffer = 16 << 20
+
+// GetReader returns a reader of the value of key and its length, or
+// ErrKeyNotFound. Uncompressed values are read straight from the mapping in
+// chunks as the reader is read, without copying the whole value. Values of
+// records stored across pages or in compressed pages are copied whole.
+//
+// Compressed values don't stream: the block formats used can only be
+// decompressed whole, in memory. Those larger than DB.MaxReaderBuffer once
+// decompressed are refused with ErrReaderTooLarge, before decompressing
+// them when the algorithm records the length, see decodedLen. Large values
+// meant to be streamed are best stored in a database with CompNone.
+//
+// The reader doesn't keep the mapping locked: it remembers the file offset of
+// the value and resolves it again on every Read, which is safe across remaps
+// as records are never moved. It fails with ErrDatabaseNotOpen once the
+// database is closed.
+//
+// Values put together from fragments of Append, and the newest value in
+// DupKeys mode, are copied whole, as Get finds them.
+func (db *DB) GetReader(key []byte) (io.ReadCloser, int64, error) {
+	db.countGet(1)
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return nil, 0, ErrDatabaseNotOpen
+	}
+	if db.dupKeys {
+		v, err := db.newest(key, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if v == nil {
+			return nil, 0, ErrKeyNotFound
+		}
+		return ioutil.NopCloser(bytes.NewReader(v)), int64(len(v)), nil
+	}
+	scratch := keyBufPool.Get().(*[]byte)
+	defer keyBufPool.Put(scratch)
+	var found bool
+	var pos int64
+	var size int
+	var flag KVFlag
+	// the value when it is part of an overflow record, which isn't
+	// contiguous in the file, or of a compressed page
+	var overflow []byte
+	// The record is looked for like Get does, only its offset is resolved
+	// here.
+	id, advance := db.dataStart, func(next PageId) PageId { return next }
+	if db.indexed() {
+		var err error
+		if id, advance, err = db.candidates(key); err != nil {
+			return nil, 0, err
+		}
+	}
+	for id != 0 {
+		p := db.page(id)
+		ok, err := db.mayContain(id, p, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			id = advance(p.Next)
+			continue
+		}
+		data, next, err := db.records(nil, id, p)
+		if err != nil {
+			return nil, 0, err
+		}
+		off := db.pageOffset(id) + int64(pageHeaderSize)
+		k := (*scratch)[:0]
+		for len(data) > 0 {
+			var raw []byte
+			var n int
+			var f KVFlag
+			k, raw, n, f, err = decodeKV(data, k, k[:0], nil, db.decompressor, false)
+			if err != nil {
+				return nil, 0, corruptRecord(err, id, int(off-db.pageOffset(id))-pageHeaderSize)
+			}
+			if db.comparator(k, key) == 0 {
+				found = f&KVDeleted == 0
+				// The raw value ends the record.
+				pos, size, flag = off+int64(n-len(raw)), len(raw), f
+				overflow = nil
+				if p.overflow() || p.Flag&PageCompressed != 0 {
+					overflow = raw
+				}
+			}
+			off += int64(n)
+			data = data[n:]
+		}
+		*scratch = k[:0]
+		id = advance(next)
+	}
+	if !found {
+		return nil, 0, ErrKeyNotFound
+	}
+	if flag&KVAppended != 0 {
+		v, err := db.newest(key, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(v)), int64(len(v)), nil
+	}
+	raw := overflow
+	if raw == nil {
+		raw = db.dataSlice(int(pos), int(pos)+size)
+	}
+	if flag&KVValueCompressed != 0 {
+		max := int64(db.MaxReaderBuffer)
+		if n, ok := db.decodedLen(raw); ok && max > 0 && n > max {
+			return nil, 0, &ErrReaderTooLarge{Size: n, Max: max}
+		}
+		value, err := db.decompressor(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n := int64(len(value)); max > 0 && n > max {
+			return nil, 0, &ErrReaderTooLarge{Size: n, Max: max}
+		}
+		return ioutil.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+	}
+	if overflow != nil {
+		return ioutil.NopCloser(bytes.NewReader(overflow)), int64(size), nil
+	}
+	return &valueReader{db: db, pos: pos, end: pos + int64(size)}, int64(size), nil
+}
+
+// valueReader reads an uncompressed value from the mapping.
+type valueReader struct {
+	db       *DB
+	pos, end int64 // file offsets of the unread part of the value
+	closed   bool
+}
+
+// readChunk is the most a valueReader copies per mmaplock critical section.
+const readChunk = 64 << 10
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read of closed value reader")
+	}
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+	if len(p) > readChunk {
+		p = p[:readChunk]
+	}
+	r.db.mmaplock.RLock()
+	defer r.db.mmaplock.RUnlock()
+	if !r.db.opened {
+		return 0, ErrDatabaseNotOpen
+	}
+	end := r.pos + int64(len(p))
+	if end > r.end {
+		end = r.end
+	}
+	n := copy(p, r.db.dataSlice(int(r.pos), int(end)))
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *valueReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// GetMany looks up several keys at once and returns their values in the
+// order of keys, with a nil entry for each key that doesn't exist or was
+// deleted. Every data page is decoded at most once, and pages whose index
+// entry shows they hold none of the keys are skipped. In DupKeys mode, the
+// keys are looked up one by one like Get, as are those whose value is put
+// together from fragments of Append.
+func (db *DB) GetMany(keys [][]byte) ([][]byte, error) {
+	db.countGet(len(keys))
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	values := make([][]byte, len(keys))
+	if db.dupKeys {
+		for i, key := range keys {
+			v, err := db.newest(key, nil)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+	// positions in keys, sorted by key
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return db.comparator(keys[order[i]], keys[order[j]]) < 0
+	})
+	sorted := make([][]byte, len(keys))
+	for i, o := range order {
+		sorted[i] = keys[o]
+	}
+	appended := make([]bool, len(keys))
+	indexes, _, err := db.index(-1)
+	if err != nil {
+		return nil, err
+	}
+	indexed := make(map[PageId]*Index, len(indexes))
+	for _, idx := range indexes {
+		indexed[PageId(idx.PageNum)] = idx
+	}
+
+	for id := db.dataStart; id != 0; {
+		p := db.page(id)
+		if idx, ok := indexed[id]; ok && !db.indexHoldsAny(idx, sorted) {
+			id = p.Next
+			continue
+		}
+		data, next, err := db.records(nil, id, p)
+		if err != nil {
+			return nil, err
+		}
+		err = db.scanData(id, data, func(kv *KVPair, flag KVFlag) bool {
+			i := sort.Search(len(sorted), func(i int) bool { return db.comparator(sorted[i], kv.Key) >= 0 })
+			for ; i < len(sorted) && db.comparator(sorted[i], kv.Key) == 0; i++ {
+				appended[order[i]] = flag&KVAppended != 0
+				if flag&KVDeleted != 0 {
+					values[order[i]] = nil
+				} else {
+					values[order[i]] = kv.Value
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		id = next
+	}
+	for i, a := range appended {
+		if a {
+			if values[i], err = db.newest(keys[i], nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// indexHoldsAny reports whether one of the sorted keys falls within the key
+// range of the page index entry idx.
+func (db *DB) indexHoldsAny(idx *Index, sorted [][]byte) bool {
+	var trunc [6]byte
+	i := sort.Search(len(sorted), func(i int) bool {
+		trunc = [6]byte{}
+		copy(trunc[:], sorted[i])
+		return db.comparator(trunc[:], idx.Start[:]) >= 0
+	})
+	if i == len(sorted) {
+		return false
+	}
+	trunc = [6]byte{}
+	copy(trunc[:], sorted[i])
+	return db.comparator(trunc[:], idx.End[:]) <= 0
+}
+
+// Count returns the number of records stored by Put, read from the data page
+// headers and the head's tombstone count. Records overwritten or deleted
+// since are counted until the database is compacted; tombstones themselves
+// aren't. In DupKeys mode every value put is a record, those of a key may
+// span pages. Every fragment of Append is a record too, until the database is
+// compacted.
+func (db *DB) Count() (uint64, error) {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return 0, ErrDatabaseNotOpen
+	}
+	var n uint64
+	for id := db.dataStart; id != 0; {
+		p := db.page(id)
+		n += uint64(p.Count)
+		id = p.Next
+	}
+	db.headlock.Lock()
+	tombstones := db.head.tombstones
+	db.headlock.Unlock()
+	return n - uint64(tombstones), nil
+}
+
+// Size returns the size of the database file on disk.
+func (db *DB) Size() int64 {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	return int64(db.filesz)
+}
+
+// scanPages decodes the records visible in s, or all records if s is nil, in
+// the order they were written, calling fn for each until it returns false.
+// The key passed to fn may be overwritten by the next record. The caller
+// holds mmaplock.
+func (db *DB) scanPages(s *snapshot, fn func(kv *KVPair, flag KVFlag) bool) error {
+	next := true
+	for id := db.dataStart; id != 0 && next; {
+		data, nextID, err := db.records(s, id, db.page(id))
+		if err != nil {
+			return err
+		}
+		err = db.scanData(id, data, func(kv *KVPair, flag KVFlag) bool {
+			next = fn(kv, flag)
+			return next
+		})
+		if err != nil {
+			return err
+		}
+		id = nextID
+	}
+	return nil
+}
+
+// scanPage decodes the records of data page id, whose header is p, calling fn
+// for each until it returns false. The caller holds mmaplock.
+func (db *DB) scanPage(id PageId, p *Page, fn func(kv *KVPair, flag KVFlag) bool) error {
+	data, _, err := db.records(nil, id, p)
+	if err != nil {
+		return err
+	}
+	return db.scanData(id, data, fn)
+}
+
+// scanData decodes data, the records of page id, see scanPage.
+func (db *DB) scanData(id PageId, data []byte, fn func(kv *KVPair, flag KVFlag) bool) error {
+	var kv KVPair
+	var prevKey []byte
+	for off := 0; off < len(data); {
+		n, flag, err := kv.unmarshal(data[off:], prevKey, db.decompressor)
+		if err != nil {
+			return corruptRecord(err, id, off)
+		}
+		if !fn(&kv, flag) {
+			return nil
+		}
+		prevKey = kv.Key
+		off += n
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	v, err := db.Get([]byte("missing"))
+	assert.NoError(err)
+	assert.Nil(v)
+
+	for i := 0; i < 2000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%d", i%500)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Put([]byte("empty"), nil))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	// the newest record wins
+	for i := 0; i < 500; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf("value-%d", 1500+i), string(v))
+	}
+	v, err = db.Get([]byte("empty"))
+	assert.NoError(err)
+	assert.NotNil(v)
+	assert.Empty(v)
+	assert.NoError(db.Close())
+	_, err = db.Get([]byte("key-1"))
+	assert.Equal(ErrDatabaseNotOpen, err)
+}
+
+func TestDelete(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("v")))
+	}
+	// tombstones are exempt from the ordering
+	assert.NoError(db.Delete([]byte("key-0001")))
+	assert.NoError(db.Delete([]byte("key-0500")))
+	// a key that never existed
+	assert.NoError(db.Delete([]byte("nope")))
+	assert.Equal(ErrKeyRequired, db.Delete(nil))
+	// the ordering is still checked against the last Put
+	assert.Equal(ErrKeyOutOfOrder, db.Put([]byte("key-0998"), []byte("v")))
+
+	v, err := db.Get([]byte("key-0001"))
+	assert.NoError(err)
+	assert.Nil(v)
+	v, err = db.Get([]byte("key-0002"))
+	assert.NoError(err)
+	assert.Equal("v", string(v))
+	assert.NoError(db.Close())
+
+	// the tail is reloaded on reopen, and a deleted key can come back
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.Equal(ErrKeyOutOfOrder, db.Put([]byte("key-0998"), []byte("v")))
+	assert.NoError(db.Delete([]byte("key-0999")))
+	assert.NoError(db.Put([]byte("key-0999"), []byte("again")))
+	v, err = db.Get([]byte("key-0999"))
+	assert.NoError(err)
+	assert.Equal("again", string(v))
+	v, err = db.Get([]byte("key-0500"))
+	assert.NoError(err)
+	assert.Nil(v)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(ErrDatabaseReadOnly, db.Delete([]byte("key-0002")))
+	assert.NoError(db.Close())
+}
+
+func TestLoadTailOnlyTombstones(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true, Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+	assert.NoError(db.Put([]byte("m"), nil))
+	// fill more than a page with tombstones
+	for i := 0; db.head.kvPtr.pageNum == 1; i++ {
+		assert.NoError(db.Delete([]byte(fmt.Sprintf("a-%d", i))))
+	}
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.Equal(ErrKeyOutOfOrder, db.Put([]byte("b"), nil))
+	assert.NoError(db.Put([]byte("n"), nil))
+	assert.NoError(db.Close())
+}
+
+func TestCountSize(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	n, err := db.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(0), n)
+	assert.Equal(int64(3*db.pageSize), db.Size())
+
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	for i := 0; i < 1000; i += 100 {
+		assert.NoError(db.Delete([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	n, err = db.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(1000), n)
+	size := db.Size()
+	info, err := os.Stat(testDB)
+	assert.NoError(err)
+	assert.Equal(info.Size(), size)
+	assert.True(size >= int64(db.head.PageCount)*int64(db.pageSize))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	n, err = db.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(1000), n)
+	assert.Equal(size, db.Size())
+	assert.NoError(db.Close())
+	_, err = db.Count()
+	assert.Equal(ErrDatabaseNotOpen, err)
+}
+
+func TestGetTo(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 2000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%d", i%500)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Put([]byte("empty"), nil))
+	assert.NoError(db.Delete([]byte("key-7")))
+
+	buf := make([]byte, 0, 64)
+	v, err := db.GetTo([]byte("key-1"), buf)
+	assert.NoError(err)
+	assert.Equal("value-1501", string(v))
+	// appended to dst
+	v, err = db.GetTo([]byte("key-2"), append(buf, "x:"...))
+	assert.NoError(err)
+	assert.Equal("x:value-1502", string(v))
+	v, err = db.GetTo([]byte("empty"), nil)
+	assert.NoError(err)
+	assert.NotNil(v)
+	assert.Len(v, 0)
+	for _, key := range []string{"key-7", "missing"} {
+		v, err = db.GetTo([]byte(key), buf)
+		assert.NoError(err)
+		assert.Nil(v)
+	}
+	assert.NoError(db.Close())
+}
+
+func TestKVUnmarshalTo(t *testing.T) {
+	assert := assertion.New(t)
+	prev := []byte("key-0001")
+	rec := KVPair{Key: []byte("key-0002"), Value: []byte("value")}.Marshal(prev, nil)
+	key := make([]byte, 0, 32)
+	key = append(key, prev...)
+	var kv KVPair
+	// the previous key in the key buffer itself
+	assert.NoError(kv.UnmarshalTo(rec, key, key, make([]byte, 0, 32), nil))
+	assert.Equal("key-0002", string(kv.Key))
+	assert.Equal("value", string(kv.Value))
+	assert.True(&key[:1][0] == &kv.Key[0])
+	assert.Error(kv.UnmarshalTo(rec[:len(rec)-1], prev, nil, nil, nil))
+	assert.Error(kv.UnmarshalTo(rec, nil, nil, nil, nil))
+}
+
+func BenchmarkGetTo(b *testing.B) {
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	key := []byte("key-500")
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if v, err := db.GetTo(key, buf); err != nil || v == nil {
+			b.Fatal(v, err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	key := []byte("key-500")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if v, err := db.Get(key); err != nil || v == nil {
+			b.Fatal(v, err)
+		}
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	values, err := db.GetMany([][]byte{[]byte("missing")})
+	assert.NoError(err)
+	assert.Equal([][]byte{nil}, values)
+
+	for i := 0; i < 2000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Put([]byte("key-00500"), []byte("newer")))
+	assert.NoError(db.Delete([]byte("key-01000")))
+	assert.NoError(db.Put([]byte("key-empty"), nil))
+
+	keys := [][]byte{
+		[]byte("key-01999"),
+		[]byte("nope"),
+		[]byte("key-00500"),
+		[]byte("key-00001"),
+		[]byte("key-01000"),
+		[]byte("key-00001"),
+		[]byte("key-empty"),
+	}
+	expect := [][]byte{
+		[]byte("value-1999"),
+		nil,
+		[]byte("newer"),
+		[]byte("value-1"),
+		nil,
+		[]byte("value-1"),
+		{},
+	}
+	values, err = db.GetMany(keys)
+	assert.NoError(err)
+	assert.Equal(expect, values)
+
+	// Pages indexed with their key range are only decoded if they may hold
+	// one of the keys, the tail page too.
+	db.indexes = nil
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		idx := &Index{PageNum: uint32(id)}
+		var min, max []byte
+		assert.NoError(db.scanPage(id, db.page(id), func(kv *KVPair, flag KVFlag) bool {
+			if min == nil || string(kv.Key) < string(min) {
+				min = append([]byte(nil), kv.Key...)
+			}
+			if string(kv.Key) > string(max) {
+				max = append([]byte(nil), kv.Key...)
+			}
+			return true
+		}))
+		copy(idx.Start[:], min)
+		copy(idx.End[:], max)
+		db.indexes = append(db.indexes, idx)
+	}
+	db.sortIndex()
+	values, err = db.GetMany(keys)
+	assert.NoError(err)
+	assert.Equal(expect, values)
+	assert.NoError(db.Close())
+}
+
+func TestGetReader(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+	value := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(value)
+	assert.NoError(db.Put([]byte("big"), []byte("old")))
+	assert.NoError(db.Put([]byte("big"), value))
+	assert.NoError(db.Put([]byte("gone"), value))
+	assert.NoError(db.Delete([]byte("gone")))
+
+	r, n, err := db.GetReader([]byte("big"))
+	assert.NoError(err)
+	assert.Equal(int64(len(value)), n)
+	buf := make([]byte, 1000)
+	_, err = io.ReadFull(r, buf)
+	assert.NoError(err)
+	// remap under the reader
+	mapGen := db.mapGen
+	for i := 0; db.mapGen == mapGen; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%d", i)), value[:1000]))
+	}
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(value, append(buf, rest...))
+	assert.NoError(r.Close())
+
+	for _, key := range []string{"gone", "missing"} {
+		_, _, err = db.GetReader([]byte(key))
+		assert.Equal(ErrKeyNotFound, err)
+	}
+	r, _, err = db.GetReader([]byte("big"))
+	assert.NoError(err)
+	assert.NoError(db.Close())
+	_, err = r.Read(buf)
+	assert.Equal(ErrDatabaseNotOpen, err)
+}
+
+// TestGetReaderIndexed checks GetReader only looks at the pages findPage
+// gives: a corrupt page holding other keys is never decoded.
+func TestGetReaderIndexed(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.True(len(db.indexes) > 10)
+	first := db.dataStart
+	off := db.pageOffset(first) + int64(pageHeaderSize)
+	assert.NoError(db.Close())
+
+	f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+	assert.NoError(err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 32), off)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	r, n, err := db.GetReader([]byte("key-0999"))
+	assert.NoError(err)
+	assert.Equal(int64(len("value-999")), n)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal("value-999", string(got))
+	assert.NoError(r.Close())
+	_, _, err = db.GetReader([]byte("key-2000"))
+	assert.Equal(ErrKeyNotFound, err)
+	// the corrupt page is a candidate for its own keys
+	_, _, err = db.GetReader([]byte("key-0000"))
+	assert.Error(err)
+	assert.NotEqual(ErrKeyNotFound, err)
+	assert.NoError(db.Close())
+}
+
+func TestGetReaderCompressed(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	value := bytes.Repeat([]byte("compressible "), 200)
+	assert.NoError(db.Put([]byte("key"), value))
+	r, n, err := db.GetReader([]byte("key"))
+	assert.NoError(err)
+	assert.Equal(int64(len(value)), n)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(value, got)
+	assert.NoError(r.Close())
+	assert.Equal(DefaultMaxReaderBuffer, db.MaxReaderBuffer)
+
+	// too large to decompress in memory, told from the snappy header
+	db.MaxReaderBuffer = len(value) - 1
+	_, _, err = db.GetReader([]byte("key"))
+	assert.Equal(&ErrReaderTooLarge{Size: int64(len(value)), Max: int64(len(value) - 1)}, err)
+	db.MaxReaderBuffer = 0
+	_, n, err = db.GetReader([]byte("key"))
+	assert.NoError(err)
+	assert.Equal(int64(len(value)), n)
+	assert.NoError(db.Close())
+
+	// and from the lz4 one
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{Compression: CompLz4})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), value))
+	db.MaxReaderBuffer = 100
+	_, _, err = db.GetReader([]byte("key"))
+	assert.Equal(&ErrReaderTooLarge{Size: int64(len(value)), Max: 100}, err)
+	assert.NoError(db.Close())
+}
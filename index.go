@@ -0,0 +1,464 @@
+package sidb
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// The page index holds an Index entry per data page no more records go to:
+// the page and the smallest and largest keys of its records, truncated to 6
+// bytes. Truncation keeps the order of keys under BytesComparator only, so
+// databases with another comparator aren't indexed, nor those created before
+// FeaturePageIndex. An overflow record is indexed by its first page.
+//
+// Entries are stored in index pages, flagged PageIndex, chained by Next from
+// head.nextIndexPage. Like records they are only ever appended: head.indexPtr
+// points past the last entry committed, on the last index page, and
+// head.IndexPageCount counts the pages. Index pages are loaded into db.indexes
+// as lookups get to them, see loadIndex, and lookups go through findPage.
+
+// indexEntriesPerPage returns the number of entries an index page holds.
+func (db *DB) indexEntriesPerPage() int {
+	return (db.pageSize - pageHeaderSize) / indexEntrySize
+}
+
+// indexed reports whether the database keeps a page index.
+func (db *DB) indexed() bool {
+	return db.indexing
+}
+
+// indexEntry appends to entries the index entry of data page id, whose header
+// is p and whose records are data, if the database is indexed. Empty pages
+// and pages of overflow records, indexed as they are created, are skipped.
+func (db *DB) indexEntry(entries []Index, id PageId, p *Page, data []byte) ([]Index, error) {
+	if !db.indexed() {
+		return entries, nil
+	}
+	return db.pageIndexEntry(entries, id, p, data)
+}
+
+// pageIndexEntry is indexEntry whether the database is indexed or not.
+func (db *DB) pageIndexEntry(entries []Index, id PageId, p *Page, data []byte) ([]Index, error) {
+	if p.Count == 0 || p.overflow() {
+		return entries, nil
+	}
+	var key, min, max []byte
+	for off := 0; len(data) > 0; {
+		// The key is expanded in place in the previous key's array.
+		k, _, n, _, err := decodeKV(data, key, key[:0], nil, db.decompressor, false)
+		if err != nil {
+			return entries, corruptRecord(err, id, off)
+		}
+		if min == nil || db.comparator(k, min) < 0 {
+			min = append(min[:0], k...)
+		}
+		if max == nil || db.comparator(k, max) > 0 {
+			max = append(max[:0], k...)
+		}
+		key = k
+		off += n
+		data = data[n:]
+	}
+	idx := Index{PageNum: uint32(id)}
+	copy(idx.Start[:], min)
+	copy(idx.End[:], max)
+	return append(entries, idx), nil
+}
+
+// overflowIndexEntry appends to entries the index entry of the overflow
+// record of key starting at page id, if the database is indexed.
+func (db *DB) overflowIndexEntry(entries []Index, id PageId, key []byte) []Index {
+	if !db.indexed() {
+		return entries
+	}
+	return append(entries, keyIndex(id, key))
+}
+
+// keyIndex returns the index entry of page id holding only key.
+func keyIndex(id PageId, key []byte) Index {
+	idx := Index{PageNum: uint32(id)}
+	copy(idx.Start[:], key)
+	copy(idx.End[:], key)
+	return idx
+}
+
+// writeIndex appends entries to the index for the commit of head in progress,
+// filling the last index page and chaining new ones. The caller holds rwlock
+// and adds the entries to db.indexes once head is written, see addIndexes.
+func (db *DB) writeIndex(head *HeadPage, entries []Index) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	// entries go after the loaded ones, see addIndexes
+	db.mmaplock.RLock()
+	_, _, err := db.index(-1)
+	db.mmaplock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return db.appendIndex(head, entries)
+}
+
+// appendIndex writes entries after the index of head, see writeIndex.
+func (db *DB) appendIndex(head *HeadPage, entries []Index) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	buf := db.getBuf(db.pageSize)
+	defer db.putBuf(buf)
+	per := db.indexEntriesPerPage()
+	id := PageId(head.indexPtr.pageNum)
+	var p Page
+	if id != 0 {
+		// The last page as of head, later entries were never committed.
+		end := int(head.indexPtr.offset)
+		start := int(db.pageOffset(id))
+		db.mmaplock.RLock()
+		copy(buf, db.dataSlice(start, start+end))
+		db.mmaplock.RUnlock()
+		p = Page{Flag: PageIndex, Count: uint16((end - pageHeaderSize) / indexEntrySize), Len: PageSz(end - pageHeaderSize), ptr: PageSz(end)}
+	}
+	for len(entries) > 0 {
+		if id == 0 || int(p.Count) == per {
+			next, err := db.allocate(head)
+			if err != nil {
+				return err
+			}
+			if id == 0 {
+				head.nextIndexPage = next
+			} else {
+				p.Next = next
+				if err := db.writeIndexPage(id, &p, buf); err != nil {
+					return err
+				}
+			}
+			head.IndexPageCount++
+			id, p = next, Page{Flag: PageIndex, ptr: PageSz(pageHeaderSize)}
+		}
+		for ; len(entries) > 0 && int(p.Count) < per; entries = entries[1:] {
+			indexEncode(buf[p.ptr:], &entries[0])
+			p.Count++
+			p.Len += indexEntrySize
+			p.ptr += indexEntrySize
+		}
+		head.indexPtr = RecordPtr{uint32(id), p.ptr}
+	}
+	return db.writeIndexPage(id, &p, buf)
+}
+
+// rollbackIndex rewrites the last index page as of db.head should a commit
+// that didn't make it have torn its header, as appendIndex rewrites it whole
+// with the entries it adds, see rollbackTail.
+func (db *DB) rollbackIndex() error {
+	id := PageId(db.head.indexPtr.pageNum)
+	end := int(db.head.indexPtr.offset)
+	if id == 0 || end < pageHeaderSize || end > db.pageSize {
+		return nil
+	}
+	buf := db.getBuf(db.pageSize)
+	defer db.putBuf(buf)
+	start := int(db.pageOffset(id))
+	page := db.dataSlice(start, start+end)
+	copy(buf, page)
+	p := Page{Flag: PageIndex, Count: uint16((end - pageHeaderSize) / indexEntrySize), Len: PageSz(end - pageHeaderSize), ptr: PageSz(end)}
+	p.CheckSum = db.checksumAlgo.sum(buf[pageHeaderSize:end])
+	pageHeaderEncode(buf, &p)
+	if bytes.Equal(buf[:end], page) {
+		return nil
+	}
+	if _, err := db.ops.writeAt(buf[:end], int64(start)); err != nil {
+		return err
+	}
+	return db.ops.sync()
+}
+
+// writeIndexPage writes index page id, whose header is p and whose entries
+// are in buf, checksumming them.
+func (db *DB) writeIndexPage(id PageId, p *Page, buf []byte) error {
+	p.CheckSum = db.checksumAlgo.sum(buf[pageHeaderSize:p.ptr])
+	pageHeaderEncode(buf, p)
+	_, err := db.write(buf[:p.ptr], db.pageOffset(id))
+	return err
+}
+
+// addIndexes adds entries, written with the head just committed, to
+// db.indexes, all loaded by writeIndex, and moves db.indexTail to tail, the
+// data page of that head.
+// Until then lookups keep to the previous tail, which still holds the
+// records of the pages the entries are for.
+func (db *DB) addIndexes(entries []Index, tail PageId) {
+	if len(entries) == 0 && tail == db.indexTail {
+		return
+	}
+	db.mmaplock.Lock()
+	for i := range entries {
+		idx := entries[i]
+		pos := len(db.indexes)
+		db.indexes = append(db.indexes, &idx)
+		// after the entries starting alike, which are older
+		j := sort.Search(len(db.indexOrder), func(j int) bool {
+			return db.comparator(db.indexes[db.indexOrder[j]].Start[:], idx.Start[:]) > 0
+		})
+		db.indexOrder = append(db.indexOrder, 0)
+		copy(db.indexOrder[j+1:], db.indexOrder[j:])
+		db.indexOrder[j] = pos
+	}
+	db.indexTail = tail
+	db.mmaplock.Unlock()
+}
+
+// sortIndex sorts db.indexOrder, the positions of db.indexes by Start and
+// then position. The caller holds mmaplock.
+func (db *DB) sortIndex() {
+	order := make([]int, len(db.indexes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return db.comparator(db.indexes[order[i]].Start[:], db.indexes[order[j]].Start[:]) < 0
+	})
+	db.indexOrder = order
+}
+
+// findPage returns the data pages that may hold key, in chain order so that
+// the newest record of key comes last: the indexed pages whose key range
+// takes in key, then the tail page. Entries hold truncated keys, so every
+// page with a key sharing its first 6 bytes with key is a candidate. The
+// caller holds mmaplock and checks db.indexed.
+func (db *DB) findPage(key []byte) ([]PageId, error) {
+	indexes, order, err := db.index(-1)
+	if err != nil {
+		return nil, err
+	}
+	var trunc [6]byte
+	copy(trunc[:], key)
+	// the entries starting at or before key
+	n := sort.Search(len(order), func(i int) bool {
+		return db.comparator(indexes[order[i]].Start[:], trunc[:]) > 0
+	})
+	var found []int
+	for _, pos := range order[:n] {
+		if db.comparator(indexes[pos].End[:], trunc[:]) >= 0 {
+			found = append(found, pos)
+		}
+	}
+	sort.Ints(found)
+	pages := make([]PageId, 0, len(found)+1)
+	for _, pos := range found {
+		id := PageId(indexes[pos].PageNum)
+		if p := db.page(id); p.Flag&PageData == 0 {
+			return nil, corruptPage(id, 0, "indexed as a data page, flags %#x", p.Flag)
+		}
+		pages = append(pages, id)
+	}
+	return append(pages, db.indexTail), nil
+}
+
+// loadIndex starts loading the index chain committed with db.head: only its
+// first page is decoded into db.indexes, the others as lookups get to them,
+// see DB.index.
+func (db *DB) loadIndex() error {
+	db.mmaplock.Lock()
+	defer db.mmaplock.Unlock()
+	head := db.head
+	db.indexTail = PageId(head.kvPtr.pageNum)
+	db.indexing = db.cmpName == defaultComparatorName && head.Features.WriteRequired&FeaturePageIndex != 0
+	db.indexes, db.indexOrder, db.indexNext = nil, nil, 0
+	if !db.indexing {
+		return nil
+	}
+	if head.indexPtr.pageNum != 0 {
+		db.indexNext = head.nextIndexPage
+	}
+	db.indexEnd, db.indexLeft = head.indexPtr, head.IndexPageCount
+	if db.indexNext == 0 {
+		db.sortIndex()
+		return nil
+	}
+	return db.loadIndexPage()
+}
+
+// loadIndexPage decodes the entries of index page db.indexNext into
+// db.indexes and moves on to the next page, sorting them once the last one is
+// loaded. The caller holds mmaplock and indexlock, or mmaplock alone for
+// writing.
+func (db *DB) loadIndexPage() error {
+	id, last := db.indexNext, PageId(db.indexEnd.pageNum)
+	if db.indexLeft == 0 {
+		return corruptPage(id, 0, "index chain longer than its page count")
+	}
+	p := db.page(id)
+	if p.Flag&PageIndex == 0 {
+		return corruptPage(id, 0, "index page has flags %#x", p.Flag)
+	}
+	end := int(p.ptr)
+	if id == last {
+		end = int(db.indexEnd.offset)
+	}
+	if end < pageHeaderSize || end > db.pageSize || end > int(p.ptr) {
+		return corruptPage(id, pagePtrOffset, "index page ends at %d", end)
+	}
+	if end == int(p.ptr) {
+		if err := db.verifyPage(id, p); err != nil {
+			return err
+		}
+	}
+	if id != last && p.Next == 0 {
+		return corruptPage(id, pageNextOffset, "index chain ends before page %d", last)
+	}
+	start := int(db.pageOffset(id))
+	data := db.dataSlice(start+pageHeaderSize, start+end)
+	for ; len(data) >= indexEntrySize; data = data[indexEntrySize:] {
+		idx := indexDecode(data)
+		db.indexes = append(db.indexes, &idx)
+	}
+	db.indexLeft--
+	if id != last {
+		db.indexNext = p.Next
+		return nil
+	}
+	db.indexNext = 0
+	db.sortIndex()
+	return nil
+}
+
+// index returns the entries of the page index, loading index pages until
+// more than n entries are loaded or the chain is, all of it if n is negative.
+// The order of the entries by Start is only returned once all are loaded. The
+// slices returned aren't modified by later loads, the caller holds mmaplock.
+func (db *DB) index(n int) ([]*Index, []int, error) {
+	db.indexlock.Lock()
+	defer db.indexlock.Unlock()
+	for db.indexNext != 0 && (n < 0 || len(db.indexes) <= n) {
+		if err := db.loadIndexPage(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if db.indexNext != 0 {
+		return db.indexes, nil, nil
+	}
+	return db.indexes, db.indexOrder, nil
+}
+
+// PreloadIndex loads the whole page index at once, instead of page by page
+// as lookups need it, so that lookups don't wait on it later. It is done
+// again after a Refresh that sees a new commit.
+func (db *DB) PreloadIndex() error {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	_, _, err := db.index(-1)
+	return err
+}
+
+// Reindex rebuilds the page index from the data pages, for when the index is
+// lost or corrupt: the entries of every data page but the last are written
+// to new index pages, committed with the head, and the old index pages are
+// freed once no read-only transaction reads them. A database created before FeaturePageIndex gets an index this way.
+// Databases with a comparator other than BytesComparator can't be indexed.
+// With Options.BloomBitsPerKey, the pages without a bloom filter that have
+// room for one get it.
+func (db *DB) Reindex() (err error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if db.cmpName != defaultComparatorName {
+		return errors.Errorf("keys ordered by %q can't be indexed", db.cmpName)
+	}
+	// Pages taken off the freelist go back to it if the commit fails.
+	db.releasePending(db.oldestTx())
+	freelist := db.freelist
+	defer func() {
+		if err != nil {
+			db.freelist = freelist
+		}
+	}()
+
+	db.mmaplock.RLock()
+	head := *db.head
+	old := db.indexPages(&head)
+	entries, err := db.dataIndex(PageId(head.kvPtr.pageNum))
+	db.mmaplock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := db.addFilters(PageId(head.kvPtr.pageNum)); err != nil {
+		return err
+	}
+	head.nextIndexPage, head.indexPtr, head.IndexPageCount = 0, RecordPtr{}, 0
+	head.Features.WriteRequired |= FeaturePageIndex
+	if err := db.appendIndex(&head, entries); err != nil {
+		return err
+	}
+	if err := db.flushHead(&head); err != nil {
+		return err
+	}
+
+	indexes := make([]*Index, len(entries))
+	for i := range entries {
+		indexes[i] = &entries[i]
+	}
+	db.mmaplock.Lock()
+	db.indexes, db.indexNext, db.indexing = indexes, 0, true
+	db.indexEnd, db.indexLeft = head.indexPtr, 0
+	db.indexTail = PageId(head.kvPtr.pageNum)
+	db.sortIndex()
+	db.mmaplock.Unlock()
+	// Only now nothing links to them, but for read-only transactions.
+	db.freeLater(head.generation, old)
+	return nil
+}
+
+// indexPages returns the pages of the index chain of head, as far as they are
+// index pages. The caller holds mmaplock.
+func (db *DB) indexPages(head *HeadPage) []PageId {
+	var pages []PageId
+	if head.indexPtr.pageNum == 0 {
+		return nil
+	}
+	for id := head.nextIndexPage; uint32(len(pages)) < head.IndexPageCount; {
+		if id < db.dataStart || id >= head.PageCount || db.page(id).Flag&PageIndex == 0 {
+			break
+		}
+		pages = append(pages, id)
+		if id == PageId(head.indexPtr.pageNum) {
+			break
+		}
+		id = db.page(id).Next
+	}
+	return pages
+}
+
+// dataIndex returns the index entries of the data pages before page tail.
+// The caller holds mmaplock.
+func (db *DB) dataIndex(tail PageId) ([]Index, error) {
+	var entries []Index
+	for id := db.dataStart; id != 0 && id != tail; {
+		p := db.page(id)
+		data, next, err := db.records(nil, id, p)
+		if err != nil {
+			return nil, err
+		}
+		if p.Flag&PageFirst != 0 {
+			key, _, _, _, err := decodeKV(data, nil, nil, nil, db.decompressor, false)
+			if err != nil {
+				return nil, corruptRecord(err, id, 0)
+			}
+			entries = append(entries, keyIndex(id, key))
+		} else if entries, err = db.pageIndexEntry(entries, id, p, data); err != nil {
+			return nil, err
+		}
+		id = next
+	}
+	return entries, nil
+}
@@ -0,0 +1,474 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("key-%04d", i)
+		values[k] = []byte(fmt.Sprintf("value-%d", i))
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	var batch []KVPair
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("batch-%04d", i)
+		values[k] = []byte(fmt.Sprintf("value-%d", i))
+		batch = append(batch, KVPair{Key: []byte(k), Value: values[k]})
+	}
+	values["big"] = bytes.Repeat([]byte("big value "), db.pageSize)
+	batch = append(batch, KVPair{Key: []byte("big"), Value: values["big"]})
+	assert.NoError(db.PutBatch(batch))
+
+	// Every finalized data page is indexed with its key range, the overflow
+	// record by its first page.
+	indexed := make(map[PageId]*Index)
+	for _, idx := range db.indexes {
+		indexed[PageId(idx.PageNum)] = idx
+	}
+	assert.Len(indexed, len(db.indexes))
+	overflows := 0
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		p := db.page(id)
+		idx, ok := indexed[id]
+		if p.overflow() {
+			if ok {
+				overflows++
+				assert.Equal([6]byte{'b', 'i', 'g'}, idx.Start)
+				assert.Equal(idx.Start, idx.End)
+			}
+			continue
+		}
+		if id == PageId(db.head.kvPtr.pageNum) {
+			assert.False(ok, "tail page %d indexed", id)
+			continue
+		}
+		if !assert.True(ok, "page %d not indexed", id) {
+			continue
+		}
+		var min, max []byte
+		assert.NoError(db.scanPage(id, p, func(kv *KVPair, flag KVFlag) bool {
+			if min == nil || string(kv.Key) < string(min) {
+				min = append([]byte(nil), kv.Key...)
+			}
+			if string(kv.Key) > string(max) {
+				max = append([]byte(nil), kv.Key...)
+			}
+			return true
+		}))
+		var start, end [6]byte
+		copy(start[:], min)
+		copy(end[:], max)
+		assert.Equal(start, idx.Start, "page %d", id)
+		assert.Equal(end, idx.End, "page %d", id)
+	}
+	assert.Equal(1, overflows)
+	// the entries of a 512 bytes page are spread over several index pages
+	assert.True(db.head.IndexPageCount > 1)
+	indexes := db.indexes
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	assert.Len(db.indexes, db.indexEntriesPerPage())
+	assert.NoError(db.PreloadIndex())
+	assert.Equal(indexes, db.indexes)
+	for k, want := range values {
+		v, err := db.Get([]byte(k))
+		assert.NoError(err)
+		assert.Equal(want, v, k)
+	}
+	keys := [][]byte{[]byte("key-0500"), []byte("batch-0001"), []byte("big"), []byte("missing")}
+	got, err := db.GetMany(keys)
+	assert.NoError(err)
+	assert.Equal([][]byte{values["key-0500"], values["batch-0001"], values["big"], nil}, got)
+
+	c := db.Cursor()
+	k, v := c.Seek([]byte("key-0500"))
+	assert.Equal("key-0500", string(k))
+	assert.Equal(values["key-0500"], v)
+	assert.NoError(c.Err())
+
+	// Entries written after a snapshot aren't used by its cursor.
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	for i := 1000; i < 1200; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("later")))
+	}
+	assert.True(len(db.indexes) > len(indexes))
+	c = tx.Cursor()
+	k, _ = c.Seek([]byte("key-1100"))
+	assert.Nil(k)
+	assert.NoError(c.Err())
+	k, v = c.Seek([]byte("key-0999"))
+	assert.Equal("key-0999", string(k))
+	assert.Equal(values["key-0999"], v)
+	assert.NoError(tx.Rollback())
+	assert.NoError(db.Close())
+}
+
+// TestFindPageCommonPrefix looks keys up when the truncated bounds of every
+// index entry are the same, so that all pages are candidates.
+func TestFindPageCommonPrefix(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+
+	values := make(map[string][]byte)
+	put := func(k string, v []byte) {
+		values[k] = v
+		assert.NoError(db.Put([]byte(k), v))
+	}
+	for i := 0; i < 1000; i++ {
+		put(fmt.Sprintf("common-prefix-%04d", i), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	// rewritten and deleted keys are in several candidate pages, the newest
+	// record wins
+	for i := 0; i < 1000; i += 7 {
+		put(fmt.Sprintf("common-prefix-%04d", i), []byte(fmt.Sprintf("new-%d", i)))
+	}
+	for i := 3; i < 1000; i += 11 {
+		k := fmt.Sprintf("common-prefix-%04d", i)
+		assert.NoError(db.Delete([]byte(k)))
+		values[k] = nil
+	}
+	put("other", []byte("other"))
+	assert.True(len(db.indexes) > 10)
+	for _, idx := range db.indexes {
+		assert.Equal([6]byte{'c', 'o', 'm', 'm', 'o', 'n'}, idx.Start)
+		assert.Equal(idx.Start, idx.End)
+	}
+
+	check := func() {
+		db.mmaplock.RLock()
+		pages, err := db.findPage([]byte("common-prefix-0500"))
+		assert.NoError(err)
+		assert.Len(pages, len(db.indexes)+1)
+		for i, idx := range db.indexes {
+			assert.Equal(PageId(idx.PageNum), pages[i])
+		}
+		assert.Equal(PageId(db.head.kvPtr.pageNum), pages[len(pages)-1])
+		// only the tail may hold keys outside the range
+		pages, err = db.findPage([]byte("commoo"))
+		assert.NoError(err)
+		assert.Equal([]PageId{db.indexTail}, pages)
+		db.mmaplock.RUnlock()
+
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+			v, err = db.GetTo([]byte(k), nil)
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+		v, err := db.Get([]byte("common-prefix-9999"))
+		assert.NoError(err)
+		assert.Nil(v)
+	}
+	check()
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	check()
+	assert.NoError(db.Close())
+}
+
+// TestIndexWithoutFeature opens a file not known to be fully indexed: its
+// pages are all looked at and no index is written.
+func TestIndexWithoutFeature(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	f := db.Features()
+	assert.NoError(db.Close())
+	f.WriteRequired &^= FeaturePageIndex
+	setFeatures(t, testDB, f)
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.False(db.indexed())
+	for i := 0; i < 500; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")))
+	}
+	assert.Empty(db.indexes)
+	assert.Equal(uint32(0), db.head.IndexPageCount)
+	v, err := db.Get([]byte("key-0001"))
+	assert.NoError(err)
+	assert.Equal("value", string(v))
+
+	// Reindex indexes it for good.
+	assert.NoError(db.Reindex())
+	assert.True(db.indexed())
+	assert.NotEmpty(db.indexes)
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.True(db.indexed())
+	assert.Equal(FeaturePageIndex, db.Features().WriteRequired&FeaturePageIndex)
+	v, err = db.Get([]byte("key-0499"))
+	assert.NoError(err)
+	assert.Equal("value", string(v))
+	assert.NoError(db.Close())
+}
+
+func TestReindex(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+	assert.NoError(db.Reindex())
+	assert.Empty(db.indexes)
+	values := make(map[string][]byte)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key-%04d", i)
+		values[k] = []byte(fmt.Sprintf("value-%d", i))
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	values["big"] = bytes.Repeat([]byte("big value "), db.pageSize)
+	assert.NoError(db.Put([]byte("big"), values["big"]))
+	assert.NoError(db.Put([]byte("after"), []byte("big")))
+	values["after"] = []byte("big")
+	indexes := db.indexes
+	first := db.head.nextIndexPage
+	second := db.page(first).Next
+	assert.True(db.head.IndexPageCount > 2)
+	assert.NoError(db.Close())
+
+	// The second index page is zeroed.
+	f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+	assert.NoError(err)
+	_, err = f.WriteAt(make([]byte, 512), int64(second)*512)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	_, err = db.Get([]byte("key-0001"))
+	assert.Equal(&ErrCorrupt{Page: second, Offset: 0, Reason: "index page has flags 0x0"}, errors.Cause(err))
+	assert.Error(db.PreloadIndex())
+	c := db.Cursor()
+	k, _ := c.Seek([]byte("key-2000"))
+	assert.Equal("key-2000", string(k))
+
+	assert.NoError(db.Reindex())
+	assert.Equal(indexes, db.indexes)
+	// The chain is followed up to the broken page.
+	assert.Contains(db.freelist, first)
+	assert.NotContains(db.freelist, second)
+	check := func() {
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+	}
+	check()
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.PreloadIndex())
+	assert.Equal(indexes, db.indexes)
+	check()
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(ErrDatabaseReadOnly, db.Reindex())
+	assert.NoError(db.Close())
+}
+
+func TestReindexBackup(t *testing.T) {
+	assert := assertion.New(t)
+	backup := testDB + ".backup"
+	os.Remove(testDB)
+	os.Remove(backup)
+	defer os.Remove(testDB)
+	defer os.Remove(backup)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%05d", i)) }
+	for i := 0; i < 3000; i++ {
+		assert.NoError(db.Put(key(i), key(i)))
+	}
+	// the backup opens and holds what was written when it started
+	verify := func(buf []byte, count int) {
+		assert.NoError(ioutil.WriteFile(backup, buf, 0755))
+		b, err := Open(backup, 0755, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer b.Close()
+		// Pages freed since the freelist was last written are leaked in a
+		// backup, nothing else may be off.
+		for _, err := range checkErrors(b) {
+			assert.Contains(err.Error(), "is unreachable and not free")
+		}
+		assert.NoError(b.PreloadIndex())
+		for i := 0; i < count; i += 97 {
+			v, err := b.Get(key(i))
+			assert.NoError(err)
+			assert.Equal(key(i), v)
+		}
+	}
+
+	// The old index pages stay out of the freelist while the transaction
+	// reads them.
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	db.mmaplock.RLock()
+	old := db.indexPages(db.head)
+	db.mmaplock.RUnlock()
+	assert.NotEmpty(old)
+	assert.NoError(db.Reindex())
+	for i := 3000; i < 4000; i++ {
+		assert.NoError(db.Put(key(i), key(i)))
+	}
+	for _, id := range old {
+		assert.NotContains(db.freelist, id)
+	}
+	assert.Len(db.pending, 1)
+	var buf bytes.Buffer
+	_, err = tx.WriteTo(&buf)
+	assert.NoError(err)
+	assert.NoError(tx.Rollback())
+	verify(buf.Bytes(), 3000)
+	// freed by the next commit, which may reuse them
+	assert.NoError(db.Put(key(4000), key(4000)))
+	assert.Empty(db.pending)
+
+	// and while Backup runs concurrently with Reindex and writers
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NoError(db.Reindex())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 4001; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NoError(db.Put(key(i), key(i)))
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		buf.Reset()
+		_, err := db.Backup(&buf)
+		assert.NoError(err)
+		verify(buf.Bytes(), 4001)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Empty(db.pending)
+	assert.NoError(db.Close())
+}
+
+func TestIndexLazy(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, Compression: CompNone})
+	assert.NoError(err)
+	for i := 0; i < 4000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	indexes := db.indexes
+	per := db.indexEntriesPerPage()
+	assert.True(len(indexes) > 3*per)
+	assert.NoError(db.Close())
+
+	// Only the first index page is loaded by Open, a Seek loads up to the
+	// page of its key.
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Len(db.indexes, per)
+	assert.Nil(db.indexOrder)
+	c := db.Cursor()
+	k, _ := c.Seek([]byte("key-0001"))
+	assert.Equal("key-0001", string(k))
+	assert.Len(db.indexes, per)
+	mem, err := db.MemoryStats()
+	assert.NoError(err)
+	small := mem.Index
+	i := 0
+	for string(indexes[i].End[:]) < "key-20" {
+		i++
+	}
+	pages := i/per + 1
+	assert.True(pages > 1 && pages*per < len(indexes))
+	k, _ = c.Seek([]byte("key-2000"))
+	assert.Equal("key-2000", string(k))
+	assert.Len(db.indexes, pages*per)
+	mem, err = db.MemoryStats()
+	assert.NoError(err)
+	assert.Equal(pages*small, mem.Index)
+
+	// Lookups load the rest once, whoever gets there first.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 4000; i += 197 {
+				v, err := db.Get([]byte(fmt.Sprintf("key-%04d", i)))
+				assert.NoError(err)
+				assert.Equal(fmt.Sprintf("value-%d", i), string(v))
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(indexes, db.indexes)
+	assert.Len(db.indexOrder, len(indexes))
+	assert.NoError(db.Close())
+
+	// Writing loads the whole index before appending to it.
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	for i := 4000; i < 4100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("later")))
+	}
+	assert.Equal(indexes, db.indexes[:len(indexes)])
+	assert.True(len(db.indexes) > len(indexes))
+	all := db.indexes
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.PreloadIndex())
+	assert.Equal(all, db.indexes)
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,100 @@
+package sidb
+
+import "sort"
+
+// ForEach calls fn for every live key/value pair, in key order. The walk
+// stops at the first error returned by fn, and ForEach returns it.
+//
+// The data page chain is in key order on databases created in OrderedWrite
+// mode, and walked as it goes. On others the live pairs are collected and
+// sorted first, which takes memory for all of them.
+//
+// Keys and values passed to fn are only valid during the call. The write lock
+// isn't held, so Puts proceed during the walk; whether it sees them is
+// undefined.
+func (db *DB) ForEach(fn func(k, v []byte) error) error {
+	c := db.Cursor()
+	if !db.orderedWrite {
+		return db.forEachSorted(c, nil, nil, fn)
+	}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// ForEachKey is like ForEach for keys only. Values are skipped over without
+// being copied or decompressed, which makes scans of large or compressed
+// values much cheaper.
+func (db *DB) ForEachKey(fn func(k []byte) error) error {
+	c := db.Cursor()
+	c.keysOnly = true
+	if !db.orderedWrite {
+		return db.forEachSorted(c, nil, nil, func(k, _ []byte) error { return fn(k) })
+	}
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// forEachSorted walks c from the first record, collecting copies of the live
+// pairs with start <= key < end, open ends if nil, and calls fn for them in
+// key order, see ForEach and Range.
+func (db *DB) forEachSorted(c *Cursor, start, end []byte, fn func(k, v []byte) error) error {
+	var pairs []KVPair
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if start != nil && db.comparator(k, start) < 0 || end != nil && db.comparator(k, end) >= 0 {
+			continue
+		}
+		kv := KVPair{Key: append([]byte(nil), k...)}
+		if !c.keysOnly {
+			kv.Value = append([]byte{}, v...)
+		}
+		pairs = append(pairs, kv)
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	sort.Slice(pairs, func(i, j int) bool { return db.comparator(pairs[i].Key, pairs[j].Key) < 0 })
+	for i := range pairs {
+		if err := fn(pairs[i].Key, pairs[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range calls fn for the live key/value pairs with start <= key < end, in
+// key order, stopping at the first error returned by fn. A nil start scans
+// from the first key and a nil end to the last one.
+//
+// On databases created in OrderedWrite mode the page index is used to skip
+// the pages entirely before start, and the scan stops at the first key >=
+// end. On others every live pair is looked at, and those in range collected
+// and sorted first, like ForEach does.
+func (db *DB) Range(start, end []byte, fn func(k, v []byte) error) error {
+	c := db.Cursor()
+	if !db.orderedWrite {
+		return db.forEachSorted(c, start, end, fn)
+	}
+	var k, v []byte
+	if start == nil {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(start)
+	}
+	for ; k != nil; k, v = c.Next() {
+		if end != nil && db.comparator(k, end) >= 0 {
+			break
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
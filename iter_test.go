@@ -0,0 +1,294 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestForEach(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 1500; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(db.Delete([]byte("key-00700")))
+
+	var prev []byte
+	var n int
+	assert.NoError(db.ForEach(func(k, v []byte) error {
+		if prev != nil {
+			assert.True(BytesComparator(prev, k) < 0, "%s >= %s", prev, k)
+		}
+		prev = append(prev[:0], k...)
+		assert.False(bytes.Equal(k, []byte("key-00700")))
+		n++
+		return nil
+	}))
+	assert.Equal(1499, n)
+
+	stop := errors.New("stop")
+	n = 0
+	err = db.ForEach(func(k, v []byte) error {
+		n++
+		if n == 10 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(stop, err)
+	assert.Equal(10, n)
+
+	assert.NoError(db.Close())
+	assert.Equal(ErrDatabaseNotOpen, db.ForEach(func(k, v []byte) error { return nil }))
+
+	// Without OrderedWrite the pairs are sorted.
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	for _, k := range []string{"b", "z", "c", "a", "y"} {
+		assert.NoError(db.Put([]byte(k), []byte("value-"+k)))
+	}
+	assert.NoError(db.Put([]byte("z"), []byte("again")))
+	assert.NoError(db.Delete([]byte("c")))
+	var keys, values []string
+	assert.NoError(db.ForEach(func(k, v []byte) error {
+		keys = append(keys, string(k))
+		values = append(values, string(v))
+		return nil
+	}))
+	assert.Equal([]string{"a", "b", "y", "z"}, keys)
+	assert.Equal([]string{"value-a", "value-b", "value-y", "again"}, values)
+	keys = nil
+	assert.NoError(db.ForEachKey(func(k []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	assert.Equal([]string{"a", "b", "y", "z"}, keys)
+	assert.Equal(stop, db.ForEach(func(k, v []byte) error { return stop }))
+	assert.NoError(db.Close())
+}
+
+func TestRange(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	const n = 2000
+	for i := 0; i < n; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.True(db.head.PageCount > 4)
+
+	keys := func(start, end []byte) (keys []string) {
+		assert.NoError(db.Range(start, end, func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		return keys
+	}
+	key := func(i int) string { return fmt.Sprintf("key-%05d", i) }
+
+	// within a page
+	assert.Equal([]string{key(10), key(11), key(12)}, keys([]byte(key(10)), []byte(key(13))))
+	// across pages
+	got := keys([]byte(key(100)), []byte(key(1900)))
+	assert.Equal(1800, len(got))
+	assert.Equal(key(100), got[0])
+	assert.Equal(key(1899), got[len(got)-1])
+	// open ends
+	got = keys(nil, []byte(key(5)))
+	assert.Equal([]string{key(0), key(1), key(2), key(3), key(4)}, got)
+	got = keys([]byte(key(1995)), nil)
+	assert.Equal([]string{key(1995), key(1996), key(1997), key(1998), key(1999)}, got)
+	assert.Equal(n, len(keys(nil, nil)))
+	// empty
+	assert.Nil(keys([]byte(key(20)), []byte(key(20))))
+	assert.Nil(keys([]byte("zzz"), nil))
+
+	stop := errors.New("stop")
+	assert.Equal(stop, db.Range(nil, nil, func(k, v []byte) error { return stop }))
+	assert.NoError(db.Close())
+
+	// Without OrderedWrite keys past end don't stop the scan.
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	for _, k := range []string{"b", "z", "c", "a", "e"} {
+		assert.NoError(db.Put([]byte(k), []byte(k)))
+	}
+	assert.NoError(db.Delete([]byte("e")))
+	assert.NoError(db.Put([]byte("d"), []byte("d")))
+	assert.Equal([]string{"b", "c"}, keys([]byte("b"), []byte("d")))
+	assert.Equal([]string{"a", "b", "c"}, keys([]byte("a"), []byte("d")))
+	assert.Equal([]string{"c", "d", "z"}, keys([]byte("c"), nil))
+	assert.Equal([]string{"a", "b", "c", "d", "z"}, keys(nil, nil))
+	assert.Nil(keys([]byte("e"), []byte("y")))
+	assert.Equal(stop, db.Range(nil, nil, func(k, v []byte) error { return stop }))
+	assert.NoError(db.Close())
+
+	// nor when the file is reopened with OrderedWrite
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	for _, k := range []string{"b", "z", "c"} {
+		assert.NoError(db.Put([]byte(k), []byte(k)))
+	}
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.Equal([]string{"b", "c"}, keys([]byte("a"), []byte("d")))
+	assert.Equal([]string{"c", "z"}, keys([]byte("c"), nil))
+	assert.NoError(db.Close())
+}
+
+func TestForEachKey(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), bytes.Repeat([]byte{byte(i)}, 100)))
+	}
+	assert.NoError(db.Put([]byte("key-00001"), []byte("again")))
+	assert.NoError(db.Delete([]byte("key-00002")))
+
+	var keys []string
+	assert.NoError(db.ForEachKey(func(k []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	var expect []string
+	assert.NoError(db.ForEach(func(k, v []byte) error {
+		expect = append(expect, string(k))
+		return nil
+	}))
+	assert.Equal(999, len(keys))
+	assert.Equal(expect, keys)
+
+	stop := errors.New("stop")
+	assert.Equal(stop, db.ForEachKey(func(k []byte) error { return stop }))
+	assert.NoError(db.Close())
+}
+
+// TestOrderedWriteReopen checks the mode a file was created in is kept,
+// whatever the OrderedWrite option it is opened with.
+func TestOrderedWriteReopen(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// Written in any order, with rewrites spread over indexed pages.
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 999; i >= 0; i-- {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	for i := 0; i < 1000; i += 10 {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("again")))
+	}
+	assert.NoError(db.Delete([]byte("key-0005")))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	assert.True(len(db.indexes) > 10)
+	assert.Zero(db.Features().WriteRequired & FeatureOrderedWrite)
+	check := func() {
+		var keys, values []string
+		assert.NoError(db.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, string(v))
+			return nil
+		}))
+		assert.Len(keys, 999)
+		for i, k := range keys {
+			var n int
+			fmt.Sscanf(k, "key-%d", &n)
+			want := fmt.Sprintf("value-%d", n)
+			if n%10 == 0 {
+				want = "again"
+			}
+			assert.Equal(want, values[i], k)
+			if i > 0 {
+				assert.True(keys[i-1] < k, "%s >= %s", keys[i-1], k)
+			}
+		}
+		var only []string
+		assert.NoError(db.ForEachKey(func(k []byte) error {
+			only = append(only, string(k))
+			return nil
+		}))
+		assert.Equal(keys, only)
+	}
+	check()
+	// keys can still be put in any order
+	assert.NoError(db.Put([]byte("key-0000"), []byte("again")))
+	check()
+	assert.NoError(db.Close())
+
+	// Written in order, opened without the option.
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("b"), []byte("b")))
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.Equal(FeatureOrderedWrite, db.Features().WriteRequired&FeatureOrderedWrite)
+	assert.Equal(ErrKeyOutOfOrder, db.Put([]byte("a"), []byte("a")))
+	assert.NoError(db.Put([]byte("c"), []byte("c")))
+	assert.NoError(db.Close())
+}
+
+// benchmarkScan fills a snappy compressed database with compressible
+// values and runs scan over it.
+func benchmarkScan(b *testing.B, scan func(db *DB) error) {
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.NoSync = true
+	var pairs []KVPair
+	for i := 0; i < 20000; i++ {
+		value := bytes.Repeat([]byte(fmt.Sprintf("value-%d ", i)), 40)
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%06d", i)), Value: value})
+	}
+	if err := db.PutBatch(pairs); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := scan(db); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkForEach(b *testing.B) {
+	benchmarkScan(b, func(db *DB) error {
+		return db.ForEach(func(k, v []byte) error { return nil })
+	})
+}
+
+func BenchmarkForEachKey(b *testing.B) {
+	benchmarkScan(b, func(db *DB) error {
+		return db.ForEachKey(func(k []byte) error { return nil })
+	})
+}
@@ -3,7 +3,7 @@ package sidb
 import (
 	"bytes"
 	"encoding/binary"
-	"github.com/pkg/errors"
+	"io"
 )
 
 type KVFlag uint8
@@ -17,6 +17,15 @@ const (
 	KVKeyPrefixed KVFlag = 1 << iota
 	KVKeyCompressed
 	KVValueCompressed
+	// tombstone: the key is deleted, the value is the commit time, see
+	// tombstoneValue, or empty for those written before
+	KVDeleted
+	// with KVDeleted, in DupKeys mode: only the newest value of the key is
+	// deleted, see DeleteDup
+	KVDeleteNewest
+	// the value is a fragment appended to the value of the previous record
+	// of the key, see Append
+	KVAppended
 	// store hex string as uint, not implemented
 	//KVStringToUint
 )
@@ -26,51 +35,94 @@ type KVPair struct {
 	Value []byte
 }
 
+// MarshalOptions are how KVPair.MarshalWith encodes a record.
+type MarshalOptions struct {
+	// Compressor compresses keys and values where that makes them shorter,
+	// none are with a nil one, as for CompNone.
+	Compressor Compressor
+	// CompressMinSize is the size from which keys and values are compressed,
+	// those shorter are stored as they are without trying.
+	CompressMinSize int
+
+	// compressAppend, if set, compresses in place of Compressor into scratch,
+	// see DB.marshal
+	compressAppend appendCompressor
+	scratch        []byte
+}
+
+// Marshal encodes kv after prevKey, with its key and value compressed by
+// compressor where that makes them shorter.
 func (kv KVPair) Marshal(prevKey []byte, compressor Compressor) []byte {
+	return kv.MarshalWith(prevKey, MarshalOptions{Compressor: compressor})
+}
+
+// MarshalWith encodes kv after prevKey as opts say.
+func (kv KVPair) MarshalWith(prevKey []byte, opts MarshalOptions) []byte {
+	return kv.MarshalAppend(nil, prevKey, opts)
+}
+
+// MarshalAppend appends the encoding of kv after prevKey, as opts say, to dst
+// and returns the extended buffer. dst is grown at most once, to the exact
+// length of the record.
+func (kv KVPair) MarshalAppend(dst, prevKey []byte, opts MarshalOptions) []byte {
 	var flag KVFlag
 	length := 1
-	var prefixed bool
-	var keyLen, valLen []byte
 	prefixLen := getCommonPrefix(prevKey, kv.Key)
 	if prefixLen > 0 {
-		prefixed = true
 		length += 1
 		flag |= KVKeyPrefixed
 	}
 	key := kv.Key[prefixLen:]
 	value := kv.Value
-	if compressor != nil {
-		keyC := compressor(key)
+	compressor := opts.Compressor
+	if compressor != nil && len(key) >= opts.CompressMinSize {
+		var keyC []byte
+		if opts.compressAppend != nil {
+			keyC = opts.compressAppend(opts.scratch, key)
+			// the value goes after it
+			opts.scratch = keyC[len(keyC):]
+		} else {
+			keyC = compressor(key)
+		}
 		if len(keyC) < len(key) {
 			key = keyC
 			flag |= KVKeyCompressed
 		}
-		valueC := compressor(value)
+	}
+	if compressor != nil && len(value) >= opts.CompressMinSize {
+		var valueC []byte
+		if opts.compressAppend != nil {
+			valueC = opts.compressAppend(opts.scratch, value)
+		} else {
+			valueC = compressor(value)
+		}
 		if len(valueC) < len(value) {
 			value = valueC
 			flag |= KVValueCompressed
 		}
 	}
-	kLenBuf := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(kLenBuf, uint64(len(key)))
-	keyLen = kLenBuf[:n]
-
-	vLenBuf := make([]byte, binary.MaxVarintLen64)
-	n = binary.PutUvarint(vLenBuf, uint64(len(value)))
-	valLen = vLenBuf[:n]
-
+	// readers of an uncompressed database have no decompressor
+	if compressor == nil {
+		flag &^= KVKeyCompressed | KVValueCompressed
+	}
+	var kLenBuf, vLenBuf [binary.MaxVarintLen64]byte
+	keyLen := kLenBuf[:binary.PutUvarint(kLenBuf[:], uint64(len(key)))]
+	valLen := vLenBuf[:binary.PutUvarint(vLenBuf[:], uint64(len(value)))]
 	length += len(keyLen) + len(key) + len(valLen) + len(value)
-	//buf := bytes.NewBuffer(make([]byte, length))
-	buf := bytes.NewBuffer(nil)
-	buf.Write([]byte{byte(flag)})
-	if prefixed {
-		buf.Write([]byte{prefixLen})
-	}
-	buf.Write(keyLen)
-	buf.Write(key)
-	buf.Write(valLen)
-	buf.Write(value)
-	return buf.Bytes()
+
+	if cap(dst)-len(dst) < length {
+		buf := make([]byte, len(dst), len(dst)+length)
+		copy(buf, dst)
+		dst = buf
+	}
+	dst = append(dst, byte(flag))
+	if prefixLen > 0 {
+		dst = append(dst, prefixLen)
+	}
+	dst = append(dst, keyLen...)
+	dst = append(dst, key...)
+	dst = append(dst, valLen...)
+	return append(dst, value...)
 }
 
 func (kv *KVPair) clear() {
@@ -79,65 +131,170 @@ func (kv *KVPair) clear() {
 }
 
 func (kv *KVPair) Unmarshal(data, prevKey []byte, decompressor DeCompressor) (err error) {
-	reader := bytes.NewReader(data)
 	if data == nil {
-		return errors.New("empty KV data")
+		return corruptPage(0, 0, "empty KV data")
 	}
 	if len(data) < minKVSize {
-		return errors.New("KV data les than min data size 5, flag + keyLen + key + valueLen + value")
+		return corruptPage(0, 0, "KV data les than min data size 5, flag + keyLen + key + valueLen + value")
 	}
+	_, _, err = kv.unmarshal(data, prevKey, decompressor)
+	return err
+}
+
+// unmarshal decodes the record at the start of data, which may be followed by
+// more records, and returns its length and flags.
+func (kv *KVPair) unmarshal(data, prevKey []byte, decompressor DeCompressor) (n int, flag KVFlag, err error) {
+	if len(data) == 0 {
+		return 0, 0, corruptPage(0, 0, "empty KV data")
+	}
+	reader := bytes.NewReader(data)
 	var prefix, key, val []byte
-	_flag, _ := reader.ReadByte()
-	flag := KVFlag(_flag)
+	_flag, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, corruptPage(0, 0, "failed to read flag: %s", err)
+	}
+	flag = KVFlag(_flag)
 	if flag&KVKeyPrefixed != 0 {
-		_prefixedLen, _ := reader.ReadByte()
+		_prefixedLen, err := reader.ReadByte()
+		if err != nil {
+			return 0, 0, corruptPage(0, 1, "failed to read key prefix length: %s", err)
+		}
 		prefixedLen := int(_prefixedLen)
 		if len(prevKey) < prefixedLen {
-			return errors.New("wrong prefixed key len")
+			return 0, 0, corruptPage(0, 1, "wrong prefixed key len")
 		}
 		prefix = prevKey[:prefixedLen]
 	}
 	if decompressor == nil && (flag&KVKeyCompressed != 0 || flag&KVValueCompressed != 0) {
-		return errors.New("key is compressed but decompressor is nil")
+		return 0, 0, corruptPage(0, 0, "record is compressed but the database is not, see CompNone")
 	}
+	// the offset in data of what is read next
+	pos := func() int { return len(data) - reader.Len() }
+	kPos := pos()
 	kLen, err := binary.ReadUvarint(reader)
 	if err != nil {
-		return errors.Wrap(err, "failed to read key length")
+		return 0, 0, corruptPage(0, kPos, "failed to read key length: %s", err)
 	}
-	key = make([]byte, kLen)
-	_, err = reader.Read(key)
-	if err != nil {
-		return errors.Wrap(err, "failed to read key")
+	kPos = pos()
+	// lengths are checked before allocating, a corrupt one may be huge
+	if kLen > uint64(reader.Len()) {
+		return 0, 0, corruptPage(0, kPos, "key of %d bytes, %d left", kLen, reader.Len())
+	}
+	// The prefix is copied, never appended to: prevKey's array may be the
+	// caller's to reuse.
+	key = make([]byte, len(prefix)+int(kLen))
+	copy(key, prefix)
+	if _, err = io.ReadFull(reader, key[len(prefix):]); err != nil {
+		return 0, 0, corruptPage(0, kPos, "failed to read key: %s", err)
 	}
 
+	vPos := pos()
 	vLen, err := binary.ReadUvarint(reader)
 	if err != nil {
-		return errors.Wrap(err, "failed to read value length")
+		return 0, 0, corruptPage(0, vPos, "failed to read value length: %s", err)
+	}
+	vPos = pos()
+	if vLen > uint64(reader.Len()) {
+		return 0, 0, corruptPage(0, vPos, "value of %d bytes, %d left", vLen, reader.Len())
 	}
 	val = make([]byte, vLen)
-	_, err = reader.Read(val)
-	if err != nil {
-		return errors.Wrap(err, "failed to read value")
+	if _, err = io.ReadFull(reader, val); err != nil {
+		return 0, 0, corruptPage(0, vPos, "failed to read value: %s", err)
 	}
 
 	if flag&KVKeyCompressed != 0 {
-		key, err = decompressor(key)
+		raw, err := decompressor(key[len(prefix):])
 		if err != nil {
-			return errors.Wrap(err, "failed to decompress key")
+			return 0, 0, corruptPage(0, kPos, "failed to decompress key: %s", err)
 		}
+		key = append(key[:len(prefix)], raw...)
 	}
 
 	if flag&KVValueCompressed != 0 {
 		val, err = decompressor(val)
 		if err != nil {
-			return errors.Wrap(err, "failed to decompress value")
+			return 0, 0, corruptPage(0, vPos, "failed to decompress value: %s", err)
 		}
 	}
-	kv.Key = append(prefix, key...)
+	kv.Key = key
 	kv.Value = val
+	return len(data) - reader.Len(), flag, nil
+}
+
+// UnmarshalTo decodes like Unmarshal, but the key and value are appended to
+// the scratch buffers key and value from their start, so that decoding
+// doesn't allocate once they are large enough. prevKey may share key's array,
+// as when decoding the records of a page in sequence with one key buffer.
+func (kv *KVPair) UnmarshalTo(data, prevKey, key, value []byte, decompressor DeCompressor) error {
+	k, v, _, _, err := decodeKV(data, prevKey, key[:0], value[:0], decompressor, true)
+	if err != nil {
+		return err
+	}
+	kv.Key, kv.Value = k, v
 	return nil
 }
 
+// decodeKV decodes the record at the start of data, appending its key to key
+// and, if withValue is set, its value to value. Otherwise v is the raw value
+// in data, still compressed if the record says so. It returns the record
+// length and flags as well.
+func decodeKV(data, prevKey, key, value []byte, decompressor DeCompressor, withValue bool) (k, v []byte, n int, flag KVFlag, err error) {
+	if len(data) == 0 {
+		return nil, nil, 0, 0, corruptPage(0, 0, "empty KV data")
+	}
+	flag = KVFlag(data[0])
+	n = 1
+	prefixLen := 0
+	if flag&KVKeyPrefixed != 0 {
+		if len(data) < 2 {
+			return nil, nil, 0, 0, corruptPage(0, 1, "failed to read key prefix length")
+		}
+		prefixLen = int(data[1])
+		if len(prevKey) < prefixLen {
+			return nil, nil, 0, 0, corruptPage(0, 1, "wrong prefixed key len")
+		}
+		n++
+	}
+	if decompressor == nil && (flag&KVKeyCompressed != 0 || flag&KVValueCompressed != 0) {
+		return nil, nil, 0, 0, corruptPage(0, 0, "record is compressed but the database is not, see CompNone")
+	}
+	kLen, m := binary.Uvarint(data[n:])
+	if m <= 0 || uint64(len(data)-n-m) < kLen {
+		return nil, nil, 0, 0, corruptPage(0, n, "failed to read key")
+	}
+	kPos := n + m
+	n += m
+	rawKey := data[n : n+int(kLen)]
+	n += int(kLen)
+	vLen, m := binary.Uvarint(data[n:])
+	if m <= 0 || uint64(len(data)-n-m) < vLen {
+		return nil, nil, 0, 0, corruptPage(0, n, "failed to read value")
+	}
+	vPos := n + m
+	n += m
+	rawValue := data[n : n+int(vLen)]
+	n += int(vLen)
+
+	if flag&KVKeyCompressed != 0 {
+		if rawKey, err = decompressor(rawKey); err != nil {
+			return nil, nil, 0, 0, corruptPage(0, kPos, "failed to decompress key: %s", err)
+		}
+	}
+	// key may be prevKey's array, in which case the prefix copies onto itself.
+	k = append(append(key, prevKey[:prefixLen]...), rawKey...)
+	if withValue {
+		if flag&KVValueCompressed != 0 {
+			if rawValue, err = decompressor(rawValue); err != nil {
+				return nil, nil, 0, 0, corruptPage(0, vPos, "failed to decompress value: %s", err)
+			}
+		}
+		v = append(value, rawValue...)
+	} else {
+		v = rawValue
+	}
+	return k, v, n, flag, nil
+}
+
 func getCommonPrefix(a, b []byte) (length uint8) {
 	if a == nil || b == nil {
 		return
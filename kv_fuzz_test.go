@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package sidb
+
+import (
+	"runtime"
+	"testing"
+)
+
+// FuzzUnmarshal checks that no record, however corrupt, makes Unmarshal
+// panic or allocate much more than its compressed parts may expand to.
+func FuzzUnmarshal(f *testing.F) {
+	prev := []byte("key-0001")
+	for _, kv := range []KVPair{
+		{[]byte("key-0002"), []byte("value")},
+		{[]byte("k"), nil},
+		{[]byte("key-0003"), []byte("valuevaluevaluevaluevaluevaluevaluevaluevaluevaluevaluevaluevaluevaluevalue")},
+	} {
+		f.Add(kv.Marshal(prev, nil), uint8(CompNone))
+		f.Add(kv.Marshal(prev, SnappyCompress), uint8(CompSnappy))
+		f.Add(kv.Marshal(prev, Lz4Compress), uint8(CompLz4))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, comp uint8) {
+		var decompressor DeCompressor
+		switch CompressAlgorithm(comp) {
+		case CompSnappy:
+			decompressor = SnappyDeCompress
+		case CompLz4:
+			decompressor = Lz4DeCompress
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var kv KVPair
+		err := kv.Unmarshal(data, prev, decompressor)
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20+uint64(len(data))*256 {
+			t.Fatalf("%d bytes allocated for a record of %d", alloc, len(data))
+		}
+		if err == nil && len(kv.Key) > len(prev)+len(data)*255 {
+			t.Fatalf("key of %d bytes from a record of %d", len(kv.Key), len(data))
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package sidb
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
 	assertion "github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -43,3 +46,137 @@ func TestKVSerdeLz4(t *testing.T) {
 	assert.Equal(kv.Key, kv2.Key)
 	assert.Equal(kv.Value, kv2.Value)
 }
+
+func TestKVSerdeMinSize(t *testing.T) {
+	assert := assertion.New(t)
+	calls := 0
+	compressor := func(in []byte) []byte {
+		calls++
+		return SnappyCompress(in)
+	}
+	kv := KVPair{[]byte("keykeykeykey"), bytes.Repeat([]byte("value"), 20)}
+	ser := kv.MarshalWith(nil, MarshalOptions{Compressor: compressor, CompressMinSize: 64})
+	assert.Equal(1, calls)
+	assert.Equal(KVValueCompressed, KVFlag(ser[0]))
+	kv2 := KVPair{}
+	assert.NoError(kv2.Unmarshal(ser, nil, SnappyDeCompress))
+	assert.Equal(kv, kv2)
+
+	calls = 0
+	ser = kv.MarshalWith(nil, MarshalOptions{Compressor: compressor, CompressMinSize: 101})
+	assert.Zero(calls)
+	assert.Zero(ser[0])
+	assert.Equal(ser, kv.Marshal(nil, nil))
+	assert.Equal(kv.Marshal(nil, compressor), kv.MarshalWith(nil, MarshalOptions{Compressor: compressor}))
+}
+
+func TestKVMarshalAppend(t *testing.T) {
+	assert := assertion.New(t)
+	prev := []byte("key-0001")
+	kv := KVPair{[]byte("key-0002"), bytes.Repeat([]byte("value"), 20)}
+	opts := MarshalOptions{Compressor: SnappyCompress}
+	rec := kv.MarshalWith(prev, opts)
+	assert.Equal(len(rec), cap(rec))
+	assert.Equal(append([]byte("head"), rec...), kv.MarshalAppend([]byte("head"), prev, opts))
+
+	// one allocation, the record, none if dst has room for it
+	assert.Equal(1.0, testing.AllocsPerRun(100, func() { kv.MarshalWith(prev, MarshalOptions{}) }))
+	dst := make([]byte, 0, 256)
+	assert.Zero(testing.AllocsPerRun(100, func() { kv.MarshalAppend(dst, prev, MarshalOptions{}) }))
+}
+
+// BenchmarkMarshal encodes records of 100-byte values, not compressed, into
+// new buffers or one reused.
+func BenchmarkMarshal(b *testing.B) {
+	kv := KVPair{Key: []byte("key-00000001"), Value: bytes.Repeat([]byte("v"), 100)}
+	prev := []byte("key-00000000")
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			kv.MarshalWith(prev, MarshalOptions{})
+		}
+	})
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst []byte
+		for i := 0; i < b.N; i++ {
+			dst = kv.MarshalAppend(dst[:0], prev, MarshalOptions{})
+		}
+	})
+}
+
+// BenchmarkMarshalSmall encodes records of 10-byte values, trying to compress
+// them or not.
+func BenchmarkMarshalSmall(b *testing.B) {
+	for _, min := range []int{-1, DefaultCompressMinSize} {
+		b.Run(fmt.Sprintf("min=%d", min), func(b *testing.B) {
+			opts := MarshalOptions{Compressor: SnappyCompress, CompressMinSize: min}
+			kv := KVPair{Key: []byte("key-00000001"), Value: []byte("value-0001")}
+			for i := 0; i < b.N; i++ {
+				kv.MarshalWith(nil, opts)
+			}
+		})
+	}
+}
+
+func TestKVCorrupt(t *testing.T) {
+	assert := assertion.New(t)
+	kv := KVPair{[]byte("key"), []byte("value")}
+	ser := kv.Marshal(nil, nil)
+	var kv2 KVPair
+	// flag, key length, key, value length
+	err := kv2.UnmarshalTo(ser[:len(ser)-1], nil, nil, nil, nil)
+	assert.Equal(&ErrCorrupt{Offset: 5, Reason: "failed to read value"}, err)
+	prefixed := append([]byte{byte(KVKeyPrefixed), 4}, ser[1:]...)
+	err = kv2.Unmarshal(prefixed, []byte("key"), nil)
+	assert.Equal(&ErrCorrupt{Offset: 1, Reason: "wrong prefixed key len"}, errors.Cause(err))
+
+	// lengths past the end of the record, no matter how large
+	err = kv2.Unmarshal(ser[:len(ser)-1], nil, nil)
+	assert.Equal(&ErrCorrupt{Offset: 6, Reason: "value of 5 bytes, 4 left"}, errors.Cause(err))
+	huge := []byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 'k'}
+	err = kv2.Unmarshal(huge, nil, nil)
+	assert.Equal(&ErrCorrupt{Offset: 10, Reason: "key of 9223372036854775807 bytes, 1 left"}, errors.Cause(err))
+	err = kv2.Unmarshal([]byte{byte(KVKeyPrefixed)}, []byte("key"), nil)
+	assert.Error(err)
+}
+
+func TestKVUnmarshalPrevKey(t *testing.T) {
+	assert := assertion.New(t)
+	// a key buffer with room to spare, as a cursor's
+	prev := append(make([]byte, 0, 64), "key-0001"...)
+	spare := prev[:cap(prev)]
+	for i := len(prev); i < len(spare); i++ {
+		spare[i] = 'x'
+	}
+	want := append([]byte(nil), spare...)
+	kv := KVPair{[]byte("key-0002"), []byte("value")}
+	var kv2 KVPair
+	assert.NoError(kv2.Unmarshal(kv.Marshal(prev, nil), prev, nil))
+	assert.Equal(kv, kv2)
+	assert.Equal(want, spare)
+
+	// a chain of prefixed records, each decoded against the last key
+	var data []byte
+	var keys [][]byte
+	var prevKey []byte
+	for i := 0; i < 20; i++ {
+		k := []byte(fmt.Sprintf("key-%04d-%s", i, bytes.Repeat([]byte("k"), i)))
+		keys = append(keys, k)
+		data = append(data, (&KVPair{k, []byte("value")}).Marshal(prevKey, SnappyCompress)...)
+		prevKey = k
+	}
+	var got [][]byte
+	prevKey = nil
+	for len(data) > 0 {
+		n, flag, err := kv2.unmarshal(data, prevKey, SnappyDeCompress)
+		assert.NoError(err)
+		if len(got) > 0 {
+			assert.NotZero(flag & KVKeyPrefixed)
+		}
+		got = append(got, kv2.Key)
+		prevKey = kv2.Key
+		data = data[n:]
+	}
+	assert.Equal(keys, got)
+}
@@ -0,0 +1,167 @@
+package sidb
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// The head page and page headers are stored at fixed offsets with every field
+// little-endian, whatever the host, so that files move between architectures.
+// The layout is the one amd64 gives the structs, padding zeroed:
+//
+//	HeadPage                          Page
+//	 0 magic           48 comparator   0 Flag      8 Next
+//	 4 Checksum        72 Features     2 Count    12 ptr
+//	 8 Version         84 tombstones   4 Len      16 CheckSum
+//	10 Compression     88 generation
+//	12 PageSize        96 freelist
+//	16 PageCount      100 freeCount
+//	20 IndexPageCount 104 CompressionLevel
+//	24 indexPtr       108 ChecksumAlgo
+//	32 kvPtr
+//	40 nextIndexPage
+//	44 ptr
+//
+// RecordPtr is pageNum then offset, Features is Required, WriteRequired and
+// Optional. Entries of index pages are Start, End and PageNum.
+const (
+	headPageSize   = 112
+	pageHeaderSize = 20
+	indexEntrySize = 16
+
+	// generationOffset is the position of HeadPage.generation in the file.
+	generationOffset = 88
+	// positions of HeadPage and Page fields, see ErrCorrupt
+	checksumOffset  = 4
+	pageSizeOffset  = 12
+	freelistOffset  = 96
+	freeCountOffset = 100
+	pageCountOffset = 2
+	pageLenOffset   = 4
+	pageNextOffset  = 8
+	pagePtrOffset   = 12
+)
+
+// nativeLayout is set if HeadPage and Page are laid out in memory as on disk,
+// as on little-endian hosts, so that they are read in place from the mapping
+// instead of decoded, see DB.page.
+var nativeLayout = func() bool {
+	h := HeadPage{
+		magic: 1, Checksum: 2, Version: 3, Compression: 4, PageSize: 5, PageCount: 6,
+		IndexPageCount: 7, indexPtr: RecordPtr{8, 9}, kvPtr: RecordPtr{10, 11},
+		nextIndexPage: 12, ptr: 13, Features: Features{14, 15, 16}, tombstones: 17,
+		generation: 18, freelist: 19, freeCount: 20, CompressionLevel: 21, ChecksumAlgo: 22,
+	}
+	copy(h.comparator[:], "comparator")
+	p := Page{Flag: 1, Count: 2, Len: 3, Next: 4, ptr: 5, CheckSum: 6}
+	if unsafe.Sizeof(h) != headPageSize || unsafe.Sizeof(p) != pageHeaderSize {
+		return false
+	}
+	var hb [headPageSize]byte
+	var pb [pageHeaderSize]byte
+	headPageEncode(hb[:], &h)
+	pageHeaderEncode(pb[:], &p)
+	return hb == *(*[headPageSize]byte)(unsafe.Pointer(&h)) &&
+		pb == *(*[pageHeaderSize]byte)(unsafe.Pointer(&p))
+}()
+
+// headPageDecode decodes the head page at the start of b.
+func headPageDecode(b []byte) HeadPage {
+	_ = b[headPageSize-1]
+	le := binary.LittleEndian
+	h := HeadPage{
+		magic:            le.Uint32(b[0:]),
+		Checksum:         le.Uint32(b[4:]),
+		Version:          le.Uint16(b[8:]),
+		Compression:      CompressAlgorithm(le.Uint16(b[10:])),
+		PageSize:         PageSz(le.Uint32(b[12:])),
+		PageCount:        PageId(le.Uint32(b[16:])),
+		IndexPageCount:   le.Uint32(b[20:]),
+		indexPtr:         RecordPtr{le.Uint32(b[24:]), PageSz(le.Uint32(b[28:]))},
+		kvPtr:            RecordPtr{le.Uint32(b[32:]), PageSz(le.Uint32(b[36:]))},
+		nextIndexPage:    PageId(le.Uint32(b[40:])),
+		ptr:              PageSz(le.Uint32(b[44:])),
+		Features:         Features{le.Uint32(b[72:]), le.Uint32(b[76:]), le.Uint32(b[80:])},
+		tombstones:       le.Uint32(b[84:]),
+		generation:       le.Uint64(b[88:]),
+		freelist:         PageId(le.Uint32(b[96:])),
+		freeCount:        le.Uint32(b[100:]),
+		CompressionLevel: int32(le.Uint32(b[104:])),
+		ChecksumAlgo:     ChecksumAlgorithm(le.Uint16(b[108:])),
+	}
+	copy(h.comparator[:], b[48:72])
+	return h
+}
+
+// headPageEncode encodes h at the start of b.
+func headPageEncode(b []byte, h *HeadPage) {
+	_ = b[headPageSize-1]
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], h.magic)
+	le.PutUint32(b[4:], h.Checksum)
+	le.PutUint16(b[8:], h.Version)
+	le.PutUint16(b[10:], uint16(h.Compression))
+	le.PutUint32(b[12:], uint32(h.PageSize))
+	le.PutUint32(b[16:], uint32(h.PageCount))
+	le.PutUint32(b[20:], h.IndexPageCount)
+	le.PutUint32(b[24:], h.indexPtr.pageNum)
+	le.PutUint32(b[28:], uint32(h.indexPtr.offset))
+	le.PutUint32(b[32:], h.kvPtr.pageNum)
+	le.PutUint32(b[36:], uint32(h.kvPtr.offset))
+	le.PutUint32(b[40:], uint32(h.nextIndexPage))
+	le.PutUint32(b[44:], uint32(h.ptr))
+	copy(b[48:72], h.comparator[:])
+	le.PutUint32(b[72:], h.Features.Required)
+	le.PutUint32(b[76:], h.Features.WriteRequired)
+	le.PutUint32(b[80:], h.Features.Optional)
+	le.PutUint32(b[84:], h.tombstones)
+	le.PutUint64(b[88:], h.generation)
+	le.PutUint32(b[96:], uint32(h.freelist))
+	le.PutUint32(b[100:], h.freeCount)
+	le.PutUint32(b[104:], uint32(h.CompressionLevel))
+	le.PutUint16(b[108:], uint16(h.ChecksumAlgo))
+	b[110], b[111] = 0, 0
+}
+
+// pageHeaderDecode decodes the page header at the start of b.
+func pageHeaderDecode(b []byte) Page {
+	_ = b[pageHeaderSize-1]
+	le := binary.LittleEndian
+	return Page{
+		Flag:     PageFlag(le.Uint16(b[0:])),
+		Count:    le.Uint16(b[2:]),
+		Len:      PageSz(le.Uint32(b[4:])),
+		Next:     PageId(le.Uint32(b[8:])),
+		ptr:      PageSz(le.Uint32(b[12:])),
+		CheckSum: le.Uint32(b[16:]),
+	}
+}
+
+// pageHeaderEncode encodes p at the start of b.
+func pageHeaderEncode(b []byte, p *Page) {
+	_ = b[pageHeaderSize-1]
+	le := binary.LittleEndian
+	le.PutUint16(b[0:], uint16(p.Flag))
+	le.PutUint16(b[2:], p.Count)
+	le.PutUint32(b[4:], uint32(p.Len))
+	le.PutUint32(b[8:], uint32(p.Next))
+	le.PutUint32(b[12:], uint32(p.ptr))
+	le.PutUint32(b[16:], p.CheckSum)
+}
+
+// indexDecode decodes the index entry at the start of b.
+func indexDecode(b []byte) Index {
+	_ = b[indexEntrySize-1]
+	idx := Index{PageNum: binary.LittleEndian.Uint32(b[12:])}
+	copy(idx.Start[:], b[0:6])
+	copy(idx.End[:], b[6:12])
+	return idx
+}
+
+// indexEncode encodes idx at the start of b.
+func indexEncode(b []byte, idx *Index) {
+	_ = b[indexEntrySize-1]
+	copy(b[0:6], idx.Start[:])
+	copy(b[6:12], idx.End[:])
+	binary.LittleEndian.PutUint32(b[12:], idx.PageNum)
+}
@@ -0,0 +1,115 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	assert := assertion.New(t)
+	h := HeadPage{
+		magic: 0x01020304, Checksum: 0x05060708, Version: 0x090a, Compression: 0x0b0c,
+		PageSize: 0x1000, PageCount: 0x11121314, IndexPageCount: 0x15161718,
+		indexPtr: RecordPtr{0x191a1b1c, 0x1d1e1f20}, kvPtr: RecordPtr{0x21222324, 0x25262728},
+		nextIndexPage: 0x292a2b2c, ptr: 0x2d2e2f30,
+		Features:   Features{0x31323334, 0x35363738, 0x393a3b3c},
+		tombstones: 0x3d3e3f40, generation: 0x4142434445464748, freelist: 0x494a4b4c, freeCount: 0x4d4e4f50,
+		CompressionLevel: 0x51525354, ChecksumAlgo: 0x5556,
+	}
+	copy(h.comparator[:], "bytes")
+	golden := []byte{
+		0x04, 0x03, 0x02, 0x01, 0x08, 0x07, 0x06, 0x05, 0x0a, 0x09, 0x0c, 0x0b, 0x00, 0x10, 0x00, 0x00,
+		0x14, 0x13, 0x12, 0x11, 0x18, 0x17, 0x16, 0x15, 0x1c, 0x1b, 0x1a, 0x19, 0x20, 0x1f, 0x1e, 0x1d,
+		0x24, 0x23, 0x22, 0x21, 0x28, 0x27, 0x26, 0x25, 0x2c, 0x2b, 0x2a, 0x29, 0x30, 0x2f, 0x2e, 0x2d,
+		'b', 'y', 't', 'e', 's', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0x34, 0x33, 0x32, 0x31, 0x38, 0x37, 0x36, 0x35,
+		0x3c, 0x3b, 0x3a, 0x39, 0x40, 0x3f, 0x3e, 0x3d, 0x48, 0x47, 0x46, 0x45, 0x44, 0x43, 0x42, 0x41,
+		0x4c, 0x4b, 0x4a, 0x49, 0x50, 0x4f, 0x4e, 0x4d, 0x54, 0x53, 0x52, 0x51, 0x56, 0x55, 0, 0,
+	}
+	buf := make([]byte, headPageSize)
+	headPageEncode(buf, &h)
+	assert.Equal(golden, buf)
+	assert.Equal(h, headPageDecode(golden))
+	assert.Equal([]byte{0x48, 0x47, 0x46, 0x45, 0x44, 0x43, 0x42, 0x41}, buf[generationOffset:generationOffset+8])
+
+	p := Page{Flag: PageData | PageSorted | PageBloom, Count: 0x0102, Len: 0x03040506, Next: 0x0708090a, ptr: 0x0b0c0d0e, CheckSum: 0x0f101112}
+	golden = []byte{
+		0x82, 0x01, 0x02, 0x01, 0x06, 0x05, 0x04, 0x03, 0x0a, 0x09, 0x08, 0x07,
+		0x0e, 0x0d, 0x0c, 0x0b, 0x12, 0x11, 0x10, 0x0f,
+	}
+	buf = bytes.Repeat([]byte{0xff}, pageHeaderSize)
+	pageHeaderEncode(buf, &p)
+	assert.Equal(golden, buf)
+	assert.Equal(p, pageHeaderDecode(golden))
+
+	idx := Index{Start: [6]byte{1, 2, 3, 4, 5, 6}, End: [6]byte{7, 8, 9, 10, 11, 12}, PageNum: 0x0d0e0f10}
+	golden = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x10, 0x0f, 0x0e, 0x0d}
+	buf = make([]byte, indexEntrySize)
+	indexEncode(buf, &idx)
+	assert.Equal(golden, buf)
+	assert.Equal(idx, indexDecode(golden))
+
+	switch runtime.GOARCH {
+	case "amd64", "386", "arm64", "arm":
+		assert.True(nativeLayout)
+	case "s390x", "ppc64", "mips", "mips64":
+		assert.False(nativeLayout)
+	}
+}
+
+// TestLayoutPortable writes and reads a file the way big-endian hosts do,
+// decoding headers instead of reading them in place, and reads it back in
+// place.
+func TestLayoutPortable(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	native := nativeLayout
+	defer func() { nativeLayout = native }()
+
+	values := make(map[string][]byte)
+	check := func(db *DB) {
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+		}
+		n := 0
+		c := db.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+		assert.NoError(c.Err())
+		assert.Equal(len(values), n)
+	}
+
+	nativeLayout = false
+	db, err := Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("key-%04d", i)
+		values[k] = []byte(fmt.Sprintf("value-%d", i))
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	values["big"] = bytes.Repeat([]byte("big value "), db.pageSize)
+	assert.NoError(db.PutBatch([]KVPair{{Key: []byte("big"), Value: values["big"]}}))
+	assert.Equal(uint64(1001), db.head.generation)
+	check(db)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	check(db)
+	assert.NoError(db.Close())
+
+	nativeLayout = native
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	assert.Equal(uint64(1001), db.Generation())
+	check(db)
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,202 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// lockFileSuffix is appended to the database path to name the external lock file.
+const lockFileSuffix = ".lock"
+
+// maxLockRetries bounds how often lock acquisition is retried when the
+// external lock file is replaced underneath us.
+const maxLockRetries = 10
+
+// lockFile returns the file the advisory lock is taken on.
+func (db *DB) lockFile() *os.File {
+	if db.lockfile != nil {
+		return db.lockfile
+	}
+	return db.file
+}
+
+// openLockFile opens the external lock file, creating it with mode 0600 if it
+// doesn't exist yet. created reports whether this call created it.
+func openLockFile(path string) (f *os.File, created bool, err error) {
+	f, err = os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		return f, true, nil
+	}
+	if !os.IsExist(err) {
+		return nil, false, errors.Wrap(err, "create lock file")
+	}
+	f, err = os.OpenFile(path, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "open lock file")
+	}
+	return f, false, nil
+}
+
+// lockExternal takes the advisory lock on path + ".lock", waiting for up to
+// timeout while another process holds it, see waitflock.
+//
+// The holder of the exclusive lock removes the lock file on Close, so a lock
+// may be won on a file that has just been unlinked. After locking, the locked
+// file is compared with the one currently at the path, and the whole dance is
+// retried if they differ.
+func (db *DB) lockExternal(timeout time.Duration) error {
+	path := db.path + lockFileSuffix
+	for i := 0; i < maxLockRetries; i++ {
+		f, created, err := openLockFile(path)
+		if err != nil {
+			return err
+		}
+		db.lockfile = f
+		if err := waitflock(db, timeout); err != nil {
+			db.closeLockFile()
+			return err
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			db.closeLockFile()
+			return errors.Wrap(err, "stat lock file")
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			db.lockCreated = created
+			db.lockedAt = time.Now()
+			return nil
+		}
+		// The file was removed or replaced by its previous owner.
+		_ = funlock(db)
+		db.closeLockFile()
+	}
+	return errors.New("lock file keeps changing")
+}
+
+// unlockExternal releases the external lock. The exclusive holder removes the
+// lock file if it created it; this happens while the lock is still held, so
+// no other handle can be holding a lock on it at that moment.
+func (db *DB) unlockExternal() error {
+	if db.lockfile == nil {
+		return nil
+	}
+	if db.lockCreated && !db.readOnly {
+		if err := os.Remove(db.lockfile.Name()); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove lock file")
+		}
+	}
+	err := funlock(db)
+	db.closeLockFile()
+	return err
+}
+
+func (db *DB) closeLockFile() {
+	_ = db.lockfile.Close()
+	db.lockfile = nil
+	db.lockCreated = false
+}
+
+// LockMechanism names how a database handle is locked.
+type LockMechanism string
+
+const (
+	// no lock is held, see Options.NoLock
+	LockMechanismNone LockMechanism = "none"
+	// flock on the data file
+	LockMechanismFlock LockMechanism = "flock"
+	// flock on path + ".lock", see Options.ExternalLockFile
+	LockMechanismExternalFile LockMechanism = "external-file"
+	// path + ".dotlock" created with O_EXCL, see LockDotfile
+	LockMechanismDotfile LockMechanism = "dotfile"
+)
+
+// LockInfo describes the lock held by a database handle.
+type LockInfo struct {
+	Mechanism LockMechanism
+	// Exclusive is true for a read-write handle, false for a shared lock.
+	Exclusive bool
+	// Acquired is when the lock was last acquired or changed mode.
+	Acquired time.Time
+	// Path is the file the lock is taken on, empty if no lock is held.
+	Path string
+}
+
+// LockInfo reports the lock held by the handle.
+func (db *DB) LockInfo() LockInfo {
+	if db.noLock || (db.lockMode == LockDotfile && db.dotlock == nil) {
+		return LockInfo{Mechanism: LockMechanismNone}
+	}
+	if db.dotlock != nil {
+		return LockInfo{
+			Mechanism: LockMechanismDotfile,
+			Exclusive: true,
+			Acquired:  db.lockedAt,
+			Path:      db.dotlock.path,
+		}
+	}
+	info := LockInfo{
+		Mechanism: LockMechanismFlock,
+		Exclusive: !db.readOnly,
+		Acquired:  db.lockedAt,
+		Path:      db.path,
+	}
+	if db.lockCreated || (db.lockfile != nil && db.lockfile.Name() == db.path+lockFileSuffix) {
+		info.Mechanism = LockMechanismExternalFile
+		info.Path = db.path + lockFileSuffix
+	}
+	return info
+}
+
+// LockProbe tells which locks could be obtained on a database at probe time.
+type LockProbe struct {
+	Shared    bool
+	Exclusive bool
+}
+
+// ProbeLock tests, without blocking, whether a shared and an exclusive lock
+// could currently be obtained on the database at path. Locks are released
+// immediately; the database is not opened. If an external lock file exists
+// it is probed as well, and both must be free. A dotfile lock younger than
+// DefaultLockStaleTTL rules out the exclusive lock.
+func ProbeLock(path string) (LockProbe, error) {
+	probe, err := probeFile(path)
+	if err != nil {
+		return probe, err
+	}
+	if info, err := os.Stat(path + dotLockSuffix); err == nil && time.Since(info.ModTime()) < DefaultLockStaleTTL {
+		probe.Exclusive = false
+	}
+	ext, err := probeFile(path + lockFileSuffix)
+	if os.IsNotExist(errors.Cause(err)) {
+		return probe, nil
+	} else if err != nil {
+		return probe, err
+	}
+	probe.Shared = probe.Shared && ext.Shared
+	probe.Exclusive = probe.Exclusive && ext.Exclusive
+	return probe, nil
+}
+
+func probeFile(path string) (LockProbe, error) {
+	var probe LockProbe
+	f, err := os.Open(path)
+	if err != nil {
+		return probe, errors.Wrap(err, "open for lock probe")
+	}
+	// Closing the descriptor releases any lock taken on it.
+	defer f.Close()
+
+	if err := flockFile(f, true); err == nil {
+		return LockProbe{Shared: true, Exclusive: true}, nil
+	} else if !errors.Is(err, ErrWriteByOther) {
+		return probe, err
+	}
+	if err := flockFile(f, false); err == nil {
+		probe.Shared = true
+	} else if !errors.Is(err, ErrWriteByOther) {
+		return probe, err
+	}
+	return probe, nil
+}
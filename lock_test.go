@@ -0,0 +1,202 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExternalLockFile(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + lockFileSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + lockFileSuffix)
+	opts := &Options{ExternalLockFile: true}
+
+	db, err := Open(testDB, 0755, opts)
+	assert.NoError(err)
+	info, err := os.Stat(testDB + lockFileSuffix)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// the data file itself is not locked
+	f, err := os.Open(testDB)
+	assert.NoError(err)
+	assert.NoError(flockFile(f, true))
+	assert.NoError(f.Close())
+
+	// mutual exclusion still holds through the lock file
+	asOtherProcess(db)
+	_, err = Open(testDB, 0755, opts)
+	assert.True(errors.Is(err, ErrWriteByOther))
+	_, err = Open(testDB, 0755, &Options{ExternalLockFile: true, ReadOnly: true})
+	assert.True(errors.Is(err, ErrWriteByOther))
+
+	// the writer created the lock file and removes it
+	assert.NoError(db.Close())
+	_, err = os.Stat(testDB + lockFileSuffix)
+	assert.True(os.IsNotExist(err))
+
+	// readers share the lock
+	ro := &Options{ExternalLockFile: true, ReadOnly: true}
+	r1, err := Open(testDB, 0755, ro)
+	assert.NoError(err)
+	r2, err := Open(testDB, 0755, ro)
+	assert.NoError(err)
+	_, err = Open(testDB, 0755, opts)
+	assert.True(errors.Is(err, ErrWriteByOther))
+	assert.NoError(r1.Close())
+	assert.NoError(r2.Close())
+
+	db, err = Open(testDB, 0755, opts)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+}
+
+func TestExternalLockFileReplaced(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + lockFileSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + lockFileSuffix)
+
+	db, err := Open(testDB, 0755, &Options{ExternalLockFile: true})
+	assert.NoError(err)
+	// a stale handle on the lock file which is then unlinked by its owner
+	stale, _, err := openLockFile(testDB + lockFileSuffix)
+	assert.NoError(err)
+	defer stale.Close()
+	assert.NoError(db.Close())
+
+	// winning the lock on the unlinked inode doesn't make a second owner
+	assert.NoError(flockFile(stale, true))
+	db, err = Open(testDB, 0755, &Options{ExternalLockFile: true})
+	assert.NoError(err)
+	assert.NoError(db.Close())
+}
+
+func TestLockInfo(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + lockFileSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + lockFileSuffix)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	info := db.LockInfo()
+	assert.Equal(LockMechanismFlock, info.Mechanism)
+	assert.True(info.Exclusive)
+	assert.Equal(testDB, info.Path)
+	assert.False(info.Acquired.IsZero())
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ExternalLockFile: true, ReadOnly: true})
+	assert.NoError(err)
+	info = db.LockInfo()
+	assert.Equal(LockMechanismExternalFile, info.Mechanism)
+	assert.False(info.Exclusive)
+	assert.Equal(testDB+lockFileSuffix, info.Path)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{NoLock: true, ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(LockInfo{Mechanism: LockMechanismNone}, db.LockInfo())
+	assert.NoError(db.Close())
+}
+
+func TestProbeLock(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	os.Remove(testDB + lockFileSuffix)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + lockFileSuffix)
+
+	_, err := ProbeLock(testDB)
+	assert.True(os.IsNotExist(errors.Cause(err)))
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	probe, err := ProbeLock(testDB)
+	assert.NoError(err)
+	assert.Equal(LockProbe{}, probe)
+	assert.NoError(db.Close())
+
+	probe, err = ProbeLock(testDB)
+	assert.NoError(err)
+	assert.Equal(LockProbe{Shared: true, Exclusive: true}, probe)
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	probe, err = ProbeLock(testDB)
+	assert.NoError(err)
+	assert.Equal(LockProbe{Shared: true}, probe)
+	// probing left the reader's lock intact and took none of its own
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrWriteByOther))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ExternalLockFile: true})
+	assert.NoError(err)
+	probe, err = ProbeLock(testDB)
+	assert.NoError(err)
+	assert.Equal(LockProbe{}, probe)
+	assert.NoError(db.Close())
+}
+
+func TestFlockTimeout(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	asOtherProcess(db)
+	start := time.Now()
+	_, err = Open(testDB, 0755, &Options{FlockTimeout: 100 * time.Millisecond})
+	assert.True(errors.Is(err, ErrWriteByOther), "%v", err)
+	assert.True(time.Since(start) >= 100*time.Millisecond)
+
+	// the other process is done before the timeout
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(db.Close())
+	}()
+	db, err = Open(testDB, 0755, &Options{FlockTimeout: 5 * time.Second})
+	assert.NoError(err)
+	assert.NoError(db.Close())
+}
+
+func TestFlockFile(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	assert.NoError(ioutil.WriteFile(testDB, []byte("data"), 0600))
+
+	// locks are held per handle, even in one process
+	f1, err := os.Open(testDB)
+	assert.NoError(err)
+	defer f1.Close()
+	f2, err := os.Open(testDB)
+	assert.NoError(err)
+	defer f2.Close()
+	assert.NoError(flockFile(f1, true))
+	assert.Equal(ErrWriteByOther, flockFile(f2, false))
+	assert.Equal(ErrWriteByOther, flockFile(f2, true))
+
+	// converted to shared, then back
+	assert.NoError(flockFile(f1, false))
+	assert.NoError(flockFile(f2, false))
+	assert.Equal(ErrWriteByOther, flockFile(f1, true))
+	assert.NoError(f2.Close())
+	assert.NoError(flockFile(f1, true))
+
+	// the locked file can still be read
+	b, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	assert.Equal("data", string(b))
+}
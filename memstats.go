@@ -0,0 +1,58 @@
+package sidb
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// MemoryStats reports the memory a DB handle is responsible for.
+type MemoryStats struct {
+	// Mapped is the size of the mmap in bytes.
+	Mapped int
+	// Resident is the number of bytes of the mapping currently resident in
+	// memory. It is read from /proc/self/smaps and is always zero on
+	// platforms other than Linux.
+	Resident int
+	// PageCache is the approximate heap bytes held by the decoded pages of
+	// the page cache, see Options.PageCacheSize.
+	PageCache int
+	// Index is the heap bytes held by the in-memory copy of the page index,
+	// as far as it is loaded, see DB.PreloadIndex.
+	Index int
+	// Pool is the bytes of the pooled scratch buffers in use by reads and
+	// writes in progress. Idle buffers kept by the pools are left to the
+	// garbage collector and not counted.
+	Pool int
+}
+
+// MemoryStats returns the current memory usage of the database handle.
+func (db *DB) MemoryStats() (MemoryStats, error) {
+	s := db.memoryStats()
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if db.dataref != nil {
+		rss, err := residentSize(db.dataref)
+		if err != nil {
+			return s, err
+		}
+		s.Resident = rss
+	}
+	return s, nil
+}
+
+// memoryStats is MemoryStats without Resident.
+func (db *DB) memoryStats() MemoryStats {
+	db.mmaplock.RLock()
+	mapped := db.datasz
+	db.mmaplock.RUnlock()
+
+	db.indexlock.Lock()
+	n, order := len(db.indexes), len(db.indexOrder)
+	db.indexlock.Unlock()
+	return MemoryStats{
+		Mapped:    mapped,
+		PageCache: db.pageCache.bytes(),
+		Index:     n*int(unsafe.Sizeof(Index{})+unsafe.Sizeof(&Index{})) + order*int(unsafe.Sizeof(0)),
+		Pool:      int(atomic.LoadInt64(&db.stats.poolInUse)),
+	}
+}
@@ -0,0 +1,48 @@
+package sidb
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// residentSize reads the Rss of the mapping starting at &b[0] from /proc/self/smaps.
+func residentSize(b []byte) (int, error) {
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		return 0, errors.Wrap(err, "open smaps")
+	}
+	defer f.Close()
+
+	prefix := fmt.Sprintf("%x-", uintptr(unsafe.Pointer(&b[0])))
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !found {
+			found = strings.HasPrefix(line, prefix)
+			continue
+		}
+		if !strings.HasPrefix(line, "Rss:") {
+			continue
+		}
+		// Rss:                   8 kB
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0, errors.Errorf("malformed smaps line %q", line)
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, errors.Wrapf(err, "malformed smaps line %q", line)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "read smaps")
+	}
+	return 0, errors.New("mapping not found in smaps")
+}
@@ -0,0 +1,29 @@
+package sidb
+
+import (
+	"context"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMemoryStatsResident(t *testing.T) {
+	assert := assertion.New(t)
+	_ = os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Preload(context.Background()))
+	warm, err := db.MemoryStats()
+	assert.NoError(err)
+	assert.Equal(db.datasz, warm.Mapped)
+	assert.Equal(db.filesz, warm.Resident)
+
+	assert.NoError(madvise(db.dataref[:db.filesz], syscall.MADV_DONTNEED))
+	cold, err := db.MemoryStats()
+	assert.NoError(err)
+	assert.Less(cold.Resident, warm.Resident)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package sidb
+
+// residentSize is not supported outside Linux.
+func residentSize([]byte) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,58 @@
+package sidb
+
+// MergeFunc computes the new value of a key from its current one, old, nil
+// if the key doesn't exist, in which case exists is false. Returning a nil
+// value deletes the key, returning an error leaves it as it is.
+type MergeFunc func(old []byte, exists bool) ([]byte, error)
+
+// Merge replaces the value of key with what fn makes of it, atomically: fn
+// runs in a read-write transaction, so no other write comes in between the
+// read and the write, and the result is committed on its own like Put. If fn
+// returns an error, nothing is written and Merge returns it.
+func (db *DB) Merge(key []byte, fn MergeFunc) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Merge(key, fn)
+	})
+}
+
+// MergeMany merges every key of keys with fn, like Merge, in a single
+// transaction and commit. A key given several times is merged as many times,
+// each call seeing the result of the previous one. If fn returns an error,
+// none of the keys is written.
+func (db *DB) MergeMany(keys [][]byte, fn func(key, old []byte, exists bool) ([]byte, error)) error {
+	return db.Update(func(tx *Tx) error {
+		for _, key := range keys {
+			err := tx.Merge(key, func(old []byte, exists bool) ([]byte, error) {
+				return fn(key, old, exists)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Merge replaces the value of key with what fn makes of it, see DB.Merge,
+// reading the writes buffered in the transaction too. The result is buffered
+// like Put.
+func (tx *Tx) Merge(key []byte, fn MergeFunc) error {
+	if err := tx.checkWrite(key); err != nil {
+		return err
+	}
+	old, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+	value, err := fn(old, old != nil)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if old == nil {
+			return nil
+		}
+		return tx.Delete(key)
+	}
+	return tx.Put(key, value)
+}
@@ -0,0 +1,111 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+
+	// a decimal counter, failing every 7th merge
+	var mu sync.Mutex
+	calls, merged := 0, 0
+	add := func(old []byte, exists bool) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls%7 == 0 {
+			return nil, errors.New("skip")
+		}
+		n := 0
+		if exists {
+			n, _ = strconv.Atoi(string(old))
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 100; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := db.Merge([]byte("counter"), add); err == nil {
+					mu.Lock()
+					merged++
+					mu.Unlock()
+				} else {
+					assert.EqualError(err, "skip")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	v, err := db.Get([]byte("counter"))
+	assert.NoError(err)
+	assert.Equal(strconv.Itoa(merged), string(v))
+	assert.Equal(1000-1000/7, merged)
+
+	// nil deletes, and only what exists
+	count := db.Stats().TxStats.Put
+	assert.NoError(db.Merge([]byte("missing"), func(old []byte, exists bool) ([]byte, error) {
+		assert.False(exists)
+		assert.Nil(old)
+		return nil, nil
+	}))
+	assert.Equal(count, db.Stats().TxStats.Put)
+	assert.NoError(db.Merge([]byte("counter"), func(old []byte, exists bool) ([]byte, error) {
+		assert.True(exists)
+		return nil, nil
+	}))
+	v, err = db.Get([]byte("counter"))
+	assert.NoError(err)
+	assert.Nil(v)
+
+	// within a transaction, its writes are seen
+	assert.NoError(db.Update(func(tx *Tx) error {
+		assert.NoError(tx.Put([]byte("a"), []byte("1")))
+		return tx.Merge([]byte("a"), func(old []byte, exists bool) ([]byte, error) {
+			return append(old, '1'), nil
+		})
+	}))
+	v, err = db.Get([]byte("a"))
+	assert.NoError(err)
+	assert.Equal("11", string(v))
+	assert.NoError(db.View(func(tx *Tx) error {
+		assert.Equal(ErrTxNotWritable, tx.Merge([]byte("a"), add))
+		return nil
+	}))
+
+	// MergeMany in one commit, repeated keys see the previous merge
+	concat := func(key, old []byte, exists bool) ([]byte, error) {
+		return append(append([]byte{}, old...), key...), nil
+	}
+	assert.NoError(db.MergeMany([][]byte{[]byte("a"), []byte("b"), []byte("a")}, concat))
+	v, _ = db.Get([]byte("a"))
+	assert.Equal("11aa", string(v))
+	v, _ = db.Get([]byte("b"))
+	assert.Equal("b", string(v))
+	// all or nothing
+	err = db.MergeMany([][]byte{[]byte("a"), []byte("b")}, func(key, old []byte, exists bool) ([]byte, error) {
+		if string(key) == "b" {
+			return nil, errors.New("fail")
+		}
+		return []byte("changed"), nil
+	})
+	assert.EqualError(err, "fail")
+	v, _ = db.Get([]byte("a"))
+	assert.Equal("11aa", string(v))
+
+	assert.Equal(ErrKeyRequired, db.Merge(nil, add))
+	assert.NoError(db.Close())
+}
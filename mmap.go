@@ -0,0 +1,85 @@
+package sidb
+
+type MmapGrowthMode uint8
+
+const (
+	// double the mapping from Floor until Ceiling, then grow by Step (default)
+	MmapGrowDoubling MmapGrowthMode = iota
+	// grow the mapping by a fixed Step
+	MmapGrowFixedStep
+	// map exactly the database size plus Slack
+	MmapGrowExact
+)
+
+const (
+	// defaultMmapFloor is the smallest mmap size of the doubling policy.
+	defaultMmapFloor = 1 << 15 // 32KB
+	// defaultMmapFixedStep is the step used by MmapGrowFixedStep when Step is not set.
+	defaultMmapFixedStep = 1 << 20 // 1MB
+)
+
+// MmapGrowthPolicy controls how the mmap size is derived from the database size.
+// The zero value doubles the mapping from 32KB until 1GB and then grows by 1GB
+// at a time.
+type MmapGrowthPolicy struct {
+	Mode MmapGrowthMode
+
+	// Floor and Ceiling bound the doubling phase of MmapGrowDoubling.
+	// If <=0, they default to 32KB and 1GB.
+	Floor   int
+	Ceiling int
+
+	// Step is the increment used past Ceiling by MmapGrowDoubling and on
+	// every grow by MmapGrowFixedStep.
+	// If <=0, it defaults to 1GB and 1MB respectively.
+	Step int
+
+	// Slack is the extra space mapped beyond the database size by MmapGrowExact.
+	Slack int
+}
+
+// size returns the unaligned mmap size for a database of the given size.
+func (p MmapGrowthPolicy) size(size int64) int64 {
+	switch p.Mode {
+	case MmapGrowExact:
+		slack := p.Slack
+		if slack < 0 {
+			slack = 0
+		}
+		return size + int64(slack)
+	case MmapGrowFixedStep:
+		step := p.Step
+		if step <= 0 {
+			step = defaultMmapFixedStep
+		}
+		return roundUp(size, int64(step))
+	default:
+		floor, ceiling := p.Floor, p.Ceiling
+		if floor <= 0 {
+			floor = defaultMmapFloor
+		}
+		if ceiling <= 0 {
+			ceiling = maxMmapStep
+		}
+		// Double the size from floor until ceiling.
+		for sz := int64(floor); sz <= int64(ceiling); sz *= 2 {
+			if size <= sz {
+				return sz
+			}
+		}
+		step := p.Step
+		if step <= 0 {
+			step = maxMmapStep
+		}
+		// If larger than ceiling then grow by step at a time.
+		return roundUp(size, int64(step))
+	}
+}
+
+// roundUp rounds n up to a multiple of step.
+func roundUp(n, step int64) int64 {
+	if remainder := n % step; remainder > 0 {
+		n += step - remainder
+	}
+	return n
+}
@@ -0,0 +1,176 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMmapSizeDoubling(t *testing.T) {
+	assert := assertion.New(t)
+	db := &DB{pageSize: 4096}
+	for _, c := range [][2]int64{
+		{0, 32 << 10},
+		{8192, 32 << 10},
+		{32<<10 + 1, 64 << 10},
+		{40 << 20, 64 << 20},
+		{1 << 30, 1 << 30},
+	} {
+		sz, err := db.mmapSize(c[0])
+		assert.NoError(err)
+		assert.Equal(c[1], int64(sz), "size %d", c[0])
+	}
+
+	db.mmapGrowth = MmapGrowthPolicy{Floor: 1 << 20, Ceiling: 8 << 20, Step: 4 << 20}
+	for _, c := range [][2]int64{
+		{0, 1 << 20},
+		{1<<20 + 1, 2 << 20},
+		{8 << 20, 8 << 20},
+		{8<<20 + 1, 12 << 20},
+		{13 << 20, 16 << 20},
+	} {
+		sz, err := db.mmapSize(c[0])
+		assert.NoError(err)
+		assert.Equal(c[1], int64(sz), "size %d", c[0])
+	}
+}
+
+func TestMmapSizeFixedStep(t *testing.T) {
+	assert := assertion.New(t)
+	db := &DB{pageSize: 4096, mmapGrowth: MmapGrowthPolicy{Mode: MmapGrowFixedStep}}
+	for _, c := range [][2]int64{
+		{8192, 1 << 20},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 2 << 20},
+		{40 << 20, 40 << 20},
+	} {
+		sz, err := db.mmapSize(c[0])
+		assert.NoError(err)
+		assert.Equal(c[1], int64(sz), "size %d", c[0])
+	}
+
+	db.mmapGrowth.Step = 10000
+	sz, err := db.mmapSize(15000)
+	assert.NoError(err)
+	// 20000 rounded up to the page size
+	assert.Equal(20480, sz)
+}
+
+func TestMmapSizeExact(t *testing.T) {
+	assert := assertion.New(t)
+	db := &DB{pageSize: 4096, mmapGrowth: MmapGrowthPolicy{Mode: MmapGrowExact}}
+	for _, c := range [][2]int64{
+		{8192, 8192},
+		{8193, 12288},
+		{40 << 20, 40 << 20},
+	} {
+		sz, err := db.mmapSize(c[0])
+		assert.NoError(err)
+		assert.Equal(c[1], int64(sz), "size %d", c[0])
+	}
+
+	db.mmapGrowth.Slack = 3 * 4096
+	sz, err := db.mmapSize(8192)
+	assert.NoError(err)
+	assert.Equal(5*4096, sz)
+}
+
+func TestMmapSizeLarge(t *testing.T) {
+	if maxMapSize < 1<<40 {
+		t.Skip("mmap larger than 2GB is not supported on this platform")
+	}
+	assert := assertion.New(t)
+	db := &DB{pageSize: 4096}
+	for _, c := range [][2]int64{
+		{1<<30 + 1, 2 << 30},
+		{5<<30 + 7, 6 << 30},
+		{maxMapSize - 1, maxMapSize},
+	} {
+		sz, err := db.mmapSize(c[0])
+		assert.NoError(err)
+		assert.Equal(c[1], int64(sz), "size %d", c[0])
+	}
+}
+
+func TestMmapSizeTooLarge(t *testing.T) {
+	assert := assertion.New(t)
+	db := &DB{pageSize: 4096}
+	_, err := db.mmapSize(int64(maxMapSize) + 1)
+	assert.Equal(ErrMapTooLarge, err)
+
+	if maxMapSize < 1<<40 {
+		// 32-bit platforms can't map more than 2GB
+		_, err = db.mmapSize(3 << 30)
+		assert.Equal(ErrMapTooLarge, err)
+		sz, err := db.mmapSize(1<<30 + 1)
+		assert.NoError(err)
+		assert.Equal(maxMapSize, sz)
+	}
+}
+
+func TestOpenMmapGrowExact(t *testing.T) {
+	assert := assertion.New(t)
+	_ = os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{MmapGrowthPolicy: MmapGrowthPolicy{Mode: MmapGrowExact}})
+	assert.NoError(err)
+	assert.Equal(3*db.pageSize, db.datasz)
+	assert.NoError(db.Close())
+}
+
+// TestMmapRelocate grows the database across several remaps while readers
+// iterate and look up keys.
+func TestMmapRelocate(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	defer db.Close()
+	db.NoSync = true
+	value := make([]byte, 200)
+	assert.NoError(db.Put([]byte("key-00000"), value))
+
+	var written int64 = 1
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// whatever was written before the scan is seen by it
+				min := int(atomic.LoadInt64(&written))
+				n := 0
+				c := db.Cursor()
+				for k, _ := c.First(); k != nil; k, _ = c.Next() {
+					n++
+				}
+				assert.NoError(c.Err())
+				assert.True(n >= min, "%d < %d", n, min)
+				v, err := db.Get([]byte(fmt.Sprintf("key-%05d", min-1)))
+				assert.NoError(err)
+				assert.Len(v, len(value))
+			}
+		}()
+	}
+
+	start := db.datasz
+	gen := db.mapGen
+	for i := 1; db.mapGen-gen < 4; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), value))
+		atomic.StoreInt64(&written, int64(i+1))
+	}
+	close(done)
+	wg.Wait()
+	assert.True(db.datasz >= 8*start, "%d after %d", db.datasz, start)
+	assert.True(int(db.head.PageCount)*db.pageSize <= db.datasz)
+}
@@ -0,0 +1,98 @@
+package sidb
+
+// A record too large for a page on its own is split across a chain of pages
+// linked by Next: a PageFirst page with the start of the record, PageMiddle
+// pages and a PageLast page with its end. Only the first page counts the
+// record. The chain is part of the data page chain, and the next record goes
+// to a new page after the last one.
+
+// overflowPages allocates contiguous pages for rec, too large for a page, and
+// copies it into them. Nothing is written yet.
+func (db *DB) overflowPages(head *HeadPage, rec []byte) ([]*batchPage, error) {
+	chunk := db.pageSize - pageHeaderSize
+	start, err := db.allocateRun(head, (len(rec)+chunk-1)/chunk)
+	if err != nil {
+		return nil, err
+	}
+	var pages []*batchPage
+	for off := 0; off < len(rec); off += chunk {
+		id := start + PageId(len(pages))
+		n := len(rec) - off
+		if n > chunk {
+			n = chunk
+		}
+		p := &batchPage{
+			id:  id,
+			hdr: Page{Flag: PageData | PageMiddle, Len: PageSz(n), ptr: PageSz(pageHeaderSize + n)},
+			buf: db.getBuf(db.pageSize),
+		}
+		copy(p.buf[pageHeaderSize:], rec[off:off+n])
+		if len(pages) > 0 {
+			pages[len(pages)-1].hdr.Next = id
+		}
+		pages = append(pages, p)
+	}
+	first, last := pages[0], pages[len(pages)-1]
+	first.hdr.Flag = PageData | PageFirst
+	first.hdr.Count = 1
+	// A record short of room for a footer only may fit one page.
+	last.hdr.Flag = last.hdr.Flag&^PageMiddle | PageLast
+	return pages, nil
+}
+
+// overflowRecord reassembles the record stored across the pages starting at
+// page id, a PageFirst page whose header is p, and returns it with the last
+// of them. The caller holds mmaplock.
+func (db *DB) overflowRecord(id PageId, p *Page) ([]byte, PageId, *Page, error) {
+	first := id
+	var rec []byte
+	for {
+		if err := db.verifyPage(id, p); err != nil {
+			return nil, 0, nil, err
+		}
+		start := int(db.pageOffset(id)) + pageHeaderSize
+		rec = append(rec, db.dataSlice(start, start+int(p.Len))...)
+		if p.Flag&PageLast != 0 {
+			return rec, id, p, nil
+		}
+		if p.Next == 0 {
+			return nil, 0, nil, corruptPage(id, pageNextOffset, "overflow record of page %d ends here, not on a last page", first)
+		}
+		id = p.Next
+		if p = db.page(id); p.Flag&(PageMiddle|PageLast) == 0 {
+			return nil, 0, nil, corruptPage(id, 0, "overflow record of page %d goes on here, flags %#x", first, p.Flag)
+		}
+	}
+}
+
+// records returns the records of data page id, whose header is p, visible in
+// s, and the data page after them. For the first page of an overflow record
+// it is the record and the page after its last page, the other pages of the
+// record hold no records of their own. The records of PageCompressed pages
+// are decompressed. The caller holds mmaplock.
+func (db *DB) records(s *snapshot, id PageId, p *Page) ([]byte, PageId, error) {
+	switch {
+	case p.Flag&PageFirst != 0:
+		rec, last, lp, err := db.overflowRecord(id, p)
+		if err != nil {
+			return nil, 0, err
+		}
+		return rec, s.next(last, lp), nil
+	case p.overflow():
+		return nil, s.next(id, p), nil
+	}
+	if p.Flag&PageCompressed != 0 {
+		data, err := db.decompressPage(id, p)
+		if err != nil {
+			return nil, 0, err
+		}
+		if end := s.end(id, p) - pageHeaderSize; end >= 0 && end < len(data) {
+			data = data[:end]
+		}
+		return data, s.next(id, p), nil
+	}
+	if err := db.verifyPage(id, p); err != nil {
+		return nil, 0, err
+	}
+	return db.snapshotData(s, id, p), s.next(id, p), nil
+}
@@ -0,0 +1,167 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestOverflow(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+
+	rnd := rand.New(rand.NewSource(1))
+	value := func(n int) []byte {
+		v := make([]byte, n)
+		rnd.Read(v)
+		return v
+	}
+	pageSize := db.pageSize
+	values := map[string][]byte{
+		// with the flag, the key, both lengths and the footer, a page exactly
+		"key-fill":  value(pageSize - pageHeaderSize - 12 - footerSize(1)),
+		"key-page":  value(pageSize),
+		"key-page1": value(pageSize + 1),
+		"key-10":    value(10*pageSize - 100),
+	}
+	keys := []string{"key-fill", "key-page", "key-page1", "key-10"}
+	for i, k := range keys {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("small-%d", i)), []byte("v")))
+		assert.NoError(db.Put([]byte(k), values[k]))
+	}
+	// the value of a small key can be stored across pages too
+	assert.NoError(db.PutBatch([]KVPair{
+		{Key: []byte("small-0"), Value: value(3 * pageSize)},
+		{Key: []byte("small-4"), Value: []byte("v")},
+	}))
+	values["small-0"] = nil
+	assert.NoError(db.Delete([]byte("small-0")))
+
+	// Only the first page of a record counts it.
+	var flags []PageFlag
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		if p := db.page(id); p.overflow() {
+			flags = append(flags, p.Flag&^PageData)
+		}
+	}
+	// 2 pages each for key-page and key-page1, 11 for key-10, 4 for small-0
+	assert.Len(flags, 19)
+	assert.Equal(PageFirst, flags[0])
+	assert.Equal(PageLast, flags[1])
+	assert.Equal(PageMiddle, flags[5])
+	n, err := db.Count()
+	assert.NoError(err)
+	// overwritten and deleted records are counted until compaction
+	assert.Equal(uint64(10), n)
+
+	check := func() {
+		for i := 0; i < 5; i++ {
+			k := fmt.Sprintf("small-%d", i)
+			if _, ok := values[k]; !ok {
+				values[k] = []byte("v")
+			}
+		}
+		for k, want := range values {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+			v, err = db.GetTo([]byte(k), nil)
+			assert.NoError(err)
+			assert.Equal(want, v, k)
+			if want == nil {
+				continue
+			}
+			r, size, err := db.GetReader([]byte(k))
+			assert.NoError(err)
+			assert.Equal(int64(len(want)), size, k)
+			v, err = ioutil.ReadAll(r)
+			assert.NoError(err)
+			assert.True(bytes.Equal(want, v), k)
+		}
+		many, err := db.GetMany([][]byte{[]byte("key-10"), []byte("key-page")})
+		assert.NoError(err)
+		assert.Equal([][]byte{values["key-10"], values["key-page"]}, many)
+
+		var forward []string
+		c := db.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			assert.Equal(values[string(k)], v, string(k))
+			forward = append(forward, string(k))
+		}
+		assert.NoError(c.Err())
+		assert.Equal([]string{"key-fill", "small-1", "key-page", "small-2", "key-page1", "small-3", "key-10", "small-4"}, forward)
+		var backward []string
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			assert.Equal(values[string(k)], v, string(k))
+			backward = append([]string{string(k)}, backward...)
+		}
+		assert.NoError(c.Err())
+		assert.Equal(forward, backward)
+	}
+	check()
+
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	check()
+	// records after an overflow record start a new page
+	assert.NoError(db.Put([]byte("small-5"), []byte("v")))
+	values["small-5"] = []byte("v")
+	v, err := db.Get([]byte("small-5"))
+	assert.NoError(err)
+	assert.Equal([]byte("v"), v)
+	assert.NoError(db.Close())
+}
+
+func TestOverflowTail(t *testing.T) {
+	assert := assertion.New(t)
+	backup := testDB + ".backup"
+	os.Remove(testDB)
+	os.Remove(backup)
+	defer os.Remove(testDB)
+	defer os.Remove(backup)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone, OrderedWrite: true})
+	assert.NoError(err)
+	value := make([]byte, 5*db.pageSize)
+	rand.New(rand.NewSource(1)).Read(value)
+	assert.NoError(db.Put([]byte("a"), []byte("v")))
+	assert.NoError(db.Put([]byte("b"), value))
+
+	// A snapshot ending with an overflow record.
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("c"), value))
+	v, err := tx.Get([]byte("b"))
+	assert.NoError(err)
+	assert.Equal(value, v)
+	v, err = tx.Get([]byte("c"))
+	assert.NoError(err)
+	assert.Nil(v)
+	f, err := os.Create(backup)
+	assert.NoError(err)
+	_, err = tx.WriteTo(f)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	assert.NoError(tx.Rollback())
+	assert.NoError(db.Close())
+
+	// The last key put is found past the overflow record ending the data.
+	db, err = Open(backup, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.Equal(ErrKeyOutOfOrder, db.Put([]byte("a"), nil))
+	assert.NoError(db.Put([]byte("c"), []byte("v")))
+	var keys []string
+	assert.NoError(db.ForEachKey(func(k []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	assert.Equal([]string{"a", "b", "c"}, keys)
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,103 @@
+package sidb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ownerFileSuffix is appended to the database path to name the file describing
+// the holder of the exclusive lock.
+const ownerFileSuffix = ".owner"
+
+// LockOwner describes the process holding the exclusive lock of a database.
+type LockOwner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Version uint16    `json:"version"`
+}
+
+// LockHeldError is returned by Open when the lock is held by another process.
+// Owner is nil if the holder didn't leave an owner file, e.g. when the
+// database is only opened read-only by others.
+type LockHeldError struct {
+	Owner *LockOwner
+	// Stale is set when Owner is a process on this host that no longer exists.
+	// The lock is never taken over automatically.
+	Stale bool
+}
+
+func (e *LockHeldError) Error() string {
+	if e.Owner == nil {
+		return ErrWriteByOther.Error()
+	}
+	msg := fmt.Sprintf("%s: pid %d on %s since %s", ErrWriteByOther, e.Owner.PID, e.Owner.Host,
+		e.Owner.Started.Format(time.RFC3339))
+	if e.Stale {
+		msg += " (stale: process no longer exists)"
+	}
+	return msg
+}
+
+func (e *LockHeldError) Unwrap() error {
+	return ErrWriteByOther
+}
+
+// processStart is reported as the start time in owner files.
+var processStart = time.Now()
+
+// writeOwner records this process as the holder of the exclusive lock.
+func (db *DB) writeOwner() error {
+	host, _ := os.Hostname()
+	b, err := json.Marshal(&LockOwner{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: processStart,
+		Version: Version,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(db.path+ownerFileSuffix, b, 0600); err != nil {
+		return errors.Wrap(err, "write owner file")
+	}
+	db.ownerWritten = true
+	return nil
+}
+
+// removeOwner removes the owner file, on clean Close or when giving up the
+// exclusive lock.
+func (db *DB) removeOwner() error {
+	if err := os.Remove(db.path + ownerFileSuffix); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove owner file")
+	}
+	db.ownerWritten = false
+	return nil
+}
+
+// lockHeldError builds the error returned when the lock of path is held.
+func lockHeldError(path string) error {
+	return ownerHeldError(path + ownerFileSuffix)
+}
+
+// ownerHeldError builds a LockHeldError from the LockOwner stored in name.
+func ownerHeldError(name string) error {
+	e := &LockHeldError{}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return e
+	}
+	owner := &LockOwner{}
+	if err := json.Unmarshal(b, owner); err != nil {
+		return e
+	}
+	e.Owner = owner
+	if host, _ := os.Hostname(); host == owner.Host && !processExists(owner.PID) {
+		e.Stale = true
+	}
+	return e
+}
@@ -0,0 +1,85 @@
+package sidb
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestLockOwner(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + ownerFileSuffix)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+
+	asOtherProcess(db)
+	_, err = Open(testDB, 0755, nil)
+	var held *LockHeldError
+	assert.True(errors.As(err, &held))
+	assert.True(errors.Is(err, ErrWriteByOther))
+	if assert.NotNil(held.Owner) {
+		host, _ := os.Hostname()
+		assert.Equal(os.Getpid(), held.Owner.PID)
+		assert.Equal(host, held.Owner.Host)
+		assert.Equal(Version, held.Owner.Version)
+	}
+	assert.False(held.Stale)
+	assert.Contains(err.Error(), "pid")
+
+	// a failed open doesn't remove the owner file of the holder
+	_, err = os.Stat(testDB + ownerFileSuffix)
+	assert.NoError(err)
+
+	// clean release
+	assert.NoError(db.Close())
+	_, err = os.Stat(testDB + ownerFileSuffix)
+	assert.True(os.IsNotExist(err))
+
+	// readers don't leave owner files
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.As(err, &held))
+	assert.Nil(held.Owner)
+	assert.NoError(db.Close())
+}
+
+func TestLockOwnerStale(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	defer os.Remove(testDB + ownerFileSuffix)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	// an owner file left by a dead process, and a lock held by someone else
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	assert.NoError(cmd.Run())
+	host, _ := os.Hostname()
+	b, _ := json.Marshal(&LockOwner{PID: cmd.Process.Pid, Host: host, Started: time.Now(), Version: Version})
+	assert.NoError(ioutil.WriteFile(testDB+ownerFileSuffix, b, 0600))
+	f, err := os.Open(testDB)
+	assert.NoError(err)
+	defer f.Close()
+	assert.NoError(flockFile(f, true))
+
+	_, err = Open(testDB, 0755, nil)
+	var held *LockHeldError
+	assert.True(errors.As(err, &held))
+	assert.True(held.Stale)
+	assert.Equal(cmd.Process.Pid, held.Owner.PID)
+	assert.Contains(err.Error(), "stale")
+
+	// the lock is never stolen
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.True(errors.Is(err, ErrWriteByOther))
+}
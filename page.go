@@ -1,12 +1,14 @@
 package sidb
 
+import "github.com/pkg/errors"
+
 var (
 	//DefaultPageSize = os.Getpagesize()
 	// default system pagesize for most OS
 	DefaultPageSize = 4096
 )
 
-type PageFlag uint8
+type PageFlag uint16
 
 const (
 	// page of page index
@@ -17,15 +19,30 @@ const (
 	// full page: all data contained in page
 	PageFull
 
-	// data is stored across pages
+	// a record too large for a page is stored across pages, see
+	// overflowPages
 	PageFirst
 	PageMiddle
 	PageLast
+
+	// ids of free pages, see loadFreelist
+	PageFree
+
+	// sealed data page of sorted keys with a footer of restarts, see
+	// restartInterval
+	PageSorted
+	// sealed data page with a bloom filter of its keys in its footer, see
+	// Options.BloomBitsPerKey
+	PageBloom
+	// sealed data page whose records are compressed together, see
+	// Options.PageCompression. ptr ends what is stored, Len is the size of
+	// the records once decompressed.
+	PageCompressed
 )
 
-// size: 11, aligned: 20
+// size: 20, stored as laid out in layout.go
 type Page struct {
-	Flag PageFlag // 1+3
+	Flag PageFlag // 2+2
 	// how many kv/index in page
 	Count uint16 // 2
 	// size of data
@@ -36,12 +53,42 @@ type Page struct {
 	CheckSum uint32 // 4
 }
 
+// overflow reports whether p holds part of a record stored across pages. Such
+// a page holds nothing else.
+func (p *Page) overflow() bool {
+	return p.Flag&(PageFirst|PageMiddle|PageLast) != 0
+}
+
+// PageHeader returns the header of page id, for tools looking into the file.
+// The head pages, 0 and with FeatureDualHead 1, have none.
+func (db *DB) PageHeader(id PageId) (Page, error) {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		return Page{}, ErrDatabaseNotOpen
+	}
+	db.headlock.Lock()
+	count := db.head.PageCount
+	db.headlock.Unlock()
+	if id < db.dataStart || id >= count {
+		return Page{}, errors.Errorf("page %d out of range [%d, %d)", id, db.dataStart, count)
+	}
+	return *db.page(id), nil
+}
+
 type PageObj struct {
 	Id         PageId
 	Header     *Page
 	data       []byte
 	start, end [6]byte
 	offsetList []PageSz
+	// keys of the records at offsetList, prefixes expanded
+	keys [][]byte
+	// values and flags of the records, set for the page cache
+	values [][]byte
+	flags  []KVFlag
+	// end of the records decoded and the bytes they take, see pageCache
+	ptr, size int
 }
 
 type Chunk struct {
@@ -0,0 +1,182 @@
+package sidb
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// pageCache holds decoded data pages, see Options.PageCacheSize. The least
+// recently used pages are evicted once they take more than max bytes.
+//
+// Pages are only appended to until they are freed, so an entry is valid for
+// as long as the records it was decoded from end where they ended then: a
+// snapshot seeing fewer records of the page, or a later put adding some, both
+// miss. Freed pages and remaps drop entries, see remove and clear.
+type pageCache struct {
+	mu    sync.Mutex
+	max   int
+	size  int
+	lru   *list.List // of *PageObj, most recently used first
+	items map[PageId]*list.Element
+}
+
+// pageObjOverhead approximates the bytes a decoded record takes on top of its
+// key and value: slice headers, offset and flag.
+const pageObjOverhead = 56
+
+func newPageCache(max int) *pageCache {
+	if max <= 0 {
+		return nil
+	}
+	return &pageCache{max: max, lru: list.New(), items: make(map[PageId]*list.Element)}
+}
+
+// bytes returns the approximate heap bytes held by the cached pages.
+func (c *pageCache) bytes() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// get returns page id decoded up to end, or nil.
+func (c *pageCache) get(id PageId, end int) *PageObj {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil
+	}
+	obj := e.Value.(*PageObj)
+	if obj.ptr != end {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return obj
+}
+
+// add caches obj, replacing any entry of its page, and evicts as needed.
+func (c *pageCache) add(obj *PageObj) {
+	if c == nil || obj.size > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(obj.Id)
+	c.items[obj.Id] = c.lru.PushFront(obj)
+	c.size += obj.size
+	for c.size > c.max {
+		c.removeLocked(c.lru.Back().Value.(*PageObj).Id)
+	}
+}
+
+// remove drops page id, which is freed or reused.
+func (c *pageCache) remove(id PageId) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.removeLocked(id)
+	c.mu.Unlock()
+}
+
+func (c *pageCache) removeLocked(id PageId) {
+	if e, ok := c.items[id]; ok {
+		c.size -= e.Value.(*PageObj).size
+		c.lru.Remove(e)
+		delete(c.items, id)
+	}
+}
+
+// clear drops every page, the file was remapped.
+func (c *pageCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.lru.Init()
+	c.items = make(map[PageId]*list.Element)
+	c.size = 0
+	c.mu.Unlock()
+}
+
+// cachedPage returns data page id, whose header is p, decoded up to the
+// records visible in s, from the page cache or decoding it into the cache.
+// It returns nil without a cache and for pages of overflow records, which
+// are read as usual. The caller holds mmaplock.
+func (db *DB) cachedPage(s *snapshot, id PageId, p *Page) (*PageObj, error) {
+	if db.pageCache == nil || p.overflow() {
+		return nil, nil
+	}
+	end := s.end(id, p)
+	if obj := db.pageCache.get(id, end); obj != nil {
+		atomic.AddInt64(&db.stats.PageCacheHit, 1)
+		return obj, nil
+	}
+	atomic.AddInt64(&db.stats.PageCacheMiss, 1)
+	data, _, err := db.records(s, id, p)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := db.decodePage(id, p, data)
+	if err != nil {
+		return nil, err
+	}
+	db.pageCache.add(obj)
+	return obj, nil
+}
+
+// decodePage decodes data, the records of data page id whose header is p,
+// values included.
+func (db *DB) decodePage(id PageId, p *Page, data []byte) (*PageObj, error) {
+	hdr := *p
+	obj := &PageObj{Id: id, Header: &hdr, ptr: pageHeaderSize + len(data)}
+	var prevKey []byte
+	for off := pageHeaderSize; len(data) > 0; {
+		var kv KVPair
+		n, flag, err := kv.unmarshal(data, prevKey, db.decompressor)
+		if err != nil {
+			return nil, corruptRecord(err, id, off-pageHeaderSize)
+		}
+		prevKey = kv.Key
+		key := kv.Key
+		obj.offsetList = append(obj.offsetList, PageSz(off))
+		obj.keys = append(obj.keys, key)
+		obj.values = append(obj.values, kv.Value)
+		obj.flags = append(obj.flags, flag)
+		obj.size += len(key) + len(kv.Value) + pageObjOverhead
+		off += n
+		data = data[n:]
+	}
+	return obj, nil
+}
+
+// search calls fn with the newest record of key in obj, if any. The keys of
+// sorted pages, see PageSorted, are binary-searched. kv is shared with the
+// cache, its value must be copied before it is handed out.
+func (obj *PageObj) search(key []byte, sorted bool, cmp Comparator, fn func(kv *KVPair, flag KVFlag)) {
+	i := -1
+	if sorted {
+		// the last record of key is just before the first one past it
+		j := sort.Search(len(obj.keys), func(j int) bool { return cmp(obj.keys[j], key) > 0 })
+		if j > 0 && cmp(obj.keys[j-1], key) == 0 {
+			i = j - 1
+		}
+	} else {
+		for j, k := range obj.keys {
+			if cmp(k, key) == 0 {
+				i = j
+			}
+		}
+	}
+	if i >= 0 {
+		fn(&KVPair{Key: obj.keys[i], Value: obj.values[i]}, obj.flags[i])
+	}
+}
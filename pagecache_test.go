@@ -0,0 +1,129 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestPageCache(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageCacheSize: 1 << 20})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	v, err := db.Get([]byte("key-0500"))
+	assert.NoError(err)
+	assert.Equal("value-500", string(v))
+	s := db.Stats()
+	assert.Zero(s.PageCacheHit)
+	pages := s.PageCacheMiss
+	assert.True(pages > 1, "%d pages", pages)
+	v[0] = 'x'
+	v, err = db.GetTo([]byte("key-0500"), nil)
+	assert.NoError(err)
+	assert.Equal("value-500", string(v))
+	assert.Equal(Stats{Get: 1, PageCacheHit: pages}, db.Stats().Sub(s))
+
+	// The tail page grows, a snapshot sees it as it was.
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key-0999"), []byte("new")))
+	assert.NoError(db.Delete([]byte("key-0000")))
+	v, err = db.Get([]byte("key-0999"))
+	assert.NoError(err)
+	assert.Equal("new", string(v))
+	v, err = db.Get([]byte("key-0000"))
+	assert.NoError(err)
+	assert.Nil(v)
+	v, err = tx.Get([]byte("key-0999"))
+	assert.NoError(err)
+	assert.Equal("value-999", string(v))
+	v, err = tx.Get([]byte("key-0000"))
+	assert.NoError(err)
+	assert.Equal("value-0", string(v))
+	assert.NoError(tx.Rollback())
+
+	c := db.Cursor()
+	n := 0
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if string(k) == "key-0999" {
+			assert.Equal("new", string(v))
+		}
+		n++
+	}
+	assert.NoError(c.Err())
+	assert.Equal(999, n)
+	assert.NoError(db.Close())
+}
+
+func TestPageCacheEviction(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{PageCacheSize: 20 << 10})
+	assert.NoError(err)
+	db.NoSync = true
+	value := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(value)
+	for i := 0; i < 500; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), value))
+	}
+	// each lookup decodes the page of its key, and the tail
+	for i := 0; i < 500; i++ {
+		_, err = db.Get([]byte(fmt.Sprintf("key-%04d", i)))
+		assert.NoError(err)
+	}
+	c := db.pageCache
+	assert.True(c.size <= c.max, "%d bytes", c.size)
+	assert.Equal(c.size, db.Stats().Memory.PageCache)
+	assert.True(c.lru.Len() > 0)
+	assert.True(c.lru.Len() < int(db.Stats().PageCacheMiss))
+	assert.Equal(c.lru.Len(), len(c.items))
+
+	// Freed pages are dropped, this one is still in use but the file goes
+	// away.
+	id := c.lru.Front().Value.(*PageObj).Id
+	db.free(id)
+	assert.NotContains(c.items, id)
+	assert.NoError(db.Close())
+}
+
+// BenchmarkGetSkewed looks up a few hot keys among many, with and without a
+// page cache.
+func BenchmarkGetSkewed(b *testing.B) {
+	for _, size := range []int{0, 4 << 20} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			os.Remove(testDB)
+			defer os.Remove(testDB)
+			db, err := Open(testDB, 0755, &Options{PageCacheSize: size})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			db.NoSync = true
+			pairs := make([]KVPair, 20000)
+			for i := range pairs {
+				pairs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%05d", i)), Value: []byte(fmt.Sprintf("value-%d", i))}
+			}
+			if err := db.PutBatch(pairs); err != nil {
+				b.Fatal(err)
+			}
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, uint64(len(pairs)-1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if v, err := db.Get(pairs[zipf.Uint64()].Key); err != nil || v == nil {
+					b.Fatal(v, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package sidb
+
+import (
+	"fmt"
+	"io"
+)
+
+// pager gives access to the bytes of the database file: the mapping of a
+// database opened with Open, or reads from the io.ReaderAt of OpenReader.
+type pager interface {
+	// slice returns the bytes of the file from start to end. Those of the
+	// mapping are valid until it is moved, see mmapRelocate, those read are
+	// a copy.
+	slice(start, end int) []byte
+	// mapped reports whether slices point into the mapping, so that page
+	// headers can be read in place, see nativeLayout.
+	mapped() bool
+}
+
+// mmapPager reads the mapping of db.
+type mmapPager struct {
+	db *DB
+}
+
+func (p mmapPager) slice(start, end int) []byte {
+	return p.db.data[start:end]
+}
+
+func (mmapPager) mapped() bool {
+	return true
+}
+
+// readerPager reads the file from r, of size bytes.
+type readerPager struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// slice reads the bytes from start to end. A read failing is what a fault
+// is to a mapping: it panics.
+func (p *readerPager) slice(start, end int) []byte {
+	b := make([]byte, end-start)
+	if n, err := p.r.ReadAt(b, int64(start)); n < len(b) {
+		panic(fmt.Sprintf("sidb: read of %d bytes at offset %d: %s", len(b), start, err))
+	}
+	return b
+}
+
+func (*readerPager) mapped() bool {
+	return false
+}
+
+// readAt reads the file at off, from the io.ReaderAt of OpenReader if set.
+func (db *DB) readAt(b []byte, off int64) (int, error) {
+	if db.reader != nil {
+		return db.reader.r.ReadAt(b, off)
+	}
+	return db.file.ReadAt(b, off)
+}
+
+// fileSize returns the size of the file, the one given to OpenReader if set.
+func (db *DB) fileSize() (int64, error) {
+	if db.reader != nil {
+		return db.reader.size, nil
+	}
+	info, err := db.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// OpenReader opens the database of size bytes that r reads, such as a file of
+// an embed.FS or ranges of an object in a store, read-only. Pages are read
+// from r as they are accessed, nothing is mapped or locked, so r must not
+// change while the database is open. A read of r failing after OpenReader
+// returns panics, as a fault on a mapped file would.
+//
+// The options are those of Open, those about files, locks, mappings and
+// writes are ignored.
+func OpenReader(r io.ReaderAt, size int64, options *Options) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	if size > maxMapSize {
+		return nil, ErrMapTooLarge
+	}
+	db, err := newDB(options)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	db.noLock = true
+	db.reader = &readerPager{r: r, size: size}
+	db.pager = db.reader
+	db.filesz = int(size)
+	db.datasz = int(size)
+	if err := db.load(options); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+	return db, nil
+}
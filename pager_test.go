@@ -0,0 +1,78 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOpenReader(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512, BloomBitsPerKey: 10})
+	assert.NoError(err)
+	db.NoSync = true
+	var pairs []KVPair
+	for i := 0; i < 300; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte(fmt.Sprintf("value-%d", i))})
+	}
+	assert.NoError(db.PutBatch(pairs))
+	for i := 300; i < 400; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	big := bytes.Repeat([]byte("big value "), 200)
+	assert.NoError(db.Put([]byte("big"), big))
+	assert.NoError(db.Delete([]byte("key-0005")))
+	assert.NoError(db.Close())
+	b, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+
+	db, err = OpenReader(bytes.NewReader(b), int64(len(b)), nil)
+	assert.NoError(err)
+	assert.Empty(checkErrors(db))
+	for i := 0; i < 400; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%04d", i)))
+		assert.NoError(err)
+		if i == 5 {
+			assert.Nil(v)
+		} else {
+			assert.Equal(fmt.Sprintf("value-%d", i), string(v))
+		}
+	}
+	v, err := db.Get([]byte("big"))
+	assert.NoError(err)
+	assert.Equal(big, v)
+	n := 0
+	c := db.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	assert.NoError(c.Err())
+	assert.Equal(400, n)
+	k, v := c.Seek([]byte("key-0350"))
+	assert.Equal("key-0350", string(k))
+	assert.Equal("value-350", string(v))
+	assert.Equal(ErrDatabaseReadOnly, db.Put([]byte("k"), []byte("v")))
+	assert.NoError(db.Refresh())
+	used := int64(db.head.PageCount) * 512
+	assert.NoError(db.Close())
+	_, err = db.Get([]byte("key-0001"))
+	assert.Equal(ErrDatabaseNotOpen, err)
+
+	// the file ends before its pages do
+	_, err = OpenReader(bytes.NewReader(b), used-600, nil)
+	assert.IsType(&ErrTruncated{}, err)
+	_, err = OpenReader(bytes.NewReader(nil), 0, nil)
+	assert.Equal(ErrNotInitialized, err)
+
+	// reads failing once open are faults
+	db, err = OpenReader(bytes.NewReader(b), int64(len(b))+4096, nil)
+	assert.NoError(err)
+	assert.Contains(panicMessage(func() { db.page(PageId(len(b)/512 + 1)) }), "sidb: read of")
+	assert.NoError(db.Close())
+}
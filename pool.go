@@ -0,0 +1,82 @@
+package sidb
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// smallest pooled buffer: 512B
+	minBufShift = 9
+	// largest pooled buffer: 16MB, larger buffers are not pooled
+	maxBufShift = 24
+)
+
+// bufferPool is a set of sync.Pools holding buffers of power-of-two capacities.
+type bufferPool struct {
+	buckets [maxBufShift - minBufShift + 1]sync.Pool
+}
+
+// bucket returns the index of the smallest bucket holding buffers of at
+// least n bytes, or -1 if n is too large to be pooled.
+func bufBucket(n int) int {
+	if n <= 1<<minBufShift {
+		return 0
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift > maxBufShift {
+		return -1
+	}
+	return shift - minBufShift
+}
+
+func (p *bufferPool) get(n int) []byte {
+	i := bufBucket(n)
+	if i < 0 {
+		return make([]byte, n)
+	}
+	if b, ok := p.buckets[i].Get().([]byte); ok {
+		return b[:n]
+	}
+	return make([]byte, n, 1<<(i+minBufShift))
+}
+
+// put takes back b and reports whether it did.
+func (p *bufferPool) put(b []byte) bool {
+	c := cap(b)
+	i := bufBucket(c)
+	// Only take back buffers handed out by get.
+	if i < 0 || c != 1<<(i+minBufShift) {
+		return false
+	}
+	p.buckets[i].Put(b[:c])
+	return true
+}
+
+// keyBufPool holds key scratch buffers for decoding. Pointers are pooled, as
+// putting a slice in a sync.Pool allocates its header. bufferPool pays that
+// on every put, which is little next to the buffers it pools, but not next to
+// a short key.
+var keyBufPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 256)
+	return &b
+}}
+
+// getBuf returns a buffer of length n from the pool. Its content is undefined.
+// The buffer should be given back with putBuf once it is no longer referenced.
+func (db *DB) getBuf(n int) []byte {
+	b := db.bufPool.get(n)
+	if bufBucket(n) >= 0 {
+		atomic.AddInt64(&db.stats.poolInUse, int64(cap(b)))
+	}
+	return b
+}
+
+// putBuf gives a buffer obtained from getBuf back to the pool.
+// The caller must not use b, or any slice of it, afterwards.
+func (db *DB) putBuf(b []byte) {
+	if db.bufPool.put(b) {
+		atomic.AddInt64(&db.stats.poolInUse, -int64(cap(b)))
+	}
+}
@@ -0,0 +1,126 @@
+package sidb
+
+import (
+	"bytes"
+	assertion "github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestBufBucket(t *testing.T) {
+	assert := assertion.New(t)
+	assert.Equal(0, bufBucket(0))
+	assert.Equal(0, bufBucket(512))
+	assert.Equal(1, bufBucket(513))
+	assert.Equal(3, bufBucket(4096))
+	assert.Equal(maxBufShift-minBufShift, bufBucket(1<<maxBufShift))
+	assert.Equal(-1, bufBucket(1<<maxBufShift+1))
+}
+
+func TestGetBuf(t *testing.T) {
+	assert := assertion.New(t)
+	db := &DB{stats: &Stats{}}
+	b := db.getBuf(4000)
+	assert.Len(b, 4000)
+	assert.Equal(4096, cap(b))
+	assert.Equal(4096, db.memoryStats().Pool)
+	db.putBuf(b)
+	assert.Zero(db.memoryStats().Pool)
+
+	b = db.getBuf(100)
+	assert.Len(b, 100)
+	assert.Equal(512, cap(b))
+	db.putBuf(b)
+
+	// too large to be pooled
+	b = db.getBuf(1<<maxBufShift + 1)
+	assert.Len(b, 1<<maxBufShift+1)
+	assert.Zero(db.memoryStats().Pool)
+	db.putBuf(b)
+
+	// foreign buffers are not taken
+	db.putBuf(make([]byte, 1000))
+	assert.Zero(db.memoryStats().Pool)
+	assert.Equal(1024, cap(db.getBuf(1000)))
+}
+
+func TestGetBufNoAliasing(t *testing.T) {
+	db := &DB{stats: &Stats{}}
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				n := 1 + (g*7919+i*104729)%20000
+				b := db.getBuf(n)
+				for j := range b {
+					b[j] = byte(g)
+				}
+				for j := range b {
+					if b[j] != byte(g) {
+						t.Errorf("buffer modified while held: goroutine %d, size %d", g, n)
+						return
+					}
+				}
+				db.putBuf(b)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkGetBuf(b *testing.B) {
+	db := &DB{stats: &Stats{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := db.getBuf(4096)
+		buf[0] = 1
+		db.putBuf(buf)
+	}
+}
+
+func BenchmarkMakeBuf(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := make([]byte, 4096)
+		buf[0] = 1
+		sink = buf
+	}
+}
+
+var sink []byte
+
+// TestMarshalPooled checks records compressed into pooled buffers are those
+// of the plain compressors, and that encoding into a buffer large enough
+// doesn't allocate more than the header of the scratch buffer put back.
+func TestMarshalPooled(t *testing.T) {
+	assert := assertion.New(t)
+	kv := KVPair{
+		Key:   bytes.Repeat([]byte("key "), 30),
+		Value: bytes.Repeat([]byte("some value, "), 100),
+	}
+	prev := []byte("key key other")
+	for _, c := range []struct {
+		a     CompressAlgorithm
+		level int
+	}{{CompSnappy, 0}, {CompLz4, 0}, {CompLz4, 9}} {
+		db := &DB{compressMinSize: DefaultCompressMinSize, stats: &Stats{}}
+		assert.NoError(db.setCompression(c.a, c.level))
+		opts := MarshalOptions{Compressor: db.compressor, CompressMinSize: db.compressMinSize}
+		want := kv.MarshalWith(prev, opts)
+		assert.Equal(want, db.marshal(nil, kv, prev, false), "%d level %d", c.a, c.level)
+		// the key and value are compressed
+		assert.Equal(KVKeyPrefixed|KVKeyCompressed|KVValueCompressed, KVFlag(want[0]))
+
+		dst := make([]byte, 0, 4096)
+		allocs := testing.AllocsPerRun(100, func() {
+			dst = db.marshal(dst[:0], kv, prev, false)
+		})
+		// lz4 HC allocates its own tables
+		if c.level == 0 && !raceEnabled {
+			assert.LessOrEqual(allocs, float64(1), "%d", c.a)
+		}
+		assert.Equal(want, dst)
+	}
+}
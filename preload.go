@@ -0,0 +1,147 @@
+package sidb
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// preloadBatch is how many OS pages are touched between progress reports and
+// context checks.
+const preloadBatch = 256
+
+// preloadSink keeps the compiler from discarding the reads done by Preload.
+var preloadSink uint32
+
+// Preload warms the page cache by touching every mapped page of the data file
+// in sequential order, after hinting the kernel with madvise(MADV_WILLNEED)
+// where there is one.
+// Only the part of the mapping backed by the file is touched.
+//
+// DB.PreloadProgress, when set, is called with the number of pages touched so
+// far and the total. Preload stops early and returns ctx.Err() if the context
+// is cancelled.
+func (db *DB) Preload(ctx context.Context) error {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	return db.touch(ctx, [][2]int{{0, db.filesz}})
+}
+
+// PreloadRange warms the page cache like Preload, but only with the data pages
+// that may hold keys with start <= key < end, a nil start or end leaving the
+// range open on that side, as Range reads them. The page index tells them
+// apart, with the pages of overflow records starting on them and the pages
+// written since the last indexed one. Without the index, the whole file is
+// touched.
+func (db *DB) PreloadRange(start, end []byte) error {
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if !db.indexed() {
+		return db.touch(context.Background(), [][2]int{{0, db.filesz}})
+	}
+	indexes, _, err := db.index(-1)
+	if err != nil {
+		return err
+	}
+	var from, to [6]byte
+	copy(from[:], start)
+	copy(to[:], end)
+	var ids []PageId
+	for _, e := range indexes {
+		if start != nil && db.comparator(e.End[:], from[:]) < 0 ||
+			end != nil && db.comparator(e.Start[:], to[:]) > 0 {
+			continue
+		}
+		id := PageId(e.PageNum)
+		ids = append(ids, id)
+		// The rest of the record, which the index doesn't list.
+		for p := db.page(id); p.Flag&(PageFirst|PageMiddle) != 0; p = db.page(id) {
+			if id = p.Next; id == 0 || id >= db.head.PageCount {
+				break
+			}
+			ids = append(ids, id)
+		}
+	}
+	// The pages written since the index, in the order of the chain.
+	for id := db.indexTail; id != 0 && id < db.head.PageCount; id = db.page(id).Next {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var spans [][2]int
+	for _, id := range ids {
+		off := int(db.pageOffset(id))
+		if n := len(spans); n > 0 && spans[n-1][1] >= off {
+			spans[n-1][1] = off + db.pageSize
+			continue
+		}
+		spans = append(spans, [2]int{off, off + db.pageSize})
+	}
+	return db.touch(context.Background(), spans)
+}
+
+// touch reads one byte of every OS page of the mapping in spans, byte ranges
+// in ascending order, after hinting the kernel, see Preload. The caller holds
+// mmaplock.
+func (db *DB) touch(ctx context.Context, spans [][2]int) error {
+	if db.dataref == nil {
+		return nil
+	}
+	sz := db.filesz
+	if sz > db.datasz {
+		sz = db.datasz
+	}
+
+	// Whole OS pages, each counted once.
+	osPageSize := os.Getpagesize()
+	var pages [][2]int
+	total := 0
+	for _, s := range spans {
+		first, last := s[0]/osPageSize, (s[1]+osPageSize-1)/osPageSize
+		if max := (sz + osPageSize - 1) / osPageSize; last > max {
+			last = max
+		}
+		if n := len(pages); n > 0 && pages[n-1][1] > first {
+			first = pages[n-1][1]
+		}
+		if first >= last {
+			continue
+		}
+		pages = append(pages, [2]int{first, last})
+		total += last - first
+	}
+	if total == 0 {
+		return nil
+	}
+
+	done := 0
+	var sum byte
+	for _, p := range pages {
+		end := p[1] * osPageSize
+		if end > sz {
+			end = sz
+		}
+		b := db.dataref[p[0]*osPageSize : end]
+		// The hint is best-effort, touching the pages is what warms the cache.
+		_ = madviseWillNeed(b)
+		for i := 0; i < len(b); i += osPageSize {
+			sum += b[i]
+			if done++; done%preloadBatch == 0 || done == total {
+				if db.PreloadProgress != nil {
+					db.PreloadProgress(done, total)
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	atomic.StoreUint32(&preloadSink, uint32(sum))
+	return nil
+}
@@ -0,0 +1,88 @@
+package sidb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestPreload(t *testing.T) {
+	assert := assertion.New(t)
+	_ = os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	defer db.Close()
+
+	var done, total int
+	db.PreloadProgress = func(d, t int) {
+		done, total = d, t
+	}
+	assert.NoError(db.Preload(context.Background()))
+	want := db.filesz / os.Getpagesize()
+	assert.Equal(want, total)
+	assert.Equal(want, done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, db.Preload(ctx))
+}
+
+func TestPreloadRange(t *testing.T) {
+	assert := assertion.New(t)
+	_ = os.Remove(testDB)
+	defer os.Remove(testDB)
+	osPageSize := os.Getpagesize()
+	db, err := Open(testDB, 0755, &Options{PageSize: uint32(osPageSize), OrderedWrite: true, Compression: CompNone})
+	assert.NoError(err)
+	defer db.Close()
+	value := bytes.Repeat([]byte("v"), 200)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key%04d", i)), value))
+	}
+	// an overflow record in the middle of the range
+	assert.NoError(db.Put([]byte("key1000"), bytes.Repeat([]byte("b"), 3*osPageSize)))
+	for i := 1001; i < 1100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key%04d", i)), value))
+	}
+	assert.True(db.indexed())
+
+	var total int
+	db.PreloadProgress = func(_, t int) {
+		total = t
+	}
+	// the pages a scan of the range reads
+	pages := func(start, end []byte) map[PageId]bool {
+		touched := make(map[PageId]bool)
+		c := db.Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			touched[c.curID] = true
+		}
+		assert.NoError(c.Err())
+		return touched
+	}
+
+	// a range within the index
+	want := pages([]byte("key0100"), []byte("key0200"))
+	assert.NoError(db.PreloadRange([]byte("key0100"), []byte("key0200")))
+	// the pages of the range, one more on each side sharing a key
+	// prefix, and the unindexed tail
+	assert.GreaterOrEqual(total, len(want))
+	assert.LessOrEqual(total, len(want)+3)
+
+	// the 4 pages of the overflow record are warmed, with the page after
+	// it sharing its key prefix and the unindexed tail
+	total = 0
+	assert.NoError(db.PreloadRange([]byte("key1000"), []byte("key1001")))
+	assert.GreaterOrEqual(total, 4)
+	assert.LessOrEqual(total, 7)
+
+	// everything
+	total = 0
+	assert.NoError(db.PreloadRange(nil, nil))
+	assert.Greater(total, len(pages(nil, []byte("z"))))
+	assert.LessOrEqual(total, db.filesz/osPageSize)
+}
@@ -0,0 +1,179 @@
+package sidb
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// promoteRetryInterval is how long SetWritable waits between attempts to get
+// the exclusive lock.
+const promoteRetryInterval = 50 * time.Millisecond
+
+// SetWritable promotes a read-only handle to read-write without closing it.
+//
+// The shared lock is upgraded to an exclusive one, retrying until it succeeds
+// or ctx is done, then the file is reopened O_RDWR and the head page is
+// validated again. If the exclusive lock can't be obtained the handle keeps
+// working as a reader.
+func (db *DB) SetWritable(ctx context.Context) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return errors.New("database not open")
+	}
+	if !db.readOnly {
+		return nil
+	}
+	if db.noLock {
+		return errors.New("can't promote a handle opened with NoLock")
+	}
+	if db.lockMode == LockDotfile {
+		return errors.New("can't promote a handle using LockDotfile")
+	}
+
+	for {
+		err := flockFile(db.lockFile(), true)
+		if err == nil {
+			break
+		}
+		// A failed lock conversion may drop the shared lock, take it again
+		// so the handle stays a valid reader.
+		if err := flockFile(db.lockFile(), false); err != nil {
+			return errors.Wrap(err, "reacquire shared lock")
+		}
+		if !errors.Is(err, ErrWriteByOther) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(promoteRetryInterval):
+		}
+	}
+
+	if err := db.setWritable(true); err != nil {
+		_ = flockFile(db.lockFile(), false)
+		return err
+	}
+
+	f, err := os.OpenFile(db.path, os.O_RDWR, 0)
+	if err != nil {
+		_ = db.setWritable(false)
+		_ = flockFile(db.lockFile(), false)
+		return errors.Wrap(err, "reopen read-write")
+	}
+	db.swapFile(f)
+	db.readOnly = false
+	db.lockedAt = time.Now()
+	if err := db.writeOwner(); err != nil {
+		return err
+	}
+
+	if err := db.mmap(0); err != nil {
+		return err
+	}
+	if err := db.loadFreelist(); err != nil {
+		return err
+	}
+	db.startSyncer()
+	return nil
+}
+
+// SetReadOnly demotes a read-write handle to read-only: the exclusive lock is
+// downgraded to a shared one and the file is reopened O_RDONLY.
+func (db *DB) SetReadOnly() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return errors.New("database not open")
+	}
+	if db.readOnly {
+		return nil
+	}
+	if db.lockMode == LockDotfile {
+		return errors.New("can't demote a handle using LockDotfile")
+	}
+
+	if err := db.flushFreelist(); err != nil {
+		return err
+	}
+	// The syncer, left running, won't find anything to sync from now on.
+	if db.unsynced && db.syncPolicy.interval > 0 {
+		if err := db.sync(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(db.path, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "reopen read-only")
+	}
+	if err := db.removeOwner(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := flockFile(db.lockFile(), false); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "downgrade lock")
+	}
+	db.swapFile(f)
+	db.readOnly = true
+	_ = db.setWritable(false)
+	db.lockedAt = time.Now()
+	return nil
+}
+
+// swapFile replaces the data file descriptor. A lock can't be moved to another
+// descriptor without a window where it isn't held, so if the lock is held on
+// the current data file, that descriptor is kept open as the lock holder.
+func (db *DB) swapFile(f *os.File) {
+	if db.lockfile == nil {
+		db.lockfile = db.file
+		db.externalLock = true
+	} else {
+		_ = db.file.Close()
+	}
+	db.file = f
+	db.ops.writeAt = f.WriteAt
+	db.ops.sync = f.Sync
+}
+
+// fallbackReadOnly turns a read-write Open that failed to get the exclusive
+// lock into a read-only one, see Options.FallbackReadOnly. The data file is
+// reopened O_RDONLY so that writes fail at the descriptor too.
+func (db *DB) fallbackReadOnly() error {
+	f, err := os.OpenFile(db.path, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "reopen read-only")
+	}
+	_ = db.file.Close()
+	db.file = f
+	db.readOnly = true
+	db.demoted = true
+	_ = db.setWritable(false)
+
+	switch {
+	case db.lockMode == LockDotfile:
+		// readers don't take a dotfile lock
+	case db.externalLock:
+		err = db.lockExternal(0)
+	default:
+		err = flock(db)
+	}
+	if errors.Is(err, ErrWriteByOther) {
+		// A writer holds the exclusive lock, read without one.
+		db.noLock = true
+		err = nil
+	}
+	db.lockedAt = time.Now()
+	return err
+}
+
+// WasDemoted reports whether the handle was opened read-only because the
+// exclusive lock was unavailable, see Options.FallbackReadOnly.
+func (db *DB) WasDemoted() bool {
+	return db.demoted
+}
@@ -0,0 +1,109 @@
+package sidb
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSetWritable(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	ro := &Options{ReadOnly: true}
+	a, err := Open(testDB, 0755, ro)
+	assert.NoError(err)
+	b, err := Open(testDB, 0755, ro)
+	assert.NoError(err)
+
+	// b holds a shared lock, a can't promote
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, a.SetWritable(ctx))
+	assert.True(a.readOnly)
+	// a is still a working reader holding its shared lock
+	assert.Equal(Magic, a.head.magic)
+	_, err = a.ops.writeAt([]byte{0}, 0)
+	assert.Error(err)
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrWriteByOther))
+
+	// promotion succeeds once b is gone
+	assert.NoError(b.Close())
+	assert.NoError(a.SetWritable(context.Background()))
+	assert.False(a.readOnly)
+	assert.Equal(Magic, a.head.magic)
+	_, err = a.ops.writeAt(a.dataref[:4], 0)
+	assert.NoError(err)
+	_, err = Open(testDB, 0755, ro)
+	assert.True(errors.Is(err, ErrWriteByOther))
+
+	// after demotion, b can open but can't promote while a reads
+	assert.NoError(a.SetReadOnly())
+	assert.True(a.readOnly)
+	_, err = a.ops.writeAt([]byte{0}, 0)
+	assert.Error(err)
+	b, err = Open(testDB, 0755, ro)
+	assert.NoError(err)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, b.SetWritable(ctx))
+
+	assert.NoError(a.Close())
+	assert.NoError(b.SetWritable(context.Background()))
+	assert.NoError(b.Close())
+
+	// the file is unlocked after close
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+}
+
+func TestFallbackReadOnly(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	fallback := &Options{FallbackReadOnly: true}
+
+	// nothing to fall back from
+	db, err := Open(testDB, 0755, fallback)
+	assert.NoError(err)
+	assert.False(db.WasDemoted())
+	assert.False(db.readOnly)
+
+	// the file is held read-write
+	asOtherProcess(db)
+	fb, err := Open(testDB, 0755, fallback)
+	assert.NoError(err)
+	assert.True(fb.WasDemoted())
+	assert.True(fb.readOnly)
+	assert.Equal(LockMechanismNone, fb.LockInfo().Mechanism)
+	assert.Equal(Magic, fb.head.magic)
+	assert.Equal(db.datasz, fb.datasz)
+	// writes fail at the descriptor
+	_, err = fb.ops.writeAt([]byte{0}, 0)
+	assert.Error(err)
+	assert.NoError(fb.Close())
+	assert.NoError(db.Close())
+
+	// the file is held by a reader, the fallback shares its lock
+	r, err := Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	fb, err = Open(testDB, 0755, fallback)
+	assert.NoError(err)
+	assert.True(fb.WasDemoted())
+	info := fb.LockInfo()
+	assert.Equal(LockMechanismFlock, info.Mechanism)
+	assert.False(info.Exclusive)
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrWriteByOther))
+	assert.NoError(r.Close())
+	assert.NoError(fb.Close())
+}
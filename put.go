@@ -0,0 +1,671 @@
+package sidb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Put appends a key/value pair to the database. A later Put of the same key
+// shadows the earlier one, or adds a value in DupKeys mode. Put commits and
+// syncs on its own, to write several pairs at once use Update.
+//
+// Records are appended to the data page pointed at by the head's kvPtr, with
+// the key prefix compressed against the previous key on the same page. When
+// the page is full a new page is chained to it, and a record too large for a
+// page is split across new pages, see overflowPages. In OrderedWrite mode keys
+// must be put in non-decreasing order, see ErrKeyOutOfOrder.
+func (db *DB) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	return db.put(KVPair{Key: key, Value: value}, 0)
+}
+
+// Delete removes a key by appending a tombstone record for it. Reads treat
+// the newest record of a key as authoritative, so the key is hidden from then
+// on. Deleting a key that doesn't exist appends a tombstone as well, without
+// looking the key up. Tombstones are exempt from OrderedWrite. In DupKeys
+// mode every value of the key is deleted, see DeleteDup.
+func (db *DB) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	return db.put(KVPair{Key: key}, KVDeleted)
+}
+
+// DeleteRange deletes the keys with start <= key < end and returns how many
+// live keys it deleted. A nil start or end leaves the range open on that side.
+// A tombstone is appended for every key, all in one batch with a single sync,
+// see PutBatch.
+//
+// In OrderedWrite mode the keys are found by seeking to start and stop at
+// end, otherwise all keys are scanned.
+func (db *DB) DeleteRange(start, end []byte) (int, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return 0, ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+	c := db.Cursor()
+	c.keysOnly = true
+	var k []byte
+	if db.orderedWrite && start != nil {
+		k, _ = c.Seek(start)
+	} else {
+		k, _ = c.First()
+	}
+	var pairs []KVPair
+	for ; k != nil; k, _ = c.Next() {
+		if end != nil && db.comparator(k, end) >= 0 {
+			if db.orderedWrite {
+				break
+			}
+			continue
+		}
+		if start != nil && db.comparator(k, start) < 0 {
+			continue
+		}
+		pairs = append(pairs, KVPair{Key: append([]byte(nil), k...)})
+	}
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	if len(pairs) == 0 {
+		return 0, nil
+	}
+	flags := make([]KVFlag, len(pairs))
+	for i := range flags {
+		flags[i] = KVDeleted
+	}
+	defer db.commitStats()
+	if err := db.putBatch(pairs, flags); err != nil {
+		return 0, err
+	}
+	return len(pairs), nil
+}
+
+// PutBatch appends pairs like a sequence of Puts, but with one write per page
+// touched and a single sync, where Put writes and syncs every record. In
+// OrderedWrite mode the pairs are sorted first, and the smallest key must not
+// be less than the last key put before. Later pairs of a key shadow earlier
+// ones, or are added after them in DupKeys mode.
+//
+// The head is only committed once every page is written, so a batch failing
+// halfway leaves the database as it was.
+func (db *DB) PutBatch(pairs []KVPair) error {
+	for _, kv := range pairs {
+		if len(kv.Key) == 0 {
+			return ErrKeyRequired
+		}
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	if db.orderedWrite {
+		pairs = append([]KVPair(nil), pairs...)
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return db.comparator(pairs[i].Key, pairs[j].Key) < 0
+		})
+	}
+	defer db.commitStats()
+	return db.putBatch(pairs, nil)
+}
+
+// putBatch appends pairs, with the extra flags at the same index in flags if
+// not nil, and commits the head, see PutBatch. The caller holds rwlock and
+// pairs isn't empty.
+func (db *DB) putBatch(pairs []KVPair, flags []KVFlag) (err error) {
+	// Pages taken off the freelist go back to it if the commit fails.
+	db.releasePending(db.oldestTx())
+	freelist := db.freelist
+	defer func() {
+		if err != nil {
+			db.freelist = freelist
+		}
+	}()
+	flagOf := func(i int) KVFlag {
+		if flags == nil {
+			return 0
+		}
+		return flags[i]
+	}
+	// the last pair that isn't a tombstone
+	lastPut := -1
+	var tombstones uint32
+	var stamped, appended bool
+	for i, kv := range pairs {
+		db.countRecord(kv, flagOf(i))
+		appended = appended || flagOf(i)&KVAppended != 0
+		if flagOf(i)&KVDeleted != 0 {
+			tombstones++
+			// Those copied, by Salvage or Compact, keep their time.
+			if len(kv.Value) == 0 {
+				if !stamped {
+					pairs = append([]KVPair(nil), pairs...)
+					stamped = true
+				}
+				pairs[i].Value = tombstoneValue(db.now())
+			}
+		} else {
+			lastPut = i
+		}
+	}
+
+	db.mmaplock.RLock()
+	head := *db.head
+	if appended {
+		head.Features.Required |= FeatureAppend
+	}
+	id := PageId(head.kvPtr.pageNum)
+	tail := &batchPage{id: id, hdr: *db.page(id), buf: db.getBuf(db.pageSize)}
+	start := int(db.pageOffset(id))
+	copy(tail.buf, db.dataSlice(start, start+int(tail.hdr.ptr)))
+	err = db.loadTail(id, &tail.hdr)
+	db.mmaplock.RUnlock()
+	pages := []*batchPage{tail}
+	defer func() {
+		for _, p := range pages {
+			db.putBuf(p.buf)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if db.orderedWrite && db.lastPutKey != nil {
+		for i, kv := range pairs {
+			if flagOf(i)&KVDeleted == 0 {
+				if db.comparator(kv.Key, db.lastPutKey) < 0 {
+					return ErrKeyOutOfOrder
+				}
+				break
+			}
+		}
+	}
+
+	prevKey := db.lastKey
+	p := tail
+	// records are encoded into it, and copied to their page
+	recBuf := db.getBuf(db.pageSize)
+	defer db.putBuf(recBuf)
+	// entries of the pages no more records go to, see writeIndex
+	var entries []Index
+	// The pages added take records past their size with page compression,
+	// see fitsPacked, the tail is committed already.
+	packed := func(p *batchPage) bool {
+		return db.pageCompression && p != tail && !p.hdr.overflow()
+	}
+	// seal closes p to further records, dropping those past what it is known
+	// to hold compressed, and returns how many.
+	seal := func(p *batchPage) (int, error) {
+		var n int
+		if packed(p) {
+			n = db.packRewind(p)
+		}
+		var err error
+		if entries, err = db.indexEntry(entries, p.id, &p.hdr, p.buf[pageHeaderSize:p.hdr.ptr]); err != nil {
+			return 0, err
+		}
+		if packed(p) {
+			return n, db.packPage(p)
+		}
+		return n, db.sealBatchPage(p)
+	}
+	// newPage chains an empty data page after p.
+	newPage := func() error {
+		next, err := db.allocate(&head)
+		if err != nil {
+			return err
+		}
+		p.hdr.Next = next
+		size := db.pageSize
+		if db.pageCompression {
+			size = db.packSize()
+		}
+		p = &batchPage{
+			id:  next,
+			hdr: Page{Flag: PageData | PageFull, ptr: PageSz(pageHeaderSize)},
+			buf: db.getBuf(size),
+		}
+		pages = append(pages, p)
+		return nil
+	}
+	for i := 0; i < len(pairs); i++ {
+		kv := pairs[i]
+		// The prefix chain restarts on every page, see restartInterval.
+		if isRestart(int(p.hdr.Count)) {
+			prevKey = nil
+		}
+		raw := packed(p)
+		rec := db.marshal(recBuf[:0], kv, prevKey, raw)
+		var full bool
+		if packed(p) {
+			full = !db.fitsPacked(p, rec)
+		} else {
+			full = p.hdr.overflow() || int(p.hdr.ptr)+len(rec)+db.footerRoom(int(p.hdr.Count)+1) > db.pageSize
+		}
+		if full {
+			n, err := seal(p)
+			if err != nil {
+				return err
+			}
+			// the records dropped go on the next page
+			i -= n
+			kv = pairs[i]
+			rec, raw = db.marshal(recBuf[:0], kv, nil, false), false
+			if pageHeaderSize+len(rec)+db.footerRoom(1) > db.pageSize {
+				rec[0] |= byte(flagOf(i))
+				db.txStats.CompressOut += int64(len(rec))
+				db.countStored(kv, rec, false)
+				chain, err := db.overflowPages(&head, rec)
+				if err != nil {
+					return err
+				}
+				p.hdr.Next = chain[0].id
+				entries = db.overflowIndexEntry(entries, chain[0].id, kv.Key)
+				pages = append(pages, chain...)
+				p = chain[len(chain)-1]
+				prevKey = nil
+				continue
+			}
+			if err := newPage(); err != nil {
+				return err
+			}
+			if db.pageCompression {
+				// compressed on its own if it only fits so
+				if r := db.marshal(nil, kv, nil, true); pageHeaderSize+len(r)+db.footerRoom(1) <= db.pageSize {
+					rec, raw = r, true
+				}
+				db.fitsPacked(p, rec)
+			}
+		}
+		rec[0] |= byte(flagOf(i))
+		db.txStats.CompressOut += int64(len(rec))
+		db.countStored(kv, rec, raw)
+		copy(p.buf[p.hdr.ptr:], rec)
+		p.hdr.Count++
+		p.hdr.Len += PageSz(len(rec))
+		p.hdr.ptr += PageSz(len(rec))
+		prevKey = kv.Key
+
+		// Put appends to the last page in place, uncompressed: one holding
+		// more is sealed, an empty one or the records it drops follow.
+		if i == len(pairs)-1 && packed(p) && int(p.hdr.ptr)+db.footerRoom(int(p.hdr.Count)) > db.pageSize {
+			n, err := seal(p)
+			if err != nil {
+				return err
+			}
+			if err := newPage(); err != nil {
+				return err
+			}
+			i -= n
+			prevKey = nil
+		}
+	}
+
+	// New pages first, nothing links to them until the tail page is written,
+	// and mapped before readers without a snapshot follow the link.
+	for _, np := range pages[1:] {
+		if err := db.writeBatchPage(np); err != nil {
+			return err
+		}
+	}
+	if err := db.mmapRelocate(int(head.PageCount) * db.pageSize); err != nil {
+		return err
+	}
+	if err := db.writeBatchPage(tail); err != nil {
+		return err
+	}
+
+	if err := db.writeIndex(&head, entries); err != nil {
+		return err
+	}
+
+	head.kvPtr = RecordPtr{uint32(p.id), p.hdr.ptr}
+	head.tombstones += tombstones
+	if err := db.flushHead(&head); err != nil {
+		return err
+	}
+	db.addIndexes(entries, PageId(head.kvPtr.pageNum))
+	db.lastKey = append(db.lastKey[:0], pairs[len(pairs)-1].Key...)
+	if lastPut >= 0 {
+		db.lastPutKey = append(db.lastPutKey[:0], pairs[lastPut].Key...)
+	}
+
+	return db.mmapRelocate(int(head.PageCount) * db.pageSize)
+}
+
+// countRecord counts kv, written with flag, in the commit in progress.
+func (db *DB) countRecord(kv KVPair, flag KVFlag) {
+	if flag&KVDeleted != 0 {
+		db.txStats.Delete++
+	} else {
+		db.txStats.Put++
+	}
+	db.txStats.CompressIn += int64(len(kv.Key) + len(kv.Value))
+}
+
+// batchPage is a data page being filled by PutBatch.
+type batchPage struct {
+	id  PageId
+	hdr Page
+	buf []byte
+	// with page compression, the records known to fit in the page, where they
+	// end and compressed up to there, and the end of the records past which to
+	// check again, see fitsPacked
+	fitCount uint16
+	fitPtr   PageSz
+	packed   []byte
+	check    int
+}
+
+// writeBatchPage writes the header and records of p, and its footer if
+// sealed, with a single write, checksumming the records.
+func (db *DB) writeBatchPage(p *batchPage) error {
+	p.hdr.CheckSum = db.checksumAlgo.sum(p.buf[pageHeaderSize:p.hdr.ptr])
+	pageHeaderEncode(p.buf, &p.hdr)
+	end := int(p.hdr.ptr)
+	if p.hdr.Flag&(PageSorted|PageBloom) != 0 {
+		end = db.pageSize
+	}
+	_, err := db.write(p.buf[:end], db.pageOffset(p.id))
+	return err
+}
+
+// put appends kv with the given extra flags and commits the head. The caller
+// holds rwlock.
+func (db *DB) put(kv KVPair, flag KVFlag) (err error) {
+	defer db.commitStats()
+	db.releasePending(db.oldestTx())
+	freelist := db.freelist
+	defer func() {
+		if err != nil {
+			db.freelist = freelist
+		}
+	}()
+	// Work on copies: the mmap is read-only, everything goes to the file
+	// through ops.writeAt and shows up in the mapping afterwards.
+	db.mmaplock.RLock()
+	head := *db.head
+	ptr := head.kvPtr
+	id := PageId(ptr.pageNum)
+	page := *db.page(id)
+	err = db.loadTail(id, &page)
+	db.mmaplock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	deleted := flag&KVDeleted != 0
+	if deleted && len(kv.Value) == 0 {
+		kv.Value = tombstoneValue(db.now())
+	}
+	if flag&KVAppended != 0 {
+		head.Features.Required |= FeatureAppend
+	}
+	var entries []Index
+	if db.orderedWrite && !deleted && db.lastPutKey != nil && db.comparator(kv.Key, db.lastPutKey) < 0 {
+		return ErrKeyOutOfOrder
+	}
+
+	// The prefix chain restarts on every page, see restartInterval.
+	var prevKey []byte
+	if !isRestart(int(page.Count)) {
+		prevKey = db.lastKey
+	}
+	recBuf := db.getBuf(db.pageSize)
+	defer db.putBuf(recBuf)
+	rec := db.marshal(recBuf[:0], kv, prevKey, false)
+	if page.overflow() || int(ptr.offset)+len(rec)+db.footerRoom(int(page.Count)+1) > db.pageSize {
+		rec = db.marshal(recBuf[:0], kv, nil, false)
+		if pageHeaderSize+len(rec)+db.footerRoom(1) > db.pageSize {
+			// Stored across pages, see overflowPages.
+			return db.putBatch([]KVPair{kv}, []KVFlag{flag})
+		}
+		next, err := db.allocatePage(&head, PageData)
+		if err != nil {
+			return err
+		}
+		start := int(db.pageOffset(id))
+		db.mmaplock.RLock()
+		entries, err = db.indexEntry(nil, id, &page, db.dataSlice(start+pageHeaderSize, start+int(page.ptr)))
+		db.mmaplock.RUnlock()
+		if err != nil {
+			return err
+		}
+		if err := db.writeIndex(&head, entries); err != nil {
+			return err
+		}
+		id = next
+		ptr = RecordPtr{uint32(id), PageSz(pageHeaderSize)}
+		page = Page{Flag: PageData | PageFull, ptr: PageSz(pageHeaderSize)}
+	}
+
+	rec[0] |= byte(flag)
+	db.countRecord(kv, flag)
+	db.txStats.CompressOut += int64(len(rec))
+	db.countStored(kv, rec, false)
+	if _, err := db.write(rec, db.pageOffset(id)+int64(ptr.offset)); err != nil {
+		return err
+	}
+	page.CheckSum = db.appendSum(id, &page, rec)
+	page.Count++
+	page.Len += PageSz(len(rec))
+	page.ptr += PageSz(len(rec))
+	if err := db.writePageHeader(id, &page); err != nil {
+		return err
+	}
+
+	head.kvPtr = RecordPtr{uint32(id), page.ptr}
+	if deleted {
+		head.tombstones++
+	}
+	if err := db.flushHead(&head); err != nil {
+		return err
+	}
+	db.addIndexes(entries, PageId(head.kvPtr.pageNum))
+	db.lastKey = append(db.lastKey[:0], kv.Key...)
+	if !deleted {
+		db.lastPutKey = append(db.lastPutKey[:0], kv.Key...)
+	}
+
+	// Map the pages appended past the end of the mapping.
+	return db.mmapRelocate(int(head.PageCount) * db.pageSize)
+}
+
+// allocatePage allocates a page for the commit of head in progress, see
+// allocate, and writes its header with flag. A data page is chained after the
+// data page kvPtr points at, which is sealed, see sealPage. It holds whole
+// records and is marked PageFull unless flag says it is part of an overflow
+// record. The page is mapped once
+// this returns. The caller holds rwlock.
+func (db *DB) allocatePage(head *HeadPage, flag PageFlag) (PageId, error) {
+	id, err := db.allocate(head)
+	if err != nil {
+		return 0, err
+	}
+	p := Page{Flag: flag | PageFull, ptr: PageSz(pageHeaderSize)}
+	if p.overflow() {
+		p.Flag &^= PageFull
+	}
+	if err := db.writePageHeader(id, &p); err != nil {
+		return 0, err
+	}
+	// Readers without a snapshot follow the link as soon as it is written.
+	if err := db.mmapRelocate(int(head.PageCount) * db.pageSize); err != nil {
+		return 0, err
+	}
+	if flag&PageData != 0 {
+		tail := PageId(head.kvPtr.pageNum)
+		db.mmaplock.RLock()
+		prev := *db.page(tail)
+		db.mmaplock.RUnlock()
+		if err := db.sealPage(tail, &prev); err != nil {
+			return 0, err
+		}
+		prev.Next = id
+		if err := db.writePageHeader(tail, &prev); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// loadTail loads db.lastKey, the last key of the data page id records are
+// appended to, and db.lastPutKey, the last key written by Put, on the first
+// write after Open. The caller holds mmaplock.
+func (db *DB) loadTail(id PageId, p *Page) error {
+	if db.tailLoaded {
+		return nil
+	}
+	err := db.scanPage(id, p, func(kv *KVPair, flag KVFlag) bool {
+		db.lastKey = append(db.lastKey[:0], kv.Key...)
+		if flag&KVDeleted == 0 {
+			db.lastPutKey = append(db.lastPutKey[:0], kv.Key...)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// Only tombstones on the last page, the last Put is further back.
+	if db.lastPutKey == nil && id != db.dataStart {
+		if err := db.scanPages(nil, func(kv *KVPair, flag KVFlag) bool {
+			if flag&KVDeleted == 0 {
+				db.lastPutKey = append(db.lastPutKey[:0], kv.Key...)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+	db.tailLoaded = true
+	return nil
+}
+
+// rollbackTail drops what a crash left past the head: records appended to
+// the last data page and its link to later pages, written before a head that
+// never made it, see FeatureDualHead.
+func (db *DB) rollbackTail() error {
+	id := PageId(db.head.kvPtr.pageNum)
+	end := int(db.head.kvPtr.offset)
+	buf := db.getBuf(db.pageSize)[:db.pageSize]
+	defer db.putBuf(buf)
+	pos := db.pageOffset(id)
+	// Past the end of a file grown by the writes, see NoGrowSync, the
+	// mapping can't be read.
+	size := db.pageSize
+	if rest := db.filesz - int(pos); rest < size {
+		size = rest
+	}
+	page := db.dataSlice(int(pos), int(pos)+size)
+	copy(buf, page)
+	for i := range buf[size:] {
+		buf[size+i] = 0
+	}
+	if err := db.cutPage(id, buf, end); err != nil {
+		// records broken in a committed page are for reads to report
+		if p := db.page(id); int(p.ptr) == end && p.Next == 0 {
+			return nil
+		}
+		return err
+	}
+	// The header may be torn, with some fields of the commit that didn't
+	// make it and not others, compare it whole.
+	if bytes.Equal(buf[:size], page) {
+		return nil
+	}
+	if _, err := db.ops.writeAt(buf, pos); err != nil {
+		return err
+	}
+	return db.ops.sync()
+}
+
+// pageData returns the records stored in data page id, whose header is p.
+func (db *DB) pageData(id PageId, p *Page) []byte {
+	start := db.pageOffset(id)
+	return db.dataSlice(int(start)+pageHeaderSize, int(start)+int(p.ptr))
+}
+
+// writePageHeader writes the header of page id to the file.
+func (db *DB) writePageHeader(id PageId, p *Page) error {
+	var buf [pageHeaderSize]byte
+	pageHeaderEncode(buf[:], p)
+	_, err := db.write(buf[:], db.pageOffset(id))
+	return err
+}
+
+// flushHead writes head to the file as the next generation and syncs it, if
+// the SyncPolicy is SyncAlways and NoSync isn't set. Everything written for
+// the commit is synced first: the disk may reorder writes between syncs, and
+// must not get to a head pointing at records it doesn't hold yet. With
+// FeatureDualHead the head goes to the head page that isn't current, the
+// current one stays valid should the write be torn.
+func (db *DB) flushHead(head *HeadPage) error {
+	syncing := commitSyncs(db.syncPolicy, db.NoSync, IgnoreNoSync)
+	if syncing {
+		if err := db.sync(); err != nil {
+			return err
+		}
+	}
+	head.generation++
+	id := db.headId
+	if head.Features.Required&FeatureDualHead != 0 {
+		id = 1 - db.headId
+	}
+	head.Checksum = db.headChecksum(head, id)
+	var buf [headPageSize]byte
+	headPageEncode(buf[:], head)
+	// Readers copying the head, see Begin, must not see it half written.
+	db.headlock.Lock()
+	_, err := db.write(buf[:], db.pageOffset(id))
+	if err == nil {
+		db.headId = id
+		if nativeLayout {
+			db.head = db.headPage()
+		} else {
+			// db.head is a decoded copy, not the mapping, see DB.headPage
+			h := *head
+			db.head = &h
+		}
+	}
+	db.headlock.Unlock()
+	if err != nil {
+		return err
+	}
+	if syncing {
+		return db.sync()
+	}
+	db.unsynced = true
+	return nil
+}
@@ -0,0 +1,339 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// readAll decodes every record of the data page chain in physical order.
+func readAll(t *testing.T, db *DB) []KVPair {
+	var pairs []KVPair
+	for id := db.dataStart; id != 0; {
+		data, next, err := db.records(nil, id, db.page(id))
+		if err != nil {
+			t.Fatalf("page %d: %s", id, err)
+		}
+		var prevKey []byte
+		for len(data) > 0 {
+			var kv KVPair
+			n, _, err := kv.unmarshal(data, prevKey, db.decompressor)
+			if err != nil {
+				t.Fatalf("page %d: %s", id, err)
+			}
+			prevKey = kv.Key
+			pairs = append(pairs, kv)
+			data = data[n:]
+		}
+		id = next
+	}
+	return pairs
+}
+
+func TestPut(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	db.NoSync = true
+	const n = 5000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%06d", i))
+		assert.NoError(db.Put(key, []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.True(db.head.PageCount > 10)
+	assert.True(int(db.head.PageCount)*db.pageSize <= db.filesz)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	pairs := readAll(t, db)
+	if assert.Len(pairs, n) {
+		for i, kv := range pairs {
+			assert.Equal(fmt.Sprintf("key-%06d", i), string(kv.Key))
+			assert.Equal(fmt.Sprintf("value-%d", i), string(kv.Value))
+		}
+	}
+	var count int
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		count += int(db.page(id).Count)
+	}
+	assert.Equal(n, count)
+
+	// appending continues the prefix chain of the last page after reopen
+	assert.NoError(db.Put([]byte(fmt.Sprintf("key-%06d", n)), nil))
+	pairs = readAll(t, db)
+	assert.Len(pairs, n+1)
+	assert.Equal(fmt.Sprintf("key-%06d", n), string(pairs[n].Key))
+	assert.Empty(pairs[n].Value)
+	assert.NoError(db.Close())
+}
+
+func TestPutManyPages(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+
+	rnd := rand.New(rand.NewSource(1))
+	values := make([][]byte, 3000)
+	for i := range values {
+		values[i] = make([]byte, 200)
+		rnd.Read(values[i])
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), values[i]))
+	}
+	count := int(db.head.PageCount)
+	assert.True(count > 100, "%d pages", count)
+	assert.True(db.datasz >= count*db.pageSize)
+	var chain []PageId
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		assert.Equal(PageData|PageFull, db.page(id).Flag&^PageSorted, "page %d", id)
+		chain = append(chain, id)
+	}
+	assert.Equal(count-int(db.dataStart)-int(db.head.IndexPageCount), len(chain))
+	assert.Equal(chain[len(chain)-1], PageId(db.head.kvPtr.pageNum))
+	// every page but the last one is indexed
+	assert.Len(db.indexes, len(chain)-1)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	var keys [][]byte
+	for i := range values {
+		keys = append(keys, []byte(fmt.Sprintf("key-%05d", i)))
+	}
+	got, err := db.GetMany(keys)
+	assert.NoError(err)
+	assert.Equal(values, got)
+	assert.NoError(db.Close())
+}
+
+func TestPutErrors(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true, Compression: CompNone})
+	assert.NoError(err)
+	assert.Equal(ErrKeyRequired, db.Put(nil, []byte("v")))
+	assert.NoError(db.Put([]byte("b"), nil))
+	assert.NoError(db.Put([]byte("b"), nil))
+	assert.Equal(ErrKeyOutOfOrder, db.Put([]byte("a"), nil))
+	gen := db.Generation()
+	assert.Equal(uint64(2), gen)
+	assert.NoError(db.Close())
+	assert.Equal(ErrDatabaseNotOpen, db.Put([]byte("c"), nil))
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(ErrDatabaseReadOnly, db.Put([]byte("c"), nil))
+	assert.NoError(db.Close())
+}
+
+func TestPutBatch(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key-00000"), []byte("first")))
+
+	writes := 0
+	writeAt := db.ops.writeAt
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		writes++
+		return writeAt(b, off)
+	}
+	const n = 3000
+	var pairs []KVPair
+	for i := n - 1; i > 0; i-- {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%05d", i)), Value: []byte(fmt.Sprintf("value-%d", i))})
+	}
+	// the later one wins
+	pairs = append(pairs, KVPair{Key: []byte("key-00005"), Value: []byte("again")})
+	assert.NoError(db.PutBatch(pairs))
+	pages := int(db.head.PageCount - db.dataStart)
+	assert.True(pages > 3)
+	// one per page and the head
+	assert.Equal(pages+1, writes)
+	assert.Equal(ErrKeyOutOfOrder, db.PutBatch([]KVPair{{Key: []byte("a")}}))
+	assert.Equal(ErrKeyRequired, db.PutBatch([]KVPair{{Key: nil}}))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	all := readAll(t, db)
+	assert.Equal(n+1, len(all))
+	assert.Equal("key-00000", string(all[0].Key))
+	for i := 1; i < len(all); i++ {
+		assert.True(string(all[i-1].Key) <= string(all[i].Key))
+	}
+	v, err := db.Get([]byte("key-00005"))
+	assert.NoError(err)
+	assert.Equal("again", string(v))
+	// appends after the batch
+	assert.NoError(db.Put([]byte("zzz"), []byte("last")))
+	v, err = db.Get([]byte("zzz"))
+	assert.NoError(err)
+	assert.Equal("last", string(v))
+	assert.NoError(db.Close())
+}
+
+func TestPutBatchFailure(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	head := *db.head
+
+	writes := 0
+	writeAt := db.ops.writeAt
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		if writes++; writes == 2 {
+			return 0, errors.New("disk full")
+		}
+		return writeAt(b, off)
+	}
+	var pairs []KVPair
+	for i := 0; i < 2000; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("batch-%d", i)), Value: []byte("v")})
+	}
+	assert.Error(db.PutBatch(pairs))
+	assert.Equal(head.kvPtr, db.head.kvPtr)
+	assert.Equal(head.generation, db.head.generation)
+	db.ops.writeAt = writeAt
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	all := readAll(t, db)
+	assert.Equal(1, len(all))
+	assert.Equal("key", string(all[0].Key))
+	assert.NoError(db.Put([]byte("more"), []byte("value")))
+	assert.Equal(2, len(readAll(t, db)))
+	assert.NoError(db.Close())
+}
+
+// TestPutTornHead crashes halfway through writing the head of a commit: the
+// file as left on disk opens with the commit before.
+func TestPutTornHead(t *testing.T) {
+	assert := assertion.New(t)
+	crashed := testDB + ".crashed"
+	var batch []KVPair
+	for i := 0; i < 2000; i++ {
+		batch = append(batch, KVPair{Key: []byte(fmt.Sprintf("lost-%04d", i)), Value: []byte("lost")})
+	}
+	commits := map[string]func(db *DB) error{
+		"put":   func(db *DB) error { return db.Put([]byte("lost"), []byte("lost")) },
+		"batch": func(db *DB) error { return db.PutBatch(batch) },
+	}
+	for name, commit := range commits {
+		os.Remove(testDB)
+		os.Remove(crashed)
+		db, err := Open(testDB, 0755, nil)
+		assert.NoError(err)
+		for i := 0; i < 100; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		gen := db.head.generation
+
+		writeAt := db.ops.writeAt
+		db.ops.writeAt = func(b []byte, off int64) (int, error) {
+			if off < db.pageOffset(db.dataStart) {
+				n, err := writeAt(b[:len(b)/2], off)
+				if err == nil {
+					err = errors.New("power failure")
+				}
+				return n, err
+			}
+			return writeAt(b, off)
+		}
+		assert.Error(commit(db), name)
+		db.ops.writeAt = writeAt
+		// the handle is gone with the crash, the file stays as it was
+		data, err := ioutil.ReadFile(testDB)
+		assert.NoError(err)
+		assert.NoError(ioutil.WriteFile(crashed, data, 0644))
+		assert.NoError(db.Close())
+
+		db, err = Open(crashed, 0755, &Options{VerifyChecksums: true})
+		if !assert.NoError(err, name) {
+			continue
+		}
+		assert.Equal(gen, db.head.generation, name)
+		all := readAll(t, db)
+		assert.Equal(100, len(all), name)
+		for i := 0; i < 100; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key-%03d", i)))
+			assert.NoError(err)
+			assert.Equal(fmt.Sprintf("value-%d", i), string(v))
+		}
+		for _, k := range []string{"lost", "lost-0000"} {
+			v, err := db.Get([]byte(k))
+			assert.NoError(err)
+			assert.Nil(v, name)
+		}
+		// and commits go on from there
+		assert.NoError(commit(db), name)
+		assert.Equal(gen+1, db.head.generation, name)
+		assert.NoError(db.Close())
+	}
+	os.Remove(testDB)
+	os.Remove(crashed)
+}
+
+func TestDeleteRange(t *testing.T) {
+	assert := assertion.New(t)
+	for _, ordered := range []bool{true, false} {
+		os.Remove(testDB)
+		db, err := Open(testDB, 0755, &Options{OrderedWrite: ordered})
+		assert.NoError(err)
+		db.NoSync = true
+		const n = 3000
+		for i := 0; i < n; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte("value")))
+		}
+		assert.NoError(db.Delete([]byte("key-01500")))
+
+		deleted, err := db.DeleteRange([]byte("key-01000"), []byte("key-02000"))
+		assert.NoError(err)
+		assert.Equal(999, deleted)
+		// nothing left to delete
+		deleted, err = db.DeleteRange([]byte("key-01000"), []byte("key-02000"))
+		assert.NoError(err)
+		assert.Equal(0, deleted)
+		deleted, err = db.DeleteRange(nil, []byte("key-00010"))
+		assert.NoError(err)
+		assert.Equal(10, deleted)
+		deleted, err = db.DeleteRange([]byte("key-02990"), nil)
+		assert.NoError(err)
+		assert.Equal(10, deleted)
+
+		v, err := db.Get([]byte("key-01234"))
+		assert.NoError(err)
+		assert.Nil(v)
+		v, err = db.Get([]byte("key-02000"))
+		assert.NoError(err)
+		assert.NotNil(v)
+		var keys int
+		assert.NoError(db.ForEachKey(func(k []byte) error {
+			keys++
+			return nil
+		}))
+		assert.Equal(n-1000-20, keys)
+		// puts are still in order after the tombstones
+		assert.NoError(db.Put([]byte("key-03000"), []byte("value")))
+		assert.NoError(db.Close())
+	}
+	os.Remove(testDB)
+}
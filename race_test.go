@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package sidb
+
+// raceEnabled is set when the tests run with the race detector, under which
+// sync.Pool drops items at random, so allocation counts aren't reliable.
+const raceEnabled = true
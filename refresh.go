@@ -0,0 +1,34 @@
+package sidb
+
+import "encoding/binary"
+
+// Generation returns the commit generation currently on disk. It reads only
+// that field of the head pages with a pread, so it is cheap enough to poll
+// from other processes to find out whether anything changed.
+func (db *DB) Generation() uint64 {
+	var buf [8]byte
+	var gen uint64
+	// the newest of both heads, see FeatureDualHead
+	for id := PageId(0); id < db.dataStart; id++ {
+		if _, err := db.readAt(buf[:], db.pageOffset(id)+generationOffset); err != nil {
+			return db.seenGen
+		}
+		if g := binary.LittleEndian.Uint64(buf[:]); g > gen {
+			gen = g
+		}
+	}
+	return gen
+}
+
+// Refresh makes commits done by another process since the last refresh visible
+// to this handle, remapping the file if it grew. It does nothing if the
+// generation didn't move.
+func (db *DB) Refresh() error {
+	if db.Generation() == db.seenGen {
+		return nil
+	}
+	if err := db.mmap(0); err != nil {
+		return err
+	}
+	return db.loadIndex()
+}
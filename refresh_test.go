@@ -0,0 +1,39 @@
+package sidb
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestGenerationRefresh(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	w, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	defer w.Close()
+	r, err := Open(testDB, 0755, &Options{ReadOnly: true, NoLock: true})
+	assert.NoError(err)
+	defer r.Close()
+
+	assert.Equal(uint64(0), r.Generation())
+	gen := r.mapGen
+	assert.NoError(r.Refresh())
+	// nothing moved, no remap
+	assert.Equal(gen, r.mapGen)
+
+	// the writer grows the file, then publishes generation 1 last
+	assert.NoError(w.file.Truncate(int64(w.datasz) * 2))
+	assert.NoError(r.Refresh())
+	assert.Equal(gen, r.mapGen)
+	assert.Equal(3*r.pageSize, r.filesz)
+
+	head := *w.head
+	assert.NoError(w.flushHead(&head))
+	assert.Equal(uint64(1), r.Generation())
+	assert.NoError(r.Refresh())
+	assert.NotEqual(gen, r.mapGen)
+	assert.Equal(uint64(1), r.head.generation)
+	assert.Equal(2*w.datasz, r.filesz)
+}
@@ -0,0 +1,123 @@
+package sidb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// ErrDatabaseOpen is returned by Open when the file is already open read-write
+// in this process.
+var ErrDatabaseOpen = errors.New("database already open in this process")
+
+// Depending on the platform, flock is either per process, in which case a
+// second Open of the same file in one process silently succeeds, or per
+// descriptor, in which case it fails only because of the process itself.
+// Open handles are therefore tracked per file, so that a second read-write
+// Open fails early with the location of the first one.
+var openFiles = struct {
+	sync.Mutex
+	m map[fileKey][]*openHandle
+}{m: make(map[fileKey][]*openHandle)}
+
+// fileKey identifies a file by device and inode, or by its cleaned absolute
+// path where those aren't available.
+type fileKey struct {
+	dev, ino uint64
+	path     string
+}
+
+type openHandle struct {
+	db       *DB
+	writable bool
+	caller   string // file:line of the Open call
+}
+
+func newFileKey(path string, info os.FileInfo) fileKey {
+	if dev, ino, ok := fileIdentity(info); ok {
+		return fileKey{dev: dev, ino: ino}
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return fileKey{path: filepath.Clean(path)}
+}
+
+// callerOf returns the file:line of the caller of the function calling it.
+func callerOf() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown location"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// register records db as open. Any number of read-only handles may share a
+// file, but only one read-write handle.
+func (db *DB) register(caller string) error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat db file")
+	}
+	key := newFileKey(db.path, info)
+
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	if !db.readOnly {
+		for _, h := range openFiles.m[key] {
+			if h.writable {
+				return errors.Wrapf(ErrDatabaseOpen, "%s opened read-write at %s", db.path, h.caller)
+			}
+		}
+	}
+	openFiles.m[key] = append(openFiles.m[key], &openHandle{db: db, writable: !db.readOnly, caller: caller})
+	db.fileKey = &key
+	return nil
+}
+
+// unregister forgets db, on Close.
+func (db *DB) unregister() {
+	if db.fileKey == nil {
+		return
+	}
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	handles := openFiles.m[*db.fileKey]
+	for i, h := range handles {
+		if h.db == db {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+	if len(handles) == 0 {
+		delete(openFiles.m, *db.fileKey)
+	} else {
+		openFiles.m[*db.fileKey] = handles
+	}
+	db.fileKey = nil
+}
+
+// setWritable updates the registered mode of db after SetWritable or
+// SetReadOnly, failing if another read-write handle is open.
+func (db *DB) setWritable(writable bool) error {
+	if db.fileKey == nil {
+		return nil
+	}
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	var self *openHandle
+	for _, h := range openFiles.m[*db.fileKey] {
+		if h.db == db {
+			self = h
+		} else if writable && h.writable {
+			return errors.Wrapf(ErrDatabaseOpen, "%s opened read-write at %s", db.path, h.caller)
+		}
+	}
+	if self != nil {
+		self.writable = writable
+	}
+	return nil
+}
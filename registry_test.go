@@ -0,0 +1,71 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// asOtherProcess unregisters db so that another Open of its file from this
+// process gets past ErrDatabaseOpen and hits the file lock, as an Open from
+// another process would.
+func asOtherProcess(db *DB) {
+	db.unregister()
+}
+
+func TestOpenTwice(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrDatabaseOpen))
+	// points at the first Open
+	assert.Contains(err.Error(), "registry_test.go:")
+
+	// open after close
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+	assert.Empty(openFiles.m)
+}
+
+func TestOpenTwiceReadOnly(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	ro := &Options{ReadOnly: true}
+	r1, err := Open(testDB, 0755, ro)
+	assert.NoError(err)
+	r2, err := Open(testDB, 0755, ro)
+	assert.NoError(err)
+	assert.NotNil(r1.fileKey)
+	assert.Len(openFiles.m[*r1.fileKey], 2)
+	assert.NoError(r1.Close())
+	assert.NoError(r2.Close())
+	assert.Empty(openFiles.m)
+}
+
+func TestOpenTwiceSymlink(t *testing.T) {
+	assert := assertion.New(t)
+	link := testDB + ".link"
+	os.Remove(testDB)
+	os.Remove(link)
+	defer os.Remove(testDB)
+	defer os.Remove(link)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(os.Symlink(testDB, link))
+	_, err = Open(link, 0755, nil)
+	assert.True(errors.Is(err, ErrDatabaseOpen))
+	assert.NoError(db.Close())
+}
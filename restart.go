@@ -0,0 +1,197 @@
+package sidb
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Every restartInterval-th record of a data page is a restart: its key isn't
+// prefixed, so it can be decoded on its own. When a page whose keys are sorted
+// is sealed, by chaining a page after it, the offsets of its restarts are
+// written in a footer at the end of the page and it is flagged PageSorted.
+// Get then binary-searches the restarts and only decodes the records of one
+// restart interval.
+//
+// The footer is, at the very end of the page, the little-endian uint16
+// offsets of the restarts in the page followed by their number. Pages leave
+// room for it as they are filled, see footerSize.
+
+// restartInterval is the number of records from one restart to the next.
+const restartInterval = 16
+
+// footerSize returns the room to leave at the end of a page of count records
+// for its footer.
+func footerSize(count int) int {
+	return 2*((count+restartInterval-1)/restartInterval) + 2
+}
+
+// isRestart reports whether the record at index i in its page must be a
+// restart.
+func isRestart(i int) bool {
+	return i%restartInterval == 0
+}
+
+// pageFooter returns the footer of a page holding the records in data and the
+// flags it takes: the restarts if their keys are sorted, PageSorted, preceded
+// by a bloom filter of the keys with Options.BloomBitsPerKey, PageBloom, as
+// far as they fit in room. Older pages may have prefixed records where
+// restarts would be, those aren't restarts.
+func (db *DB) pageFooter(data []byte, room int) ([]byte, PageFlag, error) {
+	var offsets []uint16
+	var hashes []uint32
+	var kv KVPair
+	var prevKey []byte
+	sorted := true
+	for i, off := 0, 0; off < len(data); i++ {
+		n, flag, err := kv.unmarshal(data[off:], prevKey, db.decompressor)
+		if err != nil {
+			return nil, 0, err
+		}
+		if db.bloomBits > 0 {
+			hashes = append(hashes, bloomHash(kv.Key))
+		}
+		if i > 0 && db.comparator(prevKey, kv.Key) > 0 {
+			sorted = false
+		}
+		if isRestart(i) && flag&KVKeyPrefixed == 0 {
+			offsets = append(offsets, uint16(pageHeaderSize+off))
+		}
+		prevKey = kv.Key
+		off += n
+	}
+	// Pages filled before footers existed may not have room for one.
+	var footer []byte
+	var flags PageFlag
+	if sorted && 2*len(offsets)+2 <= room {
+		footer = make([]byte, 2*len(offsets)+2)
+		for i, off := range offsets {
+			binary.LittleEndian.PutUint16(footer[2*i:], off)
+		}
+		binary.LittleEndian.PutUint16(footer[2*len(offsets):], uint16(len(offsets)))
+		flags |= PageSorted
+	}
+	if size := db.bloomSize(len(hashes)); size > 0 && len(footer)+size <= room {
+		footer = append(bloomFilter(hashes, db.bloomBits, size), footer...)
+		flags |= PageBloom
+	}
+	return footer, flags, nil
+}
+
+// sealPage writes the footer of data page id, whose header is p, and adds the
+// flags it takes, see pageFooter. The header is left to the caller. The
+// caller holds rwlock.
+func (db *DB) sealPage(id PageId, p *Page) error {
+	if p.overflow() {
+		return nil
+	}
+	db.mmaplock.RLock()
+	start := int(db.pageOffset(id))
+	footer, flags, err := db.pageFooter(db.dataSlice(start+pageHeaderSize, start+int(p.ptr)), db.pageSize-int(p.ptr))
+	db.mmaplock.RUnlock()
+	if err != nil || len(footer) == 0 {
+		return err
+	}
+	if _, err := db.write(footer, int64(start+db.pageSize-len(footer))); err != nil {
+		return err
+	}
+	p.Flag |= flags
+	return nil
+}
+
+// sealBatchPage is sealPage for a page being filled by PutBatch.
+func (db *DB) sealBatchPage(p *batchPage) error {
+	if p.hdr.overflow() {
+		return nil
+	}
+	footer, flags, err := db.pageFooter(p.buf[pageHeaderSize:p.hdr.ptr], db.pageSize-int(p.hdr.ptr))
+	if err != nil || len(footer) == 0 {
+		return err
+	}
+	tail := p.buf[p.hdr.ptr:db.pageSize]
+	// zeroed, the buffer comes from the pool
+	for i := range tail {
+		tail[i] = 0
+	}
+	copy(tail[len(tail)-len(footer):], footer)
+	p.hdr.Flag |= flags
+	return nil
+}
+
+// restarts returns the offsets in data page id, a PageSorted page, of its
+// restarts before end. The caller holds mmaplock.
+func (db *DB) restarts(id PageId, end int) ([]uint16, error) {
+	pageEnd := int(db.pageOffset(id)) + db.pageSize
+	n := int(binary.LittleEndian.Uint16(db.dataSlice(pageEnd-2, pageEnd)))
+	if 2*n+2 > db.pageSize-pageHeaderSize {
+		return nil, corruptPage(id, db.pageSize-2, "footer of %d restarts", n)
+	}
+	raw := db.dataSlice(pageEnd-2-2*n, pageEnd-2)
+	offsets := make([]uint16, 0, n)
+	for i := 0; i < n; i++ {
+		off := binary.LittleEndian.Uint16(raw[2*i:])
+		if int(off) < pageHeaderSize || (i > 0 && off <= offsets[len(offsets)-1]) {
+			return nil, corruptPage(id, db.pageSize-2-2*n+2*i, "bad restart offset %d", off)
+		}
+		if int(off) >= end {
+			// past the end of a snapshot
+			break
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets, nil
+}
+
+// searchPage looks key up in data, the records visible of data page id, a
+// PageSorted page, and calls fn with the newest record of key in it, if any.
+// The caller holds mmaplock.
+func (db *DB) searchPage(id PageId, data, key []byte, fn func(kv *KVPair, flag KVFlag)) error {
+	offsets, err := db.restarts(id, pageHeaderSize+len(data))
+	if err != nil {
+		return err
+	}
+	var scratch []byte
+	var derr error
+	// the first restart past key
+	i := sort.Search(len(offsets), func(i int) bool {
+		if derr != nil {
+			return true
+		}
+		var k []byte
+		off := int(offsets[i]) - pageHeaderSize
+		k, _, _, _, derr = decodeKV(data[off:], nil, scratch[:0], nil, db.decompressor, false)
+		derr = corruptRecord(derr, id, off)
+		scratch = k
+		return db.comparator(k, key) > 0
+	})
+	if derr != nil {
+		return derr
+	}
+	if i == 0 {
+		return nil
+	}
+	// Keys may repeat, the newest record of key is the last one.
+	var kv, found KVPair
+	var foundFlag KVFlag
+	var prevKey []byte
+	var ok bool
+	for off := int(offsets[i-1]) - pageHeaderSize; off < len(data); {
+		n, flag, err := kv.unmarshal(data[off:], prevKey, db.decompressor)
+		if err != nil {
+			return corruptRecord(err, id, off)
+		}
+		c := db.comparator(kv.Key, key)
+		if c > 0 {
+			break
+		}
+		if c == 0 {
+			found = kv
+			foundFlag, ok = flag, true
+		}
+		prevKey = kv.Key
+		off += n
+	}
+	if ok {
+		fn(&found, foundFlag)
+	}
+	return nil
+}
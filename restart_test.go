@@ -0,0 +1,104 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestRestarts(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	db.NoSync = true
+
+	values := map[string]string{}
+	for i := 0; i < 4000; i += 2 {
+		k := fmt.Sprintf("key-%05d", i)
+		values[k] = fmt.Sprintf("value-%d", i)
+		assert.NoError(db.Put([]byte(k), []byte(values[k])))
+	}
+	// A key repeated in a page, the newest record wins.
+	var pairs []KVPair
+	for i := 4000; i < 4400; i += 2 {
+		k := fmt.Sprintf("key-%05d", i)
+		pairs = append(pairs, KVPair{Key: []byte(k), Value: []byte("old")}, KVPair{Key: []byte(k), Value: []byte(k)})
+		values[k] = k
+	}
+	assert.NoError(db.PutBatch(pairs))
+
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key-04400"), []byte("after")))
+
+	check := func(get func([]byte) ([]byte, error)) {
+		for k, want := range values {
+			v, err := get([]byte(k))
+			assert.NoError(err)
+			assert.Equal(want, string(v), k)
+		}
+		for _, k := range []string{"a", "key-00001", "key-03999", "key-04401", "z"} {
+			v, err := get([]byte(k))
+			assert.NoError(err)
+			assert.Nil(v, k)
+		}
+	}
+	check(tx.Get)
+	assert.NoError(tx.Rollback())
+	values["key-04400"] = "after"
+	check(db.Get)
+
+	// Every page but the last one is sealed, with a restart every
+	// restartInterval records.
+	pages := 0
+	tail := PageId(db.head.kvPtr.pageNum)
+	for id := db.dataStart; id != 0; id = db.page(id).Next {
+		p := db.page(id)
+		if id == tail {
+			assert.Zero(p.Flag & PageSorted)
+			break
+		}
+		assert.NotZero(p.Flag&PageSorted, "page %d", id)
+		offsets, err := db.restarts(id, db.pageSize)
+		assert.NoError(err)
+		assert.Len(offsets, (int(p.Count)+restartInterval-1)/restartInterval, "page %d", id)
+		pages++
+	}
+	assert.True(pages > 5, "%d pages", pages)
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{VerifyChecksums: true})
+	assert.NoError(err)
+	check(db.Get)
+	assert.NoError(db.Close())
+}
+
+func TestRestartsUnsorted(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+
+	assert.NoError(db.Put([]byte("key-b"), []byte("b")))
+	assert.NoError(db.Put([]byte("key-a"), []byte("a")))
+	// Short of the room of a footer only, a record takes a page of its own.
+	value := make([]byte, db.pageSize-pageHeaderSize-12-2)
+	rand.New(rand.NewSource(1)).Read(value)
+	assert.NoError(db.Put([]byte("key-cccc"), value))
+
+	p := db.page(db.dataStart)
+	assert.Zero(p.Flag & PageSorted)
+	last := db.page(p.Next)
+	assert.Equal(PageData|PageFirst|PageLast, last.Flag)
+	for k, want := range map[string][]byte{"key-a": []byte("a"), "key-b": []byte("b"), "key-cccc": value} {
+		v, err := db.Get([]byte(k))
+		assert.NoError(err)
+		assert.Equal(want, v, k)
+	}
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,369 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+// salvageBatchSize is how many records Salvage copies per commit.
+const salvageBatchSize = 1000
+
+// SalvageSkip is something Salvage passed over: page Page, or the head or the
+// freelist with Page 0, and the records lost with it as counted by its
+// header.
+type SalvageSkip struct {
+	Page    PageId
+	Records int
+	Err     error
+}
+
+// SalvageReport is what Salvage copied and what it left behind.
+type SalvageReport struct {
+	// records copied, deletions included, and the data pages they came from
+	Records int
+	Pages   int
+	// data pages found by scanning the file once the data chain broke
+	Unlinked int
+	Skipped  []SalvageSkip
+}
+
+// Salvage copies what can be read of the database at srcPath into a new one
+// created at dstPath with opts, for a file too damaged to be opened or read
+// through. The source is opened read-only even if its heads or freelist don't
+// validate, and its data chain is walked from the first page. A page failing
+// its checksum is skipped, one with a record that doesn't decode is copied up
+// to it, and from its next restart if it has any. If the chain breaks before
+// the tail page, the data pages it didn't reach and that aren't free are then
+// copied in file order. Deletions are copied too, in the order records were
+// written, so that the newest record of a key wins as it did in the source.
+// A source in DupKeys mode is copied into a destination in that mode.
+func Salvage(srcPath, dstPath string, opts *Options) (SalvageReport, error) {
+	var report SalvageReport
+	if _, err := os.Lstat(dstPath); err == nil {
+		return report, errors.Errorf("salvage: %s exists", dstPath)
+	} else if !os.IsNotExist(err) {
+		return report, err
+	}
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return report, err
+	}
+	src, err := open(callerOf(), srcPath, 0, &Options{ReadOnly: true, ForceComparator: true, VerifyChecksums: true}, true)
+	if err != nil {
+		return report, errors.Wrap(err, "salvage: open source")
+	}
+	defer src.Close()
+	if src.dupKeys && (opts == nil || !opts.DupKeys) {
+		var o Options
+		if opts != nil {
+			o = *opts
+		}
+		o.DupKeys = true
+		opts = &o
+	}
+	dst, err := open(callerOf(), dstPath, info.Mode().Perm(), opts, false)
+	if err != nil {
+		return report, errors.Wrap(err, "salvage: create destination")
+	}
+	s := &salvager{src: src, dst: dst, report: &report}
+	err = s.run()
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	report.Skipped = src.salvageSkips
+	return report, err
+}
+
+// salvager is the state of a Salvage.
+type salvager struct {
+	src, dst *DB
+	report   *SalvageReport
+	// the pages of src copied or free
+	reached []bool
+	// records waiting to be copied, with KVDeleted for deletions,
+	// KVDeleteNewest for those of DeleteDup and KVAppended for the fragments
+	// of Append
+	pairs []KVPair
+	flags []KVFlag
+}
+
+// run copies the records of src to dst, see Salvage.
+func (s *salvager) run() error {
+	db := s.src
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	head := db.head
+	s.reached = make([]bool, head.PageCount)
+	for _, id := range db.freelist {
+		s.reached[id] = true
+	}
+	for _, id := range db.freelistPages {
+		s.reached[id] = true
+	}
+	tail := PageId(head.kvPtr.pageNum)
+	for id, prev := db.dataStart, PageId(0); ; {
+		if id < db.dataStart || id >= head.PageCount || s.reached[id] {
+			db.salvageSkip(prev, 0, corruptPage(prev, pageNextOffset, "data chain goes on to page %d, out of range or reached already", id))
+			break
+		}
+		s.reached[id] = true
+		last, lp, err := s.copyPage(id, id == tail)
+		if err != nil {
+			return err
+		}
+		if lp == nil {
+			break
+		}
+		if last == tail {
+			return s.flush()
+		}
+		if lp.Next == 0 {
+			db.salvageSkip(last, 0, corruptPage(last, pageNextOffset, "data chain ends before the tail page %d", tail))
+			break
+		}
+		id, prev = lp.Next, last
+	}
+	for id := db.dataStart; id < head.PageCount; id++ {
+		if s.reached[id] {
+			continue
+		}
+		if p := db.page(id); p.Flag&PageData == 0 || p.Flag&(PageMiddle|PageLast) != 0 {
+			continue
+		}
+		s.reached[id] = true
+		s.report.Unlinked++
+		if _, _, err := s.copyPage(id, id == tail); err != nil {
+			return err
+		}
+	}
+	return s.flush()
+}
+
+// copyPage copies the records of data page id, the tail page if tail, and
+// returns the last page they take, with its header, which is nil if the
+// header can't be trusted to go on with the chain. The caller holds
+// mmaplock.
+func (s *salvager) copyPage(id PageId, tail bool) (PageId, *Page, error) {
+	db := s.src
+	p := db.page(id)
+	end := int(p.ptr)
+	if tail {
+		end = int(db.head.kvPtr.offset)
+	}
+	switch {
+	case p.Flag&PageData == 0:
+		db.salvageSkip(id, 0, corruptPage(id, 0, "data page has flags %#x", p.Flag))
+		return 0, nil, nil
+	case p.Flag&PageFirst != 0:
+		return s.copyOverflow(id, p)
+	case p.overflow():
+		db.salvageSkip(id, 0, corruptPage(id, 0, "part of an overflow record without its first page"))
+		return id, p, nil
+	case int(p.ptr) < pageHeaderSize || int(p.ptr) > db.pageSize || end < pageHeaderSize || end > db.pageSize:
+		db.salvageSkip(id, int(p.Count), corruptPage(id, pagePtrOffset, "data page ends at %d", end))
+		return 0, nil, nil
+	}
+	data, _, err := db.records(&snapshot{head: *db.head}, id, p)
+	if err != nil {
+		db.salvageSkip(id, int(p.Count), err)
+		return id, p, nil
+	}
+	count, err := s.copyRecords(id, p, data)
+	if err != nil {
+		if _, ok := err.(salvageError); !ok {
+			return 0, nil, err
+		}
+		lost := int(p.Count) - count
+		if lost < 0 {
+			lost = 0
+		}
+		db.salvageSkip(id, lost, err)
+	}
+	if count > 0 {
+		s.report.Pages++
+	}
+	return id, p, nil
+}
+
+// salvageError is a record that doesn't decode, as opposed to an error
+// writing the destination.
+type salvageError struct {
+	error
+}
+
+// copyRecords copies the records in data, those of data page id whose header
+// is p, and returns how many it copied. A record that doesn't decode is
+// returned as a salvageError once the records from the next restart after it
+// are copied. The caller holds mmaplock.
+func (s *salvager) copyRecords(id PageId, p *Page, data []byte) (count int, err error) {
+	db := s.src
+	var first error
+	defer func() {
+		// decoding garbage may go where no error is checked
+		if r := recover(); r != nil {
+			err = salvageError{corruptPage(id, 0, "%v", r)}
+		} else if err == nil && first != nil {
+			err = first
+		}
+	}()
+	var kv KVPair
+	var prevKey []byte
+	for off := 0; off < len(data); {
+		n, flag, err := kv.unmarshal(data[off:], prevKey, db.decompressor)
+		if err == nil && len(kv.Key) == 0 {
+			err = ErrKeyRequired
+		}
+		if err != nil {
+			if first == nil {
+				first = salvageError{corruptRecord(err, id, off)}
+			}
+			if off = s.nextRestart(id, p, off, len(data)); off < 0 {
+				return count, nil
+			}
+			prevKey = nil
+			continue
+		}
+		if err := s.add(kv, flag&(KVDeleted|KVDeleteNewest|KVAppended)); err != nil {
+			return count, err
+		}
+		count++
+		prevKey = kv.Key
+		off += n
+	}
+	return count, nil
+}
+
+// nextRestart returns the offset in the records of data page id, whose header
+// is p, of its first restart past off, or -1 if there is none before end.
+func (s *salvager) nextRestart(id PageId, p *Page, off, end int) int {
+	if p.Flag&PageSorted == 0 {
+		return -1
+	}
+	offsets, err := s.src.restarts(id, pageHeaderSize+end)
+	if err != nil {
+		return -1
+	}
+	for _, o := range offsets {
+		if int(o)-pageHeaderSize > off {
+			return int(o) - pageHeaderSize
+		}
+	}
+	return -1
+}
+
+// copyOverflow copies the overflow record starting at page id, whose header
+// is p, and returns its last page, see copyPage. The caller holds mmaplock.
+func (s *salvager) copyOverflow(id PageId, p *Page) (PageId, *Page, error) {
+	db := s.src
+	chunk := db.pageSize - pageHeaderSize
+	// overflowRecord trusts the chain, check it first
+	last, lp := id, p
+	for {
+		if int(lp.Len) > chunk {
+			db.salvageSkip(id, 1, corruptPage(last, pageLenOffset, "overflow record of page %d holds %d bytes here", id, lp.Len))
+			return 0, nil, nil
+		}
+		if lp.Flag&PageLast != 0 {
+			break
+		}
+		next := lp.Next
+		if next < db.dataStart || next >= db.head.PageCount || s.reached[next] {
+			db.salvageSkip(id, 1, corruptPage(last, pageNextOffset, "overflow record of page %d goes on to page %d, out of range or reached already", id, next))
+			return 0, nil, nil
+		}
+		s.reached[next] = true
+		last, lp = next, db.page(next)
+	}
+	rec, _, _, err := db.overflowRecord(id, p)
+	if err != nil {
+		db.salvageSkip(id, 1, err)
+		return last, lp, nil
+	}
+	n, err := s.copyRecords(id, p, rec)
+	if err != nil {
+		if _, ok := err.(salvageError); !ok {
+			return 0, nil, err
+		}
+		db.salvageSkip(id, 1, err)
+	}
+	if n > 0 {
+		s.report.Pages++
+	}
+	return last, lp, nil
+}
+
+// add queues kv to be copied, a deletion with KVDeleted in flag.
+func (s *salvager) add(kv KVPair, flag KVFlag) error {
+	s.pairs = append(s.pairs, KVPair{
+		Key:   append([]byte(nil), kv.Key...),
+		Value: append([]byte(nil), kv.Value...),
+	})
+	s.flags = append(s.flags, flag)
+	s.report.Records++
+	if len(s.pairs) < salvageBatchSize {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush copies the records queued by add.
+func (s *salvager) flush() error {
+	if len(s.pairs) == 0 {
+		return nil
+	}
+	db := s.dst
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	defer db.commitStats()
+	err := db.putBatch(s.pairs, s.flags)
+	s.pairs, s.flags = s.pairs[:0], s.flags[:0]
+	return errors.Wrap(err, "salvage: write destination")
+}
+
+// salvageSkip notes what Salvage passes over, see SalvageSkip.
+func (db *DB) salvageSkip(id PageId, records int, err error) {
+	db.salvageSkips = append(db.salvageSkips, SalvageSkip{Page: id, Records: records, Err: err})
+}
+
+// salvageHead returns the head to salvage the file with, given what
+// currentHead returned: the current head, or the head page with the magic and
+// the page size and the highest generation if none validates, with its page
+// count cut to the pages the file holds. The caller holds mmaplock.
+func (db *DB) salvageHead(head *HeadPage, id PageId, err error) (*HeadPage, PageId, error) {
+	if err != nil {
+		db.salvageSkip(0, 0, errors.Wrap(err, "head"))
+		head = nil
+		for i := PageId(0); i < 2; i++ {
+			h := db.headPageAt(i)
+			if h.magic == Magic && int(h.PageSize) == db.pageSize && (head == nil || h.generation > head.generation) {
+				head, id = h, i
+			}
+		}
+		if head == nil {
+			return nil, 0, err
+		}
+	}
+	h := *head
+	if count := PageId(db.filesz / db.pageSize); h.PageCount > count {
+		db.salvageSkip(0, 0, &ErrTruncated{Expected: int64(h.PageCount) * int64(db.pageSize), Actual: int64(db.filesz)})
+		h.PageCount = count
+	}
+	return &h, id, nil
+}
+
+// findPageSize looks for the second head page at every page size, for a file
+// whose first one is unreadable, and sets the page size of the one found. It
+// reports whether it found one.
+func (db *DB) findPageSize(size int64) bool {
+	var buf [headPageSize]byte
+	for ps := minPageSize; ps <= maxPageSize && 2*int64(ps) <= size; ps *= 2 {
+		if n, _ := db.readAt(buf[:], int64(ps)); n < headPageSize {
+			continue
+		}
+		if h := headPageDecode(buf[:]); h.magic == Magic && h.PageSize == ps {
+			db.pageSize = int(ps)
+			return true
+		}
+	}
+	return false
+}
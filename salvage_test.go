@@ -0,0 +1,117 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSalvage(t *testing.T) {
+	assert := assertion.New(t)
+	dst := testDB + ".salvaged"
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	defer os.Remove(dst)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	db.NoSync = true
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	var pairs []KVPair
+	for i := 100; i < 400; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte(fmt.Sprintf("value-%d", i))})
+	}
+	assert.NoError(db.PutBatch(pairs))
+	big := bytes.Repeat([]byte("big value "), 200)
+	assert.NoError(db.Put([]byte("big"), big))
+	assert.NoError(db.Delete([]byte("key-0005")))
+	// a data page filled by Put, in the middle of the chain
+	id := db.dataStart
+	for i := 0; i < 2; i++ {
+		id = db.page(id).Next
+	}
+	page := int64(id)
+	assert.NoError(db.Close())
+	orig, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+
+	// salvage returns how many of the keys dst holds, checking their values
+	salvage := func() (SalvageReport, int) {
+		os.Remove(dst)
+		report, err := Salvage(testDB, dst, nil)
+		assert.NoError(err)
+		db, err := Open(dst, 0755, nil)
+		assert.NoError(err)
+		defer db.Close()
+		n := 0
+		for i := 0; i < 400; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key-%04d", i)))
+			assert.NoError(err)
+			if v != nil {
+				assert.Equal(fmt.Sprintf("value-%d", i), string(v))
+				n++
+			}
+		}
+		v, err := db.Get([]byte("big"))
+		assert.NoError(err)
+		assert.Equal(big, v)
+		assert.Empty(checkErrors(db))
+		return report, n
+	}
+	corrupt := func(off int64, b []byte) {
+		f, err := os.OpenFile(testDB, os.O_RDWR, 0)
+		assert.NoError(err)
+		_, err = f.WriteAt(b, off)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+	}
+	restore := func() {
+		assert.NoError(ioutil.WriteFile(testDB, orig, 0755))
+	}
+
+	report, n := salvage()
+	assert.Empty(report.Skipped)
+	assert.Equal(399, n)
+	assert.Equal(402, report.Records)
+	assert.Zero(report.Unlinked)
+	_, err = Salvage(testDB, dst, nil)
+	assert.Contains(fmt.Sprint(err), "exists")
+
+	// a page failing its checksum is all that's lost
+	corrupt(page*512+pageHeaderSize+4, []byte("x"))
+	report, n = salvage()
+	if assert.Len(report.Skipped, 1) {
+		skip := report.Skipped[0]
+		assert.Equal(PageId(page), skip.Page)
+		assert.Equal(&ErrChecksum{Page: PageId(page)}, errors.Cause(skip.Err))
+		assert.Equal(399-skip.Records, n)
+		assert.NotZero(skip.Records)
+	}
+	restore()
+
+	// neither head validates, the first isn't even there
+	corrupt(0, make([]byte, 512))
+	corrupt(512+32, []byte{0xff})
+	_, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.Error(err)
+	report, n = salvage()
+	assert.NotEmpty(report.Skipped)
+	assert.Contains(fmt.Sprint(report.Skipped[0].Err), "head")
+	assert.Equal(399, n)
+	restore()
+
+	// the chain breaks at a page whose header is lost, the pages after it
+	// are found by scanning the file
+	corrupt(page*512, make([]byte, pageHeaderSize))
+	report, n = salvage()
+	assert.NotZero(report.Unlinked)
+	assert.NotEmpty(report.Skipped)
+	assert.True(n < 399 && n > 300, "%d", n)
+	restore()
+}
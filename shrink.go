@@ -0,0 +1,107 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// Shrink gives back the space at the end of the file that holds nothing: the
+// free pages past the last page in use, as after Reindex, and what the file
+// was grown by ahead of the writes. The file is truncated and mapped again at
+// the size the mmap growth policy gives the smaller database, so that the
+// mapping doesn't stay as large as the database once was. It returns how many
+// bytes the file shrank by.
+//
+// The file isn't cut below the pages of the snapshot of an open read-only
+// transaction, and pages freed since it began aren't free yet, so Shrink
+// gives back less while one is open.
+func (db *DB) Shrink() (int64, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return 0, ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+	defer db.commitStats()
+	db.releasePending(db.oldestTx())
+
+	db.mmaplock.RLock()
+	head := *db.head
+	db.mmaplock.RUnlock()
+
+	// The list the new head drops, see below, frees the pages holding it.
+	free := append(append([]PageId(nil), db.freelist...), db.freelistPages...)
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	count, floor := head.PageCount, db.pinnedPages()
+	for n := len(free); n > 0 && free[n-1] == count-1 && count > floor; n-- {
+		free = free[:n-1]
+		count--
+	}
+	if count < head.PageCount {
+		head.PageCount = count
+		head.freelist = 0
+		head.freeCount = 0
+		if err := db.flushHead(&head); err != nil {
+			return 0, err
+		}
+		db.freelist = free
+		db.freelistPages = nil
+		db.freelistDirty = true
+	}
+	// The head must be on disk before the pages it no longer counts are
+	// cut off, or the file would be shorter than the one on disk says.
+	if db.unsynced {
+		if err := db.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	size := int64(count) * int64(db.pageSize)
+	was := int64(db.filesz)
+	want, err := db.mmapSize(size)
+	if err != nil {
+		return 0, err
+	}
+	if size >= was && want >= db.datasz {
+		return 0, nil
+	}
+
+	db.mmaplock.Lock()
+	defer db.mmaplock.Unlock()
+	// Windows can't truncate a mapped file, and maps it at the size of the
+	// mapping, see mmap.
+	if err := db.munmap(); err != nil {
+		return 0, err
+	}
+	if size < was {
+		if err = db.file.Truncate(size); err == nil {
+			db.txStats.Sync++
+			err = db.ops.sync()
+		}
+		err = errors.Wrap(err, "file resize error")
+	}
+	if merr := db.remap(0); merr != nil {
+		return 0, merr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return was - int64(db.filesz), nil
+}
+
+// pinnedPages returns the largest page count of the snapshots of open
+// read-only transactions, which may read up to it, see Shrink.
+func (db *DB) pinnedPages() PageId {
+	db.txlock.Lock()
+	defer db.txlock.Unlock()
+	var pinned PageId
+	for tx := range db.txs {
+		if n := tx.snap.head.PageCount; n > pinned {
+			pinned = n
+		}
+	}
+	return pinned
+}
@@ -0,0 +1,67 @@
+package sidb
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestShrink(t *testing.T) {
+	assert := assertion.New(t)
+	_ = os.Remove(testDB)
+	defer os.Remove(testDB)
+	opts := &Options{PageSize: 512, OrderedWrite: true, MmapGrowthPolicy: MmapGrowthPolicy{Mode: MmapGrowExact}}
+	db, err := Open(testDB, 0755, opts)
+	assert.NoError(err)
+	for i := 0; i < 2000; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key%06d", i)), []byte("value")))
+	}
+	// the second index takes the pages the first one freed, and frees its
+	// pages, at the end of the file
+	assert.NoError(db.Reindex())
+	assert.NoError(db.Reindex())
+	count := db.head.PageCount
+	last := db.freelist[len(db.freelist)-2:]
+	assert.Equal([]PageId{count - 2, count - 1}, last)
+	filesz, datasz := db.filesz, db.datasz
+	assert.Greater(filesz, int(count)*db.pageSize)
+
+	// an open transaction keeps the pages of its snapshot
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	n, err := db.Shrink()
+	assert.NoError(err)
+	assert.Equal(int64(filesz-int(count)*db.pageSize), n)
+	assert.Equal(count, db.head.PageCount)
+	assert.Equal(int(count)*db.pageSize, db.filesz)
+	assert.Less(db.datasz, datasz)
+	v, err := tx.Get([]byte("key001999"))
+	assert.NoError(err)
+	assert.Equal([]byte("value"), v)
+	assert.NoError(tx.Rollback())
+
+	n, err = db.Shrink()
+	assert.NoError(err)
+	assert.Equal(int64(2*db.pageSize), n)
+	assert.Equal(count-2, db.head.PageCount)
+	assert.Equal(int(count-2)*db.pageSize, db.filesz)
+	assert.Equal(db.filesz, db.datasz)
+	assert.Empty(checkErrors(db))
+	n, err = db.Shrink()
+	assert.NoError(err)
+	assert.Zero(n)
+
+	// the shrunk file grows again and reopens
+	for i := 2000; i < 2100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key%06d", i)), []byte("value")))
+	}
+	assert.NoError(db.Close())
+	db, err = Open(testDB, 0755, opts)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Empty(checkErrors(db))
+	v, err = db.Get([]byte("key002099"))
+	assert.NoError(err)
+	assert.Equal([]byte("value"), v)
+}
@@ -0,0 +1,41 @@
+// Package sidbtime encodes timestamps into keys that sort chronologically
+// under sidb.BytesComparator.
+package sidbtime
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// KeySize is the length of the time part of a key.
+const KeySize = 12
+
+// ErrShortKey is returned by DecodeTimeKey for keys shorter than KeySize.
+var ErrShortKey = errors.New("time key too short")
+
+// EncodeTimeKey returns t followed by suffix. The time is stored as the
+// seconds since the Unix epoch with the sign bit flipped, then the nanoseconds,
+// both big-endian, so that any time (including the zero time and times before
+// 1970) is represented exactly and keys sort by time, then by suffix.
+func EncodeTimeKey(t time.Time, suffix []byte) []byte {
+	key := make([]byte, KeySize+len(suffix))
+	binary.BigEndian.PutUint64(key, uint64(t.Unix())^1<<63)
+	binary.BigEndian.PutUint32(key[8:], uint32(t.Nanosecond()))
+	copy(key[KeySize:], suffix)
+	return key
+}
+
+// DecodeTimeKey splits a key built by EncodeTimeKey into its time, in UTC,
+// and suffix. The suffix aliases key.
+func DecodeTimeKey(key []byte) (time.Time, []byte, error) {
+	if len(key) < KeySize {
+		return time.Time{}, nil, ErrShortKey
+	}
+	sec := int64(binary.BigEndian.Uint64(key) ^ 1<<63)
+	nsec := int64(binary.BigEndian.Uint32(key[8:]))
+	if nsec >= int64(time.Second) {
+		return time.Time{}, nil, errors.New("time key nanoseconds out of range")
+	}
+	return time.Unix(sec, nsec).UTC(), key[KeySize:], nil
+}
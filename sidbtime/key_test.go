@@ -0,0 +1,55 @@
+package sidbtime
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"sidb"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTimeKeyRoundTrip(t *testing.T) {
+	assert := assertion.New(t)
+	for _, tm := range []time.Time{
+		{},
+		time.Unix(0, 0),
+		time.Unix(-1, 999999999),
+		time.Date(1900, 1, 2, 3, 4, 5, 6, time.UTC),
+		time.Date(2262, 4, 12, 0, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	} {
+		key := EncodeTimeKey(tm, []byte("suffix"))
+		got, suffix, err := DecodeTimeKey(key)
+		assert.NoError(err)
+		assert.True(tm.Equal(got), "%s != %s", tm, got)
+		assert.Equal("suffix", string(suffix))
+	}
+
+	_, _, err := DecodeTimeKey(make([]byte, KeySize-1))
+	assert.Equal(ErrShortKey, err)
+}
+
+func TestTimeKeyOrder(t *testing.T) {
+	assert := assertion.New(t)
+	base := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var want [][]byte
+	for _, tm := range []time.Time{
+		{},
+		time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Unix(-1, 0),
+		time.Unix(-1, 1),
+		time.Unix(0, 0),
+		base,
+		base.Add(time.Nanosecond),
+		base.Add(time.Second),
+	} {
+		// suffixes order keys within the same nanosecond
+		want = append(want, EncodeTimeKey(tm, []byte("a")), EncodeTimeKey(tm, []byte("b")))
+	}
+	got := make([][]byte, len(want))
+	for i := range want {
+		got[i] = want[len(want)-1-i]
+	}
+	sort.Slice(got, func(i, j int) bool { return sidb.BytesComparator(got[i], got[j]) < 0 })
+	assert.Equal(want, got)
+}
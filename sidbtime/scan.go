@@ -0,0 +1,30 @@
+package sidbtime
+
+import (
+	"sidb"
+	"time"
+)
+
+// minKey is the smallest time key, of the earliest time it encodes.
+var minKey = make([]byte, KeySize)
+
+// ScanTimeRange calls fn for the live records of db whose keys are time keys
+// with from <= time < to, in key order, so chronologically, see DB.Range. fn
+// gets the time and suffix of the key, and the value, valid during the call
+// only. The scan stops at the first error returned by fn.
+func ScanTimeRange(db *sidb.DB, from, to time.Time, fn func(t time.Time, suffix, value []byte) error) error {
+	return db.Range(EncodeTimeKey(from, nil), EncodeTimeKey(to, nil), func(k, v []byte) error {
+		t, suffix, err := DecodeTimeKey(k)
+		if err != nil {
+			return err
+		}
+		return fn(t, suffix, v)
+	})
+}
+
+// TrimBefore deletes the records of db whose keys are time keys before t, for
+// retention, and returns how many live keys it deleted, see DB.DeleteRange.
+// Keys sorting before every time key are left.
+func TrimBefore(db *sidb.DB, t time.Time) (int, error) {
+	return db.DeleteRange(minKey, EncodeTimeKey(t, nil))
+}
@@ -0,0 +1,78 @@
+package sidbtime
+
+import (
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sidb"
+	"testing"
+	"time"
+)
+
+func TestScanTimeRange(t *testing.T) {
+	assert := assertion.New(t)
+	path := filepath.Join(os.TempDir(), "test-sidbtime.sidb")
+	os.Remove(path)
+	defer os.Remove(path)
+	for _, ordered := range []bool{true, false} {
+		os.Remove(path)
+		db, err := sidb.Open(path, 0755, &sidb.Options{OrderedWrite: ordered})
+		assert.NoError(err)
+		db.NoSync = true
+		base := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+		at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Minute) }
+		// before 1970 and the zero time too
+		times := []time.Time{{}, time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)}
+		for i := 0; i < 100; i++ {
+			times = append(times, at(i))
+		}
+		if !ordered {
+			// written out of order
+			for i, j := 0, len(times)-1; i < j; i, j = i+1, j-1 {
+				times[i], times[j] = times[j], times[i]
+			}
+		}
+		for _, tm := range times {
+			for _, s := range []string{"a", "b"} {
+				assert.NoError(db.Put(EncodeTimeKey(tm, []byte(s)), []byte(tm.Format(time.RFC3339)+s)))
+			}
+		}
+
+		type event struct {
+			t      time.Time
+			suffix string
+		}
+		scan := func(from, to time.Time) (got []event) {
+			assert.NoError(ScanTimeRange(db, from, to, func(tm time.Time, suffix, value []byte) error {
+				assert.Equal(tm.Format(time.RFC3339)+string(suffix), string(value))
+				got = append(got, event{tm, string(suffix)})
+				return nil
+			}))
+			return got
+		}
+		got := scan(at(10), at(13))
+		assert.Equal([]event{{at(10), "a"}, {at(10), "b"}, {at(11), "a"}, {at(11), "b"}, {at(12), "a"}, {at(12), "b"}}, got, "ordered %v", ordered)
+		got = scan(time.Time{}, at(0))
+		assert.Len(got, 4)
+		assert.True(got[0].t.Equal(time.Time{}))
+		assert.Equal(1960, got[2].t.Year())
+		assert.Nil(scan(at(100), at(200)))
+
+		// retention
+		n, err := TrimBefore(db, at(50))
+		assert.NoError(err)
+		assert.Equal(2*52, n)
+		assert.Nil(scan(time.Time{}, at(50)))
+		got = scan(time.Time{}, at(1000))
+		assert.Len(got, 100)
+		assert.Equal(event{at(50), "a"}, got[0])
+		n, err = TrimBefore(db, at(50))
+		assert.NoError(err)
+		assert.Zero(n)
+
+		stop := fmt.Errorf("stop")
+		assert.Equal(stop, ScanTimeRange(db, time.Time{}, at(1000), func(time.Time, []byte, []byte) error { return stop }))
+		assert.NoError(db.Close())
+	}
+}
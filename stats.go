@@ -0,0 +1,260 @@
+package sidb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters of the work done through a database handle since Open.
+// They are updated atomically, reading them doesn't wait for writers.
+type Stats struct {
+	// Get is the number of keys looked up, by Get and its variants.
+	Get int64
+	// PageCacheHit and PageCacheMiss are the number of data pages found in
+	// the page cache and decoded into it, see Options.PageCacheSize.
+	PageCacheHit  int64
+	PageCacheMiss int64
+	// TxN is the number of write commits: every Put, Delete, PutBatch,
+	// DeleteRange and committed read-write transaction.
+	TxN int64
+	// CompressTime and DecompressTime are the time spent compressing and
+	// decompressing with Options.Compression, in nanoseconds.
+	CompressTime   int64
+	DecompressTime int64
+
+	// TxStats sums the TxStats of all commits.
+	TxStats TxStats
+
+	// Memory is what DB.MemoryStats returns, but for Resident, which takes
+	// reading /proc. It isn't a counter, Sub leaves it out.
+	Memory MemoryStats
+
+	// bytes of the pooled buffers handed out by getBuf and not given back
+	poolInUse int64
+}
+
+// TxStats are the counters of a single commit.
+type TxStats struct {
+	// Put and Delete are the number of records and tombstones written.
+	Put    int64
+	Delete int64
+
+	// PageAlloc is the number of pages appended to the file.
+	PageAlloc int64
+	// Write and WriteBytes are the number of writes to the file and the bytes
+	// written, head and page headers included.
+	Write      int64
+	WriteBytes int64
+	// Sync is the number of file syncs.
+	Sync int64
+
+	// CompressIn is the size of the keys and values written, CompressOut the
+	// size of the records they were encoded into, key prefixes and value
+	// compression included. WriteBytes over CompressIn is the write
+	// amplification, CompressOut over CompressIn the compression ratio.
+	CompressIn  int64
+	CompressOut int64
+	// KeyIn and ValueIn are the size of the keys, less the prefix they share
+	// with the previous one, and values of the records compressed one by one,
+	// KeyOut and ValueOut their size as stored. CompressFallback is the
+	// number of those stored as they are because compressing them didn't
+	// make them shorter. Records of pages compressed whole, see
+	// Options.PageCompression, are left out.
+	KeyIn            int64
+	KeyOut           int64
+	ValueIn          int64
+	ValueOut         int64
+	CompressFallback int64
+}
+
+// CompressionStats are how well the compression of a database does, see
+// DB.CompressionStats.
+type CompressionStats struct {
+	Algorithm CompressAlgorithm
+	Level     int
+	// see TxStats
+	KeyIn    int64
+	KeyOut   int64
+	ValueIn  int64
+	ValueOut int64
+	Fallback int64
+	// see Stats
+	CompressTime   time.Duration
+	DecompressTime time.Duration
+}
+
+// Ratio returns the size of the keys and values compressed one by one as
+// stored over their size, 1 if there were none.
+func (s CompressionStats) Ratio() float64 {
+	if s.KeyIn+s.ValueIn == 0 {
+		return 1
+	}
+	return float64(s.KeyOut+s.ValueOut) / float64(s.KeyIn+s.ValueIn)
+}
+
+// Stats returns a copy of the database counters.
+func (db *DB) Stats() Stats {
+	s := db.stats
+	return Stats{
+		Get:            atomic.LoadInt64(&s.Get),
+		PageCacheHit:   atomic.LoadInt64(&s.PageCacheHit),
+		PageCacheMiss:  atomic.LoadInt64(&s.PageCacheMiss),
+		TxN:            atomic.LoadInt64(&s.TxN),
+		CompressTime:   atomic.LoadInt64(&s.CompressTime),
+		DecompressTime: atomic.LoadInt64(&s.DecompressTime),
+		TxStats:        s.TxStats.load(),
+		Memory:         db.memoryStats(),
+	}
+}
+
+// CompressionStats returns the compression counters of the database, out of
+// its Stats.
+func (db *DB) CompressionStats() CompressionStats {
+	s := db.Stats()
+	a, level := db.Compression()
+	return CompressionStats{
+		Algorithm:      a,
+		Level:          level,
+		KeyIn:          s.TxStats.KeyIn,
+		KeyOut:         s.TxStats.KeyOut,
+		ValueIn:        s.TxStats.ValueIn,
+		ValueOut:       s.TxStats.ValueOut,
+		Fallback:       s.TxStats.CompressFallback,
+		CompressTime:   time.Duration(s.CompressTime),
+		DecompressTime: time.Duration(s.DecompressTime),
+	}
+}
+
+// Stats returns the counters of the transaction, set once it committed.
+func (tx *Tx) Stats() TxStats {
+	return tx.stats
+}
+
+// Sub returns the difference between s and other, the counters of what
+// happened between two calls of DB.Stats.
+func (s Stats) Sub(other Stats) Stats {
+	return Stats{
+		Get:            s.Get - other.Get,
+		PageCacheHit:   s.PageCacheHit - other.PageCacheHit,
+		PageCacheMiss:  s.PageCacheMiss - other.PageCacheMiss,
+		TxN:            s.TxN - other.TxN,
+		CompressTime:   s.CompressTime - other.CompressTime,
+		DecompressTime: s.DecompressTime - other.DecompressTime,
+		TxStats:        s.TxStats.Sub(other.TxStats),
+	}
+}
+
+// Sub returns the difference between s and other.
+func (s TxStats) Sub(other TxStats) TxStats {
+	return TxStats{
+		Put:              s.Put - other.Put,
+		Delete:           s.Delete - other.Delete,
+		PageAlloc:        s.PageAlloc - other.PageAlloc,
+		Write:            s.Write - other.Write,
+		WriteBytes:       s.WriteBytes - other.WriteBytes,
+		Sync:             s.Sync - other.Sync,
+		CompressIn:       s.CompressIn - other.CompressIn,
+		CompressOut:      s.CompressOut - other.CompressOut,
+		KeyIn:            s.KeyIn - other.KeyIn,
+		KeyOut:           s.KeyOut - other.KeyOut,
+		ValueIn:          s.ValueIn - other.ValueIn,
+		ValueOut:         s.ValueOut - other.ValueOut,
+		CompressFallback: s.CompressFallback - other.CompressFallback,
+	}
+}
+
+// add adds other to s atomically.
+func (s *TxStats) add(other *TxStats) {
+	atomic.AddInt64(&s.Put, other.Put)
+	atomic.AddInt64(&s.Delete, other.Delete)
+	atomic.AddInt64(&s.PageAlloc, other.PageAlloc)
+	atomic.AddInt64(&s.Write, other.Write)
+	atomic.AddInt64(&s.WriteBytes, other.WriteBytes)
+	atomic.AddInt64(&s.Sync, other.Sync)
+	atomic.AddInt64(&s.CompressIn, other.CompressIn)
+	atomic.AddInt64(&s.CompressOut, other.CompressOut)
+	atomic.AddInt64(&s.KeyIn, other.KeyIn)
+	atomic.AddInt64(&s.KeyOut, other.KeyOut)
+	atomic.AddInt64(&s.ValueIn, other.ValueIn)
+	atomic.AddInt64(&s.ValueOut, other.ValueOut)
+	atomic.AddInt64(&s.CompressFallback, other.CompressFallback)
+}
+
+// load returns a copy of s read atomically.
+func (s *TxStats) load() TxStats {
+	return TxStats{
+		Put:              atomic.LoadInt64(&s.Put),
+		Delete:           atomic.LoadInt64(&s.Delete),
+		PageAlloc:        atomic.LoadInt64(&s.PageAlloc),
+		Write:            atomic.LoadInt64(&s.Write),
+		WriteBytes:       atomic.LoadInt64(&s.WriteBytes),
+		Sync:             atomic.LoadInt64(&s.Sync),
+		CompressIn:       atomic.LoadInt64(&s.CompressIn),
+		CompressOut:      atomic.LoadInt64(&s.CompressOut),
+		KeyIn:            atomic.LoadInt64(&s.KeyIn),
+		KeyOut:           atomic.LoadInt64(&s.KeyOut),
+		ValueIn:          atomic.LoadInt64(&s.ValueIn),
+		ValueOut:         atomic.LoadInt64(&s.ValueOut),
+		CompressFallback: atomic.LoadInt64(&s.CompressFallback),
+	}
+}
+
+// commitStats folds the counters of the commit in progress into the database
+// Stats, and returns them. With StrictMode it checks the database once it
+// committed. The caller holds rwlock.
+func (db *DB) commitStats() TxStats {
+	s := db.txStats
+	db.txStats = TxStats{}
+	// Writes refused before writing anything aren't commits.
+	if s.Write > 0 {
+		atomic.AddInt64(&db.stats.TxN, 1)
+		if db.StrictMode {
+			db.strictCheck()
+		}
+	}
+	db.stats.TxStats.add(&s)
+	return s
+}
+
+// countGet counts a key lookup.
+func (db *DB) countGet(n int) {
+	atomic.AddInt64(&db.stats.Get, int64(n))
+}
+
+// write writes b at off through ops.writeAt, counting it in the commit in
+// progress. The caller holds rwlock.
+func (db *DB) write(b []byte, off int64) (int, error) {
+	n, err := db.ops.writeAt(b, off)
+	db.txStats.Write++
+	db.txStats.WriteBytes += int64(n)
+	return n, err
+}
+
+// timeCompression wraps the compressor and decompressor of the database to
+// count the time they take in its Stats.
+func (db *DB) timeCompression() {
+	if c := db.compressor; c != nil {
+		db.compressor = func(in []byte) []byte {
+			start := time.Now()
+			out := c(in)
+			atomic.AddInt64(&db.stats.CompressTime, int64(time.Since(start)))
+			return out
+		}
+	}
+	if a := db.compressAppend; a != nil {
+		db.compressAppend = func(dst, in []byte) []byte {
+			start := time.Now()
+			out := a(dst, in)
+			atomic.AddInt64(&db.stats.CompressTime, int64(time.Since(start)))
+			return out
+		}
+	}
+	if d := db.decompressor; d != nil {
+		db.decompressor = func(in []byte) ([]byte, error) {
+			start := time.Now()
+			out, err := d(in)
+			atomic.AddInt64(&db.stats.DecompressTime, int64(time.Since(start)))
+			return out, err
+		}
+	}
+}
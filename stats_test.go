@@ -0,0 +1,112 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	assertion "github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+
+	s := db.Stats()
+	assert.Equal(db.datasz, s.Memory.Mapped)
+	s.Memory = MemoryStats{}
+	assert.Equal(Stats{}, s)
+	value := bytes.Repeat([]byte("compressible"), 10)
+	assert.NoError(db.Put([]byte("key"), value))
+	s = db.Stats()
+	assert.Equal(int64(1), s.TxN)
+	assert.Equal(int64(1), s.TxStats.Put)
+	// the record, the page header and the head
+	assert.Equal(int64(3), s.TxStats.Write)
+	// before and after the head
+	assert.Equal(int64(2), s.TxStats.Sync)
+	assert.Equal(int64(len("key")+len(value)), s.TxStats.CompressIn)
+	assert.True(s.TxStats.CompressOut < s.TxStats.CompressIn)
+	assert.True(s.TxStats.WriteBytes > s.TxStats.CompressOut)
+
+	var tx *Tx
+	assert.NoError(db.Update(func(t *Tx) error {
+		tx = t
+		for i := 0; i < 1000; i++ {
+			if err := t.Put([]byte(fmt.Sprintf("key-%d", i)), value); err != nil {
+				return err
+			}
+		}
+		return t.Delete([]byte("key"))
+	}))
+	ts := tx.Stats()
+	assert.Equal(int64(1000), ts.Put)
+	assert.Equal(int64(1), ts.Delete)
+	assert.True(ts.PageAlloc > 0)
+	// a write per page and the head
+	assert.Equal(ts.PageAlloc+2, ts.Write)
+	assert.Equal(s.TxStats.Put+ts.Put, db.Stats().TxStats.Put)
+	assert.Equal(ts, db.Stats().Sub(s).TxStats)
+	assert.Equal(int64(2), db.Stats().TxN)
+
+	_, err = db.Get([]byte("key"))
+	assert.NoError(err)
+	_, err = db.GetMany([][]byte{[]byte("a"), []byte("b")})
+	assert.NoError(err)
+	assert.Equal(int64(3), db.Stats().Get)
+
+	// refused, nothing written
+	assert.Equal(ErrKeyRequired, db.Put(nil, nil))
+	assert.Equal(int64(2), db.Stats().TxN)
+	assert.NoError(db.Close())
+}
+
+func TestCompressionStats(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{Compression: CompLz4})
+	assert.NoError(err)
+
+	value := bytes.Repeat([]byte("compressible"), 10)
+	random := make([]byte, 100)
+	rand.Read(random)
+	assert.NoError(db.Put([]byte("key"), value))
+	assert.NoError(db.PutBatch([]KVPair{{Key: []byte("key-1"), Value: random}, {Key: []byte("key-2"), Value: value}}))
+	s := db.CompressionStats()
+	assert.Equal(CompLz4, s.Algorithm)
+	// less the prefixes shared with the previous key
+	assert.Equal(int64(len("key")+len("-1")+len("2")), s.KeyIn)
+	assert.Equal(s.KeyIn, s.KeyOut)
+	assert.Equal(int64(len(value)*2+len(random)), s.ValueIn)
+	assert.True(s.ValueOut < s.ValueIn)
+	assert.True(s.ValueOut > int64(len(random)))
+	// the random value, keys are too short to try
+	assert.Equal(int64(1), s.Fallback)
+	assert.True(s.Ratio() < 1)
+	assert.True(s.CompressTime > 0)
+	assert.Zero(s.DecompressTime)
+	assert.Equal(s.KeyIn, db.Stats().TxStats.KeyIn)
+
+	v, err := db.Get([]byte("key-2"))
+	assert.NoError(err)
+	assert.Equal(value, v)
+	assert.True(db.CompressionStats().DecompressTime > 0)
+	assert.NoError(db.Close())
+
+	os.Remove(testDB)
+	db, err = Open(testDB, 0755, &Options{Compression: CompNone})
+	assert.NoError(err)
+	assert.Equal(1.0, db.CompressionStats().Ratio())
+	assert.NoError(db.Put([]byte("key"), value))
+	s = db.CompressionStats()
+	assert.Equal(int64(len(value)), s.ValueOut)
+	assert.Equal(1.0, s.Ratio())
+	assert.Zero(s.Fallback)
+	assert.Zero(s.CompressTime)
+	assert.NoError(db.Close())
+}
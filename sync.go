@@ -0,0 +1,121 @@
+package sidb
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// SyncPolicy decides when commits are synced to disk, see Options.SyncPolicy.
+// The zero value is SyncAlways.
+type SyncPolicy struct {
+	// 0 to sync every commit, <0 to never sync
+	interval time.Duration
+}
+
+var (
+	// SyncAlways syncs every commit before it returns, unless DB.NoSync is set.
+	SyncAlways = SyncPolicy{}
+	// SyncNever leaves syncing to the system, and to DB.Sync. It is as unsafe
+	// as DB.NoSync.
+	SyncNever = SyncPolicy{interval: -1}
+)
+
+// SyncInterval syncs at most every d, if anything was committed since the
+// last sync, from a goroutine running while the database is open read-write.
+// If d <= 0, it is SyncAlways.
+//
+// A crash of the process loses nothing committed, the system still writes
+// it. A power loss may lose the commits of the last d, and as the disk may
+// write their pages in any order, a head may have made it without all of the
+// records it points at: the file then opens with records missing or broken,
+// which Check reports and Salvage copies around.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy{interval: d}
+}
+
+// Sync makes everything committed durable, for a handle writing with NoSync
+// or a SyncPolicy other than SyncAlways. It waits for the commit in progress,
+// if any.
+func (db *DB) Sync() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return nil
+	}
+	defer db.commitStats()
+	return db.sync()
+}
+
+// commitSyncs reports whether commits are synced under policy, with the NoSync
+// of a handle and IgnoreNoSync.
+func commitSyncs(policy SyncPolicy, noSync, ignoreNoSync bool) bool {
+	return policy == SyncAlways && (!noSync || ignoreNoSync)
+}
+
+// sync syncs the file. The caller holds rwlock.
+func (db *DB) sync() error {
+	db.txStats.Sync++
+	db.unsynced = false
+	return db.ops.sync()
+}
+
+// startSyncer starts the goroutine of SyncInterval if the policy is one and it
+// isn't running. The caller holds rwlock.
+func (db *DB) startSyncer() {
+	if db.syncPolicy.interval <= 0 || db.syncStop != nil {
+		return
+	}
+	db.syncStop = make(chan struct{})
+	db.syncDone = make(chan struct{})
+	go db.syncLoop(db.syncPolicy.interval, db.syncStop, db.syncDone)
+}
+
+// stopSyncer stops the goroutine of SyncInterval and returns the channel
+// closed once it has returned, nil if it wasn't running. The caller holds
+// rwlock, which the goroutine may be waiting for.
+func (db *DB) stopSyncer() chan struct{} {
+	if db.syncStop == nil {
+		return nil
+	}
+	done := db.syncDone
+	close(db.syncStop)
+	db.syncStop, db.syncDone = nil, nil
+	return done
+}
+
+// syncLoop syncs every interval what was committed since the last sync, until
+// stop is closed. Taking rwlock, it never syncs in the middle of a commit,
+// with data written for a head not yet flushed.
+func (db *DB) syncLoop(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		db.rwlock.Lock()
+		select {
+		case <-stop:
+			db.rwlock.Unlock()
+			return
+		default:
+		}
+		if db.unsynced {
+			if err := db.sync(); err != nil {
+				log.Warnf("sidb: %s: sync: %s", db.path, err)
+			}
+			db.commitStats()
+		}
+		db.rwlock.Unlock()
+	}
+}
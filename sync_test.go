@@ -0,0 +1,90 @@
+package sidb
+
+import (
+	"context"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syncerRunning reports whether a goroutine of SyncInterval is running, or
+// about to, by the goroutines created by startSyncer.
+func syncerRunning() bool {
+	buf := make([]byte, 1<<20)
+	return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "created by sidb.(*DB).startSyncer")
+}
+
+func TestSyncPolicy(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	n := db.Stats().TxStats.Sync
+	assert.NoError(db.Put([]byte("k1"), []byte("v1")))
+	// the records before the head, then the head
+	assert.Equal(n+2, db.Stats().TxStats.Sync)
+	db.NoSync = true
+	assert.NoError(db.Put([]byte("k2"), []byte("v2")))
+	assert.Equal(n+2, db.Stats().TxStats.Sync)
+	assert.NoError(db.Sync())
+	assert.Equal(n+3, db.Stats().TxStats.Sync)
+	assert.NoError(db.Close())
+	assert.Equal(ErrDatabaseNotOpen, db.Sync())
+
+	db, err = Open(testDB, 0755, &Options{SyncPolicy: SyncNever})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("k3"), []byte("v3")))
+	assert.Zero(db.Stats().TxStats.Sync)
+	assert.False(syncerRunning())
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{SyncPolicy: SyncInterval(10 * time.Millisecond)})
+	assert.NoError(err)
+	assert.True(syncerRunning())
+	assert.NoError(db.Put([]byte("k4"), []byte("v4")))
+	assert.Eventually(func() bool { return db.Stats().TxStats.Sync > 0 }, time.Second, time.Millisecond)
+	// nothing committed, nothing to sync
+	n = db.Stats().TxStats.Sync
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(n, db.Stats().TxStats.Sync)
+	assert.NoError(db.Close())
+	assert.False(syncerRunning())
+
+	// a reader doesn't sync, until promoted
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true, SyncPolicy: SyncInterval(10 * time.Millisecond)})
+	assert.NoError(err)
+	assert.False(syncerRunning())
+	assert.NoError(db.Sync())
+	assert.NoError(db.SetWritable(context.Background()))
+	assert.True(syncerRunning())
+	assert.NoError(db.Close())
+	assert.False(syncerRunning())
+}
+
+func TestCommitSyncs(t *testing.T) {
+	assert := assertion.New(t)
+	for _, c := range []struct {
+		policy               SyncPolicy
+		noSync, ignoreNoSync bool
+		want                 bool
+	}{
+		{SyncAlways, false, false, true},
+		{SyncAlways, true, false, false},
+		{SyncAlways, true, true, true},
+		{SyncAlways, false, true, true},
+		// IgnoreNoSync only overrides NoSync, not the policy
+		{SyncNever, false, false, false},
+		{SyncNever, false, true, false},
+		{SyncNever, true, true, false},
+		{SyncInterval(time.Second), false, true, false},
+		{SyncInterval(time.Second), true, true, false},
+		{SyncInterval(0), true, true, true},
+	} {
+		assert.Equal(c.want, commitSyncs(c.policy, c.noSync, c.ignoreNoSync), "%+v", c)
+	}
+}
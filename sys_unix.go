@@ -0,0 +1,108 @@
+//go:build !windows
+// +build !windows
+
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// flockSys is syscall.Flock, a test hook.
+var flockSys = syscall.Flock
+
+// flockFile acquires a shared or exclusive advisory lock on f without blocking.
+// An existing lock held on f is converted.
+func flockFile(f *os.File, exclusive bool) error {
+	flag := syscall.LOCK_SH
+	if exclusive {
+		flag = syscall.LOCK_EX
+	}
+
+	err := flockSys(int(f.Fd()), flag|syscall.LOCK_NB)
+	if err == nil {
+		return nil
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.EWOULDBLOCK || errno == syscall.EAGAIN) { // linux & unix
+		return ErrWriteByOther
+	}
+	return errors.Wrap(err, "flock failed")
+}
+
+// processExists reports whether a process with the given pid exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// funlock releases an advisory lock on a file descriptor.
+// A file not open, or closed already, holds no lock.
+func funlock(db *DB) error {
+	fd := db.lockFile().Fd()
+	if fd == ^uintptr(0) {
+		return nil
+	}
+	return flockSys(int(fd), syscall.LOCK_UN)
+}
+
+// mmap memory maps a DB's data file.
+func mmap(db *DB, sz int) error {
+	// Map the data file to memory.
+	b, err := syscall.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED|db.MmapFlags)
+	if err != nil {
+		return err
+	}
+
+	// Advise the kernel that the mmap is accessed randomly.
+	if err := madvise(b, syscall.MADV_RANDOM); err != nil {
+		return errors.Wrap(err, "madvise error")
+	}
+
+	// Save the original byte slice and convert to a byte array pointer.
+	db.dataref = b
+	db.data = (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))
+	db.datasz = sz
+	return nil
+}
+
+// munmap unmaps a DB's data file from memory.
+func munmap(db *DB) error {
+	// Ignore the unmap if we have no mapped data.
+	if db.dataref == nil {
+		return nil
+	}
+
+	// Unmap using the original byte slice.
+	err := syscall.Munmap(db.dataref)
+	db.dataref = nil
+	db.data = nil
+	db.datasz = 0
+	return err
+}
+
+// madviseWillNeed hints that the mapped bytes b are about to be read, see
+// Preload.
+func madviseWillNeed(b []byte) error {
+	return madvise(b, syscall.MADV_WILLNEED)
+}
+
+// fileIdentity returns the device and inode of the file of info.
+func fileIdentity(info os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
+
+// NOTE: This function is copied from stdlib because it is not available on darwin.
+func madvise(b []byte, advice int) (err error) {
+	_, _, e1 := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(advice))
+	if e1 != 0 {
+		err = e1
+	}
+	return
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFlockErrors(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	defer func() { flockSys = syscall.Flock }()
+
+	// not an Errno
+	failed := errors.New("flock failed")
+	flockSys = func(fd, how int) error { return failed }
+	db, err := Open(testDB, 0755, nil)
+	assert.Nil(db)
+	assert.Equal(failed, errors.Cause(err))
+
+	// a wrapped one
+	flockSys = func(fd, how int) error { return errors.Wrap(syscall.EAGAIN, "flock") }
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrWriteByOther), "%v", err)
+	flockSys = syscall.Flock
+
+	// nothing to unlock on a file not open or closed
+	db = &DB{}
+	assert.NoError(funlock(db))
+	db.file, err = os.Open(testDB)
+	assert.NoError(err)
+	assert.NoError(db.file.Close())
+	assert.NoError(funlock(db))
+}
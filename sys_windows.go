@@ -0,0 +1,123 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+	"os"
+	"unsafe"
+)
+
+// stillActive is the exit code of a process that hasn't exited.
+const stillActive = 259
+
+// lockRange is the byte the advisory lock is taken on. Windows locks are
+// mandatory for the range locked, so it is taken past any file offset ever
+// read or written.
+var lockRange = windows.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+
+// flockFile acquires a shared or exclusive lock on f without blocking, with
+// LockFileEx. An existing lock held on f is converted, by releasing it first.
+func flockFile(f *os.File, exclusive bool) error {
+	h := windows.Handle(f.Fd())
+	// Locks stack instead of being converted, only one is ever held.
+	ol := lockRange
+	_ = windows.UnlockFileEx(h, 0, 1, 0, &ol)
+
+	flag := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flag |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol = lockRange
+	err := windows.LockFileEx(h, flag, 0, 1, 0, &ol)
+	if err == nil {
+		return nil
+	} else if err == windows.ERROR_LOCK_VIOLATION || err == windows.ERROR_IO_PENDING {
+		return ErrWriteByOther
+	}
+	return errors.Wrap(err, "LockFileEx failed")
+}
+
+// processExists reports whether a process with the given pid exists.
+func processExists(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// funlock releases an advisory lock on a file descriptor.
+// A file not open, or closed already, holds no lock.
+func funlock(db *DB) error {
+	h := windows.Handle(db.lockFile().Fd())
+	if h == windows.InvalidHandle {
+		return nil
+	}
+	ol := lockRange
+	return windows.UnlockFileEx(h, 0, 1, 0, &ol)
+}
+
+// mmap memory maps a DB's data file. A mapping can't extend past the end of
+// a file opened read-only, the file of a reader is mapped up to its end, that
+// of a writer is grown to sz.
+func mmap(db *DB, sz int) error {
+	if db.readOnly {
+		info, err := db.file.Stat()
+		if err != nil {
+			return errors.Wrap(err, "mmap stat error")
+		}
+		if size := int(info.Size()); size < sz {
+			sz = size
+		}
+	} else if err := db.file.Truncate(int64(sz)); err != nil {
+		return errors.Wrap(err, "truncate")
+	}
+
+	// The mapping object is only needed to map the view, which keeps it
+	// alive.
+	size := uint64(sz)
+	h, err := windows.CreateFileMapping(windows.Handle(db.file.Fd()), nil, windows.PAGE_READONLY, uint32(size>>32), uint32(size), nil)
+	if err != nil {
+		return os.NewSyscallError("CreateFileMapping", err)
+	}
+	addr, err := windows.MapViewOfFile(h, windows.FILE_MAP_READ, 0, 0, uintptr(sz))
+	_ = windows.CloseHandle(h)
+	if err != nil {
+		return os.NewSyscallError("MapViewOfFile", err)
+	}
+
+	db.data = (*[maxMapSize]byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr)))
+	db.dataref = db.data[:sz:sz]
+	db.datasz = sz
+	return nil
+}
+
+// munmap unmaps a DB's data file from memory.
+func munmap(db *DB) error {
+	// Ignore the unmap if we have no mapped data.
+	if db.dataref == nil {
+		return nil
+	}
+
+	addr := uintptr(unsafe.Pointer(&db.dataref[0]))
+	db.dataref = nil
+	db.data = nil
+	db.datasz = 0
+	return os.NewSyscallError("UnmapViewOfFile", windows.UnmapViewOfFile(addr))
+}
+
+// madviseWillNeed does nothing, the hint has no equivalent here.
+func madviseWillNeed(b []byte) error {
+	return nil
+}
+
+// fileIdentity reports that files have no device and inode here, they are
+// identified by path.
+func fileIdentity(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,33 @@
+package sidb
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestMmapWindows(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// the file of a writer grows to the mapping
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	info, err := os.Stat(testDB)
+	assert.NoError(err)
+	assert.Equal(int64(db.datasz), info.Size())
+	size := int64(db.head.PageCount) * int64(db.pageSize)
+	assert.NoError(db.Close())
+
+	// that of a reader is mapped up to its end
+	assert.NoError(os.Truncate(testDB, size))
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(int(size), db.datasz)
+	v, err := db.Get([]byte("key"))
+	assert.NoError(err)
+	assert.Equal("value", string(v))
+	assert.NoError(db.Close())
+}
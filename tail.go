@@ -0,0 +1,227 @@
+package sidb
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// DefaultTailInterval is the default TailOptions.Interval.
+const DefaultTailInterval = 200 * time.Millisecond
+
+// TailOptions tells Tail what to follow.
+type TailOptions struct {
+	// Prefix, if set, passes only the records of keys starting with it.
+	Prefix []byte
+
+	// FromStart passes the records already in the file first, in the order
+	// they were written, instead of starting after the last commit.
+	FromStart bool
+
+	// Interval is how often the file is looked at for commits. If <=0, it
+	// defaults to DefaultTailInterval.
+	Interval time.Duration
+
+	// Options the file is opened with, ReadOnly is always set.
+	Options *Options
+}
+
+// TailRecord is a record Tail found committed. Key and Value are only valid
+// during the call.
+type TailRecord struct {
+	Key, Value []byte
+	// Deleted is set for the tombstones of Delete, which have no value, and
+	// Time is when they were committed, zero for those of files written
+	// before it was recorded. NewestOnly is set on those of DeleteDup that
+	// delete only the newest value of the key, see Options.DupKeys.
+	// Appended is set on the fragments of Append, whose Value is the
+	// suffix appended to the value of the key.
+	Deleted    bool
+	NewestOnly bool
+	Appended   bool
+	Time       time.Time
+	// Generation is the commit generation the record was found in, see
+	// DB.Generation.
+	Generation uint64
+	// Reopened is set, on a record with no key, when the file was replaced,
+	// by a compacted copy renamed over it for instance, and opened again.
+	// What was committed to the old file since it was last looked at is
+	// lost, and the new one is followed from its last commit on.
+	Reopened bool
+}
+
+// Tail opens the database at path read-only and calls fn for every record
+// committed from then on, tombstones included, in the order they were
+// written, until ctx is cancelled or fn returns an error. It polls
+// DB.Generation and Refreshes the handle when it moved, so the writer may be
+// another process.
+//
+// The file is opened with a shared lock, or without one while a writer holds
+// the exclusive lock, like Options.FallbackReadOnly does, and closed before
+// Tail returns. The shared lock keeps writers from opening the file while it
+// is held, so the writer is best started first. Cancelling ctx is the way to
+// stop Tail, it then returns nil.
+//
+// Compact drops the tombstones older than Options.TombstoneRetention, so a
+// consumer catching up on a compacted file FromStart, further behind than
+// that, misses those deletes.
+func Tail(ctx context.Context, path string, opts *TailOptions, fn func(*TailRecord) error) error {
+	t := &tailer{path: path, fn: fn}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if t.opts.Interval <= 0 {
+		t.opts.Interval = DefaultTailInterval
+	}
+	if err := t.open(!t.opts.FromStart); err != nil {
+		return err
+	}
+	defer func() {
+		if t.db != nil {
+			_ = t.db.Close()
+		}
+	}()
+	if t.opts.FromStart {
+		if err := t.walk(); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(t.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := t.poll(); err != nil {
+			return err
+		}
+	}
+}
+
+// tailer is the state of a Tail.
+type tailer struct {
+	path string
+	opts TailOptions
+	fn   func(*TailRecord) error
+	db   *DB
+	info os.FileInfo // of the file db has open
+	// the page the last record passed is on and how many records of it
+	// were looked at, to go on from
+	page PageId
+	seen int
+}
+
+// open opens the file at t.path, to be followed from its last commit if
+// atEnd is set, or from its first record.
+func (t *tailer) open(atEnd bool) error {
+	var o Options
+	if t.opts.Options != nil {
+		o = *t.opts.Options
+	}
+	o.ReadOnly = true
+	db, err := Open(t.path, 0, &o)
+	if errors.Is(err, ErrWriteByOther) && !o.NoLock {
+		o.NoLock = true
+		db, err = Open(t.path, 0, &o)
+	}
+	if err != nil {
+		return err
+	}
+	info, err := db.file.Stat()
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	t.db, t.info = db, info
+	t.page, t.seen = db.dataStart, 0
+	if atEnd {
+		return t.scan(false)
+	}
+	return nil
+}
+
+// poll passes the records committed since the last poll, after opening the
+// file again if it was replaced.
+func (t *tailer) poll() error {
+	info, err := os.Stat(t.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// A file gone for now may be about to be renamed over, the old one
+	// is followed until then.
+	if err == nil && !os.SameFile(info, t.info) {
+		_ = t.db.Close()
+		t.db = nil
+		if err := t.open(true); err != nil {
+			return err
+		}
+		return t.fn(&TailRecord{Reopened: true, Generation: t.db.Generation()})
+	}
+	if t.db.Generation() == t.db.seenGen {
+		return nil
+	}
+	return t.walk()
+}
+
+// walk makes the last commit visible and passes its new records.
+func (t *tailer) walk() error {
+	if err := t.db.Refresh(); err != nil {
+		return err
+	}
+	return t.scan(true)
+}
+
+// scan goes over the records committed after t.page and t.seen, passing them
+// to fn if pass is set, and moves the position past them.
+func (t *tailer) scan(pass bool) error {
+	db := t.db
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+
+	s := &snapshot{head: *db.head}
+	rec := TailRecord{Generation: s.head.generation}
+	for id := t.page; id != 0; {
+		p := db.page(id)
+		data, next, err := db.records(s, id, p)
+		if err != nil {
+			return err
+		}
+		n := 0
+		var ferr error
+		err = db.scanData(id, data, func(kv *KVPair, flag KVFlag) bool {
+			n++
+			if n <= t.seen || !pass || !bytes.HasPrefix(kv.Key, t.opts.Prefix) {
+				return true
+			}
+			rec.Key, rec.Value, rec.Deleted, rec.Time = kv.Key, kv.Value, flag&KVDeleted != 0, time.Time{}
+			rec.NewestOnly = flag&KVDeleteNewest != 0
+			rec.Appended = flag&KVAppended != 0
+			if rec.Deleted {
+				rec.Time, _ = tombstoneTime(kv.Value)
+				rec.Value = nil
+			}
+			ferr = t.fn(&rec)
+			return ferr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if ferr != nil {
+			return ferr
+		}
+		if n > t.seen {
+			t.seen = n
+		}
+		if next == 0 {
+			break
+		}
+		t.page, t.seen = next, 0
+		id = next
+	}
+	return nil
+}
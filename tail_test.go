@@ -0,0 +1,118 @@
+package sidb
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// tailRun runs Tail on testDB until stopped, sending what it passes on the
+// channel as "key=value", "-key" for tombstones, which have a time and no
+// value, and "reopened".
+func tailRun(t *testing.T, opts *TailOptions) (<-chan string, func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan string, 100)
+	done := make(chan error, 1)
+	opts.Interval = 5 * time.Millisecond
+	go func() {
+		done <- Tail(ctx, testDB, opts, func(rec *TailRecord) error {
+			switch {
+			case rec.Reopened:
+				out <- "reopened"
+			case rec.Deleted && (rec.Value != nil || rec.Time.IsZero()):
+				out <- "bad tombstone " + string(rec.Key)
+			case rec.Deleted:
+				out <- "-" + string(rec.Key)
+			default:
+				out <- string(rec.Key) + "=" + string(rec.Value)
+			}
+			return nil
+		})
+	}()
+	// let it open the file before anything is written
+	time.Sleep(20 * time.Millisecond)
+	return out, func() error {
+		cancel()
+		return <-done
+	}
+}
+
+// tailNext returns the next n records Tail passed, or fewer after a second.
+func tailNext(out <-chan string, n int) []string {
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) < n {
+		select {
+		case s := <-out:
+			got = append(got, s)
+		case <-timeout:
+			return got
+		}
+	}
+	return got
+}
+
+func TestTail(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	compacted := testDB + ".compact"
+	os.Remove(compacted)
+	defer os.Remove(compacted)
+
+	db, err := Open(testDB, 0755, &Options{PageSize: 512})
+	assert.NoError(err)
+	db.NoSync = true
+	assert.NoError(db.Put([]byte("old"), []byte("0")))
+
+	// from now on, while the writer holds the lock
+	out, stop := tailRun(t, &TailOptions{})
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte{'k', byte('0' + i%10)}, []byte{byte('a' + i%26)}))
+	}
+	got := tailNext(out, 100)
+	assert.Len(got, 100)
+	assert.Equal([]string{"k0=a", "k1=b"}, got[:2])
+	assert.Equal("k9=v", got[99])
+	assert.NoError(db.Delete([]byte("k1")))
+	assert.NoError(db.PutBatch([]KVPair{{Key: []byte("x"), Value: []byte("1")}, {Key: []byte("y"), Value: []byte("2")}}))
+	assert.Equal([]string{"-k1", "x=1", "y=2"}, tailNext(out, 3))
+
+	// a compacted copy renamed over the file
+	assert.NoError(db.Compact(compacted, nil))
+	assert.NoError(db.Put([]byte("lost"), []byte("1")))
+	assert.NoError(db.Close())
+	assert.NoError(os.Rename(compacted, testDB))
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	got = tailNext(out, 1)
+	if len(got) > 0 && got[0] == "lost=1" {
+		// seen before the file was replaced
+		got = tailNext(out, 1)
+	}
+	assert.Equal([]string{"reopened"}, got)
+	assert.NoError(db.Put([]byte("new"), []byte("1")))
+	assert.Equal([]string{"new=1"}, tailNext(out, 1))
+	assert.NoError(stop())
+	assert.NoError(db.Close())
+
+	// from the start, with a prefix, holding the shared lock
+	out, stop = tailRun(t, &TailOptions{FromStart: true, Prefix: []byte("k")})
+	got = tailNext(out, 9)
+	assert.Len(got, 9)
+	assert.Equal("k0=m", got[0])
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(out)
+	_, err = Open(testDB, 0755, nil)
+	assert.True(errors.Is(err, ErrWriteByOther), "%v", err)
+	assert.NoError(stop())
+	// the lock is gone
+	db, err = Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	assert.Error(Tail(context.Background(), testDB+".missing", nil, nil))
+}
@@ -0,0 +1,30 @@
+package sidb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// tombstoneValue returns the value of a tombstone committed at t: the time in
+// nanoseconds since the epoch, little endian.
+func tombstoneValue(t time.Time) []byte {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(t.UnixNano()))
+	return v
+}
+
+// tombstoneTime returns the commit time stored in the value of a tombstone,
+// and false for one written before they were.
+func tombstoneTime(v []byte) (time.Time, bool) {
+	if len(v) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(v))), true
+}
+
+// keepTombstone reports whether Compact copies the tombstone of value v, as
+// it is younger than retention at now, see Options.TombstoneRetention.
+func keepTombstone(v []byte, retention time.Duration, now time.Time) bool {
+	t, ok := tombstoneTime(v)
+	return ok && retention > 0 && now.Sub(t) < retention
+}
@@ -0,0 +1,383 @@
+package sidb
+
+import (
+	"github.com/pkg/errors"
+	"io"
+)
+
+// Tx is a transaction, started with Begin or, preferably, run with Update or
+// View which take care of ending it.
+//
+// A read-write transaction holds the writer lock from Begin until Commit or
+// Rollback, so there is at most one at a time. Its writes are buffered and
+// appended together on Commit with a single sync, like PutBatch; nothing is
+// written before. Reads through the transaction see its own writes.
+//
+// A read-only transaction reads a snapshot of the database taken by Begin and
+// doesn't block, nor is blocked by, writers.
+type Tx struct {
+	db       *DB
+	writable bool
+	snap     snapshot
+	// buffered writes, flags[i] is KVDeleted for a tombstone
+	pairs []KVPair
+	flags []KVFlag
+	// last key put by this transaction, for OrderedWrite
+	lastPut []byte
+	stats   TxStats
+}
+
+// Begin starts a transaction. Only one read-write transaction runs at a time,
+// Begin(true) waits for the current one to end. Begin(true) on a read-only
+// handle returns ErrDatabaseReadOnly.
+//
+// Every transaction must be ended with Commit or Rollback.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	if !writable {
+		db.mmaplock.RLock()
+		defer db.mmaplock.RUnlock()
+		if !db.opened {
+			return nil, ErrDatabaseNotOpen
+		}
+		tx := &Tx{db: db}
+		db.headlock.Lock()
+		tx.snap.head = *db.head
+		// Registered with the head copied, so the pages it reaches aren't
+		// freed in between, see freeLater.
+		db.txlock.Lock()
+		if db.txs == nil {
+			db.txs = make(map[*Tx]uint64)
+		}
+		db.txs[tx] = tx.snap.head.generation
+		db.txlock.Unlock()
+		db.headlock.Unlock()
+		return tx, nil
+	}
+
+	db.rwlock.Lock()
+	if !db.opened {
+		db.rwlock.Unlock()
+		return nil, ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		db.rwlock.Unlock()
+		return nil, ErrDatabaseReadOnly
+	}
+	return &Tx{db: db, writable: true}, nil
+}
+
+// Update runs fn in a read-write transaction, committed if fn returns nil and
+// rolled back otherwise. A panic in fn rolls the transaction back too and is
+// returned as an error.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if err := tx.run(fn); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// View runs fn in a read-only transaction. A panic in fn is returned as an
+// error.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	err = tx.run(fn)
+	_ = tx.Rollback()
+	return err
+}
+
+// run calls fn, turning a panic into an error.
+func (tx *Tx) run(fn func(tx *Tx) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic in transaction: %v", r)
+		}
+	}()
+	return fn(tx)
+}
+
+// DB returns the database the transaction belongs to.
+func (tx *Tx) DB() *DB {
+	return tx.db
+}
+
+// Writable reports whether the transaction can write.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// Put buffers a key/value pair, written on Commit. The key and value are
+// copied. In OrderedWrite mode keys must be put in non-decreasing order
+// within the transaction as well.
+func (tx *Tx) Put(key, value []byte) error {
+	if err := tx.checkWrite(key); err != nil {
+		return err
+	}
+	db := tx.db
+	if db.orderedWrite && tx.lastPut != nil && db.comparator(key, tx.lastPut) < 0 {
+		return ErrKeyOutOfOrder
+	}
+	kv := KVPair{Key: append([]byte(nil), key...), Value: append([]byte(nil), value...)}
+	tx.pairs = append(tx.pairs, kv)
+	tx.flags = append(tx.flags, 0)
+	tx.lastPut = kv.Key
+	return nil
+}
+
+// Delete buffers a tombstone for key, written on Commit.
+func (tx *Tx) Delete(key []byte) error {
+	if err := tx.checkWrite(key); err != nil {
+		return err
+	}
+	tx.pairs = append(tx.pairs, KVPair{Key: append([]byte(nil), key...)})
+	tx.flags = append(tx.flags, KVDeleted)
+	return nil
+}
+
+func (tx *Tx) checkWrite(key []byte) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	return nil
+}
+
+// Get returns the value of key like DB.Get, including the writes buffered in
+// the transaction.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	for i := len(tx.pairs) - 1; i >= 0; i-- {
+		if tx.db.comparator(tx.pairs[i].Key, key) == 0 {
+			// The value is put together with the records before.
+			if tx.flags[i]&(KVAppended|KVDeleteNewest) != 0 {
+				kv, err := tx.values(key)
+				if n := len(kv.values); n > 0 && err == nil {
+					return kv.values[n-1], nil
+				}
+				return nil, err
+			}
+			if tx.flags[i]&KVDeleted != 0 {
+				return nil, nil
+			}
+			if tx.pairs[i].Value == nil {
+				return []byte{}, nil
+			}
+			return tx.pairs[i].Value, nil
+		}
+	}
+	if !tx.writable {
+		tx.db.countGet(1)
+		return tx.db.get(key, &tx.snap)
+	}
+	return tx.db.Get(key)
+}
+
+// Cursor creates a cursor over the records visible to the transaction: the
+// snapshot of a read-only transaction, the current records for a read-write
+// one, without its buffered writes.
+func (tx *Tx) Cursor() *Cursor {
+	c := tx.db.Cursor()
+	if !tx.writable {
+		c.snap = &tx.snap
+	}
+	return c
+}
+
+// Commit writes the buffered writes and ends the transaction. On error
+// nothing is written and the transaction is ended all the same.
+func (tx *Tx) Commit() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	db := tx.db
+	defer tx.close()
+	if len(tx.pairs) == 0 {
+		return nil
+	}
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	err := db.putBatch(tx.pairs, tx.flags)
+	tx.stats = db.commitStats()
+	return err
+}
+
+// Rollback discards the buffered writes and ends the transaction.
+func (tx *Tx) Rollback() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	tx.close()
+	return nil
+}
+
+func (tx *Tx) close() {
+	if tx.writable {
+		tx.db.rwlock.Unlock()
+	} else {
+		tx.db.txlock.Lock()
+		delete(tx.db.txs, tx)
+		tx.db.txlock.Unlock()
+	}
+	tx.db = nil
+	tx.pairs, tx.flags = nil, nil
+}
+
+// WriteTo writes the database as of the transaction to w: the snapshot of a
+// read-only transaction, the current database without the buffered writes
+// for a read-write one. It makes consistent hot backups, writers go on
+// meanwhile.
+//
+// Only the PageCount pages of the snapshot are written, with the snapshot's
+// head in the head pages. The last data page is written as it was then, later
+// records and its link to later pages cleared.
+func (tx *Tx) WriteTo(w io.Writer) (int64, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	}
+	db := tx.db
+	db.mmaplock.RLock()
+	head := tx.snap.head
+	if tx.writable {
+		head = *db.head
+	}
+	db.mmaplock.RUnlock()
+
+	buf := db.getBuf(db.pageSize)
+	defer db.putBuf(buf)
+	var written int64
+	for id := PageId(0); id < head.PageCount; id++ {
+		if err := tx.readPage(id, &head, buf); err != nil {
+			return written, err
+		}
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Backup writes a consistent copy of the database to w, as of when it is
+// called, see Tx.WriteTo. Only the PageCount pages of the snapshot are
+// written, not the space the file is grown by ahead. Pages are read one at a
+// time, writers are only held off while one is copied, not while it is
+// written to w.
+func (db *DB) Backup(w io.Writer) (int64, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return tx.WriteTo(w)
+}
+
+// readPage copies page id as of head into buf, see WriteTo. The mmap lock is
+// only held for the copy, not for writing it out.
+func (tx *Tx) readPage(id PageId, head *HeadPage, buf []byte) error {
+	db := tx.db
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	start := int(db.pageOffset(id))
+	copy(buf, db.dataSlice(start, start+db.pageSize))
+
+	if id == 0 || id == 1 && head.Features.Required&FeatureDualHead != 0 {
+		h := *head
+		h.Checksum = headPageChecksum(buf, &h)
+		headPageEncode(buf, &h)
+		return nil
+	}
+	if id != PageId(head.kvPtr.pageNum) {
+		return nil
+	}
+	// The last data page of the snapshot: count its records then, and clear
+	// the later ones.
+	return db.cutPage(id, buf, int(head.kvPtr.offset))
+}
+
+// cutPage cuts data page id, copied in buf, the last one of the data, at
+// offset end: later records are cleared, and so is its link to later pages.
+func (db *DB) cutPage(id PageId, buf []byte, end int) error {
+	p := db.pageInBuffer(buf, 0)
+	if p.overflow() {
+		// the end of a record, later ones are on later pages
+		p.Next = 0
+		pageHeaderEncode(buf, &p)
+		return nil
+	}
+	var count uint16
+	if err := db.scanData(id, buf[pageHeaderSize:end], func(kv *KVPair, flag KVFlag) bool {
+		count++
+		return true
+	}); err != nil {
+		return err
+	}
+	p.Count = count
+	p.Len = PageSz(end - pageHeaderSize)
+	p.ptr = PageSz(end)
+	p.CheckSum = db.checksumAlgo.sum(buf[pageHeaderSize:end])
+	p.Next = 0
+	// sealed later, the footer is cleared below
+	p.Flag &^= PageSorted | PageBloom
+	pageHeaderEncode(buf, &p)
+	for i := range buf[end:] {
+		buf[end+i] = 0
+	}
+	return nil
+}
+
+// snapshot bounds reads to the records committed when its head was copied:
+// the data page chain up to the page kvPtr points at, and that page up to
+// kvPtr's offset. Records are only ever appended, so everything before stays
+// as it is. A nil snapshot sees all records.
+type snapshot struct {
+	head HeadPage
+}
+
+// end returns the offset in data page id, whose header is p, past the last
+// record visible in s.
+func (s *snapshot) end(id PageId, p *Page) int {
+	if s != nil && id == PageId(s.head.kvPtr.pageNum) {
+		return int(s.head.kvPtr.offset)
+	}
+	if p.Flag&PageCompressed != 0 {
+		// as decompressed, see records
+		return pageHeaderSize + int(p.Len)
+	}
+	return int(p.ptr)
+}
+
+// next returns the data page after page id in s, or 0 after the last one.
+func (s *snapshot) next(id PageId, p *Page) PageId {
+	if s != nil && id == PageId(s.head.kvPtr.pageNum) {
+		return 0
+	}
+	return p.Next
+}
+
+// snapshotData returns the records of data page id visible in s.
+func (db *DB) snapshotData(s *snapshot, id PageId, p *Page) []byte {
+	start := int(db.pageOffset(id))
+	return db.dataSlice(start+pageHeaderSize, start+s.end(id, p))
+}
@@ -0,0 +1,334 @@
+package sidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpdateView(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+
+	assert.NoError(db.Update(func(tx *Tx) error {
+		assert.True(tx.Writable())
+		assert.NoError(tx.Put([]byte("a"), []byte("1")))
+		assert.NoError(tx.Put([]byte("b"), []byte("2")))
+		assert.NoError(tx.Delete([]byte("a")))
+		// reads its own writes
+		v, err := tx.Get([]byte("a"))
+		assert.NoError(err)
+		assert.Nil(v)
+		v, err = tx.Get([]byte("b"))
+		assert.NoError(err)
+		assert.Equal("2", string(v))
+		// nothing written yet
+		v, err = db.Get([]byte("b"))
+		assert.NoError(err)
+		assert.Nil(v)
+		return nil
+	}))
+	assert.NoError(db.View(func(tx *Tx) error {
+		assert.False(tx.Writable())
+		assert.Equal(ErrTxNotWritable, tx.Put([]byte("c"), nil))
+		v, err := tx.Get([]byte("b"))
+		assert.NoError(err)
+		assert.Equal("2", string(v))
+		v, err = tx.Get([]byte("a"))
+		assert.NoError(err)
+		assert.Nil(v)
+		return nil
+	}))
+
+	// rolled back on error
+	fail := errors.New("fail")
+	assert.Equal(fail, db.Update(func(tx *Tx) error {
+		assert.NoError(tx.Put([]byte("c"), []byte("3")))
+		return fail
+	}))
+	v, err := db.Get([]byte("c"))
+	assert.NoError(err)
+	assert.Nil(v)
+
+	tx, err := db.Begin(true)
+	assert.NoError(err)
+	assert.NoError(tx.Commit())
+	assert.Equal(ErrTxClosed, tx.Commit())
+	assert.Equal(ErrTxClosed, tx.Rollback())
+	assert.Equal(ErrTxClosed, tx.Put([]byte("c"), nil))
+	assert.NoError(db.Close())
+
+	db, err = Open(testDB, 0755, &Options{ReadOnly: true})
+	assert.NoError(err)
+	_, err = db.Begin(true)
+	assert.Equal(ErrDatabaseReadOnly, err)
+	assert.NoError(db.Close())
+}
+
+func TestUpdatePanic(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("key"), []byte("value")))
+	before, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+
+	err = db.Update(func(tx *Tx) error {
+		assert.NoError(tx.Put([]byte("other"), []byte("value")))
+		panic("boom")
+	})
+	assert.Error(err)
+	assert.Contains(err.Error(), "boom")
+	assert.Error(db.View(func(tx *Tx) error { panic("boom") }))
+
+	after, err := ioutil.ReadFile(testDB)
+	assert.NoError(err)
+	assert.True(bytes.Equal(before, after))
+	// the writer lock was released
+	assert.NoError(db.Update(func(tx *Tx) error {
+		return tx.Put([]byte("other"), []byte("value"))
+	}))
+	assert.NoError(db.Close())
+}
+
+func TestUpdateOrderedWrite(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, &Options{OrderedWrite: true})
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("m"), nil))
+	assert.NoError(db.Update(func(tx *Tx) error {
+		assert.NoError(tx.Put([]byte("x"), nil))
+		assert.Equal(ErrKeyOutOfOrder, tx.Put([]byte("n"), nil))
+		// tombstones are exempt
+		return tx.Delete([]byte("a"))
+	}))
+	assert.Equal(ErrKeyOutOfOrder, db.Update(func(tx *Tx) error {
+		return tx.Put([]byte("b"), nil)
+	}))
+	assert.NoError(db.Close())
+}
+
+func TestViewSnapshot(t *testing.T) {
+	assert := assertion.New(t)
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("value-%d;", i)), 1+i%20)
+	}
+	const n = 3000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key-%06d", i)), value(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// scan checks every record visible to tx and returns their count.
+	scan := func(tx *Tx) int {
+		var count int
+		c := tx.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var i int
+			_, err := fmt.Sscanf(string(k), "key-%06d", &i)
+			assert.NoError(err)
+			assert.Equal(value(i), v)
+			count++
+		}
+		assert.NoError(c.Err())
+		return count
+	}
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				assert.NoError(db.View(func(tx *Tx) error {
+					count := scan(tx)
+					time.Sleep(time.Millisecond)
+					// the writer went on meanwhile, the snapshot didn't
+					assert.Equal(count, scan(tx))
+					if count > 0 {
+						v, err := tx.Get([]byte(fmt.Sprintf("key-%06d", count-1)))
+						assert.NoError(err)
+						assert.Equal(value(count-1), v)
+					}
+					v, err := tx.Get([]byte(fmt.Sprintf("key-%06d", count)))
+					assert.NoError(err)
+					assert.Nil(v)
+					return nil
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(db.View(func(tx *Tx) error {
+		assert.Equal(n, scan(tx))
+		return nil
+	}))
+	assert.NoError(db.Close())
+}
+
+func TestTxWriteTo(t *testing.T) {
+	assert := assertion.New(t)
+	backup := testDB + ".backup"
+	os.Remove(testDB)
+	os.Remove(backup)
+	defer os.Remove(testDB)
+	defer os.Remove(backup)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+	}
+	put(0, 1000)
+
+	tx, err := db.Begin(false)
+	assert.NoError(err)
+	var snapshot []string
+	c := tx.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		snapshot = append(snapshot, string(k))
+	}
+
+	// the writer goes on during the backup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		put(1000, 3000)
+	}()
+	f, err := os.Create(backup)
+	assert.NoError(err)
+	n, err := tx.WriteTo(f)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	assert.Equal(int64(tx.snap.head.PageCount)*int64(db.pageSize), n)
+	assert.NoError(tx.Rollback())
+	<-done
+	assert.NoError(db.Close())
+
+	db, err = Open(backup, 0755, nil)
+	assert.NoError(err)
+	var keys []string
+	assert.NoError(db.ForEachKey(func(k []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	assert.Equal(1000, len(keys))
+	assert.Equal(snapshot, keys)
+	n2, err := db.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(1000), n2)
+	// and takes writes
+	assert.NoError(db.Put([]byte("key-999999"), []byte("value")))
+	v, err := db.Get([]byte("key-999999"))
+	assert.NoError(err)
+	assert.Equal("value", string(v))
+	assert.NoError(db.Close())
+}
+
+func TestBackup(t *testing.T) {
+	assert := assertion.New(t)
+	backup := testDB + ".backup"
+	os.Remove(testDB)
+	os.Remove(backup)
+	defer os.Remove(testDB)
+	defer os.Remove(backup)
+	db, err := Open(testDB, 0755, nil)
+	assert.NoError(err)
+	db.NoSync = true
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%06d", i)) }
+	value := func(i int) []byte { return bytes.Repeat([]byte(fmt.Sprintf("value-%d ", i)), i%50) }
+
+	// keys are written in order, one by one and in batches, the backup must
+	// hold those up to some point and nothing after: at least those written
+	// when it started, at most those being written when it ended
+	var written, writing int64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%3 == 0 {
+				atomic.StoreInt64(&writing, int64(i+50))
+				var pairs []KVPair
+				for j := i; j < i+50; j++ {
+					pairs = append(pairs, KVPair{Key: key(j), Value: value(j)})
+				}
+				assert.NoError(db.PutBatch(pairs))
+				i += 50
+			} else {
+				atomic.StoreInt64(&writing, int64(i+1))
+				assert.NoError(db.Put(key(i), value(i)))
+				i++
+			}
+			atomic.StoreInt64(&written, int64(i))
+		}
+	}()
+	for atomic.LoadInt64(&written) < 2000 {
+		time.Sleep(time.Millisecond)
+	}
+	before := atomic.LoadInt64(&written)
+	var buf bytes.Buffer
+	n, err := db.Backup(&buf)
+	after := atomic.LoadInt64(&writing)
+	assert.NoError(err)
+	assert.Equal(int64(buf.Len()), n)
+	close(stop)
+	<-done
+	assert.NoError(db.Close())
+
+	assert.NoError(ioutil.WriteFile(backup, buf.Bytes(), 0755))
+	db, err = Open(backup, 0755, nil)
+	assert.NoError(err)
+	// only the pages of the snapshot
+	assert.Equal(int64(db.head.PageCount)*int64(db.pageSize), n)
+	assert.Empty(checkErrors(db))
+	i := 0
+	assert.NoError(db.ForEach(func(k, v []byte) error {
+		assert.Equal(string(key(i)), string(k))
+		assert.Equal(value(i), v, "%s", k)
+		i++
+		return nil
+	}))
+	assert.True(int64(i) >= before && int64(i) <= after, "%d not in [%d, %d]", i, before, after)
+	assert.NoError(db.Close())
+
+	_, err = db.Backup(&buf)
+	assert.Equal(ErrDatabaseNotOpen, err)
+}